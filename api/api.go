@@ -1,14 +1,260 @@
-package api
-
-import (
-	"github.com/popescuag/RH/internal/pkg/delta"
-	"github.com/popescuag/RH/internal/pkg/signature"
-)
-
-func Signature(data []byte) ([]byte, error) {
-	return signature.GetSignature(data)
-}
-
-func Delta(signatureData []byte, newData []byte) ([]byte, error) {
-	return delta.GetDelta(signatureData, newData)
-}
+package api
+
+import (
+	"bytes"
+	"io/fs"
+
+	"github.com/popescuag/RH/internal/pkg/algorithm"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	"github.com/popescuag/RH/internal/pkg/rdiff"
+	"github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/popescuag/RH/internal/pkg/tree"
+)
+
+type (
+	// SignatureOptions controls how signatures are computed
+	SignatureOptions = signature.Options
+	// ChunkSizePolicy chooses the chunk size used to sign a file of the given size
+	ChunkSizePolicy = signature.ChunkSizePolicy
+	// ChunkSizePolicyFunc adapts a function to the ChunkSizePolicy interface
+	ChunkSizePolicyFunc = signature.ChunkSizePolicyFunc
+	// DeltaOptions controls how deltas are computed
+	DeltaOptions = delta.Options
+	// LiteralCodec compresses the new data of deltas, with the data before it as dictionary
+	LiteralCodec = delta.LiteralCodec
+	// DiffOptions controls how the delta of two files at hand is computed
+	DiffOptions = delta.DiffOptions
+	// DiffAlgorithm chooses how the data of the new file is found in the old file
+	DiffAlgorithm = delta.DiffAlgorithm
+	// Codec compresses whole signature and delta files, which are decompressed when read with the
+	// codec named in their header
+	Codec = codec.Codec
+	// SignatureBuilder writes what the differ of the same name needs to know of the basis file
+	SignatureBuilder = algorithm.SignatureBuilder
+	// Differ writes the delta of the new file against the signature of its algorithm. Deltas of the
+	// differs that are not built in start with a header naming them
+	Differ = algorithm.Differ
+	// Patcher applies the deltas whose header names it
+	Patcher = algorithm.Patcher
+	// RsyncAlgorithm is the default algorithm, with the options of its signatures and deltas
+	RsyncAlgorithm = algorithm.RsyncAlgorithm
+	// LocalDiff is the algorithm of Diff, with the basis file as signature
+	LocalDiff = algorithm.LocalDiff
+	// RdiffAlgorithm writes and reads the signatures and deltas of librsync
+	RdiffAlgorithm = algorithm.RdiffAlgorithm
+	// RdiffSignatureOptions controls how librsync signatures are written
+	RdiffSignatureOptions = rdiff.SignatureOptions
+	// VcdiffFormat writes the deltas of RsyncAlgorithm or LocalDiff in the VCDIFF format
+	VcdiffFormat = algorithm.VcdiffFormat
+	// TreeOptions chooses the files of directory trees and how they are compared
+	TreeOptions = tree.Options
+	// TreeFilter chooses the paths of directory trees that are synced, with include and exclude rules
+	TreeFilter = tree.Filter
+)
+
+// Built-in algorithms, registered by default
+var (
+	Rsync       = algorithm.Rsync
+	SuffixArray = algorithm.SuffixArray
+	Blocks      = algorithm.Blocks
+	Rdiff       = algorithm.Rdiff
+	Vcdiff      = algorithm.Vcdiff
+)
+
+// Codecs of the new data of deltas
+const (
+	FlateLiterals = delta.FlateLiterals
+	ZlibLiterals  = delta.ZlibLiterals
+)
+
+// Algorithms of Diff
+const (
+	SuffixArrayDiff = delta.SuffixArrayDiff
+	BlockDiff       = delta.BlockDiff
+)
+
+// Codecs of whole signature and delta files, registered by default
+var (
+	NoCodec   = codec.None
+	GzipCodec = codec.Gzip
+	ZlibCodec = codec.Zlib
+)
+
+// Errors returned by the API, to be checked with errors.Is and errors.As
+var (
+	ErrInvalidSignature   = signature.ErrInvalidSignature
+	ErrInvalidDelta       = delta.ErrInvalidDelta
+	ErrSignatureMismatch  = delta.ErrSignatureMismatch
+	ErrInvalidChunkSize   = signature.ErrInvalidChunkSize
+	ErrLimitExceeded      = signature.ErrLimitExceeded
+	ErrTruncated          = signature.ErrTruncated
+	ErrUnsupportedVersion = signature.ErrUnsupportedVersion
+	ErrBasisMismatch      = patch.ErrBasisMismatch
+	ErrChainMismatch      = delta.ErrChainMismatch
+	ErrUnknownCodec       = codec.ErrUnknownCodec
+	ErrCorrupted          = codec.ErrCorrupted
+	ErrUnknownAlgorithm   = delta.ErrUnknownAlgorithm
+)
+
+// ParseError tells where a signature or a delta could not be parsed
+type ParseError = signature.ParseError
+
+var (
+	DefaultChunkSizePolicy    = signature.DefaultChunkSizePolicy
+	FixedChunkSizePolicy      = signature.FixedChunkSizePolicy
+	SqrtChunkSizePolicy       = signature.SqrtChunkSizePolicy
+	TargetSignatureSizePolicy = signature.TargetSignatureSizePolicy
+)
+
+// RegisterCodec makes a codec available to the options and to read the files it compresses
+func RegisterCodec(c Codec) error {
+	return codec.Register(c)
+}
+
+// LookupCodec returns the registered codec with the name
+func LookupCodec(name string) (Codec, error) {
+	return codec.Lookup(name)
+}
+
+// RegisterSignatureBuilder makes a signature builder available by its name
+func RegisterSignatureBuilder(b SignatureBuilder) error {
+	return algorithm.RegisterSignatureBuilder(b)
+}
+
+// RegisterDiffer makes a differ available by its name
+func RegisterDiffer(d Differ) error {
+	return algorithm.RegisterDiffer(d)
+}
+
+// RegisterPatcher makes a patcher available to Patch the deltas naming it in their header
+func RegisterPatcher(p Patcher) error {
+	return algorithm.RegisterPatcher(p)
+}
+
+// LookupSignatureBuilder returns the registered signature builder with the name
+func LookupSignatureBuilder(name string) (SignatureBuilder, error) {
+	return algorithm.LookupSignatureBuilder(name)
+}
+
+// LookupDiffer returns the registered differ with the name
+func LookupDiffer(name string) (Differ, error) {
+	return algorithm.LookupDiffer(name)
+}
+
+// LookupPatcher returns the registered patcher with the name
+func LookupPatcher(name string) (Patcher, error) {
+	return algorithm.LookupPatcher(name)
+}
+
+// SignatureWith computes the signature of the data with the signature builder of any algorithm
+func SignatureWith(b SignatureBuilder, data []byte) ([]byte, error) {
+	return algorithm.GetSignature(b, data)
+}
+
+// DeltaWith computes the delta of the new data with the differ of the algorithm of the signature
+func DeltaWith(d Differ, signatureData []byte, newData []byte) ([]byte, error) {
+	return algorithm.GetDelta(d, signatureData, newData)
+}
+
+func Signature(data []byte) ([]byte, error) {
+	return signature.GetSignature(data)
+}
+
+func SignatureWithOptions(data []byte, options SignatureOptions) ([]byte, error) {
+	return signature.GetSignatureWithOptions(data, options)
+}
+
+func Delta(signatureData []byte, newData []byte) ([]byte, error) {
+	return delta.GetDelta(signatureData, newData)
+}
+
+func DeltaWithOptions(signatureData []byte, newData []byte, options DeltaOptions) ([]byte, error) {
+	return delta.GetDeltaWithOptions(signatureData, newData, options)
+}
+
+// Diff computes the delta of newData against oldData without a signature, finding approximate matches
+// anywhere in oldData with a suffix array. The delta is applied by Patch like any other
+func Diff(oldData []byte, newData []byte) ([]byte, error) {
+	return delta.DiffData(oldData, newData, DiffOptions{})
+}
+
+// DiffWithOptions is Diff with another algorithm, chunk size or compression
+func DiffWithOptions(oldData []byte, newData []byte, options DiffOptions) ([]byte, error) {
+	return delta.DiffData(oldData, newData, options)
+}
+
+// ValidateDelta checks that a delta is well formed and matches the signature it was computed from
+func ValidateDelta(signatureData []byte, deltaData []byte) error {
+	return delta.ValidateData(signatureData, deltaData)
+}
+
+// Compose computes the delta equivalent to applying the deltas one after the other
+func Compose(deltas ...[]byte) ([]byte, error) {
+	return delta.ComposeData(deltas)
+}
+
+// Patch rebuilds the new data with the patcher named in the header of the delta, Rsync if it has none
+func Patch(basisData []byte, deltaData []byte) ([]byte, error) {
+	return algorithm.GetPatch(basisData, deltaData)
+}
+
+// SignatureTree computes the manifest of a directory tree: the paths, sizes and modes of its directories,
+// files, links and special files, with the signature of each file
+func SignatureTree(dir string, options SignatureOptions) ([]byte, error) {
+	return tree.GetSignature(dir, options, TreeOptions{})
+}
+
+// SignatureTreeWithOptions is SignatureTree of the paths the filter of the tree options includes
+func SignatureTreeWithOptions(dir string, options SignatureOptions, treeOptions TreeOptions) ([]byte, error) {
+	return tree.GetSignature(dir, options, treeOptions)
+}
+
+// SignatureFS computes the manifest of the tree under the root directory of a file system, such as an
+// embed.FS, a zip.Reader or a fstest.MapFS. Symbolic links are recorded when the file system has a ReadLink
+// method, like the ReadLinkFS of later versions of io/fs
+func SignatureFS(fsys fs.FS, root string) ([]byte, error) {
+	return tree.GetSignatureFS(fsys, root, SignatureOptions{}, TreeOptions{})
+}
+
+// SignatureFSWithOptions is SignatureFS with the chunk size, the compression and the filter of the options
+func SignatureFSWithOptions(fsys fs.FS, root string, options SignatureOptions,
+	treeOptions TreeOptions) ([]byte, error) {
+	return tree.GetSignatureFS(fsys, root, options, treeOptions)
+}
+
+// DeltaTree computes the bundle turning the directory tree of the manifest into the new one, with the
+// deltas of the changed files, the new files and the deleted paths
+func DeltaTree(manifestData []byte, newDir string, options DeltaOptions) ([]byte, error) {
+	return tree.GetDelta(manifestData, newDir, options, TreeOptions{})
+}
+
+// DeltaTreeWithOptions is DeltaTree of the paths the filter of the tree options includes. Unless the
+// options ask for checksums, files with the size and the modification time of the manifest are skipped
+func DeltaTreeWithOptions(manifestData []byte, newDir string, options DeltaOptions,
+	treeOptions TreeOptions) ([]byte, error) {
+	return tree.GetDelta(manifestData, newDir, options, treeOptions)
+}
+
+// NewTreeFilter returns the filter of the rules, in order: "+ pattern" includes the paths matching the
+// pattern, "- pattern" excludes them and ". file" reads more rules from a file
+func NewTreeFilter(rules ...string) (*TreeFilter, error) {
+	return tree.NewFilter(rules...)
+}
+
+// PatchTree applies the bundle to the directory tree the manifest was computed from, in place
+func PatchTree(dir string, bundleData []byte) error {
+	return tree.Apply(dir, bytes.NewReader(bundleData))
+}
+
+// PatchTreeWithOptions is PatchTree telling the Warn function of the tree options about the device files
+// the process is not permitted to create
+func PatchTreeWithOptions(dir string, bundleData []byte, treeOptions TreeOptions) error {
+	return tree.ApplyWithOptions(dir, bytes.NewReader(bundleData), treeOptions)
+}
+
+// Invert computes the delta that rebuilds the basis file from the file the delta produces
+func Invert(basisData []byte, deltaData []byte) ([]byte, error) {
+	return patch.GetReverseDelta(basisData, deltaData)
+}
@@ -1,35 +1,218 @@
-package main
-
-import (
-	"log"
-	"os"
-	"time"
-
-	"github.com/popescuag/RH/internal/pkg/delta"
-	"github.com/popescuag/RH/internal/pkg/signature"
-	"github.com/popescuag/RH/internal/pkg/validator"
-)
-
-func main() {
-	err := validator.ValidateInputParams(os.Args[1:])
-
-	if err != nil {
-		log.Printf("Invalid command parameters. Error was %v", err)
-		os.Exit(1)
-	}
-
-	startTime := time.Now()
-	if os.Args[1] == validator.SIGNATURE_CMD {
-		err = signature.Compute(os.Args[2], os.Args[3])
-	} else {
-		err = delta.Compute(os.Args[2], os.Args[3], os.Args[4])
-	}
-
-	if err != nil {
-		log.Printf("Command has failed. Error was %v", err)
-		os.Exit(1)
-	}
-
-	log.Printf("Command completed in %v", time.Since(startTime))
-	os.Exit(0)
-}
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/algorithm"
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	"github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/popescuag/RH/internal/pkg/tree"
+	"github.com/popescuag/RH/internal/pkg/validator"
+)
+
+func main() {
+	cmd, err := validator.ValidateInputParams(os.Args[1:])
+
+	if err != nil {
+		log.Printf("Invalid command parameters. Error was %v", err)
+		os.Exit(1)
+	}
+
+	// Outputs are only moved into place once complete, so partial ones are removed when interrupted.
+	// Partial patch outputs are only kept with their checkpoint when --checkpoint or --resume asks for it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		atomicfile.RemoveTemporaryFiles()
+		log.Printf("Command interrupted by %v", sig)
+		os.Exit(1)
+	}()
+
+	startTime := time.Now()
+	switch cmd.Operation {
+	case validator.SIGNATURE_CMD:
+		options := signature.Options{Metadata: cmd.SignatureMetadata}
+		if cmd.ChunkSize != 0 {
+			options.ChunkSize = signature.FixedChunkSizePolicy(cmd.ChunkSize)
+		}
+		options.Codec, err = lookupCodec(cmd.Compress)
+		if err != nil {
+			break
+		}
+		if cmd.Recursive {
+			var treeOptions tree.Options
+			if treeOptions, err = treeOptionsOf(cmd); err == nil {
+				err = tree.Signature(cmd.Files[0], cmd.Files[1], options, treeOptions)
+			}
+			break
+		}
+		if cmd.Algorithm == "" || cmd.Algorithm == algorithm.Rsync.Name() {
+			err = signature.Compute(cmd.Files[0], cmd.Files[1], options)
+			break
+		}
+		var builder algorithm.SignatureBuilder
+		if builder, _, err = lookupAlgorithm(cmd); err == nil {
+			err = algorithm.SignatureFile(builder, cmd.Files[0], cmd.Files[1], options.Codec)
+		}
+	case validator.DELTA_CMD:
+		options := delta.Options{Literals: delta.LiteralCodec(cmd.Literals), Metadata: !cmd.NoMetadata}
+		options.Codec, err = lookupCodec(cmd.Compress)
+		if err != nil {
+			break
+		}
+		if cmd.Recursive {
+			var treeOptions tree.Options
+			if treeOptions, err = treeOptionsOf(cmd); err == nil {
+				err = tree.Delta(cmd.Files[0], cmd.Files[1], cmd.Files[2], options, treeOptions)
+			}
+			break
+		}
+		if (cmd.Algorithm == "" || cmd.Algorithm == algorithm.Rsync.Name()) && cmd.Format != validator.VCDIFF_FORMAT {
+			err = delta.ComputeWithOptions(cmd.Files[0], cmd.Files[1], cmd.Files[2], options)
+			break
+		}
+		var differ algorithm.Differ
+		if _, differ, err = lookupAlgorithm(cmd); err == nil {
+			err = algorithm.DeltaFile(vcdiffDiffer(cmd, differ), cmd.Files[0], cmd.Files[1], cmd.Files[2],
+				options.Codec)
+		}
+	case validator.PATCH_CMD:
+		switch {
+		case cmd.Recursive:
+			var treeOptions tree.Options
+			if treeOptions, err = treeOptionsOf(cmd); err == nil {
+				err = tree.PatchWithOptions(cmd.Files[0], cmd.Files[1], treeOptions)
+			}
+		case cmd.Rollback:
+			err = patch.Rollback(cmd.Files[0])
+		case cmd.InPlace:
+			err = patch.ComputeInPlaceWithOptions(cmd.Files[0], cmd.Files[1], patch.Options{Metadata: !cmd.NoMetadata})
+		default:
+			err = patchFile(cmd)
+		}
+	case validator.DIFF_CMD:
+		options := diffOptions(cmd)
+		options.Codec, err = lookupCodec(cmd.Compress)
+		if err != nil {
+			break
+		}
+		if delta.ValidateDiffAlgorithm(options.Algorithm) == nil && cmd.Format != validator.VCDIFF_FORMAT {
+			err = delta.Diff(cmd.Files[0], cmd.Files[1], cmd.Files[2], options)
+			break
+		}
+		if cmd.Algorithm == "" {
+			cmd.Algorithm = algorithm.SuffixArray.Name()
+		}
+		var builder algorithm.SignatureBuilder
+		var differ algorithm.Differ
+		if builder, differ, err = lookupAlgorithm(cmd); err == nil {
+			err = algorithm.DiffFile(builder, vcdiffDiffer(cmd, differ), cmd.Files[0], cmd.Files[1], cmd.Files[2],
+				options.Codec)
+		}
+	case validator.VALIDATE_DELTA_CMD:
+		err = delta.Validate(cmd.Files[0], cmd.Files[1])
+	case validator.COMPOSE_CMD:
+		err = delta.Compose(cmd.Files[:len(cmd.Files)-1], cmd.Files[len(cmd.Files)-1])
+	}
+
+	if err != nil {
+		log.Printf("Command has failed. Error was %v", err)
+		os.Exit(1)
+	}
+
+	log.Printf("Command completed in %v", time.Since(startTime))
+	os.Exit(0)
+}
+
+// lookupCodec returns the codec compressing the output, none if no name is given
+func lookupCodec(name string) (codec.Codec, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return codec.Lookup(name)
+}
+
+// patchFile applies the delta with the patcher named in its header. Only the deltas of this tool can be
+// resumed and reversed
+func patchFile(cmd validator.Command) error {
+	patcher, err := algorithm.DeltaPatcher(cmd.Files[1])
+	if err != nil {
+		return err
+	}
+	if patcher.Name() != algorithm.Rsync.Name() {
+		if cmd.Checkpoint || cmd.Resume || cmd.Reverse != "" {
+			return fmt.Errorf("deltas of the %v algorithm cannot be resumed or reversed", patcher.Name())
+		}
+		return algorithm.PatchFile(cmd.Files[0], cmd.Files[1], cmd.Files[2])
+	}
+	options := patch.Options{Checkpoint: cmd.Checkpoint, Resume: cmd.Resume, ReverseDeltaFile: cmd.Reverse,
+		Metadata: !cmd.NoMetadata}
+	return patch.ComputeWithOptions(cmd.Files[0], cmd.Files[1], cmd.Files[2], options)
+}
+
+// diffOptions returns the options of the diff algorithms given on the command line
+func diffOptions(cmd validator.Command) delta.DiffOptions {
+	options := delta.DiffOptions{
+		Options:   delta.Options{Literals: delta.LiteralCodec(cmd.Literals), Metadata: !cmd.NoMetadata},
+		Algorithm: delta.DiffAlgorithm(cmd.Algorithm),
+	}
+	if cmd.ChunkSize != 0 {
+		options.ChunkSize = signature.FixedChunkSizePolicy(cmd.ChunkSize)
+	}
+	return options
+}
+
+// lookupAlgorithm returns the signature builder and the differ of the algorithm, the built-in ones with
+// the options given on the command line
+func lookupAlgorithm(cmd validator.Command) (algorithm.SignatureBuilder, algorithm.Differ, error) {
+	switch cmd.Algorithm {
+	case "", algorithm.Rsync.Name():
+		rsync := algorithm.RsyncAlgorithm{DeltaOptions: delta.Options{Literals: delta.LiteralCodec(cmd.Literals)}}
+		if cmd.ChunkSize != 0 {
+			rsync.SignatureOptions.ChunkSize = signature.FixedChunkSizePolicy(cmd.ChunkSize)
+		}
+		return rsync, rsync, nil
+	case algorithm.Rdiff.Name():
+		rdiff := algorithm.RdiffAlgorithm{}
+		if cmd.ChunkSize != 0 {
+			rdiff.SignatureOptions.ChunkSize = signature.FixedChunkSizePolicy(cmd.ChunkSize)
+		}
+		return rdiff, rdiff, nil
+	case algorithm.SuffixArray.Name(), algorithm.Blocks.Name():
+		local := algorithm.LocalDiff{DiffOptions: diffOptions(cmd)}
+		return local, local, nil
+	}
+	builder, err := algorithm.LookupSignatureBuilder(cmd.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	differ, err := algorithm.LookupDiffer(cmd.Algorithm)
+	return builder, differ, err
+}
+
+// vcdiffDiffer returns the differ writing the deltas of the differ in the VCDIFF format, when it is asked for
+func vcdiffDiffer(cmd validator.Command, differ algorithm.Differ) algorithm.Differ {
+	if cmd.Format == validator.VCDIFF_FORMAT {
+		return algorithm.VcdiffFormat{Differ: differ}
+	}
+	return differ
+}
+
+// treeOptionsOf returns the filter and the comparison of directory trees given on the command line. The
+// files that are skipped are logged
+func treeOptionsOf(cmd validator.Command) (tree.Options, error) {
+	filter, err := tree.NewFilter(cmd.Filters...)
+	return tree.Options{Filter: filter, Checksum: cmd.Checksum, SkipSpecial: cmd.SkipSpecial,
+		Warn: func(path string, reason string) {
+			log.Printf("Warning: %v: %v", path, reason)
+		}}, err
+}
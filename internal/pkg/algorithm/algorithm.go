@@ -0,0 +1,232 @@
+package algorithm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/rdiff"
+	"github.com/popescuag/RH/internal/pkg/vcdiff"
+)
+
+// SignatureBuilder writes what the differ of the same name needs to know of the basis file
+type SignatureBuilder interface {
+	// Name identifies the algorithm, at most 255 bytes
+	Name() string
+	Signature(basis io.Reader, basisSize int64, output io.Writer) error
+}
+
+// Differ writes the delta of the new file against the signature written by the SignatureBuilder of
+// the same name
+type Differ interface {
+	Name() string
+	Delta(signature io.Reader, newFile io.Reader, newFileSize int64, output io.Writer) error
+}
+
+// Patcher rebuilds the new file from the basis file and the deltas of the Differ of the same name
+type Patcher interface {
+	Name() string
+	// Patch writes the new file to output. output is an io.ReaderAt when the new file is written to
+	// a file, so the data already written can be read back
+	Patch(basis io.ReaderAt, basisSize int64, delta io.Reader, output io.Writer) error
+}
+
+// nativeDiffer is implemented by the built-in differs, which write the deltas of this tool without
+// header, so they are applied by any version of patch
+type nativeDiffer interface {
+	nativeDeltas()
+}
+
+type named interface {
+	Name() string
+}
+
+// registry keeps the implementations of one part of the algorithms by name
+type registry[T named] struct {
+	mutex sync.RWMutex
+	kind  string
+	items map[string]T
+}
+
+func newRegistry[T named](kind string, builtins ...T) *registry[T] {
+	r := &registry[T]{kind: kind, items: map[string]T{}}
+	for _, item := range builtins {
+		r.items[item.Name()] = item
+	}
+	return r
+}
+
+func (r *registry[T]) register(item T) error {
+	name := item.Name()
+	if name == "" || len(name) > 255 {
+		return fmt.Errorf("%w: invalid name %q", delta.ErrUnknownAlgorithm, name)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, found := r.items[name]; found {
+		return fmt.Errorf("%v %q already registered", r.kind, name)
+	}
+	r.items[name] = item
+	return nil
+}
+
+func (r *registry[T]) lookup(name string) (T, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	item, found := r.items[name]
+	if !found {
+		return item, fmt.Errorf("%w: no %v %q", delta.ErrUnknownAlgorithm, r.kind, name)
+	}
+	return item, nil
+}
+
+func (r *registry[T]) names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	names := make([]string, 0, len(r.items))
+	for name := range r.items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	signatureBuilders = newRegistry[SignatureBuilder]("signature builder", Rsync, SuffixArray, Blocks, Rdiff)
+	differs           = newRegistry[Differ]("differ", Rsync, SuffixArray, Blocks, Rdiff)
+	patchers          = newRegistry[Patcher]("patcher", Rsync, Rdiff, Vcdiff)
+)
+
+// RegisterSignatureBuilder makes a signature builder available by its name
+func RegisterSignatureBuilder(b SignatureBuilder) error {
+	return signatureBuilders.register(b)
+}
+
+// RegisterDiffer makes a differ available by its name
+func RegisterDiffer(d Differ) error {
+	return differs.register(d)
+}
+
+// RegisterPatcher makes a patcher available to apply the deltas naming it in their header
+func RegisterPatcher(p Patcher) error {
+	return patchers.register(p)
+}
+
+// LookupSignatureBuilder returns the registered signature builder with the name
+func LookupSignatureBuilder(name string) (SignatureBuilder, error) {
+	return signatureBuilders.lookup(name)
+}
+
+// LookupDiffer returns the registered differ with the name
+func LookupDiffer(name string) (Differ, error) {
+	return differs.lookup(name)
+}
+
+// LookupPatcher returns the registered patcher with the name
+func LookupPatcher(name string) (Patcher, error) {
+	return patchers.lookup(name)
+}
+
+// Names returns the names of the algorithms with both a signature builder and a differ, sorted
+func Names() []string {
+	names := []string{}
+	for _, name := range differs.names() {
+		if _, err := signatureBuilders.lookup(name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Deltas of the differs that are not built in start with the magic, the length of the name of the
+// differ and the name, so they are applied by the patcher with the same name. Deltas of this tool
+// start with a digit
+const magic = "RHA1"
+
+// WriteDelta writes the delta of the differ, with the header naming it when it is not built in
+func WriteDelta(d Differ, signature io.Reader, newFile io.Reader, newFileSize int64, output io.Writer) error {
+	if _, native := d.(nativeDiffer); !native {
+		name := d.Name()
+		if name == "" || len(name) > 255 {
+			return fmt.Errorf("%w: invalid name %q", delta.ErrUnknownAlgorithm, name)
+		}
+		header := append(append([]byte(magic), byte(len(name))), name...)
+		if _, err := output.Write(header); err != nil {
+			return err
+		}
+	}
+	return d.Delta(signature, newFile, newFileSize, output)
+}
+
+// ReadDeltaHeader decompresses the delta and returns the patcher named in its header, Rdiff for librsync
+// deltas, Vcdiff for VCDIFF deltas and Rsync for the others, with the reader of what follows the header
+func ReadDeltaHeader(input io.Reader) (Patcher, io.Reader, error) {
+	decoded, _, err := codec.NewReader(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	buffered := bufio.NewReader(decoded)
+	prefix, err := buffered.Peek(len(magic))
+	if err == nil && rdiff.IsDelta(prefix) {
+		return Rdiff, buffered, nil
+	}
+	if err == nil && vcdiff.IsDelta(prefix) {
+		return Vcdiff, buffered, nil
+	}
+	if err != nil || string(prefix) != magic {
+		return Rsync, buffered, nil
+	}
+
+	header := make([]byte, len(magic)+1)
+	if _, err = io.ReadFull(buffered, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated algorithm header", delta.ErrInvalidDelta)
+	}
+	name := make([]byte, header[len(magic)])
+	if _, err = io.ReadFull(buffered, name); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated algorithm header", delta.ErrInvalidDelta)
+	}
+	p, err := LookupPatcher(string(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, buffered, nil
+}
+
+// Patch applies the delta with the patcher named in its header
+func Patch(basis io.ReaderAt, basisSize int64, deltaReader io.Reader, output io.Writer) error {
+	p, rest, err := ReadDeltaHeader(deltaReader)
+	if err != nil {
+		return err
+	}
+	return p.Patch(basis, basisSize, rest, output)
+}
+
+// GetSignature = computes the signature of the basis data with the signature builder
+func GetSignature(b SignatureBuilder, basisData []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := b.Signature(bytes.NewReader(basisData), int64(len(basisData)), buf)
+	return buf.Bytes(), err
+}
+
+// GetDelta = computes the delta of the new data against the signature with the differ
+func GetDelta(d Differ, signatureData []byte, newData []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	signature, _, err := codec.NewReader(bytes.NewReader(signatureData))
+	if err != nil {
+		return nil, err
+	}
+	err = WriteDelta(d, signature, bytes.NewReader(newData), int64(len(newData)), buf)
+	return buf.Bytes(), err
+}
+
+// GetPatch = rebuilds the new data from the basis data and a delta of any registered algorithm
+func GetPatch(basisData []byte, deltaData []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := Patch(bytes.NewReader(basisData), int64(len(basisData)), bytes.NewReader(deltaData), buf)
+	return buf.Bytes(), err
+}
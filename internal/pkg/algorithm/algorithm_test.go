@@ -0,0 +1,161 @@
+package algorithm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/vcdiff"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	basisData = []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 200))
+	newData   = append(append(append([]byte{}, basisData[:3000]...), "a new sentence"...), basisData[3000:]...)
+)
+
+// wholeFile stands for the algorithms of other modules, its deltas are the whole new file
+type wholeFile struct{}
+
+func (wholeFile) Name() string {
+	return "whole"
+}
+
+func (wholeFile) Signature(basis io.Reader, basisSize int64, output io.Writer) error {
+	return nil
+}
+
+func (wholeFile) Delta(signature io.Reader, newFile io.Reader, newFileSize int64, output io.Writer) error {
+	_, err := io.Copy(output, newFile)
+	return err
+}
+
+func (wholeFile) Patch(basis io.ReaderAt, basisSize int64, deltaReader io.Reader, output io.Writer) error {
+	_, err := io.Copy(output, deltaReader)
+	return err
+}
+
+func TestBuiltinAlgorithms(t *testing.T) {
+	for _, name := range []string{"rsync", "bsdiff", "blocks", "rdiff"} {
+		t.Run(name, func(t *testing.T) {
+			b, err := LookupSignatureBuilder(name)
+			assert.Nil(t, err)
+			d, err := LookupDiffer(name)
+			assert.Nil(t, err)
+
+			signatureData, err := GetSignature(b, basisData)
+			assert.Nil(t, err)
+			deltaData, err := GetDelta(d, signatureData, newData)
+			assert.Nil(t, err)
+			assert.NotEqual(t, magic, string(deltaData[:len(magic)]), "built-in deltas have no header")
+			assert.Less(t, len(deltaData), len(newData))
+
+			patched, err := GetPatch(basisData, deltaData)
+			assert.Nil(t, err)
+			assert.Equal(t, newData, patched)
+		})
+	}
+	assert.Equal(t, []string{"blocks", "bsdiff", "rdiff", "rsync"}, Names()[:4])
+}
+
+func TestVcdiff(t *testing.T) {
+	for _, d := range []Differ{Rsync, SuffixArray, Blocks} {
+		t.Run(d.Name(), func(t *testing.T) {
+			signatureData, err := GetSignature(d.(SignatureBuilder), basisData)
+			assert.Nil(t, err)
+			deltaData, err := GetDelta(VcdiffFormat{Differ: d}, signatureData, newData)
+			assert.Nil(t, err)
+			assert.True(t, vcdiff.IsDelta(deltaData))
+
+			patched, err := GetPatch(basisData, deltaData)
+			assert.Nil(t, err)
+			assert.Equal(t, newData, patched)
+		})
+	}
+	signatureData, err := GetSignature(Rdiff, basisData)
+	assert.Nil(t, err)
+	_, err = GetDelta(VcdiffFormat{Differ: Rdiff}, signatureData, newData)
+	assert.ErrorIs(t, err, delta.ErrUnknownAlgorithm)
+}
+
+func TestRegister(t *testing.T) {
+	deltaData, err := GetDelta(wholeFile{}, nil, newData)
+	assert.Nil(t, err)
+	assert.Equal(t, magic+"\x05whole", string(deltaData[:len(magic)+6]))
+	_, err = GetPatch(basisData, deltaData)
+	assert.ErrorIs(t, err, delta.ErrUnknownAlgorithm)
+
+	assert.Nil(t, RegisterSignatureBuilder(wholeFile{}))
+	assert.Nil(t, RegisterDiffer(wholeFile{}))
+	assert.Nil(t, RegisterPatcher(wholeFile{}))
+	assert.Contains(t, Names(), "whole")
+	p, err := LookupPatcher("whole")
+	assert.Nil(t, err)
+	assert.Equal(t, wholeFile{}, p)
+
+	patched, err := GetPatch(basisData, deltaData)
+	assert.Nil(t, err)
+	assert.Equal(t, newData, patched)
+
+	assert.NotNil(t, RegisterDiffer(wholeFile{}), "algorithms are registered once")
+	assert.NotNil(t, RegisterPatcher(Rsync), "built-in algorithms cannot be replaced")
+	_, err = LookupDiffer("xdelta")
+	assert.ErrorIs(t, err, delta.ErrUnknownAlgorithm)
+
+	// The patcher is named in the decompressed delta
+	buf := new(bytes.Buffer)
+	w, err := codec.NewWriter(buf, codec.Gzip)
+	assert.Nil(t, err)
+	_, err = w.Write(deltaData)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	patched, err = GetPatch(basisData, buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, newData, patched)
+
+	_, err = GetPatch(basisData, deltaData[:len(magic)+3])
+	assert.ErrorIs(t, err, delta.ErrInvalidDelta)
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	newFile := filepath.Join(dir, "new")
+	assert.Nil(t, os.WriteFile(basisFile, basisData, 0644))
+	assert.Nil(t, os.WriteFile(newFile, newData, 0644))
+
+	for _, c := range []codec.Codec{nil, codec.Gzip} {
+		signatureFile := filepath.Join(dir, "signature")
+		deltaFile := filepath.Join(dir, "delta")
+		outputFile := filepath.Join(dir, "output")
+		assert.Nil(t, SignatureFile(Rsync, basisFile, signatureFile, c))
+		assert.Nil(t, DeltaFile(Rsync, signatureFile, newFile, deltaFile, c))
+		assert.Nil(t, PatchFile(basisFile, deltaFile, outputFile))
+		output, err := os.ReadFile(outputFile)
+		assert.Nil(t, err)
+		assert.Equal(t, newData, output)
+		p, err := DeltaPatcher(deltaFile)
+		assert.Nil(t, err)
+		assert.Equal(t, Rsync, p)
+
+		assert.Nil(t, DeltaFile(Vcdiff, signatureFile, newFile, deltaFile, c))
+		assert.Nil(t, PatchFile(basisFile, deltaFile, outputFile))
+		output, err = os.ReadFile(outputFile)
+		assert.Nil(t, err)
+		assert.Equal(t, newData, output)
+		p, err = DeltaPatcher(deltaFile)
+		assert.Nil(t, err)
+		assert.Equal(t, Vcdiff, p)
+
+		assert.Nil(t, DiffFile(SuffixArray, SuffixArray, basisFile, newFile, deltaFile, c))
+		assert.Nil(t, PatchFile(basisFile, deltaFile, outputFile))
+		output, err = os.ReadFile(outputFile)
+		assert.Nil(t, err)
+		assert.Equal(t, newData, output)
+	}
+}
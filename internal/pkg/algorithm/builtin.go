@@ -0,0 +1,177 @@
+package algorithm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	"github.com/popescuag/RH/internal/pkg/rdiff"
+	"github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/popescuag/RH/internal/pkg/vcdiff"
+)
+
+var (
+	// Rsync signs fixed size chunks of the basis file with their SHA-256, and writes the deltas
+	// pointing at them. It is the algorithm of the deltas without header
+	Rsync = RsyncAlgorithm{}
+	// SuffixArray finds the new data anywhere in the basis file, which is its own signature
+	SuffixArray = LocalDiff{DiffOptions: delta.DiffOptions{Algorithm: delta.SuffixArrayDiff}}
+	// Blocks matches the chunks of the basis file, which is its own signature, then the data around them
+	Blocks = LocalDiff{DiffOptions: delta.DiffOptions{Algorithm: delta.BlockDiff}}
+	// Rdiff writes and reads the signatures and deltas of librsync, so they are exchanged with rdiff
+	Rdiff = RdiffAlgorithm{}
+	// Vcdiff writes the deltas of Rsync in the VCDIFF format of RFC 3284, and applies the VCDIFF deltas
+	// of any tool
+	Vcdiff = VcdiffFormat{Differ: Rsync}
+)
+
+// RsyncAlgorithm is the signature builder, differ and patcher of the default algorithm
+type RsyncAlgorithm struct {
+	SignatureOptions signature.Options
+	DeltaOptions     delta.Options
+}
+
+func (RsyncAlgorithm) Name() string {
+	return "rsync"
+}
+
+func (RsyncAlgorithm) nativeDeltas() {}
+
+func (r RsyncAlgorithm) Signature(basis io.Reader, basisSize int64, output io.Writer) error {
+	return signature.Write(basis, basisSize, output, r.SignatureOptions)
+}
+
+func (r RsyncAlgorithm) Delta(sig io.Reader, newFile io.Reader, newFileSize int64, output io.Writer) error {
+	signatureData, err := signature.ParseFromReaderWithLimits(io.NopCloser(sig), -1, signature.DefaultLimits)
+	if err != nil {
+		return err
+	}
+	return delta.Write(signatureData, newFile, newFileSize, output, r.DeltaOptions)
+}
+
+func (RsyncAlgorithm) Patch(basis io.ReaderAt, basisSize int64, deltaReader io.Reader, output io.Writer) error {
+	return patch.Apply(basis, basisSize, deltaReader, output)
+}
+
+// LocalDiff is the signature builder and differ of the diff algorithms, for files on the same machine.
+// The signature is a copy of the basis file, and the deltas are applied by Rsync
+type LocalDiff struct {
+	delta.DiffOptions
+}
+
+func (l LocalDiff) Name() string {
+	if l.Algorithm == "" {
+		return string(delta.SuffixArrayDiff)
+	}
+	return string(l.Algorithm)
+}
+
+func (LocalDiff) nativeDeltas() {}
+
+func (LocalDiff) Signature(basis io.Reader, basisSize int64, output io.Writer) error {
+	_, err := io.Copy(output, basis)
+	return err
+}
+
+func (l LocalDiff) Delta(sig io.Reader, newFile io.Reader, newFileSize int64, output io.Writer) error {
+	oldData, err := io.ReadAll(sig)
+	if err != nil {
+		return err
+	}
+	newData, err := io.ReadAll(newFile)
+	if err != nil {
+		return err
+	}
+	deltaData, err := delta.DiffData(oldData, newData, l.DiffOptions)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(deltaData)
+	return err
+}
+
+// RdiffAlgorithm is the signature builder, differ and patcher of the librsync formats. Its deltas are
+// recognized by their magic instead of a header
+type RdiffAlgorithm struct {
+	SignatureOptions rdiff.SignatureOptions
+}
+
+func (RdiffAlgorithm) Name() string {
+	return "rdiff"
+}
+
+func (RdiffAlgorithm) nativeDeltas() {}
+
+func (r RdiffAlgorithm) Signature(basis io.Reader, basisSize int64, output io.Writer) error {
+	return rdiff.WriteSignature(basis, basisSize, output, r.SignatureOptions)
+}
+
+func (RdiffAlgorithm) Delta(sig io.Reader, newFile io.Reader, newFileSize int64, output io.Writer) error {
+	parsed, err := rdiff.ParseSignature(sig, signature.DefaultLimits)
+	if err != nil {
+		return err
+	}
+	return rdiff.WriteDelta(parsed, newFile, output)
+}
+
+func (RdiffAlgorithm) Patch(basis io.ReaderAt, basisSize int64, deltaReader io.Reader, output io.Writer) error {
+	return rdiff.Apply(basis, basisSize, deltaReader, output)
+}
+
+// VcdiffFormat is the differ writing the deltas of Rsync or LocalDiff in the VCDIFF format, and their
+// patcher. Its deltas are recognized by their magic instead of a header
+type VcdiffFormat struct {
+	Differ Differ
+}
+
+func (VcdiffFormat) Name() string {
+	return "vcdiff"
+}
+
+func (VcdiffFormat) nativeDeltas() {}
+
+// Delta writes the delta of the differ to a temporary file, then converts it. The data of the new file
+// that is not copied is read back from it, or from memory when newFile is not an io.ReaderAt
+func (v VcdiffFormat) Delta(sig io.Reader, newFile io.Reader, newFileSize int64, output io.Writer) error {
+	switch v.Differ.(type) {
+	case RsyncAlgorithm, LocalDiff:
+	default:
+		return fmt.Errorf("%w: deltas of the %v algorithm cannot be written as VCDIFF", delta.ErrUnknownAlgorithm,
+			v.Differ.Name())
+	}
+	newData, seekable := newFile.(io.ReaderAt)
+	var buf *bytes.Buffer
+	if !seekable {
+		buf = new(bytes.Buffer)
+		newFile = io.TeeReader(newFile, buf)
+	}
+
+	native, err := os.CreateTemp("", "rh-vcdiff-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(native.Name())
+	defer native.Close()
+	w := bufio.NewWriter(native)
+	if err = v.Differ.Delta(sig, newFile, newFileSize, w); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if _, err = native.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if !seekable {
+		newData = bytes.NewReader(buf.Bytes())
+	}
+	return vcdiff.Encode(bufio.NewReader(native), newData, output)
+}
+
+func (VcdiffFormat) Patch(basis io.ReaderAt, basisSize int64, deltaReader io.Reader, output io.Writer) error {
+	return vcdiff.Apply(basis, basisSize, deltaReader, output)
+}
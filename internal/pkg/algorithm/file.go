@@ -0,0 +1,160 @@
+package algorithm
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+)
+
+// SignatureFile computes the signature of the basis file with the signature builder, compressed with
+// the codec if it is not nil
+func SignatureFile(b SignatureBuilder, basisFile string, signatureFile string, c codec.Codec) error {
+	basis, size, err := openFile(basisFile)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	return writeFile(signatureFile, c, func(output io.Writer) error {
+		return b.Signature(bufio.NewReader(basis), size, output)
+	})
+}
+
+// DeltaFile computes the delta of the new file against the signature with the differ, compressed with
+// the codec if it is not nil
+func DeltaFile(d Differ, signatureFile string, newFile string, deltaFile string, c codec.Codec) error {
+	sig, err := os.Open(signatureFile)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+	decoded, _, err := codec.NewReader(sig)
+	if err != nil {
+		return err
+	}
+	defer decoded.Close()
+
+	f, size, err := openFile(newFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFile(deltaFile, c, func(output io.Writer) error {
+		return WriteDelta(d, decoded, newFileReader(f), size, output)
+	})
+}
+
+// DiffFile computes the signature of the old file and the delta of the new file against it, without
+// writing the signature to a file
+func DiffFile(b SignatureBuilder, d Differ, oldFile string, newFile string, deltaFile string, c codec.Codec) error {
+	old, oldSize, err := openFile(oldFile)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	sig := new(bytes.Buffer)
+	err = b.Signature(bufio.NewReader(old), oldSize, sig)
+	if err != nil {
+		return err
+	}
+
+	f, size, err := openFile(newFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFile(deltaFile, c, func(output io.Writer) error {
+		return WriteDelta(d, sig, newFileReader(f), size, output)
+	})
+}
+
+// PatchFile rebuilds the new file from the basis file and a delta of any registered algorithm
+func PatchFile(basisFile string, deltaFile string, outputFile string) error {
+	basis, size, err := openFile(basisFile)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	d, err := os.Open(deltaFile)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	out, err := atomicfile.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	// The output is not buffered, as patchers read back what they wrote to it
+	err = Patch(basis, size, bufio.NewReader(d), out.File)
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// DeltaPatcher returns the patcher named in the header of the delta file
+func DeltaPatcher(deltaFile string) (Patcher, error) {
+	d, err := os.Open(deltaFile)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	p, _, err := ReadDeltaHeader(d)
+	return p, err
+}
+
+func openFile(name string) (*os.File, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// fileReader buffers the reads of a new file, which can still be read at any offset
+type fileReader struct {
+	*bufio.Reader
+	io.ReaderAt
+}
+
+func newFileReader(f *os.File) fileReader {
+	return fileReader{Reader: bufio.NewReader(f), ReaderAt: f}
+}
+
+// writeFile writes the output file atomically, compressed with the codec
+func writeFile(name string, c codec.Codec, write func(output io.Writer) error) error {
+	out, err := atomicfile.Create(name)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := bufio.NewWriter(out)
+	compressed, err := codec.NewWriter(output, c)
+	if err != nil {
+		return err
+	}
+	err = write(compressed)
+	if err != nil {
+		return err
+	}
+	err = compressed.Close()
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
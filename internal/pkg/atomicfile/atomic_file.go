@@ -0,0 +1,129 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultMode = 0644
+
+var (
+	pendingMutex sync.Mutex
+	pending      = map[string]bool{}
+)
+
+// File is written to a temporary file in the directory of its destination, and only renamed
+// to the destination by Commit, so a failed or interrupted command never leaves a partial output
+type File struct {
+	*os.File
+	path      string
+	mode      os.FileMode
+	committed bool
+	keep      bool
+}
+
+func Create(path string) (*File, error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+
+	pendingMutex.Lock()
+	pending[f.Name()] = true
+	pendingMutex.Unlock()
+
+	return &File{File: f, path: path, mode: defaultMode}, nil
+}
+
+// CreateResumable is like Create, but the temporary file has a fixed name and is kept when the command
+// fails or is interrupted, so the output can be completed by a later command. Unless resume is set,
+// anything left in the temporary file is discarded
+func CreateResumable(path string, resume bool) (*File, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(PartialPath(path), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f, path: path, mode: defaultMode, keep: true}, nil
+}
+
+// PartialPath returns the name of the temporary file of a resumable output
+func PartialPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+".partial")
+}
+
+// SetMode sets the permissions the file gets when it is committed, 0644 by default
+func (f *File) SetMode(mode os.FileMode) {
+	f.mode = mode
+}
+
+// Commit flushes the file to disk and moves it to its destination
+func (f *File) Commit() error {
+	err := f.File.Chmod(f.mode)
+	if err != nil {
+		return err
+	}
+	err = f.File.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.File.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.File.Name(), f.path)
+	if err != nil {
+		return err
+	}
+	f.committed = true
+	forget(f.File.Name())
+
+	// The rename is only durable once the directory is synced. Not every platform can sync directories
+	if dir, err := os.Open(filepath.Dir(f.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Close removes the temporary file unless the file was committed or is resumable. It is meant
+// to be deferred right after Create
+func (f *File) Close() error {
+	if f.committed {
+		return nil
+	}
+	if f.keep {
+		return f.File.Close()
+	}
+	f.File.Close()
+	err := os.Remove(f.File.Name())
+	forget(f.File.Name())
+	return err
+}
+
+// RemoveTemporaryFiles deletes the temporary files of all the outputs not committed yet.
+// It is called when the process is interrupted, as deferred calls do not run then
+func RemoveTemporaryFiles() {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	for name := range pending {
+		os.Remove(name)
+		delete(pending, name)
+	}
+}
+
+func forget(name string) {
+	pendingMutex.Lock()
+	delete(pending, name)
+	pendingMutex.Unlock()
+}
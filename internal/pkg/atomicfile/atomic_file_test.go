@@ -0,0 +1,130 @@
+package atomicfile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "output")
+
+	f, err := Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("data"))
+	assert.Nil(t, err)
+	// Nothing at the destination until the file is committed
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, f.Commit())
+	assert.Nil(t, f.Close())
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+	assertOnlyFile(t, dir, "output")
+}
+
+func TestCommitReplacesExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "output")
+	assert.Nil(t, os.WriteFile(path, []byte("old data"), 0644))
+
+	f, err := Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	f.Write([]byte("new"))
+
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "old data", string(data))
+
+	assert.Nil(t, f.Commit())
+	data, _ = os.ReadFile(path)
+	assert.Equal(t, "new", string(data))
+}
+
+func TestCloseWithoutCommit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "output")
+	assert.Nil(t, os.WriteFile(path, []byte("old data"), 0644))
+
+	f, err := Create(path)
+	assert.Nil(t, err)
+	f.Write([]byte("partial"))
+	assert.Nil(t, f.Close())
+
+	// The previous file is untouched and the partial one is gone
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "old data", string(data))
+	assertOnlyFile(t, dir, "output")
+}
+
+func TestRemoveTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	f, err := Create(filepath.Join(dir, "output"))
+	assert.Nil(t, err)
+	f.Write([]byte("partial"))
+
+	RemoveTemporaryFiles()
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	f.Close()
+}
+
+func TestCreateResumable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "output")
+
+	f, err := CreateResumable(path, false)
+	assert.Nil(t, err)
+	f.Write([]byte("part"))
+	RemoveTemporaryFiles()
+	assert.Nil(t, f.Close())
+	// The partial output survives both
+	assertOnlyFile(t, dir, ".output.partial")
+
+	f, err = CreateResumable(path, true)
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.Seek(0, io.SeekEnd)
+	assert.Nil(t, err)
+	f.Write([]byte("ial"))
+	assert.Nil(t, f.Commit())
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "partial", string(data))
+	assertOnlyFile(t, dir, "output")
+}
+
+func TestCreateResumableDiscardsPartialOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output")
+	assert.Nil(t, os.WriteFile(PartialPath(path), []byte("old data"), 0600))
+
+	f, err := CreateResumable(path, false)
+	assert.Nil(t, err)
+	defer f.Close()
+	f.Write([]byte("new"))
+	assert.Nil(t, f.Commit())
+
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "new", string(data))
+}
+
+func assertOnlyFile(t *testing.T, dir string, name string) {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, name, entries[0].Name())
+	}
+}
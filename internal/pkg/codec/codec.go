@@ -0,0 +1,217 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrUnknownCodec is returned for codecs that were not registered
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrCorrupted is returned when the data of a compressed file cannot be decompressed
+	ErrCorrupted = errors.New("corrupted compressed file")
+)
+
+// Codec compresses whole signature and delta files. Files written with a codec start with a header
+// naming it, so they are decompressed with the same codec when read
+type Codec interface {
+	// Name identifies the codec in the files it compresses, at most 255 bytes
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Files written by a codec start with the magic, the length of the codec name and the name. As a
+// little endian chunk size, the magic is larger than any valid one, so it never starts a signature
+// file, and deltas start with a digit
+const magic = "RHC1"
+
+var (
+	// None writes files as they are, without header
+	None Codec = noneCodec{}
+	Gzip Codec = gzipCodec{}
+	Zlib Codec = zlibCodec{}
+)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Codec{}
+)
+
+func init() {
+	for _, c := range []Codec{None, Gzip, Zlib} {
+		registry[c.Name()] = c
+	}
+}
+
+// Register makes a codec available to read the files it writes
+func Register(c Codec) error {
+	name := c.Name()
+	if name == "" || len(name) > 255 {
+		return fmt.Errorf("%w: invalid name %q", ErrUnknownCodec, name)
+	}
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, found := registry[name]; found {
+		return fmt.Errorf("codec %q already registered", name)
+	}
+	registry[name] = c
+	return nil
+}
+
+// Lookup returns the registered codec with the name
+func Lookup(name string) (Codec, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	c, found := registry[name]
+	if !found {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// Names returns the names of the registered codecs, sorted
+func Names() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewWriter writes the header of the codec to output, and returns the writer compressing what follows.
+// A nil codec is None. Closing the writer does not close output
+func NewWriter(output io.Writer, c Codec) (io.WriteCloser, error) {
+	if c == nil || c.Name() == None.Name() {
+		return nopWriteCloser{output}, nil
+	}
+	name := c.Name()
+	if name == "" || len(name) > 255 {
+		return nil, fmt.Errorf("%w: invalid name %q", ErrUnknownCodec, name)
+	}
+	header := append(append([]byte(magic), byte(len(name))), name...)
+	if _, err := output.Write(header); err != nil {
+		return nil, err
+	}
+	return c.NewWriter(output)
+}
+
+// NewReader finds the codec of the data from its header and returns the reader decompressing it,
+// which reads input as it is when there is no header
+func NewReader(input io.Reader) (io.ReadCloser, Codec, error) {
+	buffered := bufio.NewReader(input)
+	prefix, err := buffered.Peek(len(magic))
+	if err != nil || string(prefix) != magic {
+		// Files too short for a header are left to the parser, which reports what is missing
+		return io.NopCloser(buffered), None, nil
+	}
+
+	header := make([]byte, len(magic)+1)
+	if _, err = io.ReadFull(buffered, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+	name := make([]byte, header[len(magic)])
+	if _, err = io.ReadFull(buffered, name); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+	c, err := Lookup(string(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := c.NewReader(buffered)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return decodingReader{r}, c, nil
+}
+
+// decodingReader reports the errors of the codec as corrupted data, except for the end of the data
+// coming too early, which parsers report as truncated files
+type decodingReader struct {
+	io.ReadCloser
+}
+
+func (r decodingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return n, err
+}
+
+// Decode returns data decompressed with the codec named in its header, or as it is without header
+func Decode(data []byte) ([]byte, error) {
+	r, c, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if c == None {
+		return data, nil
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return decoded, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Name() string {
+	return "zlib"
+}
+
+func (zlibCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(w), nil
+}
+
+func (zlibCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var data = []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100))
+
+func encode(t *testing.T, c Codec, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, c)
+	assert.Nil(t, err)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []Codec{None, Gzip, Zlib} {
+		t.Run(c.Name(), func(t *testing.T) {
+			encoded := encode(t, c, data)
+			if c == None {
+				assert.Equal(t, data, encoded)
+			} else {
+				assert.True(t, bytes.HasPrefix(encoded, []byte(magic+string(byte(len(c.Name())))+c.Name())))
+				assert.Less(t, len(encoded), len(data))
+			}
+
+			r, found, err := NewReader(bytes.NewReader(encoded))
+			assert.Nil(t, err)
+			assert.Equal(t, c, found)
+			decoded, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, data, decoded)
+
+			decoded, err = Decode(encoded)
+			assert.Nil(t, err)
+			assert.Equal(t, data, decoded)
+		})
+	}
+}
+
+// reverseCodec stands for the codecs of other modules, it writes every block of data reversed
+type reverseCodec struct{}
+
+func (reverseCodec) Name() string {
+	return "reverse"
+}
+
+func (reverseCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return reverseWriter{w}, nil
+}
+
+func (reverseCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	data, err := io.ReadAll(r)
+	return io.NopCloser(bytes.NewReader(reverse(data))), err
+}
+
+type reverseWriter struct {
+	io.Writer
+}
+
+func (w reverseWriter) Write(p []byte) (int, error) {
+	return w.Writer.Write(reverse(p))
+}
+
+func (reverseWriter) Close() error {
+	return nil
+}
+
+func reverse(p []byte) []byte {
+	reversed := make([]byte, len(p))
+	for i := range p {
+		reversed[len(p)-1-i] = p[i]
+	}
+	return reversed
+}
+
+func TestRegister(t *testing.T) {
+	encoded := encode(t, reverseCodec{}, []byte("abc"))
+	_, err := Decode(encoded)
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+
+	assert.Nil(t, Register(reverseCodec{}))
+	assert.Contains(t, Names(), "reverse")
+	c, err := Lookup("reverse")
+	assert.Nil(t, err)
+	assert.Equal(t, reverseCodec{}, c)
+	decoded, err := Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), decoded)
+
+	assert.NotNil(t, Register(reverseCodec{}), "codecs are registered once")
+	assert.NotNil(t, Register(Gzip), "built-in codecs cannot be replaced")
+	_, err = Lookup("lz4")
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+}
+
+func TestCorrupted(t *testing.T) {
+	encoded := encode(t, Gzip, data)
+	_, err := Decode(encoded[:len(magic)+3])
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	// The checksum of gzip covers the data
+	corrupted := append([]byte{}, encoded...)
+	corrupted[len(corrupted)-5] ^= 0xff
+	_, err = Decode(corrupted)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	// Data too short for a header is read as it is
+	decoded, err := Decode([]byte("RH"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("RH"), decoded)
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []Codec{None, Gzip} {
+		t.Run(c.Name(), func(t *testing.T) {
+			path := filepath.Join(dir, c.Name())
+			assert.Nil(t, os.WriteFile(path, encode(t, c, data), 0644))
+
+			f, err := Open(path)
+			assert.Nil(t, err)
+			chunk := make([]byte, 9)
+			_, err = f.ReadAt(chunk, 4)
+			assert.Nil(t, err)
+			assert.Equal(t, "quick bro", string(chunk))
+			all, err := io.ReadAll(f)
+			assert.Nil(t, err)
+			assert.Equal(t, data, all)
+			assert.Nil(t, f.Close())
+		})
+	}
+}
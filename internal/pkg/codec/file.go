@@ -0,0 +1,55 @@
+package codec
+
+import (
+	"io"
+	"os"
+)
+
+// File is a signature or delta file opened through its codec. Compressed files are decompressed
+// to a temporary file, so they can be read at any offset like the others
+type File struct {
+	*os.File
+	temporary bool // removed when closed
+}
+
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, c, err := NewReader(f)
+	if err != nil || c == None {
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		return &File{File: f}, err
+	}
+	defer f.Close()
+	defer r.Close()
+
+	decoded, err := os.CreateTemp("", "rh-decoded-*")
+	if err != nil {
+		return nil, err
+	}
+	// Where open files can be removed, nothing is left behind even if the command is killed
+	file := &File{File: decoded, temporary: os.Remove(decoded.Name()) != nil}
+	if _, err = io.Copy(decoded, r); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = decoded.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *File) Close() error {
+	err := f.File.Close()
+	if f.temporary {
+		os.Remove(f.Name())
+	}
+	return err
+}
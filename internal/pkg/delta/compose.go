@@ -0,0 +1,385 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// segment is a part of the intermediate file, copied either from the basis file, from a new chunk
+// of the first delta or from an earlier part of the intermediate file, or a zero run
+type segment struct {
+	start  int64 // offset in the intermediate file
+	length int64
+	copy   bool
+	zero   bool
+	output bool
+	source int64 // offset of the data in the basis file, the first delta or the intermediate file
+	index  int64 // chunk of the basis file for pointers, -1 otherwise
+}
+
+// ComposeData = computes the delta equivalent to applying the deltas one after the other, without
+// building the intermediate files
+func ComposeData(deltas [][]byte) ([]byte, error) {
+	if len(deltas) == 0 {
+		return nil, fmt.Errorf("%w: no delta to compose", ErrInvalidDelta)
+	}
+
+	// The first delta is read at any offset, which compressed deltas cannot be
+	composed, err := codec.Decode(deltas[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, next := range deltas[1:] {
+		buf := new(bytes.Buffer)
+		err := compose(bytes.NewReader(composed), int64(len(composed)), bytes.NewReader(next), buf)
+		if err != nil {
+			return nil, err
+		}
+		composed = buf.Bytes()
+	}
+	return composed, nil
+}
+
+func Compose(deltaFiles []string, outputFile string) error {
+	first, err := codec.Open(deltaFiles[0])
+	if err != nil {
+		return err
+	}
+	defer first.Close()
+
+	// Each delta is composed with the result of the previous ones, kept in a temporary file
+	// that is only committed for the last delta
+	previous := first.File
+	var intermediate *atomicfile.File
+	defer func() {
+		if intermediate != nil {
+			intermediate.Close()
+		}
+	}()
+	for i, deltaFile := range deltaFiles[1:] {
+		out, err := composeFile(previous, deltaFile, outputFile)
+		if err != nil {
+			return err
+		}
+		// The result of the previous deltas is not read anymore, so its temporary file is removed now
+		// rather than at the end of a long chain
+		if intermediate != nil {
+			intermediate.Close()
+		}
+		intermediate = out
+		if i == len(deltaFiles)-2 {
+			return out.Commit()
+		}
+		previous = out.File
+	}
+	return fmt.Errorf("%w: at least 2 deltas are needed", ErrInvalidDelta)
+}
+
+// composeFile composes the delta file with the delta read from previous into a temporary file next to the
+// output, which the caller commits or closes
+func composeFile(previous *os.File, deltaFile string, outputFile string) (*atomicfile.File, error) {
+	fi, err := previous.Stat()
+	if err != nil {
+		return nil, err
+	}
+	next, err := os.Open(deltaFile)
+	if err != nil {
+		return nil, err
+	}
+	defer next.Close()
+
+	out, err := atomicfile.Create(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	output := bufio.NewWriter(out)
+	err = compose(previous, fi.Size(), next, output)
+	if err != nil {
+		err = fmt.Errorf("cannot compose %v: %w", deltaFile, err)
+	} else {
+		err = output.Flush()
+	}
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+// compose writes the delta equivalent to applying first and then second. The instructions of second
+// read the intermediate file, which is described by the instructions of first
+func compose(first io.ReaderAt, firstSize int64, second io.Reader, output io.Writer) error {
+	firstReader, err := NewReader(io.NewSectionReader(first, 0, firstSize))
+	if err != nil {
+		return err
+	}
+	segments, err := readSegments(firstReader)
+	if err != nil {
+		return err
+	}
+	intermediateSize := firstReader.Metadata.Size
+
+	reader, err := NewReader(second)
+	if err != nil {
+		return err
+	}
+	if reader.Metadata.Version < sizeVersion {
+		return fmt.Errorf("%w: version 1 deltas do not record the size of the file they produce", s.ErrUnsupportedVersion)
+	}
+	// The composed delta produces the last file, so it carries its metadata
+	w, err := newWriter(output, firstReader.Metadata.ChunkSize, reader.Metadata.Size, NoLiterals, reader.Metadata.File,
+		CopyOp, ZeroOp, OutputCopyOp)
+	if err != nil {
+		return err
+	}
+	c := &composer{writer: w, first: first, segments: segments}
+
+	chunkSize := int64(reader.Metadata.ChunkSize)
+	var size int64
+	for {
+		op, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		offset, length := op.Source, op.Length
+		switch op.Type {
+		case CompressedOp:
+			return reader.parseError(fmt.Errorf("%w: compressed chunks cannot be composed", s.ErrUnsupportedVersion))
+		case AddOp:
+			return reader.parseError(fmt.Errorf("%w: add instructions cannot be composed", s.ErrUnsupportedVersion))
+		case NewChunkOp:
+			if err = c.newChunk(op.Data); err != nil {
+				return err
+			}
+			size += int64(len(op.Data))
+			continue
+		case ZeroOp:
+			if err = c.zero(op.Length); err != nil {
+				return err
+			}
+			size += op.Length
+			continue
+		case OutputCopyOp:
+			// The composed delta produces the same file, so it copies the same data
+			if op.Length > size || op.Source > size-op.Length {
+				return reader.parseError(fmt.Errorf("%w: copy of %d bytes at %d not written yet", ErrInvalidDelta,
+					op.Length, op.Source))
+			}
+			if err = c.outputCopy(op.Source, op.Length); err != nil {
+				return err
+			}
+			size += op.Length
+			continue
+		case PointerOp:
+			// The last chunk of the intermediate file can be shorter than the rest
+			offset = int64(op.Index) * chunkSize
+			length = chunkSize
+			if intermediateSize-offset < length {
+				length = intermediateSize - offset
+			}
+		}
+		if length <= 0 || length > intermediateSize || offset > intermediateSize-length {
+			return reader.parseError(fmt.Errorf("%w: %d bytes at %d not in an intermediate file of %d bytes",
+				ErrChainMismatch, length, offset, intermediateSize))
+		}
+		if err = c.copyRange(offset, length); err != nil {
+			return err
+		}
+		size += length
+	}
+
+	if size != reader.Metadata.Size {
+		return reader.parseError(fmt.Errorf("%w: instructions do not produce the %d bytes of the new file",
+			ErrInvalidDelta, reader.Metadata.Size))
+	}
+	return c.flush()
+}
+
+// readSegments reads the parts of the file a delta produces. The size of the last chunk of the basis
+// file is not in the delta: it is found from the size of the file the delta produces
+func readSegments(reader *Reader) ([]segment, error) {
+	md := reader.Metadata
+	if md.Version < sizeVersion {
+		return nil, fmt.Errorf("%w: version 1 deltas do not record the size of the file they produce", s.ErrUnsupportedVersion)
+	}
+	chunkSize := int64(md.ChunkSize)
+
+	segments := []segment{}
+	var size int64
+	lastIndex := int64(-1)
+	for {
+		op, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		seg := segment{index: -1}
+		switch op.Type {
+		case CompressedOp:
+			// Their dictionary is data of the basis file
+			return nil, reader.parseError(fmt.Errorf("%w: compressed chunks cannot be composed",
+				s.ErrUnsupportedVersion))
+		case AddOp:
+			return nil, reader.parseError(fmt.Errorf("%w: add instructions cannot be composed",
+				s.ErrUnsupportedVersion))
+		case NewChunkOp:
+			seg.source, seg.length = op.Offset, int64(len(op.Data))
+		case PointerOp:
+			seg.copy, seg.source, seg.length, seg.index = true, int64(op.Index)*chunkSize, chunkSize, int64(op.Index)
+			if seg.index > lastIndex {
+				lastIndex = seg.index
+			}
+		case CopyOp:
+			seg.copy, seg.source, seg.length = true, op.Source, op.Length
+		case ZeroOp:
+			seg.zero, seg.length = true, op.Length
+		case OutputCopyOp:
+			// Checked once the size of the segments is known
+			seg.output, seg.source, seg.length = true, op.Source, op.Length
+		}
+		segments = append(segments, seg)
+		size += seg.length
+	}
+
+	// Pointers to the highest chunk make up for the bytes produced in excess, if it is the shorter last chunk
+	if excess := size - md.Size; excess != 0 {
+		var lastChunkPointers int64
+		for _, seg := range segments {
+			if seg.index == lastIndex && lastIndex >= 0 {
+				lastChunkPointers++
+			}
+		}
+		if excess < 0 || lastChunkPointers == 0 || excess%lastChunkPointers != 0 || excess/lastChunkPointers >= chunkSize {
+			return nil, reader.parseError(fmt.Errorf("%w: instructions do not produce the %d bytes of the new file",
+				ErrInvalidDelta, md.Size))
+		}
+		for i := range segments {
+			if segments[i].index == lastIndex {
+				segments[i].length -= excess / lastChunkPointers
+			}
+		}
+	}
+
+	var start int64
+	for i := range segments {
+		if segments[i].output && segments[i].source+segments[i].length > start {
+			return nil, fmt.Errorf("%w: copy of %d bytes at %d not written yet", ErrInvalidDelta,
+				segments[i].length, segments[i].source)
+		}
+		segments[i].start = start
+		start += segments[i].length
+	}
+	return segments, nil
+}
+
+// composer writes the composed delta, merging the copies of contiguous parts of the basis file
+// and the zero runs next to each other
+type composer struct {
+	writer     *Writer
+	first      io.ReaderAt
+	segments   []segment
+	copyOffset int64
+	copyLength int64
+	zeroLength int64
+}
+
+// copyRange writes the instructions producing a part of the intermediate file
+func (c *composer) copyRange(offset int64, length int64) error {
+	end := offset + length
+	i := sort.Search(len(c.segments), func(i int) bool {
+		return c.segments[i].start+c.segments[i].length > offset
+	})
+	for ; offset < end; i++ {
+		seg := c.segments[i]
+		n := seg.start + seg.length - offset
+		if end-offset < n {
+			n = end - offset
+		}
+		source := seg.source + offset - seg.start
+
+		var err error
+		switch {
+		case seg.output:
+			// Output copies only read the intermediate file before them
+			err = c.copyRange(source, n)
+		case seg.zero:
+			err = c.zero(n)
+		case seg.copy:
+			err = c.copy(source, n)
+		default:
+			data := make([]byte, n)
+			if _, err = c.first.ReadAt(data, source); err != nil {
+				return err
+			}
+			err = c.newChunk(data)
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+func (c *composer) copy(offset int64, length int64) error {
+	if c.copyLength > 0 && c.copyOffset+c.copyLength == offset {
+		c.copyLength += length
+		return nil
+	}
+	err := c.flush()
+	c.copyOffset, c.copyLength = offset, length
+	return err
+}
+
+func (c *composer) outputCopy(offset int64, length int64) error {
+	err := c.flush()
+	if err != nil {
+		return err
+	}
+	return c.writer.OutputCopy(offset, length)
+}
+
+func (c *composer) zero(length int64) error {
+	if c.zeroLength > 0 {
+		c.zeroLength += length
+		return nil
+	}
+	err := c.flush()
+	c.zeroLength = length
+	return err
+}
+
+func (c *composer) newChunk(data []byte) error {
+	err := c.flush()
+	if err != nil {
+		return err
+	}
+	return c.writer.NewChunk(data)
+}
+
+func (c *composer) flush() error {
+	var err error
+	if c.copyLength > 0 {
+		err = c.writer.Copy(c.copyOffset, c.copyLength)
+	}
+	if c.zeroLength > 0 {
+		err = c.writer.ZeroRun(c.zeroLength)
+	}
+	c.copyLength, c.zeroLength = 0, 0
+	return err
+}
@@ -0,0 +1,239 @@
+package delta
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/metadata"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComposeData(t *testing.T) {
+	a := buildRandomChunk(64*40 + 10)
+	b := append(append(append([]byte{}, a[:640]...), buildRandomChunk(100)...), a[640:]...)
+	c := append(append([]byte{}, b[1000:]...), b[:1000]...)
+	d := append(append([]byte{}, c[:100]...), buildRandomChunk(50)...)
+	e := append(append(append([]byte{}, a[:640]...), make([]byte, 1000)...), a[640:]...)
+	block := buildRandomChunk(128)
+	f := append(append(append(append([]byte{}, a[:640]...), block...), block...), a[640:]...)
+
+	testCases := []struct {
+		name       string
+		files      [][]byte
+		chunkSizes []int
+	}{
+		{
+			name:       "two deltas",
+			files:      [][]byte{a, b, c},
+			chunkSizes: []int{32, 32},
+		},
+		{
+			name:       "three deltas with different chunk sizes",
+			files:      [][]byte{a, b, c, d},
+			chunkSizes: []int{64, 32, 128},
+		},
+		{
+			name:       "from an empty file",
+			files:      [][]byte{{}, a, b},
+			chunkSizes: []int{32, 32},
+		},
+		{
+			name:       "to an empty file",
+			files:      [][]byte{a, b, {}},
+			chunkSizes: []int{32, 32},
+		},
+		{
+			name:       "zero runs",
+			files:      [][]byte{a, e, append(append([]byte{}, e...), make([]byte, 100)...)},
+			chunkSizes: []int{32, 64},
+		},
+		{
+			name:       "repeated new data",
+			files:      [][]byte{a, f, append(append(append([]byte{}, f[:1280]...), block...), f[1280:]...)},
+			chunkSizes: []int{32, 64},
+		},
+		{
+			name:       "single delta",
+			files:      [][]byte{a, b},
+			chunkSizes: []int{32},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			deltas := [][]byte{}
+			for i, chunkSize := range tc.chunkSizes {
+				deltas = append(deltas, mustGetChunkedDelta(t, tc.files[i], tc.files[i+1], chunkSize))
+			}
+
+			composed, err := ComposeData(deltas)
+			assert.Nil(t, err)
+			output := applyForTest(t, tc.files[0], composed)
+			assert.True(t, bytes.Equal(tc.files[len(tc.files)-1], output), "composed delta does not produce the last file")
+		})
+	}
+}
+
+func TestComposeDataErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		deltas [][]byte
+		err    error
+	}{
+		{
+			name:   "no delta",
+			deltas: [][]byte{},
+			err:    ErrInvalidDelta,
+		},
+		{
+			name:   "version 1 delta",
+			deltas: [][]byte{[]byte("32|N,4,tiny"), []byte("32,v=2,size=4|P,4,0")},
+			err:    s.ErrUnsupportedVersion,
+		},
+		{
+			name:   "pointer beyond the intermediate file",
+			deltas: [][]byte{[]byte("32,v=2,size=4|N,4,tiny"), []byte("32,v=2,size=4|P,4,1")},
+			err:    ErrChainMismatch,
+		},
+		{
+			name:   "copy beyond the intermediate file",
+			deltas: [][]byte{[]byte("32,v=2,size=4|N,4,tiny"), []byte("32,v=3,size=4|C,2,4")},
+			err:    ErrChainMismatch,
+		},
+		{
+			name:   "compressed chunks",
+			deltas: [][]byte{[]byte("32,v=2,size=4|N,4,tiny"), []byte("32,v=6,size=5,literals=flate|L,5,3,abc")},
+			err:    s.ErrUnsupportedVersion,
+		},
+		{
+			name:   "instructions do not produce the size",
+			deltas: [][]byte{[]byte("32,v=2,size=40|P,4,0"), []byte("32,v=2,size=4|N,4,tiny")},
+			err:    ErrInvalidDelta,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ComposeData(tc.deltas)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestCompose(t *testing.T) {
+	a := buildRandomChunk(64*40 + 10)
+	b := append(buildRandomChunk(64), a...)
+	c := append(append([]byte{}, b[1000:]...), b[:1000]...)
+	d := append(append([]byte{}, c...), buildRandomChunk(50)...)
+
+	dir := t.TempDir()
+	files := [][]byte{a, b, c, d}
+	deltaFiles := []string{}
+	for i := 0; i < len(files)-1; i++ {
+		deltaFile := filepath.Join(dir, "delta"+string(rune('1'+i)))
+		assert.Nil(t, os.WriteFile(deltaFile, mustGetChunkedDelta(t, files[i], files[i+1], 64), 0644))
+		deltaFiles = append(deltaFiles, deltaFile)
+	}
+
+	outputFile := filepath.Join(dir, "composed")
+	assert.Nil(t, Compose(deltaFiles, outputFile))
+	composed, err := os.ReadFile(outputFile)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(d, applyForTest(t, a, composed)), "composed delta does not produce the last file")
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestComposeMetadata(t *testing.T) {
+	a := buildRandomChunk(64*10 + 10)
+	b := append(buildRandomChunk(64), a...)
+	c := append(append([]byte{}, b...), buildRandomChunk(50)...)
+
+	dir := t.TempDir()
+	files := [][]byte{a, b, c}
+	mds := []*metadata.Metadata{
+		{Mode: 0600, ModTime: time.Unix(1e9, 0), Uid: -1, Gid: -1},
+		{Mode: 0755, ModTime: time.Unix(2e9, 5), Uid: 1000, Gid: 100},
+	}
+	deltaFiles := []string{}
+	for i := 0; i < len(files)-1; i++ {
+		signatureData, err := s.GetSignatureWithOptions(files[i], s.Options{ChunkSize: s.FixedChunkSizePolicy(64)})
+		assert.Nil(t, err)
+		deltaData, err := GetDeltaWithOptions(signatureData, files[i+1], Options{file: mds[i]})
+		assert.Nil(t, err)
+		deltaFile := filepath.Join(dir, "delta"+string(rune('1'+i)))
+		assert.Nil(t, os.WriteFile(deltaFile, deltaData, 0644))
+		deltaFiles = append(deltaFiles, deltaFile)
+	}
+
+	outputFile := filepath.Join(dir, "composed")
+	assert.Nil(t, Compose(deltaFiles, outputFile))
+	composed, err := os.ReadFile(outputFile)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(c, applyForTest(t, a, composed)), "composed delta does not produce the last file")
+
+	// The composed delta carries the metadata of the last file only
+	reader, err := NewReader(bytes.NewReader(composed))
+	assert.Nil(t, err)
+	assert.Equal(t, metadataVersion, reader.Metadata.Version)
+	assert.Equal(t, mds[1], reader.Metadata.File)
+}
+
+func mustGetChunkedDelta(t *testing.T, basis []byte, newData []byte, chunkSize int) []byte {
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(chunkSize)})
+	assert.Nil(t, err)
+	return mustGetDelta(t, signatureData, newData)
+}
+
+// applyForTest applies a delta the way the patch package does, which cannot be imported here
+func applyForTest(t *testing.T, basis []byte, deltaData []byte) []byte {
+	reader, err := NewReader(bytes.NewReader(deltaData))
+	assert.Nil(t, err)
+	chunkSize := int(reader.Metadata.ChunkSize)
+
+	output := []byte{}
+	for {
+		op, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		switch op.Type {
+		case NewChunkOp:
+			output = append(output, op.Data...)
+		case PointerOp:
+			end := (int(op.Index) + 1) * chunkSize
+			if end > len(basis) {
+				end = len(basis)
+			}
+			output = append(output, basis[int(op.Index)*chunkSize:end]...)
+		case CopyOp:
+			output = append(output, basis[op.Source:op.Source+op.Length]...)
+		case ZeroOp:
+			output = append(output, make([]byte, op.Length)...)
+		case OutputCopyOp:
+			output = append(output, output[op.Source:op.Source+op.Length]...)
+		case AddOp:
+			for i, difference := range op.Data {
+				output = append(output, basis[op.Source+int64(i)]+difference)
+			}
+		case CompressedOp:
+			dictionary := output
+			if len(dictionary) > DictionarySize {
+				dictionary = dictionary[len(dictionary)-DictionarySize:]
+			}
+			data, err := Decompress(reader.Metadata.Literals, op.Data, dictionary, op.Length)
+			assert.Nil(t, err)
+			output = append(output, data...)
+		}
+	}
+	assert.Equal(t, reader.Metadata.Size, int64(len(output)))
+	return output
+}
@@ -1,121 +1,382 @@
-package delta
-
-import (
-	"bufio"
-	"bytes"
-	"fmt"
-	"io"
-	"os"
-
-	s "github.com/popescuag/RH/internal/pkg/signature"
-)
-
-const (
-	pointerMark    = "P"
-	newChunkMark   = "N"
-	fieldSeparator = ","
-	dataSeparator  = "|"
-)
-
-// GetDelta = computes deltas based on signature data and the new file
-func GetDelta(signatureData []byte, newData []byte) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	len64 := int64(len(newData))
-	sd, err := s.ParseFromReader(io.NopCloser(bytes.NewReader(signatureData)))
-	createDelta(sd, io.NopCloser(bytes.NewReader(newData)), len64, buf)
-
-	return buf.Bytes(), err
-}
-
-func Compute(signatureFile string, newFile string, deltaFile string) error {
-	signatureData, err := s.ParseFromFile(signatureFile)
-	if err != nil {
-		return err
-	}
-
-	f, err := os.Open(newFile)
-	if err != nil {
-		return err
-	}
-	inputReader := io.NopCloser(bufio.NewReader(f))
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return err
-	}
-
-	out, err := os.Create(deltaFile)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	return createDelta(signatureData, inputReader, fi.Size(), out)
-}
-
-func createDelta(signatureData s.SignatureData, newFile io.ReadCloser, newFileSize int64, output io.Writer) error {
-	//Write metadata first
-	_, err := output.Write([]byte(fmt.Sprintf("%d%v", signatureData.Metadata.ChunkSize, dataSeparator)))
-	if err != nil {
-		return err
-	}
-	defer newFile.Close()
-
-	var totalBytesRead int64
-	for {
-		chunk := make([]byte, signatureData.Metadata.ChunkSize)
-		br, err := newFile.Read(chunk)
-		if err != nil {
-			return err
-		}
-		totalBytesRead += int64(br)
-
-		checksum := s.GetChecksum(chunk[:br])
-		index := findChecksum(checksum, signatureData.Checksums)
-
-		// Write a pointer to a chunk from the original file if the signature of this chunk was found
-		// or the new chunk otherwise
-		if index == -1 {
-			err = writeNewChunk(chunk[:br], output)
-		} else {
-			err = writePointer(uint32(index), output)
-		}
-
-		if err != nil {
-			return err
-		}
-
-		if totalBytesRead == newFileSize {
-			break
-		}
-	}
-	return nil
-}
-
-func writePointer(index uint32, out io.Writer) error {
-	_, err := out.Write([]byte(fmt.Sprintf("%v%v%d%v%d", pointerMark, fieldSeparator,
-		4, fieldSeparator, index)))
-	return err
-}
-
-func writeNewChunk(newChunk []byte, out io.Writer) error {
-	_, err := out.Write([]byte(fmt.Sprintf("%v%v%v%v", newChunkMark, fieldSeparator,
-		len(newChunk), fieldSeparator)))
-	if err != nil {
-		return err
-	}
-	_, err = out.Write(newChunk)
-	return err
-}
-
-func findChecksum(newChecksum string, checksums []string) int {
-	index := -1
-	for i, checksum := range checksums {
-		if newChecksum == checksum {
-			index = i
-			break
-		}
-	}
-	return index
-}
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/metadata"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/popescuag/RH/internal/pkg/sparse"
+)
+
+const (
+	pointerMark    = "P"
+	newChunkMark   = "N"
+	copyMark       = "C"
+	zeroMark       = "Z"
+	outputCopyMark = "O"
+	compressedMark = "L"
+	addMark        = "A"
+	fieldSeparator = ","
+	dataSeparator  = "|"
+)
+
+// Options controls how deltas are computed. The zero value writes new chunks as they are
+type Options struct {
+	// Literals compresses new chunks with the codec
+	Literals LiteralCodec
+	// Codec compresses the whole delta file, which is written as it is if nil
+	Codec codec.Codec
+	// Metadata carries the mode, modification time, owner and extended attributes of the new file in the
+	// delta, when it is read from a file
+	Metadata bool
+	file     *metadata.Metadata // read from the new file when Metadata is set
+}
+
+// readMetadata reads the metadata of the new file into the options, when they ask for it
+func (o *Options) readMetadata(newFile *os.File) error {
+	if !o.Metadata {
+		return nil
+	}
+	var err error
+	o.file, err = metadata.Read(newFile)
+	return err
+}
+
+// GetDelta = computes deltas based on signature data and the new file
+func GetDelta(signatureData []byte, newData []byte) ([]byte, error) {
+	return GetDeltaWithOptions(signatureData, newData, Options{})
+}
+
+func GetDeltaWithOptions(signatureData []byte, newData []byte, options Options) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	len64 := int64(len(newData))
+	sd, err := s.ParseFromReaderWithLimits(io.NopCloser(bytes.NewReader(signatureData)), int64(len(signatureData)),
+		s.DefaultLimits)
+	if err != nil {
+		return nil, err
+	}
+	output, err := codec.NewWriter(buf, options.Codec)
+	if err != nil {
+		return nil, err
+	}
+	err = createDelta(sd, io.NopCloser(bytes.NewReader(newData)), len64, output, options, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = output.Close()
+	return buf.Bytes(), err
+}
+
+// Write computes the delta of the new file of the given size against the signature to output
+func Write(signatureData s.SignatureData, newFile io.Reader, newFileSize int64, output io.Writer,
+	options Options) error {
+	compressed, err := codec.NewWriter(output, options.Codec)
+	if err != nil {
+		return err
+	}
+	err = createDelta(signatureData, io.NopCloser(newFile), newFileSize, compressed, options, nil)
+	if err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+func Compute(signatureFile string, newFile string, deltaFile string) error {
+	return ComputeWithOptions(signatureFile, newFile, deltaFile, Options{})
+}
+
+func ComputeWithOptions(signatureFile string, newFile string, deltaFile string, options Options) error {
+	signatureData, err := s.ParseFromFile(signatureFile)
+	if err != nil {
+		return fmt.Errorf("cannot read signature file %v: %w", signatureFile, err)
+	}
+
+	f, err := os.Open(newFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err = options.readMetadata(f); err != nil {
+		return err
+	}
+	inputReader, err := sparse.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	out, err := atomicfile.Create(deltaFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := bufio.NewWriter(out)
+	compressed, err := codec.NewWriter(output, options.Codec)
+	if err != nil {
+		return err
+	}
+	err = createDelta(signatureData, inputReader, fi.Size(), compressed, options, nil)
+	if err != nil {
+		return err
+	}
+	err = compressed.Close()
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// New chunks are indexed up to this count, so a large new file does not need an unbounded index
+const maxIndexedNewChunks = 1 << 20
+
+// createDelta writes the delta of the new file. Chunks not found in the signature are matched byte by byte
+// against the basis file when refine is set
+func createDelta(signatureData s.SignatureData, newFile io.ReadCloser, newFileSize int64, output io.Writer,
+	options Options, refine *refiner) error {
+	//Write metadata first
+	w, err := newWriter(output, signatureData.Metadata.ChunkSize, newFileSize, options.Literals, options.file, CopyOp,
+		ZeroOp, OutputCopyOp)
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+	holes, _ := newFile.(sparse.HoleSkipper)
+
+	// The end of the new file read so far is the dictionary of compressed chunks
+	var past *history
+	if options.Literals != NoLiterals {
+		past = &history{}
+	}
+
+	// Chunks written as new data are copied from the new file when they appear again
+	newChunks := map[string]int64{}
+
+	// Zero chunks are merged in a single zero run, and copies of data written one after the other
+	// in a single copy, written before the next chunk that cannot be merged with them
+	var zeros, copyOffset, copyLength, basisOffset, basisLength int64
+	flush := func() error {
+		var err error
+		if zeros > 0 {
+			err = w.ZeroRun(zeros)
+		}
+		if copyLength > 0 {
+			err = w.OutputCopy(copyOffset, copyLength)
+		}
+		if basisLength > 0 {
+			err = w.Copy(basisOffset, basisLength)
+		}
+		zeros, copyLength, basisLength = 0, 0, 0
+		return err
+	}
+
+	// Offset of the basis file where the data of the next chunk is expected, after the last one found
+	var expected int64
+
+	// refineChunk writes a chunk as the copies of the basis data found in it, merged with the pending copy
+	// when they follow it, and the new data between them
+	refineChunk := func(chunk []byte) error {
+		// expected already moved past the chunk, which is matched from where it starts
+		next := expected - int64(len(chunk))
+		pieces, err := refine.match(chunk, next)
+		if err != nil {
+			return err
+		}
+		for _, p := range pieces {
+			length := int64(p.end - p.start)
+			switch {
+			case p.source >= 0 && basisLength > 0 && basisOffset+basisLength == p.source:
+				basisLength += length
+			case p.source >= 0:
+				if err = flush(); err != nil {
+					return err
+				}
+				basisOffset, basisLength = p.source, length
+			default:
+				if err = flush(); err != nil {
+					return err
+				}
+				if err = w.CompressedChunk(chunk[p.start:p.end], past.dictionary()); err != nil {
+					return err
+				}
+			}
+			past.write(chunk[p.start:p.end])
+			next += length
+			if p.source >= 0 {
+				next = p.source + length
+			}
+		}
+		expected = next
+		return nil
+	}
+
+	chunk := make([]byte, signatureData.Metadata.ChunkSize)
+	var totalBytesRead int64
+	for totalBytesRead < newFileSize {
+		// The last chunk (or the only one, for files smaller than a chunk) can be shorter
+		n := int64(len(chunk))
+		if newFileSize-totalBytesRead < n {
+			n = newFileSize - totalBytesRead
+		}
+
+		// The holes of sparse files are not even read
+		if holes != nil {
+			skipped, err := holes.SkipHole(n)
+			if err != nil {
+				return err
+			}
+			if skipped {
+				if copyLength > 0 || basisLength > 0 {
+					if err = flush(); err != nil {
+						return err
+					}
+				}
+				zeros += n
+				totalBytesRead += n
+				expected += n
+				past.writeZeros(n)
+				continue
+			}
+		}
+
+		br, err := io.ReadFull(newFile, chunk[:n])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: input ended after %d of %d bytes", s.ErrTruncated, totalBytesRead+int64(br), newFileSize)
+		}
+		if err != nil {
+			return err
+		}
+		offset := totalBytesRead
+		totalBytesRead += int64(br)
+
+		expected += int64(br)
+		if sparse.IsZero(chunk[:br]) {
+			if copyLength > 0 || basisLength > 0 {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+			zeros += int64(br)
+			past.write(chunk[:br])
+			continue
+		}
+
+		checksum := s.GetChecksum(chunk[:br])
+		index := findChecksum(checksum, signatureData.Checksums)
+		source, written := newChunks[checksum]
+		if index == -1 && written && copyLength > 0 && copyOffset+copyLength == source {
+			copyLength += int64(br)
+			past.write(chunk[:br])
+			continue
+		}
+		if index == -1 && !written && refine != nil {
+			if err = refineChunk(chunk[:br]); err != nil {
+				return err
+			}
+			if len(newChunks) < maxIndexedNewChunks {
+				newChunks[checksum] = offset
+			}
+			continue
+		}
+		if err = flush(); err != nil {
+			return err
+		}
+
+		// Write a pointer to a chunk from the original file if the signature of this chunk was found,
+		// a copy of the same chunk written before, or the new chunk otherwise
+		switch {
+		case index != -1:
+			err = w.Pointer(uint32(index))
+			expected = int64(index+1) * int64(signatureData.Metadata.ChunkSize)
+		case written:
+			copyOffset, copyLength = source, int64(br)
+		default:
+			err = w.CompressedChunk(chunk[:br], past.dictionary())
+			if len(newChunks) < maxIndexedNewChunks {
+				newChunks[checksum] = offset
+			}
+		}
+		past.write(chunk[:br])
+
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+func writePointer(index uint32, out io.Writer) error {
+	_, err := out.Write([]byte(fmt.Sprintf("%v%v%d%v%d", pointerMark, fieldSeparator,
+		4, fieldSeparator, index)))
+	return err
+}
+
+func writeNewChunk(newChunk []byte, out io.Writer) error {
+	_, err := out.Write([]byte(fmt.Sprintf("%v%v%v%v", newChunkMark, fieldSeparator,
+		len(newChunk), fieldSeparator)))
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(newChunk)
+	return err
+}
+
+func writeCompressedChunk(length int, compressed []byte, out io.Writer) error {
+	_, err := out.Write([]byte(fmt.Sprintf("%v%v%d%v%d%v", compressedMark, fieldSeparator, length, fieldSeparator,
+		len(compressed), fieldSeparator)))
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(compressed)
+	return err
+}
+
+func writeAdd(offset int64, differences []byte, out io.Writer) error {
+	_, err := out.Write([]byte(fmt.Sprintf("%v%v%d%v%d%v", addMark, fieldSeparator, offset, fieldSeparator,
+		len(differences), fieldSeparator)))
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(differences)
+	return err
+}
+
+func writeCopy(offset int64, length int64, out io.Writer) error {
+	_, err := out.Write([]byte(fmt.Sprintf("%v%v%d%v%d", copyMark, fieldSeparator, offset, fieldSeparator, length)))
+	return err
+}
+
+func writeOutputCopy(offset int64, length int64, out io.Writer) error {
+	_, err := out.Write([]byte(fmt.Sprintf("%v%v%d%v%d", outputCopyMark, fieldSeparator, offset, fieldSeparator, length)))
+	return err
+}
+
+func writeZeroRun(length int64, out io.Writer) error {
+	_, err := out.Write([]byte(fmt.Sprintf("%v%v%d", zeroMark, fieldSeparator, length)))
+	return err
+}
+
+func findChecksum(newChecksum string, checksums []string) int {
+	index := -1
+	for i, checksum := range checksums {
+		if newChecksum == checksum {
+			index = i
+			break
+		}
+	}
+	return index
+}
@@ -1,242 +1,457 @@
-package delta
-
-import (
-	"bytes"
-	"fmt"
-	"io"
-	"math/rand"
-	"sync"
-	"testing"
-	"time"
-
-	s "github.com/popescuag/RH/internal/pkg/signature"
-	"github.com/stretchr/testify/assert"
-)
-
-var (
-	chunks       = buildRandomChunks(512, 6)
-	smallerChunk = buildRandomChunk(64)
-)
-
-func TestDeltas(t *testing.T) {
-	testCases := []struct {
-		name           string
-		signature      s.SignatureData
-		newFile        []byte
-		expectedResult []byte
-	}{
-		{
-			name:           "identical files",
-			signature:      s.BuildSignatureData(chunks[0:3], 512),
-			newFile:        buildNewFile1(),
-			expectedResult: buildOutput1(),
-		},
-		{
-			name:           "2 chunks identical, last chunk different",
-			signature:      s.BuildSignatureData(chunks[0:3], 512),
-			newFile:        buildNewFile2(),
-			expectedResult: buildOutput2(),
-		},
-
-		{
-			name:           "3rd chunk deleted, the rest are the same",
-			signature:      s.BuildSignatureData(chunks[0:3], 512),
-			newFile:        buildNewFile3(),
-			expectedResult: buildOutput3(),
-		},
-
-		{
-			name:           "2nd chunk replaced, the rest are the same",
-			signature:      s.BuildSignatureData(chunks[0:3], 512),
-			newFile:        buildNewFile4(),
-			expectedResult: buildOutput4(),
-		},
-
-		{
-			name:           "Shifted chunks",
-			signature:      s.BuildSignatureData(chunks[0:3], 512),
-			newFile:        buildNewFile5(),
-			expectedResult: buildOutput5(),
-		},
-		{
-			name:           "No common chunks",
-			signature:      s.BuildSignatureData(chunks[0:3], 512),
-			newFile:        buildNewFile6(),
-			expectedResult: buildOutput6(),
-		},
-		{
-			name:           "Smaller last chunk",
-			signature:      s.BuildSignatureData(chunks[0:3], 512),
-			newFile:        buildNewFile7(),
-			expectedResult: buildOutput7(),
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			var wg sync.WaitGroup
-
-			prf, pwf := io.Pipe()
-			// Pass new file data
-			go writeBytes(tc.newFile, pwf, t)
-
-			//Read output
-			pro, pwo := io.Pipe()
-			wg.Add(1)
-			go func(r *io.PipeReader, len int, t *testing.T) {
-				output := make([]byte, len)
-				br, _ := io.ReadFull(pro, output)
-				equal := bytes.Compare(output, tc.expectedResult)
-				assert.Equal(t, 0, equal, "Expected 0, got %v", equal)
-				assert.Equal(t, len, br)
-				defer wg.Done()
-			}(pro, len(tc.expectedResult), t)
-
-			err := createDelta(tc.signature, prf, int64(len(tc.newFile)), pwo)
-			assert.Nil(t, err)
-			pwo.Close()
-
-			wg.Wait()
-
-			t.Logf("Test %v completed", tc.name)
-		})
-	}
-}
-
-func writeBytes(arr []byte, w *io.PipeWriter, t *testing.T) {
-	bw, err := io.Copy(w, bytes.NewReader(arr))
-	if err != nil {
-		t.Errorf("%v", err)
-	}
-	assert.Equal(t, bw, int64(len(arr)))
-	if bw < int64(len(arr)) {
-		t.Errorf("Less bytes written than expected: %v", bw)
-	}
-	w.Close()
-}
-
-func buildRandomChunks(chunkSize int, chunkCount int) [][]byte {
-	randomChunks := make([][]byte, chunkCount)
-	for i := 0; i < chunkCount; i++ {
-		randomChunks[i] = buildRandomChunk(chunkSize)
-	}
-	return randomChunks
-}
-
-func buildRandomChunk(chunkSize int) []byte {
-	chunk := make([]byte, chunkSize)
-	rand.Seed(time.Now().UnixNano())
-	rand.Read(chunk)
-	return chunk
-}
-
-func buildNewFile1() []byte {
-	return bytes.Join(chunks[0:3], make([]byte, 0))
-}
-
-func buildOutput1() []byte {
-	//512|P,4,0P,4,1P,4,2
-	return []byte(fmt.Sprintf("512%v%v%v4%v0%v%v4%v1%v%v4%v2", dataSeparator, pointerMark, fieldSeparator,
-		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, pointerMark, fieldSeparator, fieldSeparator))
-}
-
-func buildNewFile2() []byte {
-	newChunks := [][]byte{
-		chunks[0], chunks[1], chunks[5],
-	}
-	return bytes.Join(newChunks, make([]byte, 0))
-}
-
-func buildOutput2() []byte {
-	//512|P,4,0P,4,1N,512,...
-	var outputData []byte
-	commonData := []byte(fmt.Sprintf("512%v%v%v4%v0%v%v4%v1%v%v512%v", dataSeparator, pointerMark, fieldSeparator,
-		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, newChunkMark, fieldSeparator, fieldSeparator))
-	outputData = append(outputData, commonData...)
-	outputData = append(outputData, chunks[5]...)
-	return outputData
-}
-
-func buildNewFile3() []byte {
-	newChunks := [][]byte{
-		chunks[0], chunks[1],
-	}
-	return bytes.Join(newChunks, make([]byte, 0))
-}
-
-func buildOutput3() []byte {
-	//512|P,4,0P,4,1
-	return []byte(fmt.Sprintf("512%v%v%v4%v0%v%v4%v1", dataSeparator, pointerMark, fieldSeparator, fieldSeparator,
-		pointerMark, fieldSeparator, fieldSeparator))
-}
-
-func buildNewFile4() []byte {
-	newChunks := [][]byte{
-		chunks[0], chunks[3], chunks[2],
-	}
-	return bytes.Join(newChunks, make([]byte, 0))
-}
-
-func buildOutput4() []byte {
-	//512|P,4,0N,512,...P,4,2
-	var outputData []byte
-	data := []byte(fmt.Sprintf("512%v%v%v4%v0%v%v512%v", dataSeparator, pointerMark, fieldSeparator, fieldSeparator,
-		newChunkMark, fieldSeparator, fieldSeparator))
-	outputData = append(outputData, data...)
-	outputData = append(outputData, chunks[3]...)
-	data = []byte(fmt.Sprintf("%v%v4%v2", pointerMark, fieldSeparator, fieldSeparator))
-	outputData = append(outputData, data...)
-	return outputData
-}
-
-func buildNewFile5() []byte {
-	newChunks := [][]byte{
-		chunks[2], chunks[0], chunks[1],
-	}
-	return bytes.Join(newChunks, make([]byte, 0))
-}
-
-func buildOutput5() []byte {
-	//512|P,4,2P,4,0P,4,1
-	return []byte(fmt.Sprintf("512%v%v%v4%v2%v%v4%v0%v%v4%v1", dataSeparator, pointerMark, fieldSeparator,
-		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, pointerMark, fieldSeparator, fieldSeparator))
-}
-
-func buildNewFile6() []byte {
-	newChunks := [][]byte{
-		chunks[3], chunks[4], chunks[5],
-	}
-	return bytes.Join(newChunks, make([]byte, 0))
-}
-
-func buildOutput6() []byte {
-	//512|N,512,...N,512,...N,512,...
-	var outputData []byte
-	data := []byte(fmt.Sprintf("512%v%v%v512%v", dataSeparator, newChunkMark, fieldSeparator, fieldSeparator))
-	outputData = append(outputData, data...)
-	outputData = append(outputData, chunks[3]...)
-	data = []byte(fmt.Sprintf("%v%v512%v", newChunkMark, fieldSeparator, fieldSeparator))
-	outputData = append(outputData, data...)
-	outputData = append(outputData, chunks[4]...)
-	data = []byte(fmt.Sprintf("%v%v512%v", newChunkMark, fieldSeparator, fieldSeparator))
-	outputData = append(outputData, data...)
-	outputData = append(outputData, chunks[5]...)
-	return outputData
-}
-
-func buildNewFile7() []byte {
-	newChunks := [][]byte{
-		chunks[0], chunks[1], smallerChunk,
-	}
-	return bytes.Join(newChunks, make([]byte, 0))
-}
-
-func buildOutput7() []byte {
-	//512|P,4,0P,4,1N,512,...
-	var outputData []byte
-	commonData := []byte(fmt.Sprintf("512%v%v%v4%v0%v%v4%v1%v%v64%v", dataSeparator, pointerMark, fieldSeparator,
-		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, newChunkMark, fieldSeparator, fieldSeparator))
-	outputData = append(outputData, commonData...)
-	outputData = append(outputData, smallerChunk...)
-	return outputData
-}
+package delta
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	chunks       = buildRandomChunks(512, 6)
+	smallerChunk = buildRandomChunk(64)
+)
+
+func TestDeltas(t *testing.T) {
+	testCases := []struct {
+		name           string
+		signature      s.SignatureData
+		newFile        []byte
+		expectedResult []byte
+	}{
+		{
+			name:           "identical files",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile1(),
+			expectedResult: buildOutput1(),
+		},
+		{
+			name:           "2 chunks identical, last chunk different",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile2(),
+			expectedResult: buildOutput2(),
+		},
+
+		{
+			name:           "3rd chunk deleted, the rest are the same",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile3(),
+			expectedResult: buildOutput3(),
+		},
+
+		{
+			name:           "2nd chunk replaced, the rest are the same",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile4(),
+			expectedResult: buildOutput4(),
+		},
+
+		{
+			name:           "Shifted chunks",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile5(),
+			expectedResult: buildOutput5(),
+		},
+		{
+			name:           "No common chunks",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile6(),
+			expectedResult: buildOutput6(),
+		},
+		{
+			name:           "Smaller last chunk",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile7(),
+			expectedResult: buildOutput7(),
+		},
+		{
+			name:           "Empty new file",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        []byte{},
+			expectedResult: buildOutput8(),
+		},
+		{
+			name:           "Empty basis file",
+			signature:      s.BuildSignatureData([][]byte{}, 32),
+			newFile:        buildNewFile9(),
+			expectedResult: buildOutput9(),
+		},
+		{
+			name:           "Zero chunks",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile10(),
+			expectedResult: buildOutput10(),
+		},
+		{
+			name:           "Repeated new chunks",
+			signature:      s.BuildSignatureData(chunks[0:3], 512),
+			newFile:        buildNewFile11(),
+			expectedResult: buildOutput11(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+
+			prf, pwf := io.Pipe()
+			// Pass new file data
+			go writeBytes(tc.newFile, pwf, t)
+
+			//Read output
+			pro, pwo := io.Pipe()
+			wg.Add(1)
+			go func(r *io.PipeReader, len int, t *testing.T) {
+				output := make([]byte, len)
+				br, _ := io.ReadFull(pro, output)
+				equal := bytes.Compare(output, tc.expectedResult)
+				assert.Equal(t, 0, equal, "Expected 0, got %v", equal)
+				assert.Equal(t, len, br)
+				defer wg.Done()
+			}(pro, len(tc.expectedResult), t)
+
+			err := createDelta(tc.signature, prf, int64(len(tc.newFile)), pwo, Options{}, nil)
+			assert.Nil(t, err)
+			pwo.Close()
+
+			wg.Wait()
+
+			t.Logf("Test %v completed", tc.name)
+		})
+	}
+}
+
+func writeBytes(arr []byte, w *io.PipeWriter, t *testing.T) {
+	bw, err := io.Copy(w, bytes.NewReader(arr))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	assert.Equal(t, bw, int64(len(arr)))
+	if bw < int64(len(arr)) {
+		t.Errorf("Less bytes written than expected: %v", bw)
+	}
+	w.Close()
+}
+
+func buildRandomChunks(chunkSize int, chunkCount int) [][]byte {
+	randomChunks := make([][]byte, chunkCount)
+	for i := 0; i < chunkCount; i++ {
+		randomChunks[i] = buildRandomChunk(chunkSize)
+	}
+	return randomChunks
+}
+
+func buildRandomChunk(chunkSize int) []byte {
+	chunk := make([]byte, chunkSize)
+	rand.Seed(time.Now().UnixNano())
+	rand.Read(chunk)
+	return chunk
+}
+
+func buildNewFile1() []byte {
+	return bytes.Join(chunks[0:3], make([]byte, 0))
+}
+
+func buildOutput1() []byte {
+	//512,v=5,size=...|P,4,0P,4,1P,4,2
+	return []byte(fmt.Sprintf("%v%v%v4%v0%v%v4%v1%v%v4%v2", buildMetadata(512, 1536), pointerMark, fieldSeparator,
+		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, pointerMark, fieldSeparator, fieldSeparator))
+}
+
+func buildNewFile2() []byte {
+	newChunks := [][]byte{
+		chunks[0], chunks[1], chunks[5],
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput2() []byte {
+	//512,v=5,size=...|P,4,0P,4,1N,512,...
+	var outputData []byte
+	commonData := []byte(fmt.Sprintf("%v%v%v4%v0%v%v4%v1%v%v512%v", buildMetadata(512, 1536), pointerMark, fieldSeparator,
+		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, newChunkMark, fieldSeparator, fieldSeparator))
+	outputData = append(outputData, commonData...)
+	outputData = append(outputData, chunks[5]...)
+	return outputData
+}
+
+func buildNewFile3() []byte {
+	newChunks := [][]byte{
+		chunks[0], chunks[1],
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput3() []byte {
+	//512,v=5,size=...|P,4,0P,4,1
+	return []byte(fmt.Sprintf("%v%v%v4%v0%v%v4%v1", buildMetadata(512, 1024), pointerMark, fieldSeparator, fieldSeparator,
+		pointerMark, fieldSeparator, fieldSeparator))
+}
+
+func buildNewFile4() []byte {
+	newChunks := [][]byte{
+		chunks[0], chunks[3], chunks[2],
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput4() []byte {
+	//512,v=5,size=...|P,4,0N,512,...P,4,2
+	var outputData []byte
+	data := []byte(fmt.Sprintf("%v%v%v4%v0%v%v512%v", buildMetadata(512, 1536), pointerMark, fieldSeparator, fieldSeparator,
+		newChunkMark, fieldSeparator, fieldSeparator))
+	outputData = append(outputData, data...)
+	outputData = append(outputData, chunks[3]...)
+	data = []byte(fmt.Sprintf("%v%v4%v2", pointerMark, fieldSeparator, fieldSeparator))
+	outputData = append(outputData, data...)
+	return outputData
+}
+
+func buildNewFile5() []byte {
+	newChunks := [][]byte{
+		chunks[2], chunks[0], chunks[1],
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput5() []byte {
+	//512,v=5,size=...|P,4,2P,4,0P,4,1
+	return []byte(fmt.Sprintf("%v%v%v4%v2%v%v4%v0%v%v4%v1", buildMetadata(512, 1536), pointerMark, fieldSeparator,
+		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, pointerMark, fieldSeparator, fieldSeparator))
+}
+
+func buildNewFile6() []byte {
+	newChunks := [][]byte{
+		chunks[3], chunks[4], chunks[5],
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput6() []byte {
+	//512,v=5,size=...|N,512,...N,512,...N,512,...
+	var outputData []byte
+	data := []byte(fmt.Sprintf("%v%v%v512%v", buildMetadata(512, 1536), newChunkMark, fieldSeparator, fieldSeparator))
+	outputData = append(outputData, data...)
+	outputData = append(outputData, chunks[3]...)
+	data = []byte(fmt.Sprintf("%v%v512%v", newChunkMark, fieldSeparator, fieldSeparator))
+	outputData = append(outputData, data...)
+	outputData = append(outputData, chunks[4]...)
+	data = []byte(fmt.Sprintf("%v%v512%v", newChunkMark, fieldSeparator, fieldSeparator))
+	outputData = append(outputData, data...)
+	outputData = append(outputData, chunks[5]...)
+	return outputData
+}
+
+func buildNewFile7() []byte {
+	newChunks := [][]byte{
+		chunks[0], chunks[1], smallerChunk,
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput7() []byte {
+	//512,v=5,size=...|P,4,0P,4,1N,512,...
+	var outputData []byte
+	commonData := []byte(fmt.Sprintf("%v%v%v4%v0%v%v4%v1%v%v64%v", buildMetadata(512, 1088), pointerMark, fieldSeparator,
+		fieldSeparator, pointerMark, fieldSeparator, fieldSeparator, newChunkMark, fieldSeparator, fieldSeparator))
+	outputData = append(outputData, commonData...)
+	outputData = append(outputData, smallerChunk...)
+	return outputData
+}
+
+func buildOutput8() []byte {
+	//512,v=5,size=...|
+	return []byte(fmt.Sprintf("%v", buildMetadata(512, 0)))
+}
+
+func buildNewFile9() []byte {
+	return []byte("tiny")
+}
+
+func buildOutput9() []byte {
+	//32,v=5,size=...|N,4,tiny
+	return []byte(fmt.Sprintf("%v%v%v4%vtiny", buildMetadata(32, 4), newChunkMark, fieldSeparator, fieldSeparator))
+}
+
+func buildNewFile10() []byte {
+	newChunks := [][]byte{
+		chunks[0], make([]byte, 1100), chunks[1],
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput10() []byte {
+	//512,v=5,size=...|P,4,0Z,1024N,76,...
+	// The zeros that do not fill a chunk are part of the next chunk, which is not in the basis file
+	var outputData []byte
+	data := []byte(fmt.Sprintf("%vP,4,0Z,1024N,512,", buildMetadata(512, 2124)))
+	outputData = append(outputData, data...)
+	outputData = append(outputData, make([]byte, 76)...)
+	outputData = append(outputData, chunks[1][:436]...)
+	outputData = append(outputData, []byte("N,76,")...)
+	outputData = append(outputData, chunks[1][436:]...)
+	return outputData
+}
+
+func TestGetDeltaInvalidSignature(t *testing.T) {
+	_, err := GetDelta([]byte{1, 2, 3}, buildNewFile1())
+	assert.ErrorIs(t, err, s.ErrTruncated)
+}
+
+func buildMetadata(chunkSize int, size int) string {
+	return fmt.Sprintf("%d%vv=5%vsize=%d%v", chunkSize, fieldSeparator, fieldSeparator, size, dataSeparator)
+}
+
+func TestWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, 32, 70)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Pointer(1))
+	assert.Nil(t, w.NewChunk(bytes.Repeat([]byte("a"), 38)))
+	assert.ErrorIs(t, w.Copy(0, 10), ErrInvalidDelta)
+	assert.Equal(t, "32,v=2,size=70|P,4,1N,32,"+strings.Repeat("a", 32)+"N,6,aaaaaa", buf.String())
+
+	buf.Reset()
+	w, err = NewWriter(buf, 32, 10, CopyOp)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Copy(100, 10))
+	assert.Equal(t, "32,v=3,size=10|C,100,10", buf.String())
+
+	buf.Reset()
+	w, err = NewWriter(buf, 32, 110, CopyOp, ZeroOp)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Copy(100, 10))
+	assert.Nil(t, w.ZeroRun(100))
+	assert.Equal(t, "32,v=4,size=110|C,100,10Z,100", buf.String())
+
+	buf.Reset()
+	w, err = NewWriter(buf, 32, 10)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, w.OutputCopy(0, 10), ErrInvalidDelta)
+}
+
+func TestCompressedLiterals(t *testing.T) {
+	// Text edited in a few places, which compresses well with the text around it as dictionary
+	basis := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 200))
+	newFile := append([]byte{}, basis...)
+	copy(newFile[1000:], "cat")
+	copy(newFile[5000:], "The quick red fox")
+	newFile = append(newFile, "The lazy dog sleeps."...)
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(512)})
+	assert.Nil(t, err)
+	uncompressed := mustGetDelta(t, signatureData, newFile)
+
+	for _, codec := range []LiteralCodec{FlateLiterals, ZlibLiterals} {
+		t.Run(string(codec), func(t *testing.T) {
+			deltaData, err := GetDeltaWithOptions(signatureData, newFile, Options{Literals: codec})
+			assert.Nil(t, err)
+			assert.True(t, bytes.HasPrefix(deltaData, []byte("512,v=6,size=9020,literals="+string(codec)+"|")))
+			assert.Less(t, len(deltaData)*4, len(uncompressed), "compressed delta is not much smaller")
+			assert.Nil(t, ValidateData(signatureData, deltaData))
+			assert.Equal(t, newFile, applyForTest(t, basis, deltaData))
+		})
+	}
+
+	_, err = GetDeltaWithOptions(signatureData, newFile, Options{Literals: "lz4"})
+	assert.ErrorIs(t, err, s.ErrUnsupportedVersion)
+}
+
+func TestCompressedDelta(t *testing.T) {
+	basis := bytes.Join(chunks[0:4], nil)
+	intermediate := bytes.Join([][]byte{chunks[1], chunks[4], chunks[0], chunks[3]}, nil)
+	newFile := bytes.Join([][]byte{chunks[4], chunks[5], smallerChunk}, nil)
+	options := s.Options{ChunkSize: s.FixedChunkSizePolicy(512), Codec: codec.Gzip}
+	signatureData, err := s.GetSignatureWithOptions(basis, options)
+	assert.Nil(t, err)
+	intermediateSignature, err := s.GetSignatureWithOptions(intermediate, options)
+	assert.Nil(t, err)
+
+	for _, c := range []codec.Codec{codec.Gzip, codec.Zlib} {
+		t.Run(c.Name(), func(t *testing.T) {
+			plain := mustGetDelta(t, signatureData, intermediate)
+			deltaData, err := GetDeltaWithOptions(signatureData, intermediate, Options{Codec: c})
+			assert.Nil(t, err)
+			decoded, err := codec.Decode(deltaData)
+			assert.Nil(t, err)
+			assert.Equal(t, plain, decoded)
+			assert.Nil(t, ValidateData(signatureData, deltaData))
+			assert.Equal(t, intermediate, applyForTest(t, basis, deltaData))
+
+			next, err := GetDeltaWithOptions(intermediateSignature, newFile, Options{Codec: c})
+			assert.Nil(t, err)
+			composed, err := ComposeData([][]byte{deltaData, next})
+			assert.Nil(t, err)
+			assert.Equal(t, newFile, applyForTest(t, basis, composed))
+
+			dir := t.TempDir()
+			signatureFile := filepath.Join(dir, "signature")
+			newFileName := filepath.Join(dir, "new")
+			deltaFile := filepath.Join(dir, "delta")
+			nextFile := filepath.Join(dir, "next")
+			assert.Nil(t, os.WriteFile(signatureFile, signatureData, 0644))
+			assert.Nil(t, os.WriteFile(newFileName, intermediate, 0644))
+			assert.Nil(t, os.WriteFile(nextFile, next, 0644))
+			assert.Nil(t, ComputeWithOptions(signatureFile, newFileName, deltaFile, Options{Codec: c}))
+			assert.Nil(t, Validate(signatureFile, deltaFile))
+			composedFile := filepath.Join(dir, "composed")
+			assert.Nil(t, Compose([]string{deltaFile, nextFile}, composedFile))
+			composed, err = os.ReadFile(composedFile)
+			assert.Nil(t, err)
+			assert.Equal(t, newFile, applyForTest(t, basis, composed))
+		})
+	}
+}
+
+func TestComputeSparseFile(t *testing.T) {
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	assert.Nil(t, os.WriteFile(basisFile, bytes.Join(chunks[0:3], nil), 0644))
+	signatureFile := filepath.Join(dir, "signature")
+	assert.Nil(t, s.Compute(basisFile, signatureFile, s.Options{ChunkSize: s.FixedChunkSizePolicy(512)}))
+
+	// The new file has a hole of 1MB between two chunks of the basis file
+	newFile := filepath.Join(dir, "new")
+	f, err := os.Create(newFile)
+	assert.Nil(t, err)
+	_, err = f.Write(chunks[0])
+	assert.Nil(t, err)
+	_, err = f.WriteAt(chunks[1], 512+1<<20)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, Compute(signatureFile, newFile, deltaFile))
+	deltaData, err := os.ReadFile(deltaFile)
+	assert.Nil(t, err)
+	expected := fmt.Sprintf("%vP,4,0Z,%dP,4,1", buildMetadata(512, 1024+1<<20), 1<<20)
+	assert.Equal(t, expected, string(deltaData))
+}
+
+func buildNewFile11() []byte {
+	newChunks := [][]byte{
+		chunks[3], chunks[4], chunks[0], chunks[3], chunks[4], chunks[3], smallerChunk,
+	}
+	return bytes.Join(newChunks, make([]byte, 0))
+}
+
+func buildOutput11() []byte {
+	//512,v=5,size=...|N,512,...N,512,...P,4,0O,0,1024O,0,512N,64,...
+	var outputData []byte
+	outputData = append(outputData, []byte(buildMetadata(512, 3136)+"N,512,")...)
+	outputData = append(outputData, chunks[3]...)
+	outputData = append(outputData, []byte("N,512,")...)
+	outputData = append(outputData, chunks[4]...)
+	outputData = append(outputData, []byte("P,4,0O,0,1024O,0,512N,64,")...)
+	outputData = append(outputData, smallerChunk...)
+	return outputData
+}
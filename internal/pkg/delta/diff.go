@@ -0,0 +1,161 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/popescuag/RH/internal/pkg/sparse"
+)
+
+// DiffAlgorithm chooses how the data of the new file is found in the old file
+type DiffAlgorithm string
+
+const (
+	// SuffixArrayDiff finds approximate matches anywhere in the old file with a suffix array, like bsdiff.
+	// Both files are loaded in memory, it suits executables and other small files
+	SuffixArrayDiff DiffAlgorithm = "bsdiff"
+	// BlockDiff matches the chunks of the signature of the old file, then the chunks not found byte by
+	// byte against the old data around them, so a small edit does not turn a whole chunk into new data
+	BlockDiff DiffAlgorithm = "blocks"
+)
+
+// ValidateDiffAlgorithm returns an error if the algorithm is not known
+func ValidateDiffAlgorithm(algorithm DiffAlgorithm) error {
+	switch algorithm {
+	case "", SuffixArrayDiff, BlockDiff:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algorithm)
+}
+
+// DiffOptions controls how the delta of two files is computed. The zero value uses SuffixArrayDiff
+type DiffOptions struct {
+	Options
+	Algorithm DiffAlgorithm
+	// ChunkSize chooses the chunk size of the signature of the old file, for BlockDiff
+	ChunkSize s.ChunkSizePolicy
+}
+
+// DiffData = computes the delta of newData against oldData, both at hand
+func DiffData(oldData []byte, newData []byte, options DiffOptions) ([]byte, error) {
+	err := ValidateDiffAlgorithm(options.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	output, err := codec.NewWriter(buf, options.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Algorithm == BlockDiff {
+		oldSize := int64(len(oldData))
+		err = blockDiff(bytes.NewReader(oldData), io.NopCloser(bytes.NewReader(oldData)), oldSize,
+			io.NopCloser(bytes.NewReader(newData)), int64(len(newData)), output, options)
+	} else {
+		err = suffixArrayDiff(oldData, newData, output, options.Options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = output.Close()
+	return buf.Bytes(), err
+}
+
+// Diff computes the delta of newFile against oldFile, like DiffData. BlockDiff does not load them in memory
+func Diff(oldFile string, newFile string, deltaFile string, options DiffOptions) error {
+	err := ValidateDiffAlgorithm(options.Algorithm)
+	if err != nil {
+		return err
+	}
+	old, err := os.Open(oldFile)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	oldInfo, err := old.Stat()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(newFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err = options.readMetadata(f); err != nil {
+		return err
+	}
+
+	out, err := atomicfile.Create(deltaFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := bufio.NewWriter(out)
+	compressed, err := codec.NewWriter(output, options.Codec)
+	if err != nil {
+		return err
+	}
+	if options.Algorithm == BlockDiff {
+		err = diffFiles(old, oldInfo.Size(), f, fi.Size(), compressed, options)
+	} else {
+		var oldData, newData []byte
+		if oldData, err = io.ReadAll(old); err != nil {
+			return err
+		}
+		if newData, err = io.ReadAll(f); err != nil {
+			return err
+		}
+		err = suffixArrayDiff(oldData, newData, compressed, options.Options)
+	}
+	if err != nil {
+		return err
+	}
+	err = compressed.Close()
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// diffFiles runs blockDiff on files, skipping their holes
+func diffFiles(old *os.File, oldSize int64, newFile *os.File, newSize int64, output io.Writer,
+	options DiffOptions) error {
+	oldReader, err := sparse.NewReader(old, oldSize)
+	if err != nil {
+		return err
+	}
+	newReader, err := sparse.NewReader(newFile, newSize)
+	if err != nil {
+		return err
+	}
+	return blockDiff(old, oldReader, oldSize, newReader, newSize, output, options)
+}
+
+// blockDiff writes the delta of the new file against the signature of the old one, matching the chunks
+// not found in the signature against the old data, read at any offset from old
+func blockDiff(old io.ReaderAt, oldReader io.ReadCloser, oldSize int64, newFile io.ReadCloser, newSize int64,
+	output io.Writer, options DiffOptions) error {
+	sd, err := s.BuildFromReader(oldReader, oldSize, s.Options{ChunkSize: options.ChunkSize})
+	if err != nil {
+		return err
+	}
+	refine := &refiner{basis: old, basisSize: oldSize}
+	return createDelta(sd, newFile, newSize, output, options.Options, refine)
+}
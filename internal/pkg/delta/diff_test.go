@@ -0,0 +1,131 @@
+package delta
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffData(t *testing.T) {
+	old := buildRandomChunk(8 * 4096)
+	changed := append([]byte{}, old...)
+	changed[5000] ^= 0xff
+	inserted := append(append(append([]byte{}, old[:10000]...), 'x'), old[10000:]...)
+	removed := append(append([]byte{}, old[:10000]...), old[10100:]...)
+	// Data is only looked for around where it is expected
+	moved := bytes.Join([][]byte{old[:5000], old[7000:9000], old[5000:7000], old[9000:]}, nil)
+
+	testCases := []struct {
+		name    string
+		newFile []byte
+		maxSize int // of the delta
+	}{
+		{name: "byte changed", newFile: changed, maxSize: 200},
+		{name: "byte inserted", newFile: inserted, maxSize: 200},
+		{name: "bytes removed", newFile: removed, maxSize: 200},
+		{name: "data moved", newFile: moved, maxSize: 200},
+		{name: "new data", newFile: buildRandomChunk(5000), maxSize: 5100},
+		{name: "empty file", newFile: []byte{}, maxSize: 50},
+	}
+	options := DiffOptions{Algorithm: BlockDiff, ChunkSize: s.FixedChunkSizePolicy(4096)}
+	signatureData, err := s.GetSignatureWithOptions(old, s.Options{ChunkSize: options.ChunkSize})
+	assert.Nil(t, err)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			deltaData, err := DiffData(old, tc.newFile, options)
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(deltaData), tc.maxSize)
+			assert.Nil(t, ValidateData(signatureData, deltaData))
+			assert.Equal(t, tc.newFile, applyForTest(t, old, deltaData))
+		})
+	}
+}
+
+func TestDiffDataWithCompressedLiterals(t *testing.T) {
+	old := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 400)
+	newFile := append([]byte{}, old...)
+	copy(newFile[1000:], "The quick red fox")
+	newFile = append(newFile[:9000], append([]byte("The lazy dog sleeps. "), newFile[9000:]...)...)
+
+	options := DiffOptions{Options: Options{Literals: ZlibLiterals}, Algorithm: BlockDiff,
+		ChunkSize: s.FixedChunkSizePolicy(4096)}
+	deltaData, err := DiffData(old, newFile, options)
+	assert.Nil(t, err)
+	assert.Less(t, len(deltaData), 200)
+	assert.Equal(t, newFile, applyForTest(t, old, deltaData))
+}
+
+func TestSuffixArrayDiff(t *testing.T) {
+	old := buildRandomChunk(64 << 10)
+	changed := append([]byte{}, old...)
+	changed[5000] ^= 0xff
+	inserted := bytes.Join([][]byte{old[:10000], []byte("inserted"), old[10000:]}, nil)
+	moved := bytes.Join([][]byte{old[40000:], buildRandomChunk(100), old[:40000]}, nil)
+	// Like the addresses of an executable after code was inserted: most bytes are the same, every
+	// hundredth is shifted
+	shifted := append([]byte{}, old...)
+	for i := 0; i < len(shifted); i += 100 {
+		shifted[i] += 4
+	}
+
+	testCases := []struct {
+		name    string
+		old     []byte
+		newFile []byte
+		maxSize int // of the delta compressed with gzip
+	}{
+		{name: "same file", old: old, newFile: old, maxSize: 100},
+		{name: "byte changed", old: old, newFile: changed, maxSize: 100},
+		{name: "bytes inserted", old: old, newFile: inserted, maxSize: 100},
+		{name: "data moved", old: old, newFile: moved, maxSize: 250},
+		{name: "bytes shifted", old: old, newFile: shifted, maxSize: 4000},
+		{name: "new data", old: old, newFile: buildRandomChunk(5000), maxSize: 5100},
+		{name: "from an empty file", old: []byte{}, newFile: changed[:1000], maxSize: 1100},
+		{name: "empty file", old: old, newFile: []byte{}, maxSize: 60},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			deltaData, err := DiffData(tc.old, tc.newFile, DiffOptions{})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.newFile, applyForTest(t, tc.old, deltaData))
+
+			compressed, err := DiffData(tc.old, tc.newFile, DiffOptions{Options: Options{Codec: codec.Gzip}})
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(compressed), tc.maxSize)
+		})
+	}
+
+	_, err := DiffData(old, changed, DiffOptions{Algorithm: "xdelta"})
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+}
+
+func TestDiff(t *testing.T) {
+	old := buildRandomChunk(8 * 4096)
+	newFile := append(append(append([]byte{}, old[:10000]...), "inserted"...), old[10000:]...)
+	dir := t.TempDir()
+	oldFile := filepath.Join(dir, "old")
+	newFileName := filepath.Join(dir, "new")
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, os.WriteFile(oldFile, old, 0644))
+	assert.Nil(t, os.WriteFile(newFileName, newFile, 0644))
+
+	for _, algorithm := range []DiffAlgorithm{SuffixArrayDiff, BlockDiff} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			options := DiffOptions{Algorithm: algorithm, ChunkSize: s.FixedChunkSizePolicy(4096)}
+			assert.Nil(t, Diff(oldFile, newFileName, deltaFile, options))
+			deltaData, err := os.ReadFile(deltaFile)
+			assert.Nil(t, err)
+			expected, err := DiffData(old, newFile, options)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, deltaData)
+			assert.Equal(t, newFile, applyForTest(t, old, deltaData))
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package delta
+
+import (
+	"errors"
+)
+
+var (
+	// ErrInvalidDelta is returned when a delta file is malformed
+	ErrInvalidDelta = errors.New("invalid delta file")
+	// ErrSignatureMismatch is returned when a delta was not computed from the given signature
+	ErrSignatureMismatch = errors.New("delta does not match the signature")
+	// ErrChainMismatch is returned when a delta does not apply to the file produced by the previous one
+	ErrChainMismatch = errors.New("delta does not apply to the file produced by the previous delta")
+	// ErrUnknownAlgorithm is returned for algorithms that do not exist
+	ErrUnknownAlgorithm = errors.New("unknown algorithm")
+)
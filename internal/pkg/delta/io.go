@@ -0,0 +1,114 @@
+package delta
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/popescuag/RH/internal/pkg/metadata"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+const (
+	formatVersion     = 8 // latest version that can be read
+	sizeVersion       = 2 // first version with the size of the new file
+	copyVersion       = 3 // first version with copy instructions
+	zeroVersion       = 4 // first version with zero runs
+	outputCopyVersion = 5 // first version with copies from the new file
+	literalsVersion   = 6 // first version with compressed new chunks
+	addVersion        = 7 // first version with copies of approximate matches
+	metadataVersion   = 8 // first version with the metadata of the new file
+	versionKey        = "v"
+	sizeKey           = "size"
+	literalsKey       = "literals"
+)
+
+// deltaMetadata is written at the start of the delta file as
+// <chunk size>,v=<format version>,size=<new file size>[,literals=<codec>][,<metadata of the new file>]|
+// Version 1 deltas only have the chunk size. The version is the oldest one that has all the instructions
+// the writer declares. The deltas of a new file are streamed, so their metadata is written before it is
+// known which instructions they use: they declare all the ones they may use and are at least version 5.
+// Writers that know their instructions beforehand, such as reverse deltas, use older versions
+type deltaMetadata struct {
+	ChunkSize uint32
+	Version   int
+	Size      int64              // size of the new file, -1 when unknown
+	Literals  LiteralCodec       // codec of the compressed new chunks
+	File      *metadata.Metadata // mode, modification time, owner and extended attributes of the new file, if any
+}
+
+func (md *deltaMetadata) write(output io.Writer) error {
+	optional := ""
+	if md.Literals != NoLiterals {
+		optional = fmt.Sprintf("%v%v=%v", fieldSeparator, literalsKey, md.Literals)
+	}
+	if md.File != nil {
+		optional += fieldSeparator + strings.Join(md.File.Fields(), fieldSeparator)
+	}
+	_, err := output.Write([]byte(fmt.Sprintf("%d%v%v=%d%v%v=%d%v%v", md.ChunkSize, fieldSeparator, versionKey, md.Version,
+		fieldSeparator, sizeKey, md.Size, optional, dataSeparator)))
+	return err
+}
+
+func (md *deltaMetadata) parse(header string) error {
+	fields := strings.Split(header, fieldSeparator)
+
+	chunkSize, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil || chunkSize < s.MinChunkSize || chunkSize > s.MaxChunkSize {
+		return fmt.Errorf("%w: chunk size %q", ErrInvalidDelta, fields[0])
+	}
+	md.ChunkSize = uint32(chunkSize)
+	md.Version = 1
+	md.Size = -1
+
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return fmt.Errorf("%w: metadata field %q", ErrInvalidDelta, field)
+		}
+		switch key {
+		case versionKey:
+			md.Version, err = strconv.Atoi(value)
+			if err != nil || md.Version < 1 {
+				return fmt.Errorf("%w: version %q", ErrInvalidDelta, value)
+			}
+			if md.Version > formatVersion {
+				return fmt.Errorf("%w: delta version %d", s.ErrUnsupportedVersion, md.Version)
+			}
+		case sizeKey:
+			md.Size, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || md.Size < 0 {
+				return fmt.Errorf("%w: size %q", ErrInvalidDelta, value)
+			}
+		case literalsKey:
+			md.Literals = LiteralCodec(value)
+			if err = ValidateLiteralCodec(md.Literals); err != nil || md.Literals == NoLiterals {
+				return fmt.Errorf("%w: unknown literal codec %q", s.ErrUnsupportedVersion, value)
+			}
+		default:
+			if metadata.IsField(key) {
+				if md.File == nil {
+					md.File = metadata.New()
+				}
+				if err = md.File.ParseField(key, value); err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+				}
+				continue
+			}
+			// Written by a newer version
+			return fmt.Errorf("%w: unknown metadata field %q", s.ErrUnsupportedVersion, key)
+		}
+	}
+
+	if md.Version >= sizeVersion && md.Size < 0 {
+		return fmt.Errorf("%w: size missing from the metadata", ErrInvalidDelta)
+	}
+	if md.Version < literalsVersion && md.Literals != NoLiterals {
+		return fmt.Errorf("%w: literal codec in a version %d delta", ErrInvalidDelta, md.Version)
+	}
+	if md.Version < metadataVersion && md.File != nil {
+		return fmt.Errorf("%w: metadata of the new file in a version %d delta", ErrInvalidDelta, md.Version)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package delta
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// LiteralCodec compresses the data of new chunks. The dictionary of a compressed chunk is the data of
+// the new file right before it, which the patch already wrote when it reaches the chunk: edits of
+// similar content compress to a few bytes
+type LiteralCodec string
+
+const (
+	NoLiterals    LiteralCodec = ""
+	FlateLiterals LiteralCodec = "flate"
+	// ZlibLiterals also checks that the patch uses the same dictionary as the delta
+	ZlibLiterals LiteralCodec = "zlib"
+)
+
+// DictionarySize is the most data before a compressed chunk used as its dictionary, the window of flate
+const DictionarySize = 32 << 10
+
+// ValidateLiteralCodec returns an error if the codec is not known
+func ValidateLiteralCodec(codec LiteralCodec) error {
+	switch codec {
+	case NoLiterals, FlateLiterals, ZlibLiterals:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown literal codec %q", s.ErrUnsupportedVersion, codec)
+}
+
+func compressLiteral(codec LiteralCodec, data []byte, dictionary []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case FlateLiterals:
+		w, err = flate.NewWriterDict(buf, flate.BestCompression, dictionary)
+	case ZlibLiterals:
+		w, err = zlib.NewWriterLevelDict(buf, zlib.BestCompression, dictionary)
+	default:
+		err = ValidateLiteralCodec(codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+// Decompress returns the data of a compressed new chunk of length bytes, with the same dictionary
+// as when it was compressed
+func Decompress(codec LiteralCodec, data []byte, dictionary []byte, length int64) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch codec {
+	case FlateLiterals:
+		r = flate.NewReaderDict(bytes.NewReader(data), dictionary)
+	case ZlibLiterals:
+		r, err = zlib.NewReaderDict(bytes.NewReader(data), dictionary)
+	default:
+		err = ValidateLiteralCodec(codec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decompress new chunk: %v", ErrInvalidDelta, err)
+	}
+	defer r.Close()
+
+	// One more byte than expected is read, to find chunks longer than they should be
+	chunk, err := io.ReadAll(io.LimitReader(r, length+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decompress new chunk: %v", ErrInvalidDelta, err)
+	}
+	if int64(len(chunk)) != length {
+		return nil, fmt.Errorf("%w: new chunk of %d bytes decompressed to %d", ErrInvalidDelta, length, len(chunk))
+	}
+	return chunk, nil
+}
+
+// history keeps the end of the data written so far, the dictionary of the next compressed chunk.
+// A nil history keeps nothing
+type history struct {
+	data []byte
+}
+
+func (h *history) write(p []byte) {
+	if h == nil {
+		return
+	}
+	if len(p) >= DictionarySize {
+		h.data = append(h.data[:0], p[len(p)-DictionarySize:]...)
+		return
+	}
+	if len(h.data)+len(p) > 2*DictionarySize {
+		h.data = append(h.data[:0], h.data[len(h.data)-DictionarySize:]...)
+	}
+	h.data = append(h.data, p...)
+}
+
+func (h *history) writeZeros(n int64) {
+	if n > DictionarySize {
+		n = DictionarySize
+	}
+	h.write(make([]byte, n))
+}
+
+func (h *history) dictionary() []byte {
+	if h == nil {
+		return nil
+	}
+	if len(h.data) > DictionarySize {
+		return h.data[len(h.data)-DictionarySize:]
+	}
+	return h.data
+}
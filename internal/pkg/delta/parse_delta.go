@@ -0,0 +1,308 @@
+package delta
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+const (
+	PointerOp    = pointerMark
+	NewChunkOp   = newChunkMark
+	CopyOp       = copyMark
+	ZeroOp       = zeroMark
+	OutputCopyOp = outputCopyMark
+	CompressedOp = compressedMark
+	AddOp        = addMark
+)
+
+// Op is a single instruction read from a delta file
+type Op struct {
+	Type   string
+	Index  uint32 // chunk of the basis file, for pointers
+	Data   []byte // chunk contents, for new chunks, compressed for compressed chunks, differences for adds
+	Offset int64  // offset of Data in the delta file
+	Source int64  // offset in the basis file, for copies and adds, or in the new file, for output copies
+	Length int64  // bytes to copy, for copies and adds, zeros, for zero runs, or chunk length, for compressed chunks
+}
+
+// Reader reads the instructions of a delta file one at a time, so deltas of large files
+// never have to be loaded in memory
+type Reader struct {
+	input    *bufio.Reader
+	offset   int64
+	opIndex  int
+	Metadata deltaMetadata
+}
+
+// Metadata longer than this is not accepted, so a delta without separator cannot be read in memory
+const maxMetadataSize = 1 << 20
+
+func NewReader(input io.Reader) (*Reader, error) {
+	// Compressed deltas are read decompressed: offsets are the ones of the decompressed delta
+	decoded, _, err := codec.NewReader(input)
+	if err != nil {
+		return nil, &s.ParseError{Offset: 0, ChunkIndex: -1, Err: err}
+	}
+	r := &Reader{input: bufio.NewReader(decoded), opIndex: -1}
+
+	header := make([]byte, 0, 64)
+	for {
+		b, err := r.input.ReadByte()
+		if err != nil {
+			return nil, r.readError(err)
+		}
+		r.offset++
+		if b == dataSeparator[0] {
+			break
+		}
+		if len(header) == maxMetadataSize {
+			return nil, r.parseError(fmt.Errorf("%w: metadata longer than %d bytes", ErrInvalidDelta, maxMetadataSize))
+		}
+		header = append(header, b)
+	}
+
+	err = r.Metadata.parse(string(header))
+	if err != nil {
+		return nil, r.parseError(err)
+	}
+	return r, nil
+}
+
+// Next returns the next instruction of the delta or io.EOF once all of them were read
+func (r *Reader) Next() (Op, error) {
+	mark, err := r.input.ReadByte()
+	if err == io.EOF {
+		return Op{}, io.EOF
+	}
+	if err != nil {
+		return Op{}, r.parseError(err)
+	}
+	r.offset++
+	r.opIndex++
+	op := Op{Type: string(mark)}
+
+	switch op.Type {
+	case pointerMark:
+		// P,4,<index>
+		if err = r.expect(fieldSeparator + "4" + fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		index, err := r.readNumber()
+		if err != nil {
+			return Op{}, err
+		}
+		if index > 1<<32-1 {
+			return Op{}, r.parseError(fmt.Errorf("%w: chunk index %d out of range", ErrInvalidDelta, index))
+		}
+		op.Index = uint32(index)
+	case newChunkMark, compressedMark:
+		// N,<length>,<data> or L,<length>,<compressed length>,<compressed data>
+		if op.Type == compressedMark && r.Metadata.Literals == NoLiterals {
+			return Op{}, r.parseError(fmt.Errorf("%w: compressed chunk in a delta without literal codec", ErrInvalidDelta))
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		length, err := r.readNumber()
+		if err != nil {
+			return Op{}, err
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		if length > uint64(r.Metadata.ChunkSize) {
+			return Op{}, r.parseError(fmt.Errorf("%w: new chunk of %d bytes larger than chunk size", ErrInvalidDelta, length))
+		}
+		if op.Type == compressedMark {
+			op.Length = int64(length)
+			// Only chunks that compress are written compressed
+			if length, err = r.readNumber(); err != nil {
+				return Op{}, err
+			}
+			if err = r.expect(fieldSeparator); err != nil {
+				return Op{}, err
+			}
+			if length >= uint64(op.Length) {
+				return Op{}, r.parseError(fmt.Errorf("%w: compressed chunk of %d bytes not smaller than its %d bytes",
+					ErrInvalidDelta, length, op.Length))
+			}
+		}
+		// Only allocate what is actually in the file, whatever the length says
+		op.Offset = r.offset
+		op.Data, err = io.ReadAll(io.LimitReader(r.input, int64(length)))
+		r.offset += int64(len(op.Data))
+		if err != nil {
+			return Op{}, r.readError(err)
+		}
+		if len(op.Data) < int(length) {
+			return Op{}, r.readError(io.EOF)
+		}
+	case copyMark, outputCopyMark:
+		// C,<basis offset>,<length> or O,<new file offset>,<length>
+		if op.Type == copyMark && r.Metadata.Version < copyVersion {
+			return Op{}, r.parseError(fmt.Errorf("%w: copy instruction in a version %d delta", ErrInvalidDelta,
+				r.Metadata.Version))
+		}
+		if op.Type == outputCopyMark && r.Metadata.Version < outputCopyVersion {
+			return Op{}, r.parseError(fmt.Errorf("%w: output copy in a version %d delta", ErrInvalidDelta,
+				r.Metadata.Version))
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		source, err := r.readNumber()
+		if err != nil {
+			return Op{}, err
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		length, err := r.readNumber()
+		if err != nil {
+			return Op{}, err
+		}
+		// The end of the copy is bounded too, so the range checks of the patch cannot overflow
+		if length > 1<<62 || source > 1<<62-length {
+			return Op{}, r.parseError(fmt.Errorf("%w: copy of %d bytes at %d out of range", ErrInvalidDelta, length, source))
+		}
+		op.Source = int64(source)
+		op.Length = int64(length)
+	case addMark:
+		// A,<basis offset>,<length>,<differences>
+		if r.Metadata.Version < addVersion {
+			return Op{}, r.parseError(fmt.Errorf("%w: add instruction in a version %d delta", ErrInvalidDelta,
+				r.Metadata.Version))
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		source, err := r.readNumber()
+		if err != nil {
+			return Op{}, err
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		length, err := r.readNumber()
+		if err != nil {
+			return Op{}, err
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		if source > 1<<62 {
+			return Op{}, r.parseError(fmt.Errorf("%w: add at %d out of range", ErrInvalidDelta, source))
+		}
+		if length > uint64(r.Metadata.ChunkSize) {
+			return Op{}, r.parseError(fmt.Errorf("%w: add of %d bytes larger than chunk size", ErrInvalidDelta, length))
+		}
+		op.Source = int64(source)
+		op.Length = int64(length)
+		op.Offset = r.offset
+		op.Data, err = io.ReadAll(io.LimitReader(r.input, int64(length)))
+		r.offset += int64(len(op.Data))
+		if err != nil {
+			return Op{}, r.readError(err)
+		}
+		if len(op.Data) < int(length) {
+			return Op{}, r.readError(io.EOF)
+		}
+	case zeroMark:
+		// Z,<length>
+		if r.Metadata.Version < zeroVersion {
+			return Op{}, r.parseError(fmt.Errorf("%w: zero run in a version %d delta", ErrInvalidDelta,
+				r.Metadata.Version))
+		}
+		if err = r.expect(fieldSeparator); err != nil {
+			return Op{}, err
+		}
+		length, err := r.readNumber()
+		if err != nil {
+			return Op{}, err
+		}
+		if length > 1<<62 {
+			return Op{}, r.parseError(fmt.Errorf("%w: zero run of %d bytes out of range", ErrInvalidDelta, length))
+		}
+		op.Length = int64(length)
+	default:
+		return Op{}, r.parseError(fmt.Errorf("%w: unknown instruction %q", ErrInvalidDelta, mark))
+	}
+	return op, nil
+}
+
+// Offset returns the offset in the delta file of the next instruction
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// OpCount returns the number of instructions read so far
+func (r *Reader) OpCount() int {
+	return r.opIndex + 1
+}
+
+// ResumeAt continues reading the delta from input, positioned at the offset of an instruction
+// returned by Offset, after opCount instructions
+func (r *Reader) ResumeAt(input io.Reader, offset int64, opCount int) {
+	r.input.Reset(input)
+	r.offset = offset
+	r.opIndex = opCount - 1
+}
+
+func (r *Reader) expect(str string) error {
+	for i := 0; i < len(str); i++ {
+		b, err := r.input.ReadByte()
+		if err != nil {
+			return r.readError(err)
+		}
+		if b != str[i] {
+			return r.parseError(fmt.Errorf("%w: expected %q, found %q", ErrInvalidDelta, str[i], b))
+		}
+		r.offset++
+	}
+	return nil
+}
+
+// readNumber reads a decimal number, which ends at the first non digit character
+func (r *Reader) readNumber() (uint64, error) {
+	digits := make([]byte, 0, 10)
+	for {
+		b, err := r.input.ReadByte()
+		if err == io.EOF && len(digits) > 0 {
+			break
+		}
+		if err != nil {
+			return 0, r.readError(err)
+		}
+		if b < '0' || b > '9' {
+			r.input.UnreadByte()
+			break
+		}
+		digits = append(digits, b)
+	}
+	if len(digits) == 0 {
+		return 0, r.parseError(fmt.Errorf("%w: number expected", ErrInvalidDelta))
+	}
+	number, err := strconv.ParseUint(string(digits), 10, 64)
+	if err != nil {
+		return 0, r.parseError(fmt.Errorf("%w: %v", ErrInvalidDelta, err))
+	}
+	r.offset += int64(len(digits))
+	return number, nil
+}
+
+// readError reports a premature end of the delta file as truncated
+func (r *Reader) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = s.ErrTruncated
+	}
+	return r.parseError(err)
+}
+
+func (r *Reader) parseError(err error) error {
+	return &s.ParseError{Offset: r.offset, ChunkIndex: r.opIndex, Err: err}
+}
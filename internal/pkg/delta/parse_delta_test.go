@@ -0,0 +1,299 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/metadata"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDelta(t *testing.T) {
+	testCases := []struct {
+		name             string
+		inputData        []byte
+		expectedMetadata deltaMetadata
+		expectedOps      []Op
+		err              error
+		errOffset        int64
+	}{
+		{
+			name:             "Pointers and new chunks",
+			inputData:        []byte("32,v=2,size=67|P,4,12N,3,abcP,4,0"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 2, Size: 67},
+			expectedOps: []Op{
+				{Type: PointerOp, Index: 12},
+				{Type: NewChunkOp, Data: []byte("abc"), Offset: 25},
+				{Type: PointerOp, Index: 0},
+			},
+		},
+		{
+			name:             "Version 1 delta",
+			inputData:        []byte("32|P,4,12N,3,abc"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 1, Size: -1},
+			expectedOps: []Op{
+				{Type: PointerOp, Index: 12},
+				{Type: NewChunkOp, Data: []byte("abc"), Offset: 13},
+			},
+		},
+		{
+			name:             "Copies",
+			inputData:        []byte("32,v=3,size=1003|C,100,1000N,3,abc"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 3, Size: 1003},
+			expectedOps: []Op{
+				{Type: CopyOp, Source: 100, Length: 1000},
+				{Type: NewChunkOp, Data: []byte("abc"), Offset: 31},
+			},
+		},
+		{
+			name:             "Zero runs",
+			inputData:        []byte("32,v=4,size=1003|Z,1000N,3,abc"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 4, Size: 1003},
+			expectedOps: []Op{
+				{Type: ZeroOp, Length: 1000},
+				{Type: NewChunkOp, Data: []byte("abc"), Offset: 27},
+			},
+		},
+		{
+			name:             "Output copies",
+			inputData:        []byte("32,v=5,size=6|N,3,abcO,0,3"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 5, Size: 6},
+			expectedOps: []Op{
+				{Type: NewChunkOp, Data: []byte("abc"), Offset: 18},
+				{Type: OutputCopyOp, Source: 0, Length: 3},
+			},
+		},
+		{
+			name:             "Compressed chunks",
+			inputData:        []byte("32,v=6,size=5,literals=zlib|L,5,3,abcN,0,"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 6, Size: 5, Literals: ZlibLiterals},
+			expectedOps: []Op{
+				{Type: CompressedOp, Data: []byte("abc"), Offset: 34, Length: 5},
+				{Type: NewChunkOp, Data: []byte{}, Offset: 41},
+			},
+		},
+		{
+			name:             "Adds",
+			inputData:        []byte("32,v=7,size=5|A,10,3,\x01\x00\xffC,0,2"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 7, Size: 5},
+			expectedOps: []Op{
+				{Type: AddOp, Data: []byte{1, 0, 0xff}, Offset: 21, Source: 10, Length: 3},
+				{Type: CopyOp, Source: 0, Length: 2},
+			},
+		},
+		{
+			name:      "Metadata of the new file",
+			inputData: []byte("32,v=8,size=0,mode=4755,mtime=5,uid=1,gid=2,xattr=dXNlci5h:Yg|"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 8, Size: 0, File: &metadata.Metadata{
+				Mode:    0755 | fs.ModeSetuid,
+				ModTime: time.Unix(0, 5),
+				Uid:     1,
+				Gid:     2,
+				Xattrs:  map[string][]byte{"user.a": []byte("b")},
+			}},
+		},
+		{
+			name:             "Empty new file",
+			inputData:        []byte("512,v=2,size=0|"),
+			expectedMetadata: deltaMetadata{ChunkSize: 512, Version: 2, Size: 0},
+		},
+		{
+			name:      "Missing metadata",
+			inputData: []byte{},
+			err:       s.ErrTruncated,
+			errOffset: 0,
+		},
+		{
+			name:      "Invalid metadata",
+			inputData: []byte("abc|"),
+			err:       ErrInvalidDelta,
+			errOffset: 4,
+		},
+		{
+			name:      "Chunk size too small",
+			inputData: []byte("16|"),
+			err:       ErrInvalidDelta,
+			errOffset: 3,
+		},
+		{
+			name:      "Size missing",
+			inputData: []byte("32,v=2|"),
+			err:       ErrInvalidDelta,
+			errOffset: 7,
+		},
+		{
+			name:      "Newer version",
+			inputData: []byte("32,v=9,size=0|"),
+			err:       s.ErrUnsupportedVersion,
+			errOffset: 14,
+		},
+		{
+			name:      "Unknown metadata field",
+			inputData: []byte("32,v=2,size=0,x=1|"),
+			err:       s.ErrUnsupportedVersion,
+			errOffset: 18,
+		},
+		{
+			name:      "Metadata of the new file in a version 7 delta",
+			inputData: []byte("32,v=7,size=0,mode=644|"),
+			err:       ErrInvalidDelta,
+			errOffset: 23,
+		},
+		{
+			name:      "Invalid mode",
+			inputData: []byte("32,v=8,size=0,mode=999|"),
+			err:       ErrInvalidDelta,
+			errOffset: 23,
+		},
+		{
+			name:             "Unknown instruction",
+			inputData:        []byte("32,v=2,size=1|X,1"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 2, Size: 1},
+			err:              ErrInvalidDelta,
+			errOffset:        15,
+		},
+		{
+			name:             "Copy in a version 2 delta",
+			inputData:        []byte("32,v=2,size=10|C,0,10"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 2, Size: 10},
+			err:              ErrInvalidDelta,
+			errOffset:        16,
+		},
+		{
+			name:             "Zero run in a version 3 delta",
+			inputData:        []byte("32,v=3,size=10|Z,10"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 3, Size: 10},
+			err:              ErrInvalidDelta,
+			errOffset:        16,
+		},
+		{
+			name:             "Copy whose end is out of range",
+			inputData:        []byte("32,v=3,size=0|C,4611686018427387904,4611686018427387904"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 3, Size: 0},
+			err:              ErrInvalidDelta,
+			errOffset:        55,
+		},
+		{
+			name:             "Output copy in a version 4 delta",
+			inputData:        []byte("32,v=4,size=10|O,0,10"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 4, Size: 10},
+			err:              ErrInvalidDelta,
+			errOffset:        16,
+		},
+		{
+			name:      "Unknown literal codec",
+			inputData: []byte("32,v=6,size=5,literals=lz4|"),
+			err:       s.ErrUnsupportedVersion,
+			errOffset: 27,
+		},
+		{
+			name:      "Literal codec in a version 5 delta",
+			inputData: []byte("32,v=5,size=5,literals=zlib|"),
+			err:       ErrInvalidDelta,
+			errOffset: 28,
+		},
+		{
+			name:             "Compressed chunk without literal codec",
+			inputData:        []byte("32,v=6,size=5|L,5,3,abc"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 6, Size: 5},
+			err:              ErrInvalidDelta,
+			errOffset:        15,
+		},
+		{
+			name:             "Compressed chunk larger than its data",
+			inputData:        []byte("32,v=6,size=3,literals=flate|L,3,5,abcde"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 6, Size: 3, Literals: FlateLiterals},
+			err:              ErrInvalidDelta,
+			errOffset:        35,
+		},
+		{
+			name:             "Add in a version 6 delta",
+			inputData:        []byte("32,v=6,size=3|A,0,3,abc"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 6, Size: 3},
+			err:              ErrInvalidDelta,
+			errOffset:        15,
+		},
+		{
+			name:             "Add larger than a chunk",
+			inputData:        []byte("32,v=7,size=33|A,0,33,"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 7, Size: 33},
+			err:              ErrInvalidDelta,
+			errOffset:        22,
+		},
+		{
+			name:             "New chunk larger than a chunk",
+			inputData:        []byte("32,v=2,size=33|N,33,"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 2, Size: 33},
+			err:              ErrInvalidDelta,
+			errOffset:        20,
+		},
+		{
+			name:             "Truncated new chunk",
+			inputData:        []byte("32,v=2,size=5|N,5,ab"),
+			expectedMetadata: deltaMetadata{ChunkSize: 32, Version: 2, Size: 5},
+			err:              s.ErrTruncated,
+			errOffset:        20,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ops []Op
+			reader, err := NewReader(bytes.NewReader(tc.inputData))
+			if err == nil {
+				assert.Equal(t, tc.expectedMetadata, reader.Metadata)
+				for {
+					var op Op
+					op, err = reader.Next()
+					if err != nil {
+						break
+					}
+					ops = append(ops, op)
+				}
+				if err == io.EOF {
+					err = nil
+				}
+			}
+
+			if tc.err == nil {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expectedOps, ops)
+			} else {
+				assert.ErrorIs(t, err, tc.err)
+				var parseError *s.ParseError
+				if assert.True(t, errors.As(err, &parseError)) {
+					assert.Equal(t, tc.errOffset, parseError.Offset)
+				}
+			}
+		})
+	}
+}
+
+func TestResumeDelta(t *testing.T) {
+	data := []byte("32|P,4,12N,3,abcP,4,0")
+	reader, err := NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	_, err = reader.Next()
+	assert.Nil(t, err)
+	offset, opCount := reader.Offset(), reader.OpCount()
+	assert.Equal(t, int64(9), offset)
+	assert.Equal(t, 1, opCount)
+
+	resumed, err := NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	resumed.ResumeAt(bytes.NewReader(data[offset:]), offset, opCount)
+	op, err := resumed.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, Op{Type: NewChunkOp, Data: []byte("abc"), Offset: 13}, op)
+	op, err = resumed.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, Op{Type: PointerOp, Index: 0}, op)
+	assert.Equal(t, 3, resumed.OpCount())
+	_, err = resumed.Next()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,135 @@
+package delta
+
+import (
+	"bytes"
+	"io"
+)
+
+// Chunks not found in the signature are matched byte by byte against the basis data around them, when
+// the basis file is available, looking for blocks of this size at any offset of the chunk
+const fineBlockSize = 32
+
+// Blocks of the basis data with the same checksum are only looked at up to this count
+const maxBlockCandidates = 8
+
+// refiner finds the data of changed chunks in the basis file, so a small edit only costs the bytes
+// edited instead of the whole chunk
+type refiner struct {
+	basis     io.ReaderAt
+	basisSize int64
+	window    []byte
+}
+
+// piece is part of a chunk, copied from the basis file at source, or new data if source is negative
+type piece struct {
+	start  int
+	end    int
+	source int64
+}
+
+// match splits the chunk into copies of the basis data and new data. The basis data looked at is the
+// chunk expected at the offset, with the chunks before and after it
+func (r *refiner) match(chunk []byte, expected int64) ([]piece, error) {
+	size := int64(len(chunk))
+	from := expected - size
+	if from < 0 {
+		from = 0
+	}
+	to := expected + 2*size
+	if to > r.basisSize {
+		to = r.basisSize
+	}
+	if len(chunk) < fineBlockSize || to-from < fineBlockSize {
+		return []piece{{start: 0, end: len(chunk), source: -1}}, nil
+	}
+
+	if int64(cap(r.window)) < to-from {
+		r.window = make([]byte, to-from)
+	}
+	window := r.window[:to-from]
+	n, err := r.basis.ReadAt(window, from)
+	if n < len(window) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	blocks := map[uint32][]int{}
+	for i := 0; i+fineBlockSize <= len(window); i += fineBlockSize {
+		sum := newRollingSum(window[i : i+fineBlockSize])
+		if len(blocks[sum.value()]) < maxBlockCandidates {
+			blocks[sum.value()] = append(blocks[sum.value()], i)
+		}
+	}
+
+	pieces := []piece{}
+	literal := 0
+	p := 0
+	sum := newRollingSum(chunk[:fineBlockSize])
+	for p+fineBlockSize <= len(chunk) {
+		// The longest match is extended back into the new data before it, and forward as far as it goes
+		bestStart, bestLength, bestSource := 0, 0, 0
+		for _, c := range blocks[sum.value()] {
+			if !bytes.Equal(window[c:c+fineBlockSize], chunk[p:p+fineBlockSize]) {
+				continue
+			}
+			back := 0
+			for p-back > literal && c-back > 0 && chunk[p-back-1] == window[c-back-1] {
+				back++
+			}
+			forward := fineBlockSize
+			for p+forward < len(chunk) && c+forward < len(window) && chunk[p+forward] == window[c+forward] {
+				forward++
+			}
+			if back+forward > bestLength {
+				bestStart, bestLength, bestSource = p-back, back+forward, c-back
+			}
+		}
+
+		if bestLength == 0 {
+			if p+fineBlockSize < len(chunk) {
+				sum.roll(chunk[p], chunk[p+fineBlockSize])
+			}
+			p++
+			continue
+		}
+		if bestStart > literal {
+			pieces = append(pieces, piece{start: literal, end: bestStart, source: -1})
+		}
+		pieces = append(pieces, piece{start: bestStart, end: bestStart + bestLength, source: from + int64(bestSource)})
+		p = bestStart + bestLength
+		literal = p
+		if p+fineBlockSize <= len(chunk) {
+			sum = newRollingSum(chunk[p : p+fineBlockSize])
+		}
+	}
+	if literal < len(chunk) {
+		pieces = append(pieces, piece{start: literal, end: len(chunk), source: -1})
+	}
+	return pieces, nil
+}
+
+// rollingSum is the weak checksum of rsync, which is moved one byte forward without reading the
+// whole block again
+type rollingSum struct {
+	a, b uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	sum := rollingSum{}
+	for i, c := range block {
+		sum.a += uint32(c)
+		sum.b += uint32(len(block)-i) * uint32(c)
+	}
+	return sum
+}
+
+func (r *rollingSum) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - fineBlockSize*uint32(out)
+}
+
+func (r rollingSum) value() uint32 {
+	return r.a&0xffff | r.b<<16
+}
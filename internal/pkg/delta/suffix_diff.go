@@ -0,0 +1,217 @@
+package delta
+
+import (
+	"index/suffixarray"
+	"io"
+)
+
+// Deltas of suffix array diffs are written with this chunk size, which bounds new chunks and adds
+const suffixDiffChunkSize = 64 << 10
+
+// Bytes equal in the old and new files inside an approximate match are copied rather than added when
+// there are at least this many in a row
+const minCopyLength = 32
+
+// suffixArrayDiff writes the delta of newData against oldData the way bsdiff finds it: the longest matches
+// of the new data anywhere in the old file are extended into approximate matches, whose bytes that
+// differ are added to the old data, and the data between them is new data
+func suffixArrayDiff(oldData []byte, newData []byte, output io.Writer, options Options) error {
+	w, err := newWriter(output, suffixDiffChunkSize, int64(len(newData)), options.Literals, options.file, CopyOp, AddOp)
+	if err != nil {
+		return err
+	}
+	e := &suffixEncoder{w: w, old: oldData}
+	if options.Literals != NoLiterals {
+		e.past = &history{}
+	}
+	index := suffixarray.New(oldData)
+
+	oldSize, newSize := len(oldData), len(newData)
+	var scan, length, pos, lastScan, lastPos, lastOffset int
+	for scan < newSize {
+		// Look for a match better than keeping the alignment of the last one by more than 8 bytes
+		oldScore := 0
+		scan += length
+		for scsc := scan; scan < newSize; scan++ {
+			pos, length = longestMatch(index, newData[scan:])
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastOffset < oldSize && oldData[scsc+lastOffset] == newData[scsc] {
+					oldScore++
+				}
+			}
+			if (length == oldScore && length != 0) || length > oldScore+8 {
+				break
+			}
+			if scan+lastOffset < oldSize && oldData[scan+lastOffset] == newData[scan] {
+				oldScore--
+			}
+		}
+		if length == oldScore && scan != newSize {
+			continue
+		}
+
+		// The last match extends forward and the new one backward, as long as more than half of
+		// their bytes are equal, without overlapping
+		score, best, forward := 0, 0, 0
+		for i := 0; lastScan+i < scan && lastPos+i < oldSize; {
+			if oldData[lastPos+i] == newData[lastScan+i] {
+				score++
+			}
+			i++
+			if score*2-i > best*2-forward {
+				best, forward = score, i
+			}
+		}
+		backward := 0
+		if scan < newSize {
+			score, best = 0, 0
+			for i := 1; scan >= lastScan+i && pos >= i; i++ {
+				if oldData[pos-i] == newData[scan-i] {
+					score++
+				}
+				if score*2-i > best*2-backward {
+					best, backward = score, i
+				}
+			}
+		}
+		if lastScan+forward > scan-backward {
+			overlap := lastScan + forward - (scan - backward)
+			score, best, split := 0, 0, 0
+			for i := 0; i < overlap; i++ {
+				if newData[lastScan+forward-overlap+i] == oldData[lastPos+forward-overlap+i] {
+					score++
+				}
+				if newData[scan-backward+i] == oldData[pos-backward+i] {
+					score--
+				}
+				if score > best {
+					best, split = score, i+1
+				}
+			}
+			forward += split - overlap
+			backward -= split
+		}
+
+		if err = e.approximate(lastPos, newData[lastScan:lastScan+forward]); err != nil {
+			return err
+		}
+		if err = e.newData(newData[lastScan+forward : scan-backward]); err != nil {
+			return err
+		}
+		lastScan, lastPos, lastOffset = scan-backward, pos-backward, pos-scan
+	}
+	return e.flush()
+}
+
+// longestMatch returns where the longest prefix of data is found in the indexed data, and its length
+func longestMatch(index *suffixarray.Index, data []byte) (int, int) {
+	// A prefix found means all shorter ones are found too: the length doubles until a prefix is not
+	// found, then the longest one found is searched between the two
+	pos, found, missing := 0, 0, 1
+	for ; missing <= len(data); missing *= 2 {
+		offsets := index.Lookup(data[:missing], 1)
+		if len(offsets) == 0 {
+			break
+		}
+		pos, found = offsets[0], missing
+	}
+	if missing > len(data) {
+		missing = len(data) + 1
+	}
+	for missing-found > 1 {
+		middle := (found + missing) / 2
+		if offsets := index.Lookup(data[:middle], 1); len(offsets) > 0 {
+			pos, found = offsets[0], middle
+		} else {
+			missing = middle
+		}
+	}
+	return pos, found
+}
+
+// suffixEncoder writes the matches found by a suffix array diff, merging the copies that follow each other
+type suffixEncoder struct {
+	w          *Writer
+	old        []byte
+	past       *history
+	copyOffset int64
+	copyLength int64
+}
+
+// approximate writes data found at source in the old file with some bytes changed: runs of equal
+// bytes are copied and the bytes around them added
+func (e *suffixEncoder) approximate(source int, data []byte) error {
+	added := 0
+	for i := 0; i < len(data); {
+		if data[i] != e.old[source+i] {
+			i++
+			continue
+		}
+		end := i
+		for end < len(data) && data[end] == e.old[source+end] {
+			end++
+		}
+		if end-i >= minCopyLength {
+			if err := e.add(source+added, data[added:i]); err != nil {
+				return err
+			}
+			if e.copyLength > 0 && e.copyOffset+e.copyLength == int64(source+i) {
+				e.copyLength += int64(end - i)
+			} else {
+				if err := e.flush(); err != nil {
+					return err
+				}
+				e.copyOffset, e.copyLength = int64(source+i), int64(end-i)
+			}
+			e.past.write(data[i:end])
+			added = end
+		}
+		i = end
+	}
+	return e.add(source+added, data[added:])
+}
+
+func (e *suffixEncoder) add(source int, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	differences := make([]byte, len(data))
+	for i := range data {
+		differences[i] = data[i] - e.old[source+i]
+	}
+	e.past.write(data)
+	return e.w.Add(int64(source), differences)
+}
+
+func (e *suffixEncoder) newData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > suffixDiffChunkSize {
+			n = suffixDiffChunkSize
+		}
+		if err := e.w.CompressedChunk(data[:n], e.past.dictionary()); err != nil {
+			return err
+		}
+		e.past.write(data[:n])
+		data = data[n:]
+	}
+	return nil
+}
+
+func (e *suffixEncoder) flush() error {
+	if e.copyLength == 0 {
+		return nil
+	}
+	err := e.w.Copy(e.copyOffset, e.copyLength)
+	e.copyLength = 0
+	return err
+}
@@ -0,0 +1,141 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// ValidateData checks that a delta is well formed and can be applied to the file the signature
+// was computed from, without needing that file
+func ValidateData(signatureData []byte, deltaData []byte) error {
+	sd, err := s.ParseFromReaderWithLimits(io.NopCloser(bytes.NewReader(signatureData)), int64(len(signatureData)),
+		s.DefaultLimits)
+	if err != nil {
+		return err
+	}
+	return validateDelta(sd, bytes.NewReader(deltaData))
+}
+
+func Validate(signatureFile string, deltaFile string) error {
+	signatureData, err := s.ParseFromFile(signatureFile)
+	if err != nil {
+		return fmt.Errorf("cannot read signature file %v: %w", signatureFile, err)
+	}
+
+	f, err := os.Open(deltaFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return validateDelta(signatureData, bufio.NewReader(f))
+}
+
+func validateDelta(signatureData s.SignatureData, delta io.Reader) error {
+	reader, err := NewReader(delta)
+	if err != nil {
+		return err
+	}
+	md := reader.Metadata
+	if md.ChunkSize != signatureData.Metadata.ChunkSize {
+		return reader.parseError(fmt.Errorf("%w: chunk size %d, the signature has %d", ErrSignatureMismatch,
+			md.ChunkSize, signatureData.Metadata.ChunkSize))
+	}
+	chunkCount := signatureData.Metadata.ChunkCount
+
+	// The size of the last chunk of the basis file is not in its signature, so the pointers
+	// to it are counted apart
+	var size int64
+	var lastChunkPointers int64
+	chunkSize := int64(md.ChunkSize)
+	// grow adds the bytes an instruction produces. It stops as soon as the instructions produce more than
+	// the new file, each pointer to the last chunk producing at least a byte, so the size never wraps
+	grow := func(length int64) error {
+		if length > math.MaxInt64-size-lastChunkPointers {
+			return reader.parseError(fmt.Errorf("%w: instructions produce more than %d bytes", ErrInvalidDelta,
+				int64(math.MaxInt64)))
+		}
+		if md.Size >= 0 && length > md.Size-size-lastChunkPointers {
+			return reader.parseError(fmt.Errorf("%w: instructions produce more than the %d bytes of the new file",
+				ErrInvalidDelta, md.Size))
+		}
+		size += length
+		return nil
+	}
+	for {
+		op, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch op.Type {
+		case PointerOp:
+			if op.Index >= chunkCount {
+				return reader.parseError(fmt.Errorf("%w: chunk %d not in a basis file of %d chunks",
+					ErrSignatureMismatch, op.Index, chunkCount))
+			}
+			if op.Index == chunkCount-1 {
+				lastChunkPointers++
+				err = grow(0)
+			} else {
+				err = grow(chunkSize)
+			}
+		case NewChunkOp:
+			err = grow(int64(len(op.Data)))
+		case CompressedOp:
+			err = grow(op.Length)
+		case CopyOp, AddOp:
+			// Copies may end anywhere in the last chunk
+			if basisEnd := int64(chunkCount) * chunkSize; op.Length > basisEnd || op.Source > basisEnd-op.Length {
+				return reader.parseError(fmt.Errorf("%w: copy of %d bytes at %d not in a basis file of %d chunks",
+					ErrSignatureMismatch, op.Length, op.Source, chunkCount))
+			}
+			err = grow(op.Length)
+		case ZeroOp:
+			err = grow(op.Length)
+		case OutputCopyOp:
+			// The data written so far is at most as long as with full last chunks
+			written := int64(math.MaxInt64)
+			if lastChunkPointers <= (written-size)/chunkSize {
+				written = size + lastChunkPointers*chunkSize
+			}
+			if op.Length > written || op.Source > written-op.Length {
+				return reader.parseError(fmt.Errorf("%w: copy of %d bytes at %d not written yet", ErrInvalidDelta,
+					op.Length, op.Source))
+			}
+			err = grow(op.Length)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if md.Size >= 0 && !sizeMatches(md.Size, size, lastChunkPointers, chunkSize) {
+		return reader.parseError(fmt.Errorf("%w: instructions do not produce the %d bytes of the new file",
+			ErrInvalidDelta, md.Size))
+	}
+	return nil
+}
+
+// sizeMatches tells whether some size of the last basis chunk (between 1 byte and a full chunk)
+// makes the instructions produce exactly the expected size
+func sizeMatches(expectedSize int64, size int64, lastChunkPointers int64, chunkSize int64) bool {
+	if lastChunkPointers == 0 {
+		return size == expectedSize
+	}
+	rest := expectedSize - size
+	if rest%lastChunkPointers != 0 {
+		return false
+	}
+	lastChunkSize := rest / lastChunkPointers
+	return lastChunkSize >= 1 && lastChunkSize <= chunkSize
+}
@@ -0,0 +1,129 @@
+package delta
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDelta(t *testing.T) {
+	basis := append(append([]byte{}, chunks[0]...), smallerChunk...)
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(512)})
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		name      string
+		deltaData []byte
+		err       error
+	}{
+		{
+			name:      "Computed delta",
+			deltaData: mustGetDelta(t, signatureData, buildNewFile2()),
+		},
+		{
+			name:      "Pointers to the shorter last chunk",
+			deltaData: []byte(fmt.Sprintf("%vP,4,1P,4,0P,4,1", buildMetadata(512, 64+512+64))),
+		},
+		{
+			name:      "Version 1 delta",
+			deltaData: []byte("512|P,4,1N,3,abc"),
+		},
+		{
+			name:      "Copies",
+			deltaData: []byte("512,v=3,size=600|C,10,500C,0,100"),
+		},
+		{
+			name:      "Copy beyond the basis chunks",
+			deltaData: []byte("512,v=3,size=600|C,1000,600"),
+			err:       ErrSignatureMismatch,
+		},
+		{
+			name:      "Adds",
+			deltaData: []byte("512,v=7,size=5|A,10,3,\x01\x00\x02C,0,2"),
+		},
+		{
+			name:      "Add beyond the basis chunks",
+			deltaData: []byte("512,v=7,size=3|A,1023,3,abc"),
+			err:       ErrSignatureMismatch,
+		},
+		{
+			name:      "Output copies",
+			deltaData: []byte(fmt.Sprintf("%vN,3,abcO,0,3P,4,1O,3,20", buildMetadata(512, 90))),
+		},
+		{
+			name:      "Output copy of data not written yet",
+			deltaData: []byte(fmt.Sprintf("%vN,3,abcO,2,3", buildMetadata(512, 6))),
+			err:       ErrInvalidDelta,
+		},
+		{
+			name:      "Zero runs whose sum wraps",
+			deltaData: []byte("512,v=4,size=0|" + strings.Repeat("Z,4611686018427387904", 4)),
+			err:       ErrInvalidDelta,
+		},
+		{
+			name:      "Copy whose end wraps",
+			deltaData: []byte("512,v=3,size=0|C,4611686018427387904,4611686018427387904"),
+			err:       ErrInvalidDelta,
+		},
+		{
+			name:      "Copy of more than the basis chunks",
+			deltaData: []byte("512,v=3,size=0|C,2305843009213693952,2305843009213693952"),
+			err:       ErrSignatureMismatch,
+		},
+		{
+			name:      "Instructions longer than the new file",
+			deltaData: []byte("512,v=4,size=10|Z,6Z,6Z,2"),
+			err:       ErrInvalidDelta,
+		},
+		{
+			name:      "Chunk size differs from the signature",
+			deltaData: []byte(fmt.Sprintf("%vP,4,0", buildMetadata(1024, 512))),
+			err:       ErrSignatureMismatch,
+		},
+		{
+			name:      "Pointer beyond the basis chunks",
+			deltaData: []byte(fmt.Sprintf("%vP,4,0P,4,2", buildMetadata(512, 1024))),
+			err:       ErrSignatureMismatch,
+		},
+		{
+			name:      "Instructions shorter than the new file",
+			deltaData: []byte(fmt.Sprintf("%vP,4,0N,3,abc", buildMetadata(512, 516))),
+			err:       ErrInvalidDelta,
+		},
+		{
+			name:      "Last chunk pointers cannot make the new file size",
+			deltaData: []byte(fmt.Sprintf("%vP,4,1P,4,1", buildMetadata(512, 1025))),
+			err:       ErrInvalidDelta,
+		},
+		{
+			name:      "New chunk beyond the end of the delta",
+			deltaData: []byte(fmt.Sprintf("%vN,100,abc", buildMetadata(512, 100))),
+			err:       s.ErrTruncated,
+		},
+		{
+			name:      "Malformed instruction",
+			deltaData: []byte(fmt.Sprintf("%vP,5,0", buildMetadata(512, 512))),
+			err:       ErrInvalidDelta,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateData(signatureData, tc.deltaData)
+			if tc.err == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func mustGetDelta(t *testing.T, signatureData []byte, newData []byte) []byte {
+	deltaData, err := GetDelta(signatureData, newData)
+	assert.Nil(t, err)
+	return deltaData
+}
@@ -0,0 +1,153 @@
+package delta
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/popescuag/RH/internal/pkg/metadata"
+)
+
+// Version of the format that introduced each instruction
+var opVersions = map[string]int{
+	PointerOp:    1,
+	NewChunkOp:   1,
+	CopyOp:       copyVersion,
+	ZeroOp:       zeroVersion,
+	OutputCopyOp: outputCopyVersion,
+	CompressedOp: literalsVersion,
+	AddOp:        addVersion,
+}
+
+// Writer writes the instructions of a delta file one at a time
+type Writer struct {
+	output   io.Writer
+	Metadata deltaMetadata
+}
+
+// NewWriter writes the metadata of a delta producing a new file of the given size. Besides pointers
+// and new chunks, the delta can only have the instructions listed in ops
+func NewWriter(output io.Writer, chunkSize uint32, size int64, ops ...string) (*Writer, error) {
+	return NewCompressedWriter(output, chunkSize, size, NoLiterals, ops...)
+}
+
+// NewCompressedWriter writes the metadata of a delta whose new chunks can be compressed with the codec
+func NewCompressedWriter(output io.Writer, chunkSize uint32, size int64, codec LiteralCodec,
+	ops ...string) (*Writer, error) {
+	return newWriter(output, chunkSize, size, codec, nil, ops...)
+}
+
+// newWriter writes the metadata of a delta carrying the metadata of the new file, unless it is nil
+func newWriter(output io.Writer, chunkSize uint32, size int64, codec LiteralCodec, file *metadata.Metadata,
+	ops ...string) (*Writer, error) {
+	err := ValidateLiteralCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{output: output, Metadata: deltaMetadata{ChunkSize: chunkSize, Version: sizeVersion, Size: size,
+		Literals: codec, File: file}}
+	if codec != NoLiterals {
+		ops = append(ops, CompressedOp)
+	}
+	if file != nil {
+		w.Metadata.Version = metadataVersion
+	}
+	for _, op := range ops {
+		version, found := opVersions[op]
+		if !found {
+			return nil, fmt.Errorf("%w: unknown instruction %q", ErrInvalidDelta, op)
+		}
+		if version > w.Metadata.Version {
+			w.Metadata.Version = version
+		}
+	}
+
+	err = w.Metadata.write(output)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) Pointer(index uint32) error {
+	return writePointer(index, w.output)
+}
+
+// NewChunk writes new data, in as many instructions as needed
+func (w *Writer) NewChunk(data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > int(w.Metadata.ChunkSize) {
+			n = int(w.Metadata.ChunkSize)
+		}
+		err := writeNewChunk(data[:n], w.output)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// CompressedChunk writes new data of at most a chunk, compressed with the data of the new file right
+// before it as dictionary. Data that does not compress is written as it is
+func (w *Writer) CompressedChunk(data []byte, dictionary []byte) error {
+	if w.Metadata.Literals == NoLiterals {
+		return w.NewChunk(data)
+	}
+	if len(data) > int(w.Metadata.ChunkSize) {
+		return fmt.Errorf("%w: new chunk of %d bytes larger than chunk size", ErrInvalidDelta, len(data))
+	}
+	compressed, err := compressLiteral(w.Metadata.Literals, data, dictionary)
+	if err != nil {
+		return err
+	}
+	if len(compressed) >= len(data) {
+		return w.NewChunk(data)
+	}
+	return writeCompressedChunk(len(data), compressed, w.output)
+}
+
+// Copy copies length bytes of the basis file, starting at offset
+func (w *Writer) Copy(offset int64, length int64) error {
+	if w.Metadata.Version < copyVersion {
+		return fmt.Errorf("%w: copy instruction in a version %d delta", ErrInvalidDelta, w.Metadata.Version)
+	}
+	return writeCopy(offset, length, w.output)
+}
+
+// Add copies the basis file starting at offset, adding each of the differences to the byte copied. The
+// differences are written in as many instructions as needed
+func (w *Writer) Add(offset int64, differences []byte) error {
+	if w.Metadata.Version < addVersion {
+		return fmt.Errorf("%w: add instruction in a version %d delta", ErrInvalidDelta, w.Metadata.Version)
+	}
+	for len(differences) > 0 {
+		n := len(differences)
+		if n > int(w.Metadata.ChunkSize) {
+			n = int(w.Metadata.ChunkSize)
+		}
+		err := writeAdd(offset, differences[:n], w.output)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		differences = differences[n:]
+	}
+	return nil
+}
+
+// OutputCopy copies length bytes of the new file already written, starting at offset
+func (w *Writer) OutputCopy(offset int64, length int64) error {
+	if w.Metadata.Version < outputCopyVersion {
+		return fmt.Errorf("%w: output copy in a version %d delta", ErrInvalidDelta, w.Metadata.Version)
+	}
+	return writeOutputCopy(offset, length, w.output)
+}
+
+// ZeroRun writes length zeros
+func (w *Writer) ZeroRun(length int64) error {
+	if w.Metadata.Version < zeroVersion {
+		return fmt.Errorf("%w: zero run in a version %d delta", ErrInvalidDelta, w.Metadata.Version)
+	}
+	return writeZeroRun(length, w.output)
+}
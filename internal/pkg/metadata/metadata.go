@@ -0,0 +1,198 @@
+package metadata
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMetadata is returned for fields that cannot be parsed
+var ErrInvalidMetadata = errors.New("invalid file metadata")
+
+// Metadata is what a file has besides its contents
+type Metadata struct {
+	Mode    fs.FileMode // permissions, with the setuid, setgid and sticky bits
+	ModTime time.Time
+	// Uid and Gid are -1 when the system does not report them
+	Uid    int
+	Gid    int
+	Xattrs map[string][]byte // extended attributes
+}
+
+// Keys of the fields of the metadata
+const (
+	modeKey    = "mode"  // permissions and special bits, in octal as chmod takes them
+	modTimeKey = "mtime" // nanoseconds since 1970
+	uidKey     = "uid"
+	gidKey     = "gid"
+	xattrKey   = "xattr" // one per attribute, <name>:<value> both in unpadded URL-safe base64
+)
+
+// Special bits of chmod
+const (
+	setuidBit = 04000
+	setgidBit = 02000
+	stickyBit = 01000
+)
+
+// Read returns the metadata of the open file
+func Read(f *os.File) (*Metadata, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	md := &Metadata{
+		Mode:    fi.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		ModTime: fi.ModTime(),
+	}
+	md.Uid, md.Gid = owner(fi)
+	if md.Xattrs, err = readXattrs(f.Name()); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// Apply sets the metadata on the open file, once it is written. The owner and the extended attributes the
+// process is not permitted to set, or the file system does not support, are left as they are
+func Apply(f *os.File, md *Metadata) error {
+	// Changing the owner clears the setuid and setgid bits, so it comes before the mode
+	if md.Uid >= 0 || md.Gid >= 0 {
+		if err := f.Chown(md.Uid, md.Gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	if err := writeXattrs(f.Name(), md.Xattrs); err != nil {
+		return err
+	}
+	if err := f.Chmod(md.Mode); err != nil {
+		return err
+	}
+	return os.Chtimes(f.Name(), time.Now(), md.ModTime)
+}
+
+// Fields returns the metadata as key=value fields, without commas
+func (md *Metadata) Fields() []string {
+	mode := uint32(md.Mode.Perm())
+	if md.Mode&fs.ModeSetuid != 0 {
+		mode |= setuidBit
+	}
+	if md.Mode&fs.ModeSetgid != 0 {
+		mode |= setgidBit
+	}
+	if md.Mode&fs.ModeSticky != 0 {
+		mode |= stickyBit
+	}
+	fields := []string{
+		modeKey + "=" + strconv.FormatUint(uint64(mode), 8),
+		modTimeKey + "=" + strconv.FormatInt(md.ModTime.UnixNano(), 10),
+	}
+	if md.Uid >= 0 {
+		fields = append(fields, uidKey+"="+strconv.Itoa(md.Uid))
+	}
+	if md.Gid >= 0 {
+		fields = append(fields, gidKey+"="+strconv.Itoa(md.Gid))
+	}
+	names := make([]string, 0, len(md.Xattrs))
+	for name := range md.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, xattrKey+"="+base64.RawURLEncoding.EncodeToString([]byte(name))+":"+
+			base64.RawURLEncoding.EncodeToString(md.Xattrs[name]))
+	}
+	return fields
+}
+
+// IsField tells if the key is the one of a field of the metadata
+func IsField(key string) bool {
+	switch key {
+	case modeKey, modTimeKey, uidKey, gidKey, xattrKey:
+		return true
+	}
+	return false
+}
+
+// New returns metadata without any field, to be parsed
+func New() *Metadata {
+	return &Metadata{Uid: -1, Gid: -1}
+}
+
+// ParseField reads a field written by Fields
+func (md *Metadata) ParseField(key string, value string) error {
+	invalid := func() error {
+		return fmt.Errorf("%w: %v %q", ErrInvalidMetadata, key, value)
+	}
+	switch key {
+	case modeKey:
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 07777 {
+			return invalid()
+		}
+		md.Mode = fs.FileMode(mode).Perm()
+		if mode&setuidBit != 0 {
+			md.Mode |= fs.ModeSetuid
+		}
+		if mode&setgidBit != 0 {
+			md.Mode |= fs.ModeSetgid
+		}
+		if mode&stickyBit != 0 {
+			md.Mode |= fs.ModeSticky
+		}
+	case modTimeKey:
+		// Times before 1970 are negative
+		modTime, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return invalid()
+		}
+		md.ModTime = time.Unix(0, modTime)
+	case uidKey, gidKey:
+		id, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return invalid()
+		}
+		if key == uidKey {
+			md.Uid = int(id)
+		} else {
+			md.Gid = int(id)
+		}
+	case xattrKey:
+		encodedName, encodedValue, found := strings.Cut(value, ":")
+		name, err := base64.RawURLEncoding.DecodeString(encodedName)
+		if !found || err != nil || len(name) == 0 {
+			return invalid()
+		}
+		data, err := base64.RawURLEncoding.DecodeString(encodedValue)
+		if err != nil {
+			return invalid()
+		}
+		if md.Xattrs == nil {
+			md.Xattrs = make(map[string][]byte)
+		}
+		md.Xattrs[string(name)] = data
+	default:
+		return fmt.Errorf("%w: unknown field %q", ErrInvalidMetadata, key)
+	}
+	return nil
+}
+
+// Parse reads the comma separated fields written by Fields
+func Parse(fields string) (*Metadata, error) {
+	md := New()
+	for _, field := range strings.Split(fields, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return nil, fmt.Errorf("%w: field %q", ErrInvalidMetadata, field)
+		}
+		if err := md.ParseField(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return md, nil
+}
@@ -0,0 +1,65 @@
+package metadata
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFields(t *testing.T) {
+	md := &Metadata{
+		Mode:    0755 | fs.ModeSetgid | fs.ModeSticky,
+		ModTime: time.Unix(-10, 5),
+		Uid:     1000,
+		Gid:     -1,
+		Xattrs:  map[string][]byte{"user.b": {0, ',', '|'}, "user.a": {}},
+	}
+	fields := strings.Join(md.Fields(), ",")
+	assert.Equal(t, "mode=3755,mtime=-9999999995,uid=1000,xattr=dXNlci5h:,xattr=dXNlci5i:ACx8", fields)
+	parsed, err := Parse(fields)
+	assert.Nil(t, err)
+	assert.Equal(t, md, parsed)
+
+	for _, fields := range []string{"mode=10000", "mode=x", "mtime=1.5", "uid=-1", "xattr=:YQ", "xattr=YQ",
+		"owner=1", "mode"} {
+		_, err = Parse(fields)
+		assert.ErrorIs(t, err, ErrInvalidMetadata, fields)
+	}
+}
+
+func TestReadAndApply(t *testing.T) {
+	dir := t.TempDir()
+	source, err := os.Create(filepath.Join(dir, "source"))
+	assert.Nil(t, err)
+	defer source.Close()
+	assert.Nil(t, source.Chmod(0750))
+	modTime := time.Unix(1e9, 789)
+	assert.Nil(t, os.Chtimes(source.Name(), modTime, modTime))
+	xattrs := map[string][]byte{"user.test": []byte("value")}
+	if err = writeXattrs(source.Name(), xattrs); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := Read(source)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0750), md.Mode)
+	assert.True(t, modTime.Equal(md.ModTime))
+
+	target, err := os.Create(filepath.Join(dir, "target"))
+	assert.Nil(t, err)
+	defer target.Close()
+	assert.Nil(t, Apply(target, md))
+	applied, err := Read(target)
+	assert.Nil(t, err)
+	assert.Equal(t, md.Mode, applied.Mode)
+	assert.True(t, modTime.Equal(applied.ModTime))
+	assert.Equal(t, md.Uid, applied.Uid)
+	assert.Equal(t, md.Gid, applied.Gid)
+	// Extended attributes are only kept where the file system supports them
+	assert.Equal(t, md.Xattrs, applied.Xattrs)
+}
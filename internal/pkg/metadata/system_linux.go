@@ -0,0 +1,65 @@
+package metadata
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+func owner(fi fs.FileInfo) (int, int) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+	return int(st.Uid), int(st.Gid)
+}
+
+// notSupported tells if the extended attributes cannot be read or set on the file system
+func notSupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if notSupported(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(path, list); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		// Attributes of other processes can be hidden from this one
+		size, err := syscall.Getxattr(path, name, nil)
+		if errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.EPERM) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		err := syscall.Setxattr(path, name, value, 0)
+		if err != nil && !notSupported(err) && !errors.Is(err, syscall.EPERM) {
+			return err
+		}
+	}
+	return nil
+}
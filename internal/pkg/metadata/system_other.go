@@ -0,0 +1,20 @@
+//go:build !linux
+
+package metadata
+
+import (
+	"io/fs"
+)
+
+// The owner and the extended attributes of files are only read and set on Linux
+func owner(fi fs.FileInfo) (int, int) {
+	return -1, -1
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	return nil
+}
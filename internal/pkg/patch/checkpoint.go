@@ -0,0 +1,212 @@
+package patch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+)
+
+// DefaultCheckpointInterval is the number of output bytes written between two checkpoints
+const DefaultCheckpointInterval = 64 << 20
+
+var checkpointMagic = [4]byte{'R', 'H', 'K', '1'}
+
+// ErrCheckpointMismatch is returned when a patch cannot be resumed from the checkpoint left next to its output
+var ErrCheckpointMismatch = errors.New("checkpoint does not match the patch")
+
+// checkpoint is a point up to which the partial output of a patch was written and synced
+type checkpoint struct {
+	Magic        [4]byte
+	Identity     [32]byte // sha256 of the delta file
+	BasisSize    int64
+	OpCount      uint64 // instructions applied
+	DeltaOffset  int64  // offset in the delta file of the next instruction
+	OutputOffset int64
+	OutputHash   [32]byte // sha256 of the output written so far
+}
+
+func checkpointPath(outputFile string) string {
+	dir, name := filepath.Split(outputFile)
+	return filepath.Join(dir, "."+name+".checkpoint")
+}
+
+func readCheckpoint(path string) (checkpoint, error) {
+	cp := checkpoint{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cp, err
+	}
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &cp)
+	if err != nil || len(data) != binary.Size(cp) || cp.Magic != checkpointMagic {
+		return cp, fmt.Errorf("%w: %v is not a patch checkpoint", ErrCheckpointMismatch, path)
+	}
+	return cp, nil
+}
+
+// write replaces the previous checkpoint, so a crash leaves either the old one or the new one
+func (cp checkpoint) write(path string) error {
+	f, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cp.Magic = checkpointMagic
+	err = binary.Write(f, binary.LittleEndian, &cp)
+	if err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// computeResumable writes the output to a partial file kept until the patch completes, with
+// a checkpoint next to it every CheckpointInterval bytes. When resuming, the partial output is
+// checked against the checkpoint and the patch continues from there
+func computeResumable(basis io.ReaderAt, basisSize int64, delta *os.File, outputFile string, options Options) error {
+	identity, err := fileIdentity(delta)
+	if err != nil {
+		return err
+	}
+	reader, err := d.NewReader(delta)
+	if err != nil {
+		return fmt.Errorf("cannot read delta: %w", err)
+	}
+
+	cpPath := checkpointPath(outputFile)
+	cp := checkpoint{Identity: identity, BasisSize: basisSize}
+	resume := false
+	if options.Resume {
+		previous, err := readCheckpoint(cpPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Without checkpoint the patch starts over
+		if err == nil {
+			if previous.Identity != identity || previous.BasisSize != basisSize {
+				return fmt.Errorf("%w: it was written for another delta or basis file", ErrCheckpointMismatch)
+			}
+			cp = previous
+			resume = true
+		}
+	}
+
+	if !resume {
+		err = os.Remove(cpPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	out, err := atomicfile.CreateResumable(outputFile, resume)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	reverse := options.reverseDelta(reader, basisSize)
+	outputHash := sha256.New()
+	if resume {
+		err = verifyPartialOutput(out.File, cp, outputHash)
+		if err != nil {
+			return err
+		}
+		// The reverse delta needs the instructions applied before the checkpoint too
+		if reverse != nil {
+			err = reverse.replay(reader, int(cp.OpCount))
+			if err != nil {
+				return err
+			}
+		} else {
+			_, err = delta.Seek(cp.DeltaOffset, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			reader.ResumeAt(delta, cp.DeltaOffset, int(cp.OpCount))
+		}
+	}
+
+	interval := options.CheckpointInterval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	next := cp.OutputOffset + interval
+	output := newSparseOutput(out.File, outputHash)
+	err = applyOps(reader, basis, basisSize, output, cp.OutputOffset, reverse, func(size int64) error {
+		if size < next {
+			return nil
+		}
+		next = size + interval
+
+		err := output.Flush()
+		if err != nil {
+			return err
+		}
+		err = out.Sync()
+		if err != nil {
+			return err
+		}
+		cp.OpCount = uint64(reader.OpCount())
+		cp.DeltaOffset = reader.Offset()
+		cp.OutputOffset = size
+		copy(cp.OutputHash[:], outputHash.Sum(nil))
+		return cp.write(cpPath)
+	})
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	if err = options.applyMetadata(reader, out); err != nil {
+		return err
+	}
+	if reverse != nil {
+		err = reverse.writeFile(options.ReverseDeltaFile, basis)
+		if err != nil {
+			return err
+		}
+	}
+	err = out.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(cpPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// verifyPartialOutput checks the partial output up to the checkpoint and drops what was written after it.
+// outputHash is left with the hash of the verified output, so it can be completed
+func verifyPartialOutput(partial *os.File, cp checkpoint, outputHash hash.Hash) error {
+	n, err := io.Copy(outputHash, bufio.NewReader(io.NewSectionReader(partial, 0, cp.OutputOffset)))
+	if err != nil {
+		return err
+	}
+	if n != cp.OutputOffset {
+		return fmt.Errorf("%w: partial output of %d bytes, %d expected", ErrCheckpointMismatch, n, cp.OutputOffset)
+	}
+	if !bytes.Equal(outputHash.Sum(nil), cp.OutputHash[:]) {
+		return fmt.Errorf("%w: partial output was modified", ErrCheckpointMismatch)
+	}
+
+	err = partial.Truncate(cp.OutputOffset)
+	if err != nil {
+		return err
+	}
+	_, err = partial.Seek(cp.OutputOffset, io.SeekStart)
+	return err
+}
@@ -0,0 +1,120 @@
+package patch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeWithCheckpoints(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	newFile := append(buildRandomData(100), reverseChunks(basis, 32)...)
+	basisFile, deltaFile, outputFile := writePatchFiles(t, basis, newFile)
+
+	err := ComputeWithOptions(basisFile, deltaFile, outputFile, Options{Checkpoint: true, CheckpointInterval: 100})
+	assert.Nil(t, err)
+	assertFileContent(t, outputFile, newFile)
+	assertNoPatchState(t, outputFile)
+}
+
+func TestResume(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	newFile := append(buildRandomData(100), reverseChunks(basis, 32)...)
+	basisFile, deltaFile, outputFile := writePatchFiles(t, basis, newFile)
+	interruptPatch(t, basis, deltaFile, outputFile, newFile, 30)
+
+	err := ComputeWithOptions(basisFile, deltaFile, outputFile, Options{Checkpoint: true, Resume: true})
+	assert.Nil(t, err)
+	assertFileContent(t, outputFile, newFile)
+	assertNoPatchState(t, outputFile)
+}
+
+func TestResumeWithoutCheckpoint(t *testing.T) {
+	basis := buildRandomData(1000)
+	basisFile, deltaFile, outputFile := writePatchFiles(t, basis, reverseChunks(basis, 32))
+	assert.Nil(t, os.WriteFile(atomicfile.PartialPath(outputFile), []byte("garbage"), 0600))
+
+	err := ComputeWithOptions(basisFile, deltaFile, outputFile, Options{Checkpoint: true, Resume: true})
+	assert.Nil(t, err)
+	assertFileContent(t, outputFile, reverseChunks(basis, 32))
+}
+
+func TestResumeMismatch(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	newFile := reverseChunks(basis, 32)
+
+	t.Run("another delta", func(t *testing.T) {
+		basisFile, deltaFile, outputFile := writePatchFiles(t, basis, newFile)
+		interruptPatch(t, basis, deltaFile, outputFile, newFile, 30)
+		assert.Nil(t, os.WriteFile(deltaFile, []byte("32|N,4,tiny"), 0644))
+
+		err := ComputeWithOptions(basisFile, deltaFile, outputFile, Options{Resume: true})
+		assert.ErrorIs(t, err, ErrCheckpointMismatch)
+	})
+
+	t.Run("modified partial output", func(t *testing.T) {
+		basisFile, deltaFile, outputFile := writePatchFiles(t, basis, newFile)
+		interruptPatch(t, basis, deltaFile, outputFile, newFile, 30)
+		partial, err := os.OpenFile(atomicfile.PartialPath(outputFile), os.O_WRONLY, 0)
+		assert.Nil(t, err)
+		partial.WriteAt([]byte("x"), 10)
+		partial.Close()
+
+		err = ComputeWithOptions(basisFile, deltaFile, outputFile, Options{Resume: true})
+		assert.ErrorIs(t, err, ErrCheckpointMismatch)
+	})
+}
+
+func writePatchFiles(t *testing.T, basis []byte, newFile []byte) (string, string, string) {
+	basisFile, deltaFile := writeInPlaceFiles(t, basis, newFile)
+	return basisFile, deltaFile, filepath.Join(filepath.Dir(basisFile), "output")
+}
+
+// interruptPatch leaves the state of a patch interrupted after some instructions: the partial output,
+// with some bytes written after the last checkpoint, and the checkpoint
+func interruptPatch(t *testing.T, basis []byte, deltaFile string, outputFile string, newFile []byte, ops int) {
+	delta, err := codec.Open(deltaFile)
+	assert.Nil(t, err)
+	defer delta.Close()
+	identity, err := fileIdentity(delta.File)
+	assert.Nil(t, err)
+
+	reader, err := d.NewReader(delta)
+	assert.Nil(t, err)
+	var size int64
+	for i := 0; i < ops; i++ {
+		op, err := reader.Next()
+		assert.Nil(t, err)
+		if op.Type == d.NewChunkOp {
+			size += int64(len(op.Data))
+		} else {
+			size += min64(32, int64(len(basis))-int64(op.Index)*32)
+		}
+	}
+
+	cp := checkpoint{
+		Identity:     identity,
+		BasisSize:    int64(len(basis)),
+		OpCount:      uint64(reader.OpCount()),
+		DeltaOffset:  reader.Offset(),
+		OutputOffset: size,
+		OutputHash:   sha256.Sum256(newFile[:size]),
+	}
+	assert.Nil(t, cp.write(checkpointPath(outputFile)))
+	partial := append(append([]byte{}, newFile[:size]...), bytes.Repeat([]byte{0}, 50)...)
+	assert.Nil(t, os.WriteFile(atomicfile.PartialPath(outputFile), partial, 0600))
+}
+
+func assertNoPatchState(t *testing.T, outputFile string) {
+	_, err := os.Stat(atomicfile.PartialPath(outputFile))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(checkpointPath(outputFile))
+	assert.True(t, os.IsNotExist(err))
+}
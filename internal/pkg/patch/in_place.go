@@ -0,0 +1,416 @@
+package patch
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/metadata"
+)
+
+// The original data of the steps is journaled and synced in batches, so a patch does not need
+// one sync per chunk but a crash never loses the data of a region already overwritten
+const (
+	maxBatchSteps = 4096
+	maxBatchBytes = 16 << 20
+
+	// A rollback only writes the journal back, it never looks regions up
+	rollbackBucketSize = 1 << 20
+)
+
+// step writes length bytes at target, copied either from the basis file, from the delta or from data
+// an earlier step wrote, or zeros
+type step struct {
+	copy   bool
+	zero   bool
+	output bool  // copied from data an earlier step wrote
+	added  bool  // copied from the basis file with the differences at offset diff of the delta added
+	diff   int64 // offset in the delta file of the differences, for adds
+	packed int64 // length of the data in the delta, for compressed chunks
+	source int64 // offset in the basis file for copies, in the delta file for new chunks, in the new file otherwise
+	target int64
+	length int64
+}
+
+type inPlacePlan struct {
+	steps     []step // in the order they must run
+	chunkSize int64
+	size      int64
+	literals  d.LiteralCodec
+}
+
+// ComputeInPlace applies the delta to the basis file itself, so no second copy of the file is needed.
+// The original content of every region is saved to a journal next to the basis file before it is
+// overwritten: an interrupted patch is resumed by running it again, or undone with Rollback
+func ComputeInPlace(basisFile string, deltaFile string) error {
+	return ComputeInPlaceWithOptions(basisFile, deltaFile, Options{})
+}
+
+// ComputeInPlaceWithOptions applies the delta to the basis file itself. Only the Metadata option applies to
+// patches in place: the metadata of the new file is set once the content is patched and the journal removed
+func ComputeInPlaceWithOptions(basisFile string, deltaFile string, options Options) error {
+	// Compressed deltas are decompressed first, the steps read the data of the delta at any offset
+	delta, err := codec.Open(deltaFile)
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+
+	identity, err := fileIdentity(delta.File)
+	if err != nil {
+		return err
+	}
+
+	basis, err := os.OpenFile(basisFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	reader, err := d.NewReader(delta)
+	if err != nil {
+		return fmt.Errorf("cannot read delta: %w", err)
+	}
+
+	j, err := openJournal(journalPath(basisFile), int64(reader.Metadata.ChunkSize))
+	if err != nil {
+		return err
+	}
+	var basisSize int64
+	if j != nil {
+		defer j.close()
+		if j.header.Identity != identity {
+			return fmt.Errorf("%w: roll it back before applying %v", ErrJournalMismatch, deltaFile)
+		}
+		basisSize = j.header.OriginalSize
+	} else {
+		fi, err := basis.Stat()
+		if err != nil {
+			return err
+		}
+		basisSize = fi.Size()
+	}
+
+	// Nothing is modified until the whole delta was checked against the basis file
+	plan, err := planInPlace(reader, basisSize)
+	if err != nil {
+		return err
+	}
+
+	if j == nil {
+		header := journalHeader{Identity: identity, OriginalSize: basisSize, FinalSize: plan.size}
+		j, err = createJournal(journalPath(basisFile), header, plan.chunkSize)
+		if err != nil {
+			return err
+		}
+		defer j.close()
+	}
+
+	err = plan.run(basis, delta, j)
+	if err != nil {
+		return err
+	}
+	if err = j.remove(); err != nil {
+		return err
+	}
+	if file := reader.Metadata.File; options.Metadata && file != nil {
+		return metadata.Apply(basis, file)
+	}
+	return nil
+}
+
+// Rollback restores the basis file of an interrupted in-place patch
+func Rollback(basisFile string) error {
+	basis, err := os.OpenFile(basisFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	j, err := openJournal(journalPath(basisFile), rollbackBucketSize)
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		return fmt.Errorf("no interrupted patch to roll back for %v", basisFile)
+	}
+	defer j.close()
+
+	err = j.rollback(basis)
+	if err != nil {
+		return err
+	}
+	return j.remove()
+}
+
+// fileIdentity returns the sha256 of the file, which tells whether a journal was written for it
+func fileIdentity(f *os.File) ([sha256.Size]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, bufio.NewReader(io.NewSectionReader(f, 0, 1<<62)))
+	identity := [sha256.Size]byte{}
+	copy(identity[:], h.Sum(nil))
+	return identity, err
+}
+
+// planInPlace turns the instructions of the delta into steps and orders them so that no step
+// overwrites data another step still has to copy
+func planInPlace(reader *d.Reader, basisSize int64) (inPlacePlan, error) {
+	plan := inPlacePlan{chunkSize: int64(reader.Metadata.ChunkSize), literals: reader.Metadata.Literals}
+	copies := []step{}
+	newChunks := []step{}
+	add := func(st step) {
+		if st.copy && (st.source != st.target || st.added) {
+			copies = append(copies, st)
+		} else if !st.copy {
+			newChunks = append(newChunks, st)
+		}
+		plan.size += st.length
+	}
+
+	for {
+		op, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return plan, fmt.Errorf("cannot read delta: %w", err)
+		}
+
+		switch op.Type {
+		case d.NewChunkOp:
+			add(step{source: op.Offset, target: plan.size, length: int64(len(op.Data))})
+			continue
+		case d.CompressedOp:
+			add(step{packed: int64(len(op.Data)), source: op.Offset, target: plan.size, length: op.Length})
+			continue
+		case d.ZeroOp:
+			// Zero runs read nothing, so only the size of the new file bounds the steps they are split in
+			if size := reader.Metadata.Size; size >= 0 && op.Length > size-plan.size {
+				return plan, fmt.Errorf("%w: zero run of %d bytes beyond the %d bytes of the new file",
+					d.ErrInvalidDelta, op.Length, size)
+			}
+			for length := op.Length; length > 0; {
+				n := min64(length, plan.chunkSize)
+				add(step{zero: true, target: plan.size, length: n})
+				length -= n
+			}
+			continue
+		case d.AddOp:
+			offset, length, err := basisRange(op, plan.chunkSize, basisSize)
+			if err != nil {
+				return plan, err
+			}
+			add(step{copy: true, added: true, diff: op.Offset, source: offset, target: plan.size, length: length})
+			continue
+		case d.OutputCopyOp:
+			if op.Length > plan.size || op.Source > plan.size-op.Length {
+				return plan, fmt.Errorf("%w: %d bytes at %d not written yet", d.ErrInvalidDelta, op.Length, op.Source)
+			}
+			for offset, length := op.Source, op.Length; length > 0; {
+				n := min64(length, plan.chunkSize)
+				add(step{output: true, source: offset, target: plan.size, length: n})
+				offset += n
+				length -= n
+			}
+			continue
+		}
+
+		offset, length, err := basisRange(op, plan.chunkSize, basisSize)
+		if err != nil {
+			return plan, err
+		}
+		// Long copies are split in chunks, so each step fits in the same buffer
+		for length > 0 {
+			n := min64(length, plan.chunkSize)
+			add(step{copy: true, source: offset, target: plan.size, length: n})
+			offset += n
+			length -= n
+		}
+	}
+
+	if reader.Metadata.Size >= 0 && plan.size != reader.Metadata.Size {
+		return plan, fmt.Errorf("%w: %d bytes produced, %d expected", ErrBasisMismatch, plan.size, reader.Metadata.Size)
+	}
+
+	// The other steps do not read the basis file, so they can run once all copies are done. They run in
+	// the order of the new file: output copies and the dictionaries of compressed chunks only read data
+	// before theirs, which is already written
+	plan.steps = append(orderCopies(copies), newChunks...)
+	return plan, nil
+}
+
+// orderCopies runs every copy before the ones overwriting its source, so sources are read from the
+// basis file itself. The copies that form a cycle run in delta order and read theirs back from the journal
+func orderCopies(copies []step) []step {
+	bySource := make([]int, len(copies))
+	var maxLength int64
+	for i := range copies {
+		bySource[i] = i
+		maxLength = max64(maxLength, copies[i].length)
+	}
+	sort.Slice(bySource, func(a, b int) bool {
+		return copies[bySource[a]].source < copies[bySource[b]].source
+	})
+
+	successors := make([][]int, len(copies))
+	predecessors := make([]int, len(copies))
+	for w, writer := range copies {
+		end := writer.target + writer.length
+		i := sort.Search(len(bySource), func(i int) bool {
+			return copies[bySource[i]].source >= end
+		})
+		for i--; i >= 0 && copies[bySource[i]].source+maxLength > writer.target; i-- {
+			r := bySource[i]
+			if r != w && copies[r].source+copies[r].length > writer.target {
+				successors[r] = append(successors[r], w)
+				predecessors[w]++
+			}
+		}
+	}
+
+	ordered := make([]step, 0, len(copies))
+	done := make([]bool, len(copies))
+	ready := []int{}
+	for i := range copies {
+		if predecessors[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	next := 0
+	for len(ordered) < len(copies) {
+		if len(ready) == 0 {
+			for done[next] {
+				next++
+			}
+			predecessors[next] = 0
+			ready = append(ready, next)
+		}
+		c := ready[0]
+		ready = ready[1:]
+		if done[c] {
+			continue
+		}
+		done[c] = true
+		ordered = append(ordered, copies[c])
+		for _, w := range successors[c] {
+			predecessors[w]--
+			if predecessors[w] == 0 && !done[w] {
+				ready = append(ready, w)
+			}
+		}
+	}
+	return ordered
+}
+
+// run applies the steps in batches: the original data of a batch is journaled and synced before
+// the batch writes anything. Steps already journaled by an interrupted run are written again
+func (p inPlacePlan) run(basis *os.File, delta io.ReaderAt, j *journal) error {
+	originalSize := j.header.OriginalSize
+	buf := make([]byte, p.chunkSize)
+	var packed, dictionary, differences []byte
+
+	for start := 0; start < len(p.steps); {
+		end := start
+		var journaled int64
+		for end < len(p.steps) && end-start < maxBatchSteps && journaled < maxBatchBytes {
+			st := p.steps[end]
+			length := min64(st.target+st.length, originalSize) - st.target
+			if !j.has(uint64(end)) && length > 0 {
+				if _, err := basis.ReadAt(buf[:length], st.target); err != nil {
+					return err
+				}
+				if err := j.add(uint64(end), st.target, buf[:length]); err != nil {
+					return err
+				}
+				journaled += length
+			}
+			end++
+		}
+		if err := j.sync(); err != nil {
+			return err
+		}
+
+		for i := start; i < end; i++ {
+			st := p.steps[i]
+			data := buf[:st.length]
+			var err error
+			switch {
+			case st.added:
+				if differences == nil {
+					differences = make([]byte, p.chunkSize)
+				}
+				err = j.readOriginal(basis, data, st.source)
+				if err == nil {
+					_, err = delta.ReadAt(differences[:st.length], st.diff)
+					addDifferences(data, differences[:st.length])
+				}
+			case st.copy:
+				err = j.readOriginal(basis, data, st.source)
+			case st.zero:
+				for i := range data {
+					data[i] = 0
+				}
+			case st.output:
+				_, err = basis.ReadAt(data, st.source)
+			case st.packed > 0:
+				if packed == nil {
+					packed, dictionary = make([]byte, p.chunkSize), make([]byte, d.DictionarySize)
+				}
+				err = p.decompress(basis, delta, st, packed, dictionary, data)
+			default:
+				_, err = delta.ReadAt(data, st.source)
+			}
+			if err != nil {
+				return err
+			}
+			if _, err = basis.WriteAt(data, st.target); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+
+	// The end of a file that shrinks is journaled too, so a rollback can restore it
+	if originalSize > p.size {
+		for offset, i := p.size, len(p.steps); offset < originalSize; offset, i = offset+p.chunkSize, i+1 {
+			length := min64(p.chunkSize, originalSize-offset)
+			if j.has(uint64(i)) {
+				continue
+			}
+			if _, err := basis.ReadAt(buf[:length], offset); err != nil {
+				return err
+			}
+			if err := j.add(uint64(i), offset, buf[:length]); err != nil {
+				return err
+			}
+		}
+		if err := j.sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := basis.Truncate(p.size); err != nil {
+		return err
+	}
+	return basis.Sync()
+}
+
+// decompress reads the data of a compressed chunk, whose dictionary is the data written right before it
+func (p inPlacePlan) decompress(basis *os.File, delta io.ReaderAt, st step, packed []byte, dictionary []byte,
+	data []byte) error {
+	if _, err := delta.ReadAt(packed[:st.packed], st.source); err != nil {
+		return err
+	}
+	n := min64(st.target, d.DictionarySize)
+	if _, err := basis.ReadAt(dictionary[:n], st.target-n); err != nil {
+		return err
+	}
+	chunk, err := d.Decompress(p.literals, packed[:st.packed], dictionary[:n], st.length)
+	copy(data, chunk)
+	return err
+}
@@ -0,0 +1,325 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeInPlace(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+
+	testCases := []struct {
+		name    string
+		basis   []byte
+		newFile []byte
+	}{
+		{
+			name:    "identical files",
+			basis:   basis,
+			newFile: basis,
+		},
+		{
+			name:    "changed middle chunk",
+			basis:   basis,
+			newFile: buildChangedData(basis, 1000),
+		},
+		{
+			name:    "chunks in reverse order",
+			basis:   basis,
+			newFile: reverseChunks(basis, 32),
+		},
+		{
+			name:    "data inserted at the front",
+			basis:   basis,
+			newFile: append(buildRandomData(100), basis...),
+		},
+		{
+			name:    "data removed from the front",
+			basis:   basis,
+			newFile: basis[100:],
+		},
+		{
+			name:    "file duplicated",
+			basis:   basis,
+			newFile: append(append([]byte{}, basis...), basis...),
+		},
+		{
+			name:    "non-empty to empty",
+			basis:   basis,
+			newFile: []byte{},
+		},
+		{
+			name:    "empty to non-empty",
+			basis:   []byte{},
+			newFile: basis,
+		},
+		{
+			name:    "new data repeated",
+			basis:   basis,
+			newFile: append(bytes.Repeat(buildRandomData(256), 3), basis[:1024]...),
+		},
+		{
+			name:    "zeros inserted in the middle",
+			basis:   basis,
+			newFile: append(append(append([]byte{}, basis[:1024]...), make([]byte, 1000)...), basis[1024:]...),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			basisFile, deltaFile := writeInPlaceFiles(t, tc.basis, tc.newFile)
+
+			err := ComputeInPlace(basisFile, deltaFile)
+			assert.Nil(t, err)
+			assertFileContent(t, basisFile, tc.newFile)
+			_, err = os.Stat(journalPath(basisFile))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestComputeInPlaceMetadata(t *testing.T) {
+	dir := t.TempDir()
+	basis := buildRandomData(32*64 + 10)
+	newData := buildChangedData(basis, 1000)
+	newFile := filepath.Join(dir, "new")
+	signatureFile := filepath.Join(dir, "signature")
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, os.WriteFile(newFile, newData, 0600))
+	assert.Nil(t, os.Chmod(newFile, 0750))
+	modTime := time.Unix(1e9, 456)
+	assert.Nil(t, os.Chtimes(newFile, modTime, modTime))
+
+	for _, options := range []Options{{Metadata: true}, {}} {
+		basisFile := filepath.Join(dir, "basis")
+		assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+		assert.Nil(t, os.Chmod(basisFile, 0644))
+		assert.Nil(t, s.Compute(basisFile, signatureFile, s.Options{}))
+		assert.Nil(t, d.ComputeWithOptions(signatureFile, newFile, deltaFile, d.Options{Metadata: true}))
+
+		assert.Nil(t, ComputeInPlaceWithOptions(basisFile, deltaFile, options))
+		assertFileContent(t, basisFile, newData)
+		fi, err := os.Stat(basisFile)
+		assert.Nil(t, err)
+		if options.Metadata {
+			assert.Equal(t, os.FileMode(0750), fi.Mode())
+			assert.True(t, modTime.Equal(fi.ModTime()))
+		} else {
+			assert.Equal(t, os.FileMode(0644), fi.Mode())
+			assert.False(t, modTime.Equal(fi.ModTime()))
+		}
+	}
+}
+
+func TestComputeInPlaceSwappedChunks(t *testing.T) {
+	basis := buildRandomData(96)
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+	// Each copy overwrites the source of the next one
+	assert.Nil(t, os.WriteFile(deltaFile, []byte("32|P,4,1P,4,2P,4,0"), 0644))
+
+	err := ComputeInPlace(basisFile, deltaFile)
+	assert.Nil(t, err)
+	assertFileContent(t, basisFile, append(append(append([]byte{}, basis[32:64]...), basis[64:]...), basis[:32]...))
+}
+
+func TestComputeInPlaceOutputCopies(t *testing.T) {
+	basis := buildRandomData(96)
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+	// The output copies read data the patch copied from chunks it then overwrites
+	assert.Nil(t, os.WriteFile(deltaFile, []byte("32,v=5,size=160|P,4,2O,0,32P,4,0O,16,64"), 0644))
+
+	err := ComputeInPlace(basisFile, deltaFile)
+	assert.Nil(t, err)
+	c := basis[64:]
+	assertFileContent(t, basisFile, bytes.Join([][]byte{c, c, basis[:32], c[16:], c, basis[:16]}, nil))
+}
+
+func TestComputeInPlaceDiff(t *testing.T) {
+	// Bytes inserted and removed shift the copies of the rest of the file over the data they read
+	basis := buildRandomData(16 * 256)
+	newFile := bytes.Join([][]byte{basis[:300], []byte("inserted"), basis[300:2000], basis[2100:]}, nil)
+	options := d.DiffOptions{Algorithm: d.BlockDiff, ChunkSize: s.FixedChunkSizePolicy(256)}
+	deltaData, err := d.DiffData(basis, newFile, options)
+	assert.Nil(t, err)
+	assert.Contains(t, string(deltaData), "C,")
+
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+	assert.Nil(t, os.WriteFile(deltaFile, deltaData, 0644))
+	assert.Nil(t, ComputeInPlace(basisFile, deltaFile))
+	assertFileContent(t, basisFile, newFile)
+
+	reverseData, err := GetReverseDelta(basis, deltaData)
+	assert.Nil(t, err)
+	output, err := GetPatch(newFile, reverseData)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(basis, output), "reverse patch differs from the basis file")
+}
+
+func TestComputeInPlaceInvalidDelta(t *testing.T) {
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, os.WriteFile(basisFile, []byte("tiny"), 0644))
+	assert.Nil(t, os.WriteFile(deltaFile, []byte("32|N,4,tinyP,4,5"), 0644))
+
+	err := ComputeInPlace(basisFile, deltaFile)
+	assert.ErrorIs(t, err, ErrBasisMismatch)
+	assertFileContent(t, basisFile, []byte("tiny"))
+	_, err = os.Stat(journalPath(basisFile))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestComputeInPlaceOverflow(t *testing.T) {
+	// Each of these would be split in more steps than fit in memory
+	for _, delta := range []string{
+		"32,v=5,size=0|O,4611686018427387904,4611686018427387904",
+		"32,v=3,size=0|C,4611686018427387904,4611686018427387904",
+		"32,v=3,size=0|C,2305843009213693952,2305843009213693952",
+		"32,v=4,size=0|Z,4611686018427387904",
+	} {
+		dir := t.TempDir()
+		basisFile := filepath.Join(dir, "basis")
+		deltaFile := filepath.Join(dir, "delta")
+		assert.Nil(t, os.WriteFile(basisFile, []byte("tiny"), 0644))
+		assert.Nil(t, os.WriteFile(deltaFile, []byte(delta), 0644))
+
+		err := ComputeInPlace(basisFile, deltaFile)
+		assert.NotNil(t, err, delta)
+		assertFileContent(t, basisFile, []byte("tiny"))
+	}
+}
+
+func TestComputeInPlaceResume(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	newFile := append(buildRandomData(100), reverseChunks(basis, 32)[:1500]...)
+	basisFile, deltaFile := writeInPlaceFiles(t, basis, newFile)
+	interruptInPlace(t, basisFile, deltaFile, 20)
+
+	err := ComputeInPlace(basisFile, deltaFile)
+	assert.Nil(t, err)
+	assertFileContent(t, basisFile, newFile)
+	_, err = os.Stat(journalPath(basisFile))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestComputeInPlaceResumeWithAnotherDelta(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	basisFile, deltaFile := writeInPlaceFiles(t, basis, reverseChunks(basis, 32))
+	interruptInPlace(t, basisFile, deltaFile, 20)
+
+	assert.Nil(t, os.WriteFile(deltaFile, []byte("32|N,4,tiny"), 0644))
+	err := ComputeInPlace(basisFile, deltaFile)
+	assert.ErrorIs(t, err, ErrJournalMismatch)
+}
+
+func TestRollback(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	basisFile, deltaFile := writeInPlaceFiles(t, basis, append(reverseChunks(basis, 32), basis...))
+	interruptInPlace(t, basisFile, deltaFile, 100)
+
+	err := Rollback(basisFile)
+	assert.Nil(t, err)
+	assertFileContent(t, basisFile, basis)
+	_, err = os.Stat(journalPath(basisFile))
+	assert.True(t, os.IsNotExist(err))
+
+	err = Rollback(basisFile)
+	assert.NotNil(t, err)
+}
+
+func TestRollbackDropsCorruptRecords(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	basisFile, deltaFile := writeInPlaceFiles(t, basis, reverseChunks(basis, 32))
+	interruptInPlace(t, basisFile, deltaFile, 20)
+
+	// A record appended but not synced before a crash, whose data is garbage
+	journal, err := os.OpenFile(journalPath(basisFile), os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	record := journalRecord{Step: 1 << 40, Offset: 0, Length: 32}
+	record.Checksum = record.checksum(make([]byte, 32))
+	assert.Nil(t, binary.Write(journal, binary.LittleEndian, &record))
+	_, err = journal.Write(bytes.Repeat([]byte{0xff}, 32))
+	assert.Nil(t, err)
+	assert.Nil(t, journal.Close())
+
+	err = Rollback(basisFile)
+	assert.Nil(t, err)
+	assertFileContent(t, basisFile, basis)
+}
+
+func writeInPlaceFiles(t *testing.T, basis []byte, newFile []byte) (string, string) {
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(32)})
+	assert.Nil(t, err)
+	deltaData, err := d.GetDelta(signatureData, newFile)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	deltaFile := filepath.Join(dir, "delta")
+	assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+	assert.Nil(t, os.WriteFile(deltaFile, deltaData, 0644))
+	return basisFile, deltaFile
+}
+
+// interruptInPlace runs the first steps of an in-place patch, leaving its journal behind as a crash would
+func interruptInPlace(t *testing.T, basisFile string, deltaFile string, steps int) {
+	delta, err := os.Open(deltaFile)
+	assert.Nil(t, err)
+	defer delta.Close()
+	basis, err := os.OpenFile(basisFile, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	defer basis.Close()
+	fi, err := basis.Stat()
+	assert.Nil(t, err)
+
+	identity, err := fileIdentity(delta)
+	assert.Nil(t, err)
+	reader, err := d.NewReader(delta)
+	assert.Nil(t, err)
+	plan, err := planInPlace(reader, fi.Size())
+	assert.Nil(t, err)
+	assert.Greater(t, len(plan.steps), steps)
+
+	header := journalHeader{Identity: identity, OriginalSize: fi.Size(), FinalSize: plan.size}
+	j, err := createJournal(journalPath(basisFile), header, plan.chunkSize)
+	assert.Nil(t, err)
+	defer j.close()
+
+	partial := inPlacePlan{steps: plan.steps[:steps], chunkSize: plan.chunkSize, size: fi.Size()}
+	assert.Nil(t, partial.run(basis, delta, j))
+}
+
+func reverseChunks(data []byte, chunkSize int) []byte {
+	reversed := make([]byte, 0, len(data))
+	for start := (len(data) - 1) / chunkSize * chunkSize; start >= 0; start -= chunkSize {
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		reversed = append(reversed, data[start:end]...)
+	}
+	return reversed
+}
+
+func assertFileContent(t *testing.T, file string, expected []byte) {
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected, data), "%v differs from the expected content", file)
+}
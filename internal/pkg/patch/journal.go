@@ -0,0 +1,273 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const journalSuffix = ".rhjournal"
+
+var journalMagic = [4]byte{'R', 'H', 'J', '2'}
+
+// ErrJournalMismatch is returned when resuming an in-place patch with another delta
+var ErrJournalMismatch = errors.New("journal belongs to the patch of another delta")
+
+type journalHeader struct {
+	Magic        [4]byte
+	Identity     [32]byte // sha256 of the delta file
+	OriginalSize int64
+	FinalSize    int64
+}
+
+// journalRecord is followed by the Length original bytes found at Offset
+type journalRecord struct {
+	Step     uint64
+	Offset   int64
+	Length   uint32
+	Checksum uint32 // CRC32 of the record, with a zero checksum, and of its data
+}
+
+func (r journalRecord) checksum(data []byte) uint32 {
+	r.Checksum = 0
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &r)
+	return crc32.Update(crc32.ChecksumIEEE(buf.Bytes()), crc32.IEEETable, data)
+}
+
+type journalEntry struct {
+	offset     int64
+	length     int64
+	dataOffset int64 // offset of the original bytes in the journal
+}
+
+// journal saves the original content of every region of the basis file before an in-place patch
+// overwrites it. It is used to read the original data of regions already overwritten, to resume
+// an interrupted patch and to roll it back
+type journal struct {
+	file       *os.File
+	header     journalHeader
+	entries    []journalEntry
+	buckets    map[int64][]int // entries by region of bucketSize bytes, to find the ones overlapping a read
+	bucketSize int64
+	steps      map[uint64]bool
+	end        int64
+}
+
+func journalPath(basisFile string) string {
+	return basisFile + journalSuffix
+}
+
+func createJournal(path string, header journalHeader, bucketSize int64) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := newJournal(f, header, bucketSize)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &j.header)
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.end = int64(buf.Len())
+	return j, nil
+}
+
+// openJournal loads the journal of an interrupted patch, or returns nil if there is none.
+// A journal without complete header is discarded, as nothing was patched before it was written
+func openJournal(path string, bucketSize int64) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := journalHeader{}
+	err = binary.Read(f, binary.LittleEndian, &header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, os.Remove(path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if header.Magic != journalMagic {
+		f.Close()
+		return nil, fmt.Errorf("%v is not a patch journal", path)
+	}
+
+	j := newJournal(f, header, bucketSize)
+	j.end = int64(binary.Size(header))
+	err = j.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func newJournal(f *os.File, header journalHeader, bucketSize int64) *journal {
+	header.Magic = journalMagic
+	return &journal{
+		file:       f,
+		header:     header,
+		buckets:    map[int64][]int{},
+		bucketSize: bucketSize,
+		steps:      map[uint64]bool{},
+	}
+}
+
+// load indexes the records of the journal. A record cut short or left with garbage by a crash is dropped
+// with the ones after it: its region was not overwritten, as records are synced before the patch writes
+// anything
+func (j *journal) load() error {
+	recordSize := int64(binary.Size(journalRecord{}))
+	for {
+		record := journalRecord{}
+		err := binary.Read(io.NewSectionReader(j.file, j.end, recordSize), binary.LittleEndian, &record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		fi, err := j.file.Stat()
+		if err != nil {
+			return err
+		}
+		if j.end+recordSize+int64(record.Length) > fi.Size() {
+			break
+		}
+		data := make([]byte, record.Length)
+		if _, err = j.file.ReadAt(data, j.end+recordSize); err != nil {
+			return err
+		}
+		if record.checksum(data) != record.Checksum {
+			break
+		}
+		j.index(record, j.end+recordSize)
+		j.end += recordSize + int64(record.Length)
+	}
+	return j.file.Truncate(j.end)
+}
+
+// add saves the original data of a region about to be overwritten by a step
+func (j *journal) add(step uint64, offset int64, data []byte) error {
+	record := journalRecord{Step: step, Offset: offset, Length: uint32(len(data))}
+	record.Checksum = record.checksum(data)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &record)
+	dataOffset := j.end + int64(buf.Len())
+	buf.Write(data)
+
+	_, err := j.file.WriteAt(buf.Bytes(), j.end)
+	if err != nil {
+		return err
+	}
+	j.end += int64(buf.Len())
+	j.index(record, dataOffset)
+	return nil
+}
+
+func (j *journal) index(record journalRecord, dataOffset int64) {
+	j.steps[record.Step] = true
+	if record.Length == 0 {
+		return
+	}
+	j.entries = append(j.entries, journalEntry{offset: record.Offset, length: int64(record.Length), dataOffset: dataOffset})
+	last := (record.Offset + int64(record.Length) - 1) / j.bucketSize
+	for bucket := record.Offset / j.bucketSize; bucket <= last; bucket++ {
+		j.buckets[bucket] = append(j.buckets[bucket], len(j.entries)-1)
+	}
+}
+
+func (j *journal) has(step uint64) bool {
+	return j.steps[step]
+}
+
+func (j *journal) sync() error {
+	return j.file.Sync()
+}
+
+// readOriginal reads the original content of the basis file, wherever it was overwritten since
+func (j *journal) readOriginal(basis io.ReaderAt, buf []byte, offset int64) error {
+	_, err := basis.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	end := offset + int64(len(buf))
+	last := (end - 1) / j.bucketSize
+	for bucket := offset / j.bucketSize; bucket <= last; bucket++ {
+		for _, i := range j.buckets[bucket] {
+			entry := j.entries[i]
+			from, to := max64(offset, entry.offset), min64(end, entry.offset+entry.length)
+			if from >= to {
+				continue
+			}
+			_, err = j.file.ReadAt(buf[from-offset:to-offset], entry.dataOffset+from-entry.offset)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rollback writes the original data back and restores the original size of the basis file
+func (j *journal) rollback(basis *os.File) error {
+	for _, entry := range j.entries {
+		data := make([]byte, entry.length)
+		_, err := j.file.ReadAt(data, entry.dataOffset)
+		if err != nil {
+			return err
+		}
+		_, err = basis.WriteAt(data, entry.offset)
+		if err != nil {
+			return err
+		}
+	}
+	err := basis.Truncate(j.header.OriginalSize)
+	if err != nil {
+		return err
+	}
+	return basis.Sync()
+}
+
+// remove deletes the journal once the basis file is either fully patched or rolled back
+func (j *journal) remove() error {
+	j.file.Close()
+	return os.Remove(j.file.Name())
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
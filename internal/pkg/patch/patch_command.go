@@ -0,0 +1,324 @@
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/metadata"
+)
+
+// ErrBasisMismatch is returned when a delta refers to data the basis file does not have
+var ErrBasisMismatch = errors.New("delta does not match the basis file")
+
+// GetPatch = rebuilds the new file from the basis file and the delta computed against its signature
+func GetPatch(basisData []byte, deltaData []byte) ([]byte, error) {
+	buf := new(memoryOutput)
+	err := applyDelta(bytes.NewReader(basisData), int64(len(basisData)), bytes.NewReader(deltaData), buf)
+	return buf.Bytes(), err
+}
+
+// Options controls how a patch is applied to an output file
+type Options struct {
+	// Checkpoint keeps the partial output of a failed or interrupted patch, with periodic
+	// checkpoints of its progress, so the patch can be resumed
+	Checkpoint bool
+	// Resume continues the patch from the last checkpoint left by a previous run with the same delta
+	Resume bool
+	// CheckpointInterval is the number of output bytes between checkpoints, DefaultCheckpointInterval if 0
+	CheckpointInterval int64
+	// ReverseDeltaFile, if set, receives the delta that rebuilds the basis file from the output
+	ReverseDeltaFile string
+	// Metadata sets the mode, modification time, owner and extended attributes of the new file carried by
+	// the delta on the output. The owner is only changed when the process is permitted to
+	Metadata bool
+}
+
+// applyMetadata sets the metadata of the new file on the output, when the delta has it and it is asked for
+func (options Options) applyMetadata(reader *d.Reader, out *atomicfile.File) error {
+	file := reader.Metadata.File
+	if !options.Metadata || file == nil {
+		return nil
+	}
+	if err := metadata.Apply(out.File, file); err != nil {
+		return err
+	}
+	out.SetMode(file.Mode)
+	return nil
+}
+
+// Apply writes the new file rebuilt from the basis file of the given size and the delta to output. Data
+// of the new file copied by the delta is read back from output when it is an io.ReaderAt, such as a file
+// open for reading and writing, otherwise the new file is kept in memory until the end
+func Apply(basis io.ReaderAt, basisSize int64, delta io.Reader, output io.Writer) error {
+	if file, ok := output.(io.ReaderAt); ok {
+		return applyDelta(basis, basisSize, delta, &readerAtOutput{Writer: output, file: file})
+	}
+	buf := new(memoryOutput)
+	err := applyDelta(basis, basisSize, delta, buf)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(buf.Bytes())
+	return err
+}
+
+func Compute(basisFile string, deltaFile string, outputFile string) error {
+	return ComputeWithOptions(basisFile, deltaFile, outputFile, Options{})
+}
+
+func ComputeWithOptions(basisFile string, deltaFile string, outputFile string, options Options) error {
+	basis, err := os.Open(basisFile)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	fi, err := basis.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Resuming reads the delta from the offset of the checkpoint, so compressed deltas are decompressed first
+	deltaReader, err := codec.Open(deltaFile)
+	if err != nil {
+		return err
+	}
+	defer deltaReader.Close()
+
+	if options.Checkpoint || options.Resume {
+		return computeResumable(basis, fi.Size(), deltaReader.File, outputFile, options)
+	}
+
+	reader, err := d.NewReader(deltaReader)
+	if err != nil {
+		return fmt.Errorf("cannot read delta: %w", err)
+	}
+	reverse := options.reverseDelta(reader, fi.Size())
+
+	out, err := atomicfile.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := newSparseOutput(out.File, nil)
+	err = applyOps(reader, basis, fi.Size(), output, 0, reverse, nil)
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	if err = options.applyMetadata(reader, out); err != nil {
+		return err
+	}
+	if reverse != nil {
+		err = reverse.writeFile(options.ReverseDeltaFile, basis)
+		if err != nil {
+			return err
+		}
+	}
+	return out.Commit()
+}
+
+// reverseDelta returns where to record the reverse delta, if one was asked for
+func (options Options) reverseDelta(reader *d.Reader, basisSize int64) *reverseDelta {
+	if options.ReverseDeltaFile == "" {
+		return nil
+	}
+	return newReverseDelta(int64(reader.Metadata.ChunkSize), basisSize)
+}
+
+// outputReader is an output that can read back the data written to it, for the instructions
+// copying data of the new file
+type outputReader interface {
+	io.Writer
+	ReadOutputAt(p []byte, offset int64) error
+}
+
+// memoryOutput keeps the output in memory
+type memoryOutput struct {
+	bytes.Buffer
+}
+
+func (o *memoryOutput) ReadOutputAt(p []byte, offset int64) error {
+	size := int64(o.Len())
+	if offset < 0 || offset > size || int64(len(p)) > size-offset {
+		return io.ErrUnexpectedEOF
+	}
+	copy(p, o.Bytes()[offset:])
+	return nil
+}
+
+// readerAtOutput reads back the output from the file it is written to
+type readerAtOutput struct {
+	io.Writer
+	file io.ReaderAt
+}
+
+func (o *readerAtOutput) ReadOutputAt(p []byte, offset int64) error {
+	n, err := o.file.ReadAt(p, offset)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func applyDelta(basis io.ReaderAt, basisSize int64, delta io.Reader, output outputReader) error {
+	reader, err := d.NewReader(delta)
+	if err != nil {
+		return fmt.Errorf("cannot read delta: %w", err)
+	}
+	return applyOps(reader, basis, basisSize, output, 0, nil, nil)
+}
+
+// applyOps writes the output of the instructions left in the delta, after size bytes already written.
+// reverse, if set, records where the basis data is copied to. afterOp, if set, is called after every
+// instruction with the output size so far
+func applyOps(reader *d.Reader, basis io.ReaderAt, basisSize int64, output outputReader, size int64,
+	reverse *reverseDelta, afterOp func(size int64) error) error {
+	chunkSize := int64(reader.Metadata.ChunkSize)
+
+	chunk := make([]byte, chunkSize)
+	var dictionary []byte
+	for {
+		op, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read delta: %w", err)
+		}
+
+		switch op.Type {
+		case d.NewChunkOp:
+			if _, err = output.Write(op.Data); err != nil {
+				return err
+			}
+			size += int64(len(op.Data))
+		case d.CompressedOp:
+			// The dictionary is the output right before the chunk
+			if dictionary == nil {
+				dictionary = make([]byte, d.DictionarySize)
+			}
+			n := min64(size, d.DictionarySize)
+			if err = output.ReadOutputAt(dictionary[:n], size-n); err != nil {
+				return err
+			}
+			data, err := d.Decompress(reader.Metadata.Literals, op.Data, dictionary[:n], op.Length)
+			if err != nil {
+				return err
+			}
+			if _, err = output.Write(data); err != nil {
+				return err
+			}
+			size += op.Length
+		case d.ZeroOp:
+			if zw, ok := output.(zeroWriter); ok {
+				err = zw.WriteZeros(op.Length)
+			} else {
+				err = writeZeros(output, op.Length)
+			}
+			if err != nil {
+				return err
+			}
+			size += op.Length
+		case d.AddOp:
+			// The basis data is not copied as it is, so the reverse delta does not copy it back
+			offset, length, err := basisRange(op, chunkSize, basisSize)
+			if err != nil {
+				return err
+			}
+			if _, err = basis.ReadAt(chunk[:length], offset); err != nil {
+				return err
+			}
+			addDifferences(chunk[:length], op.Data)
+			if _, err = output.Write(chunk[:length]); err != nil {
+				return err
+			}
+			size += length
+		case d.OutputCopyOp:
+			// Both values can be up to 1<<62, so their sum is not compared
+			if op.Length > size || op.Source > size-op.Length {
+				return fmt.Errorf("%w: %d bytes at %d not written yet", d.ErrInvalidDelta, op.Length, op.Source)
+			}
+			for offset, length := op.Source, op.Length; length > 0; {
+				n := min64(length, chunkSize)
+				if err = output.ReadOutputAt(chunk[:n], offset); err != nil {
+					return err
+				}
+				if _, err = output.Write(chunk[:n]); err != nil {
+					return err
+				}
+				offset += n
+				length -= n
+				size += n
+			}
+		default:
+			offset, length, err := basisRange(op, chunkSize, basisSize)
+			if err != nil {
+				return err
+			}
+			if reverse != nil {
+				reverse.record(offset, length, size)
+			}
+			for length > 0 {
+				n := min64(length, chunkSize)
+				if _, err = basis.ReadAt(chunk[:n], offset); err != nil {
+					return err
+				}
+				if _, err = output.Write(chunk[:n]); err != nil {
+					return err
+				}
+				offset += n
+				length -= n
+				size += n
+			}
+		}
+
+		if afterOp != nil {
+			if err = afterOp(size); err != nil {
+				return err
+			}
+		}
+	}
+
+	if reader.Metadata.Size >= 0 && size != reader.Metadata.Size {
+		return fmt.Errorf("%w: %d bytes produced, %d expected", ErrBasisMismatch, size, reader.Metadata.Size)
+	}
+	return nil
+}
+
+// addDifferences adds the differences of an add instruction to the basis data it copies
+func addDifferences(data []byte, differences []byte) {
+	for i := range data {
+		data[i] += differences[i]
+	}
+}
+
+// basisRange returns the region of the basis file read by a pointer, a copy or an add
+func basisRange(op d.Op, chunkSize int64, basisSize int64) (int64, int64, error) {
+	if op.Type == d.CopyOp || op.Type == d.AddOp {
+		if op.Length > basisSize || op.Source > basisSize-op.Length {
+			return 0, 0, fmt.Errorf("%w: %d bytes at %d not found", ErrBasisMismatch, op.Length, op.Source)
+		}
+		return op.Source, op.Length, nil
+	}
+
+	// The last chunk of the basis file can be shorter than the rest
+	offset := int64(op.Index) * chunkSize
+	if offset >= basisSize {
+		return 0, 0, fmt.Errorf("%w: chunk %d not found", ErrBasisMismatch, op.Index)
+	}
+	return offset, min64(chunkSize, basisSize-offset), nil
+}
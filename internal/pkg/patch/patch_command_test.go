@@ -0,0 +1,361 @@
+package patch
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/popescuag/RH/internal/pkg/sparse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatch(t *testing.T) {
+	basis := buildRandomData(1<<10 + 10)
+
+	testCases := []struct {
+		name    string
+		basis   []byte
+		newFile []byte
+	}{
+		{
+			name:    "identical files",
+			basis:   basis,
+			newFile: basis,
+		},
+		{
+			name:    "changed middle chunk",
+			basis:   basis,
+			newFile: buildChangedData(basis, 100),
+		},
+		{
+			name:    "shorter last chunk moved to the front",
+			basis:   basis,
+			newFile: append(append([]byte{}, basis[1<<10:]...), basis[:1<<10]...),
+		},
+		{
+			name:    "empty to non-empty",
+			basis:   []byte{},
+			newFile: basis,
+		},
+		{
+			name:    "non-empty to empty",
+			basis:   basis,
+			newFile: []byte{},
+		},
+		{
+			name:    "empty to empty",
+			basis:   []byte{},
+			newFile: []byte{},
+		},
+		{
+			name:    "files smaller than a chunk",
+			basis:   []byte("tiny"),
+			newFile: []byte("tinier"),
+		},
+		{
+			name:    "new data repeated",
+			basis:   basis,
+			newFile: append(append(append([]byte{}, basis[:512]...), bytes.Repeat(buildRandomData(256), 3)...), basis[512:]...),
+		},
+		{
+			name:    "zeros inserted",
+			basis:   basis,
+			newFile: append(append(append([]byte{}, basis[:512]...), make([]byte, 2048)...), basis[512:]...),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			signatureData, err := s.GetSignature(tc.basis)
+			assert.Nil(t, err)
+			deltaData, err := d.GetDelta(signatureData, tc.newFile)
+			assert.Nil(t, err)
+
+			output, err := GetPatch(tc.basis, deltaData)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(tc.newFile, output), "patched file differs from the new file")
+		})
+	}
+}
+
+func TestPatchInvalidDelta(t *testing.T) {
+	testCases := []struct {
+		name  string
+		delta []byte
+		err   error
+	}{
+		{
+			name:  "chunk missing from the basis file",
+			delta: []byte("32|P,4,5"),
+			err:   ErrBasisMismatch,
+		},
+		{
+			name:  "truncated new chunk",
+			delta: []byte("32|N,10,abc"),
+			err:   s.ErrTruncated,
+		},
+		{
+			name:  "new file size differs from the metadata",
+			delta: []byte("32,v=2,size=10|P,4,0"),
+			err:   ErrBasisMismatch,
+		},
+		{
+			name:  "copy beyond the end of the basis file",
+			delta: []byte("32,v=3,size=10|C,0,10"),
+			err:   ErrBasisMismatch,
+		},
+		{
+			name:  "copy whose end overflows",
+			delta: []byte("32,v=3,size=0|C,4611686018427387904,4611686018427387904"),
+			err:   d.ErrInvalidDelta,
+		},
+		{
+			name:  "copy of more than the basis file",
+			delta: []byte("32,v=3,size=0|C,2305843009213693952,2305843009213693952"),
+			err:   ErrBasisMismatch,
+		},
+		{
+			name:  "output copy of data not written yet",
+			delta: []byte("32,v=5,size=8|P,4,0O,2,4"),
+			err:   d.ErrInvalidDelta,
+		},
+		{
+			name:  "output copy whose end overflows",
+			delta: []byte("32,v=5,size=0|O,4611686018427387904,4611686018427387904"),
+			err:   d.ErrInvalidDelta,
+		},
+		{
+			name:  "unknown instruction",
+			delta: []byte("32|X"),
+			err:   d.ErrInvalidDelta,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := GetPatch([]byte("tiny"), tc.delta)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func buildRandomData(size int) []byte {
+	data := make([]byte, size)
+	rand.Seed(time.Now().UnixNano())
+	rand.Read(data)
+	return data
+}
+
+func buildChangedData(data []byte, offset int) []byte {
+	changed := append([]byte{}, data...)
+	changed[offset]++
+	return changed
+}
+
+func TestComputeLeavesNoPartialOutput(t *testing.T) {
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	deltaFile := filepath.Join(dir, "delta")
+	outputFile := filepath.Join(dir, "output")
+	assert.Nil(t, os.WriteFile(basisFile, []byte("tiny"), 0644))
+	// The new chunk is written before the missing chunk is found
+	assert.Nil(t, os.WriteFile(deltaFile, []byte("32|N,4,tinyP,4,5"), 0644))
+
+	err := Compute(basisFile, deltaFile, outputFile)
+	assert.ErrorIs(t, err, ErrBasisMismatch)
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	_, err = os.Stat(outputFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestComputeSparseOutput(t *testing.T) {
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	deltaFile := filepath.Join(dir, "delta")
+	outputFile := filepath.Join(dir, "output")
+	assert.Nil(t, os.WriteFile(basisFile, []byte{}, 0644))
+	// A 1MB zero run between two new chunks, and another one at the end of the file
+	assert.Nil(t, os.WriteFile(deltaFile, []byte("32,v=4,size=2097160|N,4,tinyZ,1048576N,4,tinyZ,1048576"), 0644))
+
+	assert.Nil(t, Compute(basisFile, deltaFile, outputFile))
+	expected := append(append(append([]byte("tiny"), make([]byte, 1<<20)...), []byte("tiny")...), make([]byte, 1<<20)...)
+	assertFileContent(t, outputFile, expected)
+
+	f, err := os.Open(outputFile)
+	assert.Nil(t, err)
+	defer f.Close()
+	holes, err := sparse.Holes(f, int64(len(expected)))
+	assert.Nil(t, err)
+	if len(holes) == 0 {
+		t.Skip("the file system does not report holes")
+	}
+	// Both zero runs are holes, apart from the pages they share with the new chunks
+	var holeSize int64
+	for _, hole := range holes {
+		holeSize += hole.Length
+	}
+	assert.GreaterOrEqual(t, holeSize, int64(2<<20-16<<10))
+}
+
+func TestPatchMetadata(t *testing.T) {
+	dir := t.TempDir()
+	basisFile := filepath.Join(dir, "basis")
+	newFile := filepath.Join(dir, "new")
+	signatureFile := filepath.Join(dir, "signature")
+	deltaFile := filepath.Join(dir, "delta")
+	basis := buildRandomData(1 << 12)
+	assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+	assert.Nil(t, os.WriteFile(newFile, buildChangedData(basis, 100), 0600))
+	assert.Nil(t, os.Chmod(newFile, 0750))
+	modTime := time.Unix(1e9, 456)
+	assert.Nil(t, os.Chtimes(newFile, modTime, modTime))
+
+	assert.Nil(t, s.Compute(basisFile, signatureFile, s.Options{Metadata: true}))
+	assert.Nil(t, d.ComputeWithOptions(signatureFile, newFile, deltaFile, d.Options{Metadata: true}))
+
+	for _, options := range []Options{{Metadata: true}, {Metadata: true, Checkpoint: true}, {}} {
+		outputFile := filepath.Join(dir, "output")
+		assert.Nil(t, ComputeWithOptions(basisFile, deltaFile, outputFile, options))
+		assertFileContent(t, outputFile, buildChangedData(basis, 100))
+		fi, err := os.Stat(outputFile)
+		assert.Nil(t, err)
+		if options.Metadata {
+			assert.Equal(t, os.FileMode(0750), fi.Mode())
+			assert.True(t, modTime.Equal(fi.ModTime()))
+		} else {
+			assert.Equal(t, os.FileMode(0644), fi.Mode())
+			assert.False(t, modTime.Equal(fi.ModTime()))
+		}
+	}
+}
+
+func TestPatchCompressedLiterals(t *testing.T) {
+	basis := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 200))
+	newFile := append([]byte("The lazy dog sleeps."), basis...)
+	copy(newFile[5000:], "The quick red fox")
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(64)})
+	assert.Nil(t, err)
+
+	for _, codec := range []d.LiteralCodec{d.FlateLiterals, d.ZlibLiterals} {
+		t.Run(string(codec), func(t *testing.T) {
+			deltaData, err := d.GetDeltaWithOptions(signatureData, newFile, d.Options{Literals: codec})
+			assert.Nil(t, err)
+			assert.Contains(t, string(deltaData), "L,")
+
+			output, err := GetPatch(basis, deltaData)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(newFile, output), "patched file differs from the new file")
+
+			reverseData, err := GetReverseDelta(basis, deltaData)
+			assert.Nil(t, err)
+			output, err = GetPatch(newFile, reverseData)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(basis, output), "reverse patch differs from the basis file")
+
+			dir := t.TempDir()
+			basisFile := filepath.Join(dir, "basis")
+			deltaFile := filepath.Join(dir, "delta")
+			assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+			assert.Nil(t, os.WriteFile(deltaFile, deltaData, 0644))
+			outputFile := filepath.Join(dir, "output")
+			options := Options{Checkpoint: true, CheckpointInterval: 256}
+			assert.Nil(t, ComputeWithOptions(basisFile, deltaFile, outputFile, options))
+			assertFileContent(t, outputFile, newFile)
+			assert.Nil(t, ComputeInPlace(basisFile, deltaFile))
+			assertFileContent(t, basisFile, newFile)
+		})
+	}
+}
+
+func TestPatchCompressedDelta(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	newFile := append(buildRandomData(100), reverseChunks(basis, 32)...)
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(32)})
+	assert.Nil(t, err)
+
+	for _, c := range []codec.Codec{codec.Gzip, codec.Zlib} {
+		t.Run(c.Name(), func(t *testing.T) {
+			deltaData, err := d.GetDeltaWithOptions(signatureData, newFile, d.Options{Codec: c})
+			assert.Nil(t, err)
+			output, err := GetPatch(basis, deltaData)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(newFile, output), "patched file differs from the new file")
+			reverseData, err := GetReverseDelta(basis, deltaData)
+			assert.Nil(t, err)
+			output, err = GetPatch(newFile, reverseData)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(basis, output), "reverse patch differs from the basis file")
+
+			basisFile, deltaFile, outputFile := writePatchFiles(t, basis, newFile)
+			assert.Nil(t, os.WriteFile(deltaFile, deltaData, 0644))
+			interruptPatch(t, basis, deltaFile, outputFile, newFile, 30)
+			err = ComputeWithOptions(basisFile, deltaFile, outputFile, Options{Checkpoint: true, Resume: true})
+			assert.Nil(t, err)
+			assertFileContent(t, outputFile, newFile)
+			assert.Nil(t, ComputeInPlace(basisFile, deltaFile))
+			assertFileContent(t, basisFile, newFile)
+		})
+	}
+}
+
+func TestPatchSuffixArrayDiff(t *testing.T) {
+	// Approximate matches moved around the file, which in place overwrite the data other adds read
+	basis := buildRandomData(20000)
+	shifted := append([]byte{}, basis...)
+	for i := 0; i < len(shifted); i += 50 {
+		shifted[i]++
+	}
+	newFile := bytes.Join([][]byte{shifted[12000:], []byte("inserted"), shifted[:12000]}, nil)
+	deltaData, err := d.DiffData(basis, newFile, d.DiffOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, string(deltaData), "A,")
+
+	output, err := GetPatch(basis, deltaData)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(newFile, output), "patched file differs from the new file")
+	reverseData, err := GetReverseDelta(basis, deltaData)
+	assert.Nil(t, err)
+	output, err = GetPatch(newFile, reverseData)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(basis, output), "reverse patch differs from the basis file")
+
+	basisFile, deltaFile, outputFile := writePatchFiles(t, basis, newFile)
+	assert.Nil(t, os.WriteFile(deltaFile, deltaData, 0644))
+	assert.Nil(t, ComputeWithOptions(basisFile, deltaFile, outputFile, Options{Checkpoint: true}))
+	assertFileContent(t, outputFile, newFile)
+	assert.Nil(t, ComputeInPlace(basisFile, deltaFile))
+	assertFileContent(t, basisFile, newFile)
+
+	// Adds to the data at their own target
+	deltaData, err = d.DiffData(basis, shifted, d.DiffOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(basisFile, basis, 0644))
+	assert.Nil(t, os.WriteFile(deltaFile, deltaData, 0644))
+	assert.Nil(t, ComputeInPlace(basisFile, deltaFile))
+	assertFileContent(t, basisFile, shifted)
+}
+
+func TestPatchCompressedLiteralsWithAnotherBasis(t *testing.T) {
+	basis := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20))
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(64)})
+	assert.Nil(t, err)
+	newFile := append(append([]byte{}, basis...), strings.Repeat("The quick brown fox jumps over the lazy cat. ", 2)...)
+	deltaData, err := d.GetDeltaWithOptions(signatureData, newFile, d.Options{Literals: d.ZlibLiterals})
+	assert.Nil(t, err)
+	assert.Contains(t, string(deltaData), "L,")
+
+	// The chunks of the other basis file make another dictionary
+	otherBasis := bytes.ToUpper(basis)
+	_, err = GetPatch(otherBasis, deltaData)
+	assert.ErrorIs(t, err, d.ErrInvalidDelta)
+}
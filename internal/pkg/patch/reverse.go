@@ -0,0 +1,168 @@
+package patch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/sparse"
+)
+
+// reverseDelta rebuilds the basis file from the new file: the chunks of the basis file a patch
+// copied to the new file are copied back from there, the others are written as new chunks
+type reverseDelta struct {
+	chunkSize int64
+	basisSize int64
+	targets   []int64 // where each chunk of the basis file was copied to in the new file, -1 if it was not
+}
+
+func newReverseDelta(chunkSize int64, basisSize int64) *reverseDelta {
+	targets := make([]int64, (basisSize+chunkSize-1)/chunkSize)
+	for i := range targets {
+		targets[i] = -1
+	}
+	return &reverseDelta{chunkSize: chunkSize, basisSize: basisSize, targets: targets}
+}
+
+// GetReverseDelta = computes the delta that rebuilds the basis file from the file the delta produces
+func GetReverseDelta(basisData []byte, deltaData []byte) ([]byte, error) {
+	reader, err := d.NewReader(bytes.NewReader(deltaData))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read delta: %w", err)
+	}
+	basisSize := int64(len(basisData))
+	reverse := newReverseDelta(int64(reader.Metadata.ChunkSize), basisSize)
+	err = applyOps(reader, bytes.NewReader(basisData), basisSize, new(memoryOutput), 0, reverse, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = reverse.write(bytes.NewReader(basisData), buf)
+	return buf.Bytes(), err
+}
+
+// record notes that length bytes of the basis file at offset were copied to target in the new file.
+// Only whole chunks are recorded, the first time they are copied
+func (r *reverseDelta) record(offset int64, length int64, target int64) {
+	first := (offset + r.chunkSize - 1) / r.chunkSize
+	for i := first; i < int64(len(r.targets)); i++ {
+		start := i * r.chunkSize
+		end := min64(start+r.chunkSize, r.basisSize)
+		if end > offset+length {
+			break
+		}
+		if r.targets[i] < 0 {
+			r.targets[i] = target + start - offset
+		}
+	}
+}
+
+// replay records the copies of the first instructions of the delta, which a resumed patch does not apply
+func (r *reverseDelta) replay(reader *d.Reader, opCount int) error {
+	var size int64
+	for reader.OpCount() < opCount {
+		op, err := reader.Next()
+		if err != nil {
+			return fmt.Errorf("cannot read delta: %w", err)
+		}
+		switch op.Type {
+		case d.NewChunkOp:
+			size += int64(len(op.Data))
+			continue
+		case d.ZeroOp, d.OutputCopyOp, d.CompressedOp, d.AddOp:
+			size += op.Length
+			continue
+		}
+		offset, length, err := basisRange(op, r.chunkSize, r.basisSize)
+		if err != nil {
+			return err
+		}
+		r.record(offset, length, size)
+		size += length
+	}
+	return nil
+}
+
+// write writes the reverse delta, reading the chunks that were not copied from the basis file.
+// Chunks copied next to each other are copied back by a single instruction, zero chunks next to
+// each other are written as a single zero run
+func (r *reverseDelta) write(basis io.ReaderAt, output io.Writer) error {
+	w, err := d.NewWriter(output, uint32(r.chunkSize), r.basisSize, d.CopyOp, d.ZeroOp)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, r.chunkSize)
+	var copyOffset, copyLength, zeroLength int64
+	flush := func() error {
+		var err error
+		if copyLength > 0 {
+			err = w.Copy(copyOffset, copyLength)
+		}
+		if zeroLength > 0 {
+			err = w.ZeroRun(zeroLength)
+		}
+		copyLength, zeroLength = 0, 0
+		return err
+	}
+
+	for i, target := range r.targets {
+		offset := int64(i) * r.chunkSize
+		length := min64(r.chunkSize, r.basisSize-offset)
+		if target >= 0 {
+			if copyLength > 0 && copyOffset+copyLength == target {
+				copyLength += length
+				continue
+			}
+			if err = flush(); err != nil {
+				return err
+			}
+			copyOffset, copyLength = target, length
+			continue
+		}
+
+		if _, err = basis.ReadAt(chunk[:length], offset); err != nil {
+			return err
+		}
+		// The pending instruction is only written when the next one is of another kind
+		if sparse.IsZero(chunk[:length]) {
+			if copyLength > 0 {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+			zeroLength += length
+			continue
+		}
+		if err = flush(); err != nil {
+			return err
+		}
+		if err = w.NewChunk(chunk[:length]); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+func (r *reverseDelta) writeFile(path string, basis io.ReaderAt) error {
+	out, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := bufio.NewWriter(out)
+	err = r.write(basis, output)
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
@@ -0,0 +1,154 @@
+package patch
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetReverseDelta(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+
+	testCases := []struct {
+		name    string
+		basis   []byte
+		newFile []byte
+	}{
+		{
+			name:    "identical files",
+			basis:   basis,
+			newFile: basis,
+		},
+		{
+			name:    "changed middle chunk",
+			basis:   basis,
+			newFile: buildChangedData(basis, 1000),
+		},
+		{
+			name:    "data inserted at the front",
+			basis:   basis,
+			newFile: append(buildRandomData(100), basis...),
+		},
+		{
+			name:    "chunks in reverse order",
+			basis:   basis,
+			newFile: reverseChunks(basis, 32),
+		},
+		{
+			name:    "non-empty to empty",
+			basis:   basis,
+			newFile: []byte{},
+		},
+		{
+			name:    "empty to non-empty",
+			basis:   []byte{},
+			newFile: basis,
+		},
+		{
+			name:    "new data repeated",
+			basis:   basis,
+			newFile: append(append([]byte{}, basis...), bytes.Repeat(buildRandomData(256), 3)...),
+		},
+		{
+			name:    "zeros removed",
+			basis:   append(append(append([]byte{}, basis[:1024]...), make([]byte, 1000)...), basis[1024:]...),
+			newFile: basis,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			signatureData, err := s.GetSignatureWithOptions(tc.basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(32)})
+			assert.Nil(t, err)
+			deltaData, err := d.GetDelta(signatureData, tc.newFile)
+			assert.Nil(t, err)
+
+			reverseData, err := GetReverseDelta(tc.basis, deltaData)
+			assert.Nil(t, err)
+			output, err := GetPatch(tc.newFile, reverseData)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(tc.basis, output), "reverse patch differs from the basis file")
+		})
+	}
+}
+
+func TestReverseDeltaCopiesSharedData(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	newFile := append(buildRandomData(64), basis...)
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(32)})
+	assert.Nil(t, err)
+	deltaData, err := d.GetDelta(signatureData, newFile)
+	assert.Nil(t, err)
+
+	reverseData, err := GetReverseDelta(basis, deltaData)
+	assert.Nil(t, err)
+	// The data moved by the insertion is copied back by a single instruction
+	assert.Less(t, len(reverseData), 100)
+}
+
+func TestReverseDeltaMergesZeroRuns(t *testing.T) {
+	basis := make([]byte, 640)
+	newFile := buildRandomData(100)
+	signatureData, err := s.GetSignatureWithOptions(basis, s.Options{ChunkSize: s.FixedChunkSizePolicy(64)})
+	assert.Nil(t, err)
+	deltaData, err := d.GetDelta(signatureData, newFile)
+	assert.Nil(t, err)
+
+	reverseData, err := GetReverseDelta(basis, deltaData)
+	assert.Nil(t, err)
+	// The zero chunks are written back by a single zero run
+	assert.True(t, strings.HasSuffix(string(reverseData), "|Z,640"), string(reverseData))
+	output, err := GetPatch(newFile, reverseData)
+	assert.Nil(t, err)
+	assert.Equal(t, basis, output)
+}
+
+func TestComputeWithReverseDelta(t *testing.T) {
+	basis := buildRandomData(32*64 + 10)
+	newFile := append(buildRandomData(100), reverseChunks(basis, 32)...)
+
+	testCases := []struct {
+		name      string
+		options   Options
+		interrupt bool
+	}{
+		{
+			name: "without checkpoints",
+		},
+		{
+			name:    "with checkpoints",
+			options: Options{Checkpoint: true, CheckpointInterval: 100},
+		},
+		{
+			name:      "resumed",
+			options:   Options{Checkpoint: true, Resume: true},
+			interrupt: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			basisFile, deltaFile, outputFile := writePatchFiles(t, basis, newFile)
+			if tc.interrupt {
+				interruptPatch(t, basis, deltaFile, outputFile, newFile, 30)
+			}
+			reverseFile := filepath.Join(filepath.Dir(outputFile), "reverse")
+			tc.options.ReverseDeltaFile = reverseFile
+
+			err := ComputeWithOptions(basisFile, deltaFile, outputFile, tc.options)
+			assert.Nil(t, err)
+			assertFileContent(t, outputFile, newFile)
+
+			// Undo the patch in place, without the basis file
+			assert.Nil(t, os.Remove(basisFile))
+			assert.Nil(t, ComputeInPlace(outputFile, reverseFile))
+			assertFileContent(t, outputFile, basis)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package patch
+
+import (
+	"bufio"
+	"hash"
+	"io"
+	"os"
+)
+
+// Zero runs shorter than this are written: seeking over them would not leave a hole in the file,
+// only fragment it
+const minHoleSize = 64 << 10
+
+// zeroWriter is an output that can write zero runs without writing each zero
+type zeroWriter interface {
+	io.Writer
+	WriteZeros(n int64) error
+}
+
+// sparseOutput writes the output file sequentially, seeking over long zero runs so they become holes.
+// Everything written, zeros included, is also added to hash if it is set
+type sparseOutput struct {
+	file   *os.File
+	output *bufio.Writer
+	hash   hash.Hash
+}
+
+func newSparseOutput(f *os.File, h hash.Hash) *sparseOutput {
+	return &sparseOutput{file: f, output: bufio.NewWriter(f), hash: h}
+}
+
+func (o *sparseOutput) Write(p []byte) (int, error) {
+	if o.hash != nil {
+		o.hash.Write(p)
+	}
+	return o.output.Write(p)
+}
+
+func (o *sparseOutput) WriteZeros(n int64) error {
+	if n < minHoleSize {
+		return writeZeros(o, n)
+	}
+	if o.hash != nil {
+		if err := writeZeros(o.hash, n); err != nil {
+			return err
+		}
+	}
+	err := o.output.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = o.file.Seek(n, io.SeekCurrent)
+	return err
+}
+
+// ReadOutputAt reads back data already written. The zero runs seeked over at the end of the file
+// are not in the file yet
+func (o *sparseOutput) ReadOutputAt(p []byte, offset int64) error {
+	err := o.output.Flush()
+	if err != nil {
+		return err
+	}
+	n, err := o.file.ReadAt(p, offset)
+	if err == io.EOF {
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
+// Flush writes the buffered data and sets the size of the file, which does not grow when seeking
+// over a zero run at its end
+func (o *sparseOutput) Flush() error {
+	err := o.output.Flush()
+	if err != nil {
+		return err
+	}
+	size, err := o.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return o.file.Truncate(size)
+}
+
+var zeros = make([]byte, 32<<10)
+
+// writeZeros writes n zeros to an output that cannot skip them
+func writeZeros(output io.Writer, n int64) error {
+	for n > 0 {
+		length := min64(n, int64(len(zeros)))
+		if _, err := output.Write(zeros[:length]); err != nil {
+			return err
+		}
+		n -= length
+	}
+	return nil
+}
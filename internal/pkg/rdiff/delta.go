@@ -0,0 +1,257 @@
+package rdiff
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Commands of librsync deltas, followed by their big endian parameters
+const (
+	opEnd = 0x00
+	// opLiteral1 to opLiteral64 are followed by that many bytes of new data
+	opLiteral1  = 0x01
+	opLiteral64 = 0x40
+	// opLiteralN1 to opLiteralN8 are followed by the length of the new data, on 1, 2, 4 or 8 bytes
+	opLiteralN1 = 0x41
+	opLiteralN8 = 0x44
+	// opCopyN1N1 to opCopyN8N8 are followed by the offset in the basis file and the length of the copy,
+	// each on 1, 2, 4 or 8 bytes
+	opCopyN1N1 = 0x45
+	opCopyN8N8 = 0x54
+)
+
+// Literals longer than this are written as several commands, so the new data is never buffered whole
+const maxLiteral = 1 << 20
+
+// The new file is read by this size at least
+const readSize = 64 << 10
+
+// commandWriter writes the commands of a librsync delta, merging the copies that follow each other
+type commandWriter struct {
+	out          *bufio.Writer
+	copyOffset   int64
+	copyLength   int64
+	pendingCopy  bool
+	commandBytes []byte
+}
+
+func (w *commandWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := w.flushCopy(); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		if n <= opLiteral64 {
+			w.commandBytes = append(w.commandBytes[:0], byte(opLiteral1-1+n))
+		} else {
+			w.commandBytes = appendParameter(append(w.commandBytes[:0], 0), opLiteralN1, uint64(n))
+		}
+		if _, err := w.out.Write(w.commandBytes); err != nil {
+			return err
+		}
+		if _, err := w.out.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (w *commandWriter) copy(offset int64, length int64) error {
+	if w.pendingCopy && w.copyOffset+w.copyLength == offset {
+		w.copyLength += length
+		return nil
+	}
+	if err := w.flushCopy(); err != nil {
+		return err
+	}
+	w.copyOffset, w.copyLength, w.pendingCopy = offset, length, true
+	return nil
+}
+
+func (w *commandWriter) flushCopy() error {
+	if !w.pendingCopy {
+		return nil
+	}
+	w.pendingCopy = false
+	command := appendParameter(append(w.commandBytes[:0], 0), opCopyN1N1, uint64(w.copyOffset))
+	// The width of the length is added to the command of the width of the offset
+	lengthWidth := intWidth(uint64(w.copyLength))
+	command[0] += byte(widthIndex(lengthWidth))
+	command = appendInt(command, uint64(w.copyLength), lengthWidth)
+	w.commandBytes = command
+	_, err := w.out.Write(command)
+	return err
+}
+
+func (w *commandWriter) end() error {
+	if err := w.flushCopy(); err != nil {
+		return err
+	}
+	if err := w.out.WriteByte(opEnd); err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
+
+// appendParameter sets the command, the first byte of b, to base plus the width of the value, and appends
+// the value. For copies the width of the offset counts 4 times the width of the length
+func appendParameter(b []byte, base byte, value uint64) []byte {
+	width := intWidth(value)
+	if base == opCopyN1N1 {
+		b[0] = base + byte(4*widthIndex(width))
+	} else {
+		b[0] = base + byte(widthIndex(width))
+	}
+	return appendInt(b, value, width)
+}
+
+// intWidth returns the smallest of 1, 2, 4 or 8 bytes holding the value
+func intWidth(value uint64) int {
+	switch {
+	case value <= 0xff:
+		return 1
+	case value <= 0xffff:
+		return 2
+	case value <= 0xffffffff:
+		return 4
+	}
+	return 8
+}
+
+func widthIndex(width int) int {
+	switch width {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	case 4:
+		return 2
+	}
+	return 3
+}
+
+func appendInt(b []byte, value uint64, width int) []byte {
+	for i := width - 1; i >= 0; i-- {
+		b = append(b, byte(value>>(8*i)))
+	}
+	return b
+}
+
+// WriteDelta writes the librsync delta of the new file against the signature to output. The blocks of the
+// signature are found at any offset of the new file with their rolling checksum
+func WriteDelta(sig *Signature, newFile io.Reader, output io.Writer) error {
+	w := &commandWriter{out: bufio.NewWriter(output)}
+	if _, err := w.out.Write(appendUint32(nil, uint32(DeltaMagic))); err != nil {
+		return err
+	}
+
+	blocks := make(map[uint32][]int, len(sig.blocks))
+	for i, b := range sig.blocks {
+		blocks[b.weak] = append(blocks[b.weak], i)
+	}
+	blockLen := int(sig.BlockLen)
+	weak := sig.Magic.weakSum()
+	strong := sig.Magic.strongSum()
+	sum := make([]byte, 0, strong.Size())
+
+	// match returns the block with the data of the window, preferring the one after the last copy
+	match := func(window []byte) int {
+		candidates := blocks[weak.digest()]
+		if len(candidates) == 0 {
+			return -1
+		}
+		strong.Reset()
+		strong.Write(window)
+		sum = strong.Sum(sum[:0])[:sig.StrongLen]
+		found := -1
+		for _, i := range candidates {
+			if !bytes.Equal(sig.blocks[i].strong, sum) {
+				continue
+			}
+			if w.pendingCopy && int64(i)*int64(blockLen) == w.copyOffset+w.copyLength {
+				return i
+			}
+			if found < 0 {
+				found = i
+			}
+		}
+		return found
+	}
+
+	// The data is read in a buffer holding more than a block after the current position, until the end
+	buf := make([]byte, 0, 2*blockLen+readSize)
+	p, literal := 0, 0
+	eof := false
+	valid := false // the weak sum is the one of the window at p
+	window := 0
+	for {
+		if !eof && len(buf)-p <= blockLen {
+			if err := w.literal(buf[literal:p]); err != nil {
+				return err
+			}
+			n := copy(buf[:cap(buf)], buf[p:])
+			buf = buf[:n]
+			p, literal = 0, 0
+			for len(buf) < cap(buf) && !eof {
+				read, err := newFile.Read(buf[len(buf):cap(buf)])
+				buf = buf[:len(buf)+read]
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		if p == len(buf) {
+			break
+		}
+
+		if !valid {
+			window = blockLen
+			if len(buf)-p < window {
+				window = len(buf) - p
+			}
+			weak.reset(buf[p : p+window])
+			valid = true
+		}
+		if i := match(buf[p : p+window]); i >= 0 {
+			if err := w.literal(buf[literal:p]); err != nil {
+				return err
+			}
+			if err := w.copy(int64(i)*int64(blockLen), int64(window)); err != nil {
+				return err
+			}
+			p += window
+			literal = p
+			valid = false
+			continue
+		}
+
+		// The window shrinks at the end of the data, for the last block of the basis file
+		if p+window < len(buf) {
+			weak.rotate(buf[p], buf[p+window])
+		} else {
+			weak.rollout(buf[p])
+			window--
+		}
+		p++
+		if p-literal == maxLiteral {
+			if err := w.literal(buf[literal:p]); err != nil {
+				return err
+			}
+			literal = p
+		}
+	}
+	if err := w.literal(buf[literal:p]); err != nil {
+		return err
+	}
+	return w.end()
+}
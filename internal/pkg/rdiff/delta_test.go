@@ -0,0 +1,86 @@
+package rdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeakSums(t *testing.T) {
+	data := make([]byte, 300)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, sum := range []weakSum{&rollSum{}, &rabinKarp{}} {
+		rolled := sum
+		rolled.reset(data[:100])
+		for p := 1; p+100 <= len(data); p++ {
+			rolled.rotate(data[p-1], data[p+99])
+		}
+		// The window at the end shrinks down to the last byte
+		for p := len(data) - 100; p < len(data)-1; p++ {
+			rolled.rollout(data[p])
+		}
+		digest := rolled.digest()
+		rolled.reset(data[len(data)-1:])
+		assert.Equal(t, rolled.digest(), digest)
+	}
+}
+
+func TestWriteDelta(t *testing.T) {
+	basis := readTestFile(t, "basis.txt")
+	newData := readTestFile(t, "new.txt")
+	for _, name := range []string{"basis.blake2.sig", "basis.rabinkarp.sig"} {
+		t.Run(name, func(t *testing.T) {
+			sig, err := ParseSignature(bytes.NewReader(readTestFile(t, name)), s.DefaultLimits)
+			assert.Nil(t, err)
+			delta := new(bytes.Buffer)
+			assert.Nil(t, WriteDelta(sig, bytes.NewReader(newData), delta))
+
+			// The blocks are found at the offsets they were moved to
+			assert.Less(t, delta.Len(), 1200)
+			output := new(bytes.Buffer)
+			assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), delta, output))
+			assert.Equal(t, newData, output.Bytes())
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	basis := make([]byte, 200000)
+	r.Read(basis)
+	testCases := []struct {
+		name    string
+		newData []byte
+		magic   Magic
+	}{
+		{name: "Empty", newData: nil, magic: MD4Magic},
+		{name: "Same", newData: basis, magic: Blake2Magic},
+		{name: "Shifted", newData: append([]byte("prefix"), basis...), magic: RabinKarpMD4Magic},
+		{name: "Last block", newData: append(append([]byte{}, basis[:1000]...), basis[len(basis)-100:]...),
+			magic: RabinKarpBlake2Magic},
+		{name: "Long literal", newData: append(make([]byte, 3<<20), basis[:5000]...), magic: Blake2Magic},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := SignatureOptions{Magic: tc.magic, ChunkSize: s.FixedChunkSizePolicy(1024)}
+			sig := new(bytes.Buffer)
+			assert.Nil(t, WriteSignature(bytes.NewReader(basis), int64(len(basis)), sig, options))
+			parsed, err := ParseSignature(sig, s.DefaultLimits)
+			assert.Nil(t, err)
+
+			delta := new(bytes.Buffer)
+			assert.Nil(t, WriteDelta(parsed, bytes.NewReader(tc.newData), delta))
+			if tc.name == "Same" {
+				// A single copy of the whole basis file
+				assert.Equal(t, []byte{0x72, 0x73, 0x02, 0x36, 0x47, 0, 0, 3, 0x0d, 0x40, 0}, delta.Bytes())
+			}
+			output := new(bytes.Buffer)
+			assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), delta, output))
+			assert.Equal(t, len(tc.newData), output.Len())
+			assert.True(t, bytes.Equal(tc.newData, output.Bytes()))
+		})
+	}
+}
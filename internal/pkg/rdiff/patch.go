@@ -0,0 +1,116 @@
+package rdiff
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// Basis data is copied to the output in pieces of this size at most
+const copyBufferSize = 64 << 10
+
+// Apply writes the new file rebuilt from the basis file of the given size and the librsync delta to output
+func Apply(basis io.ReaderAt, basisSize int64, delta io.Reader, output io.Writer) error {
+	r := &commandReader{input: bufio.NewReader(delta), index: -1}
+	magic, err := r.readInt(4)
+	if err != nil {
+		return err
+	}
+	if Magic(magic) != DeltaMagic {
+		return r.parseError(fmt.Errorf("%w: not a librsync delta", d.ErrInvalidDelta))
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		command, err := r.input.ReadByte()
+		if err != nil {
+			return r.readError(err)
+		}
+		r.offset++
+		r.index++
+
+		switch {
+		case command == opEnd:
+			return nil
+		case command >= opLiteral1 && command <= opLiteral64 || command >= opLiteralN1 && command <= opLiteralN8:
+			length := uint64(command - opLiteral1 + 1)
+			if command >= opLiteralN1 {
+				if length, err = r.readInt(1 << (command - opLiteralN1)); err != nil {
+					return err
+				}
+			}
+			if length > math.MaxInt64 {
+				return r.parseError(fmt.Errorf("%w: literal of %d bytes out of range", d.ErrInvalidDelta, length))
+			}
+			n, err := io.CopyN(output, r.input, int64(length))
+			r.offset += n
+			if err != nil {
+				return r.readError(err)
+			}
+		case command >= opCopyN1N1 && command <= opCopyN8N8:
+			offset, err := r.readInt(1 << ((command - opCopyN1N1) / 4))
+			if err != nil {
+				return err
+			}
+			length, err := r.readInt(1 << ((command - opCopyN1N1) % 4))
+			if err != nil {
+				return err
+			}
+			if offset > uint64(basisSize) || length > uint64(basisSize)-offset {
+				return fmt.Errorf("%w: copy of %d bytes at offset %d of a %d bytes basis file", patch.ErrBasisMismatch,
+					length, offset, basisSize)
+			}
+			for length > 0 {
+				n := uint64(len(buf))
+				if length < n {
+					n = length
+				}
+				if _, err = basis.ReadAt(buf[:n], int64(offset)); err != nil {
+					return err
+				}
+				if _, err = output.Write(buf[:n]); err != nil {
+					return err
+				}
+				offset += n
+				length -= n
+			}
+		default:
+			return r.parseError(fmt.Errorf("%w: unknown command %#x", d.ErrInvalidDelta, command))
+		}
+	}
+}
+
+// commandReader reads the commands of a librsync delta, keeping track of where it is for the errors
+type commandReader struct {
+	input  *bufio.Reader
+	offset int64
+	index  int
+}
+
+// readInt reads a big endian integer on width bytes
+func (r *commandReader) readInt(width int) (uint64, error) {
+	var b [8]byte
+	n, err := io.ReadFull(r.input, b[8-width:])
+	r.offset += int64(n)
+	if err != nil {
+		return 0, r.readError(err)
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func (r *commandReader) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: librsync delta without end command", s.ErrTruncated)
+	}
+	return r.parseError(err)
+}
+
+func (r *commandReader) parseError(err error) error {
+	return &s.ParseError{Offset: r.offset, ChunkIndex: r.index, Err: err}
+}
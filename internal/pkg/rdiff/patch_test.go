@@ -0,0 +1,40 @@
+package rdiff
+
+import (
+	"bytes"
+	"testing"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	basis := readTestFile(t, "basis.txt")
+	delta := readTestFile(t, "new.delta")
+	buf := new(bytes.Buffer)
+	assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), bytes.NewReader(delta), buf))
+	assert.Equal(t, readTestFile(t, "new.txt"), buf.Bytes())
+
+	testCases := []struct {
+		name  string
+		basis []byte
+		delta []byte
+		err   error
+	}{
+		{name: "Without end", basis: basis, delta: delta[:len(delta)-1], err: s.ErrTruncated},
+		{name: "Truncated literal", basis: basis, delta: delta[:len(delta)-10], err: s.ErrTruncated},
+		{name: "Signature", basis: basis, delta: readTestFile(t, "basis.blake2.sig"), err: d.ErrInvalidDelta},
+		{name: "Unknown command", basis: basis, delta: []byte("\x72\x73\x02\x36\x55"), err: d.ErrInvalidDelta},
+		{name: "Literal out of range", basis: basis,
+			delta: []byte("\x72\x73\x02\x36\x44\x80\x00\x00\x00\x00\x00\x00\x00\x00"), err: d.ErrInvalidDelta},
+		{name: "Shorter basis", basis: basis[:1000], delta: delta, err: patch.ErrBasisMismatch},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Apply(bytes.NewReader(tc.basis), int64(len(tc.basis)), bytes.NewReader(tc.delta), new(bytes.Buffer))
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
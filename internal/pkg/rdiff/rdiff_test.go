@@ -0,0 +1,72 @@
+package rdiff
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRdiff checks the files of this package against rdiff of librsync 2.3, when it is installed. From
+// this directory, the signatures must be those of
+//
+//	rdiff signature -b 512 -S 8 -H blake2 -R rollsum testdata/basis.txt testdata/basis.blake2.sig
+//	rdiff signature -b 512 -S 32 -H blake2 -R rabinkarp testdata/basis.txt testdata/basis.rabinkarp.sig
+//
+// the delta of rdiff delta testdata/basis.blake2.sig testdata/new.txt must rebuild new.txt with Apply,
+// and rdiff patch testdata/basis.txt must accept the delta WriteDelta writes
+func TestRdiff(t *testing.T) {
+	rdiff, err := exec.LookPath("rdiff")
+	if err != nil {
+		t.Skip("rdiff is not installed")
+	}
+	dir := t.TempDir()
+	basisFile := filepath.Join("testdata", "basis.txt")
+	newFile := filepath.Join("testdata", "new.txt")
+	basis := readTestFile(t, "basis.txt")
+	newData := readTestFile(t, "new.txt")
+	run := func(args ...string) {
+		output, err := exec.Command(rdiff, args...).CombinedOutput()
+		assert.Nil(t, err, string(output))
+	}
+
+	signatures := map[string][]string{
+		"basis.blake2.sig":    {"-b", "512", "-S", "8", "-H", "blake2", "-R", "rollsum"},
+		"basis.rabinkarp.sig": {"-b", "512", "-S", "32", "-H", "blake2", "-R", "rabinkarp"},
+	}
+	for name, options := range signatures {
+		t.Run(name, func(t *testing.T) {
+			signatureFile := filepath.Join(dir, name)
+			run(append(append([]string{"signature"}, options...), basisFile, signatureFile)...)
+			signatureData, err := os.ReadFile(signatureFile)
+			assert.Nil(t, err)
+			assert.Equal(t, readTestFile(t, name), signatureData)
+
+			// A delta of rdiff is applied by Apply
+			deltaFile := filepath.Join(dir, name+".delta")
+			run("delta", signatureFile, newFile, deltaFile)
+			deltaData, err := os.ReadFile(deltaFile)
+			assert.Nil(t, err)
+			output := new(bytes.Buffer)
+			assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), bytes.NewReader(deltaData), output))
+			assert.Equal(t, newData, output.Bytes())
+
+			// A delta of WriteDelta is applied by rdiff patch
+			sig, err := ParseSignature(bytes.NewReader(signatureData), s.DefaultLimits)
+			assert.Nil(t, err)
+			delta := new(bytes.Buffer)
+			assert.Nil(t, WriteDelta(sig, bytes.NewReader(newData), delta))
+			deltaFile = filepath.Join(dir, name+".ours.delta")
+			assert.Nil(t, os.WriteFile(deltaFile, delta.Bytes(), 0644))
+			outputFile := filepath.Join(dir, name+".new")
+			run("patch", basisFile, deltaFile, outputFile)
+			patched, err := os.ReadFile(outputFile)
+			assert.Nil(t, err)
+			assert.Equal(t, newData, patched)
+		})
+	}
+}
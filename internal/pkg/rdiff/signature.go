@@ -0,0 +1,184 @@
+package rdiff
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// Magic is the first 4 bytes of librsync files, big endian. For signatures it names the checksums
+type Magic uint32
+
+const (
+	MD4Magic             Magic = 0x72730136 // rollsum and MD4, written by librsync before 1.0
+	Blake2Magic          Magic = 0x72730137 // rollsum and BLAKE2b
+	RabinKarpMD4Magic    Magic = 0x72730146 // RabinKarp and MD4
+	RabinKarpBlake2Magic Magic = 0x72730147 // RabinKarp and BLAKE2b, the default of librsync 2.2 and later
+	DeltaMagic           Magic = 0x72730236
+)
+
+// IsSignature tells if the data starts like a librsync signature
+func IsSignature(prefix []byte) bool {
+	return len(prefix) >= 4 && Magic(binary.BigEndian.Uint32(prefix)).isSignature()
+}
+
+func (m Magic) isSignature() bool {
+	switch m {
+	case MD4Magic, Blake2Magic, RabinKarpMD4Magic, RabinKarpBlake2Magic:
+		return true
+	}
+	return false
+}
+
+// IsDelta tells if the data starts like a librsync delta
+func IsDelta(prefix []byte) bool {
+	return len(prefix) >= 4 && Magic(binary.BigEndian.Uint32(prefix)) == DeltaMagic
+}
+
+// SignatureOptions controls how librsync signatures are written. The zero value writes BLAKE2b signatures,
+// which librsync 1.0 and later can read, with the block length of the default chunk size policy
+type SignatureOptions struct {
+	Magic     Magic
+	ChunkSize s.ChunkSizePolicy
+	// StrongLen truncates the strong sums, which are written whole if 0
+	StrongLen uint32
+}
+
+// block is the checksums of a block of the basis file
+type block struct {
+	weak   uint32
+	strong []byte
+}
+
+// Signature is a parsed librsync signature
+type Signature struct {
+	Magic     Magic
+	BlockLen  uint32
+	StrongLen uint32
+	blocks    []block
+}
+
+// header is <magic><block length><strong sum length>, big endian
+const headerSize = 12
+
+// WriteSignature writes the librsync signature of the input of the given size to output
+func WriteSignature(input io.Reader, inputSize int64, output io.Writer, options SignatureOptions) error {
+	magic := options.Magic
+	if magic == 0 {
+		magic = Blake2Magic
+	}
+	if !magic.isSignature() {
+		return fmt.Errorf("%w: magic %#x", s.ErrUnsupportedVersion, uint32(magic))
+	}
+	policy := options.ChunkSize
+	if policy == nil {
+		policy = s.DefaultChunkSizePolicy
+	}
+	blockLen := policy.ChunkSize(inputSize)
+	if err := s.ValidateChunkSize(blockLen); err != nil {
+		return err
+	}
+	strongLen := options.StrongLen
+	if strongLen == 0 || strongLen > magic.maxStrongLen() {
+		strongLen = magic.maxStrongLen()
+	}
+
+	out := bufio.NewWriter(output)
+	header := make([]byte, 0, headerSize)
+	header = appendUint32(header, uint32(magic))
+	header = appendUint32(header, uint32(blockLen))
+	header = appendUint32(header, strongLen)
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	weak := magic.weakSum()
+	strong := magic.strongSum()
+	buf := make([]byte, blockLen)
+	sums := make([]byte, 0, 4+strong.Size())
+	for {
+		n, err := io.ReadFull(input, buf)
+		if n > 0 {
+			weak.reset(buf[:n])
+			strong.Reset()
+			strong.Write(buf[:n])
+			sums = appendUint32(sums[:0], weak.digest())
+			sums = strong.Sum(sums)
+			if _, err := out.Write(sums[:4+strongLen]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// ParseSignature reads a librsync signature within the limits
+func ParseSignature(input io.Reader, limits s.Limits) (*Signature, error) {
+	r := bufio.NewReader(input)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, signatureError(0, -1, err)
+	}
+	if !IsSignature(header) {
+		return nil, signatureError(0, -1, fmt.Errorf("%w: not a librsync signature", s.ErrInvalidSignature))
+	}
+	sig := &Signature{
+		Magic:     Magic(binary.BigEndian.Uint32(header)),
+		BlockLen:  binary.BigEndian.Uint32(header[4:]),
+		StrongLen: binary.BigEndian.Uint32(header[8:]),
+	}
+	if sig.BlockLen == 0 {
+		return nil, signatureError(4, -1, fmt.Errorf("%w: block length 0", s.ErrInvalidSignature))
+	}
+	if sig.BlockLen > limits.MaxChunkSize {
+		return nil, signatureError(4, -1, fmt.Errorf("%w: block length %d larger than %d", s.ErrLimitExceeded,
+			sig.BlockLen, limits.MaxChunkSize))
+	}
+	if sig.StrongLen == 0 || sig.StrongLen > sig.Magic.maxStrongLen() {
+		return nil, signatureError(8, -1, fmt.Errorf("%w: strong sum length %d", s.ErrInvalidSignature, sig.StrongLen))
+	}
+
+	blockSize := int64(4 + sig.StrongLen)
+	offset := int64(headerSize)
+	for {
+		sums := make([]byte, blockSize)
+		n, err := io.ReadFull(r, sums)
+		if err == io.EOF {
+			return sig, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, signatureError(offset+int64(n), len(sig.blocks), fmt.Errorf("%w: partial block sums",
+				s.ErrTruncated))
+		}
+		if err != nil {
+			return nil, signatureError(offset, len(sig.blocks), err)
+		}
+		if uint32(len(sig.blocks)) >= limits.MaxChunkCount ||
+			int64(len(sig.blocks)+1)*(blockSize+24) > limits.MaxMemory {
+			return nil, signatureError(offset, len(sig.blocks), fmt.Errorf("%w: more than %d blocks",
+				s.ErrLimitExceeded, len(sig.blocks)))
+		}
+		sig.blocks = append(sig.blocks, block{weak: binary.BigEndian.Uint32(sums), strong: sums[4:]})
+		offset += blockSize
+	}
+}
+
+func signatureError(offset int64, index int, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: librsync signature header", s.ErrTruncated)
+	}
+	return &s.ParseError{Offset: offset, ChunkIndex: index, Err: err}
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
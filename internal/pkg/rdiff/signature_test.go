@@ -0,0 +1,87 @@
+package rdiff
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+// The golden files of testdata were assembled from the description of the librsync formats, and TestRdiff
+// checks them against the output of rdiff where it is installed: basis.blake2.sig is what
+// rdiff signature -b 512 -S 8 -H blake2 -R rollsum testdata/basis.txt writes, and basis.rabinkarp.sig what
+// rdiff signature -b 512 -S 32 -H blake2 -R rabinkarp testdata/basis.txt writes. new.delta rebuilds
+// new.txt from basis.txt with every width of commands, which rdiff delta does not produce for so small files
+func readTestFile(t *testing.T, name string) []byte {
+	data, err := os.ReadFile("testdata/" + name)
+	assert.Nil(t, err)
+	return data
+}
+
+func TestWriteSignature(t *testing.T) {
+	basis := readTestFile(t, "basis.txt")
+	testCases := []struct {
+		name     string
+		options  SignatureOptions
+		expected string
+	}{
+		{
+			name:     "BLAKE2b with truncated sums",
+			options:  SignatureOptions{Magic: Blake2Magic, ChunkSize: s.FixedChunkSizePolicy(512), StrongLen: 8},
+			expected: "basis.blake2.sig",
+		},
+		{
+			name:     "RabinKarp",
+			options:  SignatureOptions{Magic: RabinKarpBlake2Magic, ChunkSize: s.FixedChunkSizePolicy(512)},
+			expected: "basis.rabinkarp.sig",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			assert.Nil(t, WriteSignature(bytes.NewReader(basis), int64(len(basis)), buf, tc.options))
+			assert.Equal(t, readTestFile(t, tc.expected), buf.Bytes())
+		})
+	}
+
+	options := SignatureOptions{Magic: DeltaMagic}
+	err := WriteSignature(bytes.NewReader(basis), int64(len(basis)), new(bytes.Buffer), options)
+	assert.ErrorIs(t, err, s.ErrUnsupportedVersion)
+}
+
+func TestParseSignature(t *testing.T) {
+	sig, err := ParseSignature(bytes.NewReader(readTestFile(t, "basis.blake2.sig")), s.DefaultLimits)
+	assert.Nil(t, err)
+	assert.Equal(t, Blake2Magic, sig.Magic)
+	assert.Equal(t, uint32(512), sig.BlockLen)
+	assert.Equal(t, uint32(8), sig.StrongLen)
+	assert.Len(t, sig.blocks, 6)
+
+	valid := readTestFile(t, "basis.rabinkarp.sig")
+	testCases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{name: "Empty", data: nil, err: s.ErrTruncated},
+		{name: "Delta", data: readTestFile(t, "new.delta"), err: s.ErrInvalidSignature},
+		{name: "Block length 0", data: append(append([]byte{}, valid[:4]...), 0, 0, 0, 0, 0, 0, 0, 32),
+			err: s.ErrInvalidSignature},
+		{name: "Strong sums longer than the hash", data: append(append([]byte{}, valid[:8]...), 0, 0, 0, 33),
+			err: s.ErrInvalidSignature},
+		{name: "Partial block", data: valid[:len(valid)-1], err: s.ErrTruncated},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseSignature(bytes.NewReader(tc.data), s.DefaultLimits)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	limits := s.DefaultLimits
+	limits.MaxChunkCount = 5
+	_, err = ParseSignature(bytes.NewReader(valid), limits)
+	assert.ErrorIs(t, err, s.ErrLimitExceeded)
+}
@@ -0,0 +1,110 @@
+package rdiff
+
+import (
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+// weakSum is the rolling checksum of the blocks of a signature, moved one byte forward without
+// reading the whole block again
+type weakSum interface {
+	reset(block []byte)
+	rotate(out byte, in byte)
+	// rollout removes the first byte of the block, at the end of the data
+	rollout(out byte)
+	digest() uint32
+}
+
+// rollSum is the checksum of rsync, with an offset added to every byte
+type rollSum struct {
+	count  uint32
+	s1, s2 uint32
+}
+
+const rollSumCharOffset = 31
+
+func (r *rollSum) reset(block []byte) {
+	r.count, r.s1, r.s2 = uint32(len(block)), 0, 0
+	for _, c := range block {
+		r.s1 += uint32(c) + rollSumCharOffset
+		r.s2 += r.s1
+	}
+}
+
+func (r *rollSum) rotate(out byte, in byte) {
+	r.s1 += uint32(in) - uint32(out)
+	r.s2 += r.s1 - r.count*(uint32(out)+rollSumCharOffset)
+}
+
+func (r *rollSum) rollout(out byte) {
+	r.s1 -= uint32(out) + rollSumCharOffset
+	r.s2 -= r.count * (uint32(out) + rollSumCharOffset)
+	r.count--
+}
+
+func (r *rollSum) digest() uint32 {
+	return r.s2<<16 | r.s1&0xffff
+}
+
+// rabinKarp is the polynomial checksum of the signatures of librsync 2.2 and later
+type rabinKarp struct {
+	hash uint32
+	mult uint32 // rabinKarpMult to the power of the block length
+}
+
+const (
+	rabinKarpSeed = 1
+	rabinKarpMult = 0x08104225
+	// rabinKarpAdjust rolls the seed out with the byte leaving the block, (rabinKarpMult - 1) * rabinKarpSeed
+	rabinKarpAdjust = 0x08104224
+	// rabinKarpInverse is the inverse of rabinKarpMult modulo 2^32, rabinKarpMult * rabinKarpInverse == 1
+	rabinKarpInverse = 0x98f009ad
+)
+
+func (r *rabinKarp) reset(block []byte) {
+	r.hash, r.mult = rabinKarpSeed, 1
+	for _, c := range block {
+		r.hash = r.hash*rabinKarpMult + uint32(c)
+		r.mult *= rabinKarpMult
+	}
+}
+
+func (r *rabinKarp) rotate(out byte, in byte) {
+	r.hash = r.hash*rabinKarpMult + uint32(in) - r.mult*(uint32(out)+rabinKarpAdjust)
+}
+
+func (r *rabinKarp) rollout(out byte) {
+	r.mult *= rabinKarpInverse
+	r.hash -= r.mult * (uint32(out) + rabinKarpAdjust)
+}
+
+func (r *rabinKarp) digest() uint32 {
+	return r.hash
+}
+
+func (m Magic) weakSum() weakSum {
+	if m == RabinKarpMD4Magic || m == RabinKarpBlake2Magic {
+		return &rabinKarp{}
+	}
+	return &rollSum{}
+}
+
+// strongSum returns the hash of the blocks, whose sums are truncated to the strong sum length
+func (m Magic) strongSum() hash.Hash {
+	if m == MD4Magic || m == RabinKarpMD4Magic {
+		return md4.New()
+	}
+	// The sums of librsync are unkeyed BLAKE2b of 32 bytes
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// maxStrongLen returns the length of the full strong sums
+func (m Magic) maxStrongLen() uint32 {
+	if m == MD4Magic || m == RabinKarpMD4Magic {
+		return md4.Size
+	}
+	return blake2b.Size256
+}
@@ -0,0 +1,77 @@
+package signature
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	MinChunkSize = 32
+	MaxChunkSize = 256 << 20
+
+	sqrtMinChunkSize = 700
+	sqrtMaxChunkSize = 128 << 10
+)
+
+// ChunkSizePolicy chooses the chunk size used to sign a file of the given size
+type ChunkSizePolicy interface {
+	ChunkSize(fileSize int64) int
+}
+
+// ChunkSizePolicyFunc adapts a function to the ChunkSizePolicy interface
+type ChunkSizePolicyFunc func(fileSize int64) int
+
+func (f ChunkSizePolicyFunc) ChunkSize(fileSize int64) int {
+	return f(fileSize)
+}
+
+// DefaultChunkSizePolicy picks the chunk size from a fixed table of file size ranges
+var DefaultChunkSizePolicy ChunkSizePolicy = ChunkSizePolicyFunc(computeChunkSize)
+
+// FixedChunkSizePolicy uses the same chunk size whatever the file size
+func FixedChunkSizePolicy(chunkSize int) ChunkSizePolicy {
+	return ChunkSizePolicyFunc(func(int64) int {
+		return chunkSize
+	})
+}
+
+// SqrtChunkSizePolicy uses the square root of the file size, like rsync does: rounded to a
+// multiple of 8 and kept between 700 bytes and 128k
+func SqrtChunkSizePolicy() ChunkSizePolicy {
+	return ChunkSizePolicyFunc(func(fileSize int64) int {
+		chunkSize := int(math.Sqrt(float64(fileSize))) &^ 7
+		if chunkSize < sqrtMinChunkSize {
+			chunkSize = sqrtMinChunkSize
+		}
+		if chunkSize > sqrtMaxChunkSize {
+			chunkSize = sqrtMaxChunkSize
+		}
+		return chunkSize
+	})
+}
+
+// TargetSignatureSizePolicy picks the smallest chunk size that keeps the signature file
+// within signatureSize bytes
+func TargetSignatureSizePolicy(signatureSize int64) ChunkSizePolicy {
+	return ChunkSizePolicyFunc(func(fileSize int64) int {
+		maxChunkCount := (signatureSize - metadataSize) / checksumSize
+		if maxChunkCount < 1 {
+			return MaxChunkSize
+		}
+		chunkSize := (fileSize + maxChunkCount - 1) / maxChunkCount
+		if chunkSize < MinChunkSize {
+			return MinChunkSize
+		}
+		if chunkSize > MaxChunkSize {
+			return MaxChunkSize
+		}
+		return int(chunkSize)
+	})
+}
+
+func ValidateChunkSize(chunkSize int) error {
+	if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+		return fmt.Errorf("%w: %d out of range [%d, %d]", ErrInvalidChunkSize, chunkSize, MinChunkSize, MaxChunkSize)
+	}
+	return nil
+}
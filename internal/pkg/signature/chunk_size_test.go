@@ -0,0 +1,85 @@
+package signature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkSizePolicies(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         ChunkSizePolicy
+		fileSize       int64
+		expectedResult int
+	}{
+		{
+			name:           "Default policy",
+			policy:         DefaultChunkSizePolicy,
+			fileSize:       7 << 20,
+			expectedResult: 4 << 10,
+		},
+		{
+			name:           "Fixed chunk size",
+			policy:         FixedChunkSizePolicy(1000),
+			fileSize:       7 << 20,
+			expectedResult: 1000,
+		},
+		{
+			name:           "Square root of the file size",
+			policy:         SqrtChunkSizePolicy(),
+			fileSize:       100 << 20,
+			expectedResult: 10240,
+		},
+		{
+			name:           "Square root of a small file",
+			policy:         SqrtChunkSizePolicy(),
+			fileSize:       1 << 10,
+			expectedResult: 700,
+		},
+		{
+			name:           "Square root of a huge file",
+			policy:         SqrtChunkSizePolicy(),
+			fileSize:       1 << 40,
+			expectedResult: 128 << 10,
+		},
+		{
+			name:           "Target signature size",
+			policy:         TargetSignatureSizePolicy(8 + 32*100),
+			fileSize:       1 << 20,
+			expectedResult: 10486,
+		},
+		{
+			name:           "Target signature size of a small file",
+			policy:         TargetSignatureSizePolicy(8 + 32*100),
+			fileSize:       100,
+			expectedResult: MinChunkSize,
+		},
+		{
+			name:           "Target signature size smaller than the metadata",
+			policy:         TargetSignatureSizePolicy(4),
+			fileSize:       100,
+			expectedResult: MaxChunkSize,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedResult, tc.policy.ChunkSize(tc.fileSize))
+		})
+	}
+}
+
+func TestSignatureWithInvalidChunkSize(t *testing.T) {
+	_, err := GetSignatureWithOptions([]byte("tiny"), Options{ChunkSize: FixedChunkSizePolicy(16)})
+	assert.ErrorIs(t, err, ErrInvalidChunkSize)
+	assert.EqualError(t, err, "invalid chunk size: 16 out of range [32, 268435456]")
+}
+
+func TestSignatureWithChunkSizePolicy(t *testing.T) {
+	data := make([]byte, 100)
+	sig, err := GetSignatureWithOptions(data, Options{ChunkSize: FixedChunkSizePolicy(64)})
+	assert.Nil(t, err)
+	// metadata + 2 checksums
+	assert.Equal(t, 8+2*32, len(sig))
+}
@@ -0,0 +1,37 @@
+package signature
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signature file is malformed
+	ErrInvalidSignature = errors.New("invalid signature file")
+	// ErrTruncated is returned when a file ends before all the data announced by its metadata
+	ErrTruncated = errors.New("unexpected end of file")
+	// ErrLimitExceeded is returned when parsing a signature would need more resources than allowed
+	ErrLimitExceeded = errors.New("signature exceeds the parser limits")
+	// ErrInvalidChunkSize is returned for chunk sizes outside [MinChunkSize, MaxChunkSize]
+	ErrInvalidChunkSize = errors.New("invalid chunk size")
+	// ErrUnsupportedVersion is returned when a file is written in a format version this build cannot read
+	ErrUnsupportedVersion = errors.New("unsupported file format version")
+)
+
+// ParseError tells where a signature or a delta file could not be parsed
+type ParseError struct {
+	Offset     int64 // offset in the file, in bytes
+	ChunkIndex int   // index of the checksum or of the delta instruction, -1 for the metadata
+	Err        error
+}
+
+func (e *ParseError) Error() string {
+	if e.ChunkIndex < 0 {
+		return fmt.Sprintf("%v (metadata, offset %d)", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%v (chunk %d, offset %d)", e.Err, e.ChunkIndex, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
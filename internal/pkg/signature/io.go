@@ -1,35 +1,82 @@
-package signature
-
-import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/binary"
-	"io"
-)
-
-type signatureMetadata struct {
-	ChunkSize  uint32
-	ChunkCount uint32
-}
-
-func (md *signatureMetadata) write(output io.Writer) error {
-	return binary.Write(output, binary.LittleEndian, md)
-}
-
-func (md *signatureMetadata) read(input io.Reader) error {
-	return binary.Read(input, binary.LittleEndian, md)
-}
-
-func writeChecksum(chunk []byte, output io.Writer) error {
-	return binary.Write(output, binary.LittleEndian, sha256.Sum256(chunk))
-}
-
-func readChecksum(input io.Reader, sum []byte) error {
-	return binary.Read(input, binary.LittleEndian, sum)
-}
-
-func GetChecksum(chunk []byte) string {
-	buf := new(bytes.Buffer)
-	writeChecksum(chunk, buf)
-	return buf.String()
-}
+package signature
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/popescuag/RH/internal/pkg/metadata"
+)
+
+const (
+	metadataSize = 8
+	checksumSize = sha256.Size
+	// Set in the chunk size of signatures recording the metadata of the file, which follows the chunk count
+	// as its length and its comma separated fields
+	fileMetadataFlag = 1 << 30
+	// Metadata of the file longer than this is not accepted
+	maxFileMetadataSize = 1 << 20
+)
+
+type signatureMetadata struct {
+	ChunkSize  uint32
+	ChunkCount uint32
+}
+
+func (md *signatureMetadata) write(output io.Writer) error {
+	return binary.Write(output, binary.LittleEndian, md)
+}
+
+func (md *signatureMetadata) read(input io.Reader) error {
+	return binary.Read(input, binary.LittleEndian, md)
+}
+
+func writeFileMetadata(file *metadata.Metadata, output io.Writer) error {
+	fields := strings.Join(file.Fields(), ",")
+	if len(fields) > maxFileMetadataSize {
+		return fmt.Errorf("%w: metadata of the file longer than %d bytes", ErrLimitExceeded, maxFileMetadataSize)
+	}
+	if err := binary.Write(output, binary.LittleEndian, uint32(len(fields))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(output, fields)
+	return err
+}
+
+// readFileMetadata reads the metadata of the file and returns it with the number of bytes read
+func readFileMetadata(input io.Reader) (*metadata.Metadata, int64, error) {
+	var length uint32
+	if err := binary.Read(input, binary.LittleEndian, &length); err != nil {
+		return nil, 0, err
+	}
+	if length > maxFileMetadataSize {
+		return nil, 4, fmt.Errorf("%w: metadata of the file longer than %d bytes", ErrLimitExceeded,
+			maxFileMetadataSize)
+	}
+	fields := make([]byte, length)
+	if _, err := io.ReadFull(input, fields); err != nil {
+		return nil, 4, err
+	}
+	file, err := metadata.Parse(string(fields))
+	if err != nil {
+		return nil, 4, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return file, 4 + int64(length), nil
+}
+
+func writeChecksum(chunk []byte, output io.Writer) error {
+	return binary.Write(output, binary.LittleEndian, sha256.Sum256(chunk))
+}
+
+func readChecksum(input io.Reader, sum []byte) error {
+	return binary.Read(input, binary.LittleEndian, sum)
+}
+
+func GetChecksum(chunk []byte) string {
+	buf := new(bytes.Buffer)
+	writeChecksum(chunk, buf)
+	return buf.String()
+}
@@ -1,65 +1,179 @@
-package signature
-
-import (
-	"bufio"
-	"errors"
-	"io"
-	"os"
-)
-
-type SignatureData struct {
-	Metadata  signatureMetadata
-	Checksums []string
-}
-
-func ParseFromFile(signatureFile string) (SignatureData, error) {
-	f, err := os.Open(signatureFile)
-	signatureData := SignatureData{}
-	if err != nil {
-		return signatureData, err
-	}
-	defer f.Close()
-
-	input := io.NopCloser(bufio.NewReader(f))
-	signatureData, err = ParseFromReader(input)
-	return signatureData, err
-}
-
-func ParseFromReader(input io.ReadCloser) (SignatureData, error) {
-	md := signatureMetadata{}
-	signatureData := SignatureData{}
-	defer input.Close()
-
-	err := md.read(input)
-
-	if err != nil && err != io.EOF {
-		return SignatureData{}, err
-	}
-	if md.ChunkSize < 32 {
-		return signatureData, errors.New("invalid signature file metadata: chunkSize too small")
-	}
-	signatureData.Metadata.ChunkCount = md.ChunkCount
-	signatureData.Metadata.ChunkSize = md.ChunkSize
-
-	signatureData.Checksums = make([]string, signatureData.Metadata.ChunkCount)
-	chunksRead := 0
-	for i := 0; i < int(md.ChunkCount); i++ {
-		sum := make([]byte, 32)
-		err = readChecksum(input, sum)
-		if err == io.EOF {
-			break
-		}
-		if err != nil && err != io.EOF {
-			return SignatureData{}, err
-		}
-		signatureData.Checksums[i] = string(sum)
-		chunksRead++
-	}
-	if chunksRead < int(md.ChunkCount) {
-		return SignatureData{}, errors.New("invalid signature file: size too small")
-	}
-	if chunksRead > int(md.ChunkCount) {
-		return SignatureData{}, errors.New("invalid signature file: size too large")
-	}
-	return signatureData, nil
-}
+package signature
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/metadata"
+)
+
+type SignatureData struct {
+	Metadata  signatureMetadata
+	Checksums []string
+	// File is the metadata of the file the signature was computed from, nil when it was not recorded
+	File *metadata.Metadata
+}
+
+// Limits bounds the resources used to parse a signature, which may come from an untrusted source
+type Limits struct {
+	MaxChunkCount uint32
+	MaxChunkSize  uint32
+	MaxMemory     int64 // memory used by the parsed checksums, in bytes
+}
+
+// DefaultLimits accept the signatures of files up to 1TB with any chunk size chosen by
+// DefaultChunkSizePolicy, while keeping the parsed checksums under 1GB
+var DefaultLimits = Limits{
+	MaxChunkCount: 1 << 24,
+	MaxChunkSize:  MaxChunkSize,
+	MaxMemory:     1 << 30,
+}
+
+// Memory used by each parsed checksum: the string header and its data
+const parsedChecksumSize = 16 + checksumSize
+
+// Checksums are allocated in batches when the signature size is not known in advance,
+// so a forged chunk count cannot make the parser allocate more than what it actually reads
+const checksumBatch = 4096
+
+func ParseFromFile(signatureFile string) (SignatureData, error) {
+	return ParseFromFileWithLimits(signatureFile, DefaultLimits)
+}
+
+func ParseFromFileWithLimits(signatureFile string, limits Limits) (SignatureData, error) {
+	f, err := os.Open(signatureFile)
+	signatureData := SignatureData{}
+	if err != nil {
+		return signatureData, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return signatureData, err
+	}
+
+	input := io.NopCloser(bufio.NewReader(f))
+	signatureData, err = ParseFromReaderWithLimits(input, fi.Size(), limits)
+	return signatureData, err
+}
+
+func ParseFromReader(input io.ReadCloser) (SignatureData, error) {
+	return ParseFromReaderWithLimits(input, -1, DefaultLimits)
+}
+
+// ParseFromReaderWithLimits parses a signature of the given size in bytes, or of unknown size if
+// size is negative, refusing the ones that exceed the limits
+func ParseFromReaderWithLimits(input io.ReadCloser, size int64, limits Limits) (SignatureData, error) {
+	md := signatureMetadata{}
+	signatureData := SignatureData{}
+	defer input.Close()
+
+	decoded, c, err := codec.NewReader(input)
+	if err != nil {
+		return SignatureData{}, &ParseError{Offset: 0, ChunkIndex: -1, Err: err}
+	}
+	defer decoded.Close()
+	// The size of a compressed signature says nothing about the signature itself
+	if c != codec.None {
+		size = -1
+	}
+
+	err = md.read(decoded)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return SignatureData{}, &ParseError{Offset: 0, ChunkIndex: -1, Err: ErrTruncated}
+	}
+	if err != nil {
+		return SignatureData{}, &ParseError{Offset: 0, ChunkIndex: -1, Err: err}
+	}
+	headerSize := int64(metadataSize)
+	if md.ChunkSize&fileMetadataFlag != 0 {
+		md.ChunkSize &^= fileMetadataFlag
+		file, n, err := readFileMetadata(decoded)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: metadata of the file cut", ErrTruncated)
+		}
+		if err != nil {
+			return SignatureData{}, &ParseError{Offset: metadataSize + n, ChunkIndex: -1, Err: err}
+		}
+		signatureData.File = file
+		headerSize += n
+	}
+	err = checkMetadata(md, size, headerSize, limits)
+	if err != nil {
+		return SignatureData{}, err
+	}
+	signatureData.Metadata.ChunkCount = md.ChunkCount
+	signatureData.Metadata.ChunkSize = md.ChunkSize
+
+	capacity := int(md.ChunkCount)
+	if size < 0 && capacity > checksumBatch {
+		capacity = checksumBatch
+	}
+	signatureData.Checksums = make([]string, 0, capacity)
+	for i := 0; i < int(md.ChunkCount); i++ {
+		sum := make([]byte, checksumSize)
+		err = readChecksum(decoded, sum)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: %d of %d checksums found", ErrTruncated, i, md.ChunkCount)
+		}
+		if err != nil {
+			return SignatureData{}, &ParseError{Offset: headerSize + int64(i)*checksumSize, ChunkIndex: i, Err: err}
+		}
+		signatureData.Checksums = append(signatureData.Checksums, string(sum))
+	}
+
+	// Nothing is expected after the last checksum, and compressed signatures are checked up to their end
+	n, err := io.ReadFull(decoded, make([]byte, 1))
+	if err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	if err != nil && err != io.EOF {
+		return SignatureData{}, &ParseError{Offset: headerSize + int64(md.ChunkCount)*checksumSize,
+			ChunkIndex: int(md.ChunkCount), Err: err}
+	}
+	if n > 0 {
+		return SignatureData{}, &ParseError{Offset: headerSize + int64(md.ChunkCount)*checksumSize,
+			ChunkIndex: int(md.ChunkCount), Err: fmt.Errorf("%w: trailing data after the last checksum", ErrInvalidSignature)}
+	}
+	return signatureData, nil
+}
+
+// checkMetadata validates the metadata before anything is allocated from it. The checksums start after
+// headerSize bytes
+func checkMetadata(md signatureMetadata, size int64, headerSize int64, limits Limits) error {
+	metadataError := func(err error) error {
+		return &ParseError{Offset: 0, ChunkIndex: -1, Err: err}
+	}
+
+	if md.ChunkSize < MinChunkSize {
+		return metadataError(fmt.Errorf("%w: chunk size %d too small", ErrInvalidSignature, md.ChunkSize))
+	}
+	if md.ChunkSize > limits.MaxChunkSize {
+		return metadataError(fmt.Errorf("%w: chunk size %d larger than %d", ErrLimitExceeded, md.ChunkSize, limits.MaxChunkSize))
+	}
+	if md.ChunkCount > limits.MaxChunkCount {
+		return metadataError(fmt.Errorf("%w: %d chunks, more than %d", ErrLimitExceeded, md.ChunkCount, limits.MaxChunkCount))
+	}
+	if int64(md.ChunkCount)*parsedChecksumSize > limits.MaxMemory {
+		return metadataError(fmt.Errorf("%w: %d chunks need more than %d bytes of memory", ErrLimitExceeded,
+			md.ChunkCount, limits.MaxMemory))
+	}
+
+	if size >= 0 {
+		expectedSize := headerSize + int64(md.ChunkCount)*checksumSize
+		if size < expectedSize {
+			return metadataError(fmt.Errorf("%w: %d chunks need %d bytes, the file has %d", ErrTruncated,
+				md.ChunkCount, expectedSize, size))
+		}
+		if size > expectedSize {
+			return metadataError(fmt.Errorf("%w: %d chunks need %d bytes, the file has %d", ErrInvalidSignature,
+				md.ChunkCount, expectedSize, size))
+		}
+	}
+	return nil
+}
@@ -1,124 +1,259 @@
-package signature
-
-import (
-	"bytes"
-	"errors"
-	"io"
-	"sync"
-	"testing"
-
-	"github.com/stretchr/testify/assert"
-)
-
-func TestParseSignatureFile(t *testing.T) {
-	testCases := []struct {
-		name           string
-		inputData      []byte
-		expectedResult SignatureData
-		err            error
-	}{
-		{
-			name:           "Valid signature file",
-			inputData:      buildValidSignatureFile(),
-			expectedResult: buildValidParseOutput(),
-		},
-
-		{
-			name:           "Invalid signature file metadata: chunkSize too small",
-			inputData:      buildInvalidSignatureMetadata1(),
-			expectedResult: SignatureData{},
-			err:            errors.New("invalid signature file metadata: chunkSize too small"),
-		},
-		{
-			name:           "Invalid signature file: size too small",
-			inputData:      buildInvalidSignatureMetadata2(),
-			expectedResult: SignatureData{},
-			err:            errors.New("invalid signature file: size too small"),
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			var wg sync.WaitGroup
-			// For input
-			pri, pwi := io.Pipe()
-
-			wg.Add(1)
-			go func(w *io.PipeWriter, t *testing.T) {
-				bw, err := io.Copy(w, bytes.NewReader(tc.inputData))
-				if err != nil {
-					t.Errorf("%v", err)
-				}
-				assert.Equal(t, bw, int64(len(tc.inputData)))
-				if bw < int64(len(tc.inputData)) {
-					t.Errorf("Less bytes written than expected: %v", bw)
-				}
-				w.Close()
-				wg.Done()
-			}(pwi, t)
-
-			signatureData, err := ParseFromReader(pri)
-
-			wg.Wait()
-
-			assert.Equal(t, tc.err, err)
-			assert.Equal(t, tc.expectedResult, signatureData)
-			t.Logf("Test %v complete", tc.name)
-		})
-	}
-
-}
-
-func buildValidSignatureFile() []byte {
-	// 2 chunks, 512 bytes each
-	buf := new(bytes.Buffer)
-	chunk512 := make([]byte, 512)
-
-	md := signatureMetadata{
-		ChunkSize:  512,
-		ChunkCount: 2,
-	}
-	md.write(buf)
-	writeChecksum(chunk512, buf)
-	writeChecksum(chunk512, buf)
-
-	return buf.Bytes()
-}
-
-func buildValidParseOutput() SignatureData {
-	buf := new(bytes.Buffer)
-	writeChecksum(make([]byte, 512), buf)
-	sum512 := buf.Bytes()
-	return SignatureData{
-		Metadata: signatureMetadata{
-			ChunkSize:  512,
-			ChunkCount: 2},
-		Checksums: []string{string(sum512), string(sum512)},
-	}
-}
-
-func buildInvalidSignatureMetadata1() []byte {
-	// chunk size too small
-	buf := new(bytes.Buffer)
-
-	md := signatureMetadata{
-		ChunkSize:  31,
-		ChunkCount: 2,
-	}
-	md.write(buf)
-	return buf.Bytes()
-}
-
-func buildInvalidSignatureMetadata2() []byte {
-	// size too small
-	buf := new(bytes.Buffer)
-	chunk512 := make([]byte, 512)
-
-	md := signatureMetadata{
-		ChunkSize:  512,
-		ChunkCount: 2,
-	}
-	md.write(buf)
-	writeChecksum(chunk512, buf)
-	return buf.Bytes()
-}
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignatureFile(t *testing.T) {
+	testCases := []struct {
+		name           string
+		inputData      []byte
+		expectedResult SignatureData
+		err            error
+		errOffset      int64
+		errChunkIndex  int
+	}{
+		{
+			name:           "Valid signature file",
+			inputData:      buildValidSignatureFile(),
+			expectedResult: buildValidParseOutput(),
+		},
+
+		{
+			name:           "Invalid signature file metadata: chunkSize too small",
+			inputData:      buildInvalidSignatureMetadata1(),
+			expectedResult: SignatureData{},
+			err:            ErrInvalidSignature,
+			errOffset:      0,
+			errChunkIndex:  -1,
+		},
+		{
+			name:           "Invalid signature file: size too small",
+			inputData:      buildInvalidSignatureMetadata2(),
+			expectedResult: SignatureData{},
+			err:            ErrTruncated,
+			errOffset:      40,
+			errChunkIndex:  1,
+		},
+		{
+			name:           "Invalid signature file: metadata too small",
+			inputData:      []byte{1, 2, 3},
+			expectedResult: SignatureData{},
+			err:            ErrTruncated,
+			errOffset:      0,
+			errChunkIndex:  -1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			// For input
+			pri, pwi := io.Pipe()
+
+			wg.Add(1)
+			go func(w *io.PipeWriter, t *testing.T) {
+				bw, err := io.Copy(w, bytes.NewReader(tc.inputData))
+				if err != nil {
+					t.Errorf("%v", err)
+				}
+				assert.Equal(t, bw, int64(len(tc.inputData)))
+				if bw < int64(len(tc.inputData)) {
+					t.Errorf("Less bytes written than expected: %v", bw)
+				}
+				w.Close()
+				wg.Done()
+			}(pwi, t)
+
+			signatureData, err := ParseFromReader(pri)
+
+			wg.Wait()
+
+			if tc.err == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.err)
+				var parseError *ParseError
+				if assert.True(t, errors.As(err, &parseError)) {
+					assert.Equal(t, tc.errOffset, parseError.Offset)
+					assert.Equal(t, tc.errChunkIndex, parseError.ChunkIndex)
+				}
+			}
+			assert.Equal(t, tc.expectedResult, signatureData)
+			t.Logf("Test %v complete", tc.name)
+		})
+	}
+
+}
+
+func buildValidSignatureFile() []byte {
+	// 2 chunks, 512 bytes each
+	buf := new(bytes.Buffer)
+	chunk512 := make([]byte, 512)
+
+	md := signatureMetadata{
+		ChunkSize:  512,
+		ChunkCount: 2,
+	}
+	md.write(buf)
+	writeChecksum(chunk512, buf)
+	writeChecksum(chunk512, buf)
+
+	return buf.Bytes()
+}
+
+func buildValidParseOutput() SignatureData {
+	buf := new(bytes.Buffer)
+	writeChecksum(make([]byte, 512), buf)
+	sum512 := buf.Bytes()
+	return SignatureData{
+		Metadata: signatureMetadata{
+			ChunkSize:  512,
+			ChunkCount: 2},
+		Checksums: []string{string(sum512), string(sum512)},
+	}
+}
+
+func buildInvalidSignatureMetadata1() []byte {
+	// chunk size too small
+	buf := new(bytes.Buffer)
+
+	md := signatureMetadata{
+		ChunkSize:  31,
+		ChunkCount: 2,
+	}
+	md.write(buf)
+	return buf.Bytes()
+}
+
+func buildInvalidSignatureMetadata2() []byte {
+	// size too small
+	buf := new(bytes.Buffer)
+	chunk512 := make([]byte, 512)
+
+	md := signatureMetadata{
+		ChunkSize:  512,
+		ChunkCount: 2,
+	}
+	md.write(buf)
+	writeChecksum(chunk512, buf)
+	return buf.Bytes()
+}
+
+func TestParseSignatureWithLimits(t *testing.T) {
+	validSignature := buildValidSignatureFile()
+	testCases := []struct {
+		name      string
+		inputData []byte
+		size      int64
+		limits    Limits
+		err       error
+	}{
+		{
+			name:      "Valid signature of known size",
+			inputData: validSignature,
+			size:      int64(len(validSignature)),
+			limits:    DefaultLimits,
+		},
+		{
+			name:      "Forged chunk count",
+			inputData: buildSignatureMetadata(512, 1<<31),
+			size:      -1,
+			limits:    DefaultLimits,
+			err:       ErrLimitExceeded,
+		},
+		{
+			name:      "Forged chunk size",
+			inputData: buildSignatureMetadata(1<<31, 1),
+			size:      -1,
+			limits:    DefaultLimits,
+			err:       ErrLimitExceeded,
+		},
+		{
+			name:      "Too many chunks for the memory limit",
+			inputData: validSignature,
+			size:      -1,
+			limits:    Limits{MaxChunkCount: 2, MaxChunkSize: 512, MaxMemory: parsedChecksumSize},
+			err:       ErrLimitExceeded,
+		},
+		{
+			name:      "Chunk count larger than the file",
+			inputData: buildSignatureMetadata(512, 1<<20),
+			size:      8,
+			limits:    DefaultLimits,
+			err:       ErrTruncated,
+		},
+		{
+			name:      "Chunk count smaller than the file",
+			inputData: validSignature,
+			size:      int64(len(validSignature)) + 1,
+			limits:    DefaultLimits,
+			err:       ErrInvalidSignature,
+		},
+		{
+			name:      "Trailing data",
+			inputData: append(append([]byte{}, validSignature...), 0),
+			size:      -1,
+			limits:    DefaultLimits,
+			err:       ErrInvalidSignature,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			signatureData, err := ParseFromReaderWithLimits(io.NopCloser(bytes.NewReader(tc.inputData)), tc.size, tc.limits)
+			if tc.err == nil {
+				assert.Nil(t, err)
+				assert.Equal(t, buildValidParseOutput(), signatureData)
+			} else {
+				assert.ErrorIs(t, err, tc.err)
+				assert.Equal(t, SignatureData{}, signatureData)
+			}
+		})
+	}
+}
+
+func FuzzParseSignature(f *testing.F) {
+	f.Add(buildValidSignatureFile())
+	f.Add(buildInvalidSignatureMetadata1())
+	f.Add(buildInvalidSignatureMetadata2())
+	f.Add(buildSignatureMetadata(32, 0))
+	f.Add(buildSignatureMetadata(512, 1<<31))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, size := range []int64{-1, int64(len(data))} {
+			signatureData, err := ParseFromReaderWithLimits(io.NopCloser(bytes.NewReader(data)), size, DefaultLimits)
+			if err != nil {
+				var parseError *ParseError
+				if !errors.As(err, &parseError) {
+					t.Fatalf("expected a ParseError, got %v", err)
+				}
+				continue
+			}
+			// A valid signature is exactly its metadata, the one of the file if any, and its checksums
+			size := int64(metadataSize + len(signatureData.Checksums)*checksumSize)
+			if signatureData.File == nil && int64(len(data)) != size || int64(len(data)) < size {
+				t.Fatalf("%d checksums parsed from %d bytes", len(signatureData.Checksums), len(data))
+			}
+			if int(signatureData.Metadata.ChunkCount) != len(signatureData.Checksums) {
+				t.Fatalf("%d checksums parsed, %d expected", len(signatureData.Checksums), signatureData.Metadata.ChunkCount)
+			}
+		}
+	})
+}
+
+func buildSignatureMetadata(chunkSize uint32, chunkCount uint32) []byte {
+	buf := new(bytes.Buffer)
+	md := signatureMetadata{
+		ChunkSize:  chunkSize,
+		ChunkCount: chunkCount,
+	}
+	md.write(buf)
+	return buf.Bytes()
+}
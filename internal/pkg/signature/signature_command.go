@@ -1,114 +1,249 @@
-package signature
-
-import (
-	"bufio"
-	"bytes"
-	"io"
-	"os"
-)
-
-func GetSignature(data []byte) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	len64 := int64(len(data))
-	chunkSize := computeChunkSize(len64)
-	err := createSignatureFile(io.NopCloser(bytes.NewReader(data)), len64, chunkSize, buf)
-	return buf.Bytes(), err
-}
-
-func Compute(inputFileName string, outputFile string) error {
-	f, err := os.Open(inputFileName)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	input := io.NopCloser(bufio.NewReader(f))
-	fi, err := f.Stat()
-	if err != nil {
-		return err
-	}
-	inputFileSize := fi.Size()
-
-	chunkSize := computeChunkSize(inputFileSize)
-	out, err := os.Create(outputFile)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	return createSignatureFile(input, inputFileSize, chunkSize, out)
-}
-
-func createSignatureFile(input io.ReadCloser, inputFileSize int64, chunkSize int, output io.Writer) error {
-	defer input.Close()
-
-	md := signatureMetadata{}
-
-	chunkCount := uint32(inputFileSize / int64(chunkSize))
-	if inputFileSize%int64(chunkSize) > 0 {
-		chunkCount++
-	}
-	md.ChunkCount = chunkCount
-	md.ChunkSize = uint32(chunkSize)
-
-	err := md.write(output)
-
-	//err := binary.Write(output, binary.LittleEndian, binarySignature)
-	if err != nil {
-		return err
-	}
-	var totalBytesRead int64
-	var chunkIndex uint32
-	for {
-		chunk := make([]byte, chunkSize)
-		br, err := input.Read(chunk)
-		if err != nil {
-			return err
-		}
-		totalBytesRead += int64(br)
-		//err = binary.Write(output, binary.LittleEndian, sha256.Sum256(chunk[:br]))
-		err = writeChecksum(chunk[:br], output)
-		if err != nil {
-			return err
-		}
-		if totalBytesRead == inputFileSize {
-			break
-		}
-		chunkIndex++
-	}
-	return nil
-}
-
-func BuildSignatureData(chunks [][]byte, chunkSize uint32) SignatureData {
-	chunksCount := len(chunks)
-	signatureData := SignatureData{
-		Metadata: signatureMetadata{
-			ChunkSize:  chunkSize,
-			ChunkCount: uint32(chunksCount),
-		},
-	}
-	signatureData.Checksums = make([]string, chunksCount)
-
-	for i := 0; i < chunksCount; i++ {
-		buf := new(bytes.Buffer)
-		writeChecksum(chunks[i], buf)
-		signatureData.Checksums[i] = buf.String()
-	}
-	return signatureData
-}
-
-func computeChunkSize(fileSize int64) int {
-	chunkSize := 32
-	if fileSize > 5<<20 && fileSize <= 50<<20 {
-		chunkSize = 4 << 10 //4k
-	} else if fileSize > 50<<20 && fileSize <= 100<<20 {
-		chunkSize = 64 << 10 //64k
-	} else if fileSize > 100<<20 && fileSize <= 300<<20 {
-		chunkSize = 256 << 10 //256k
-	} else if fileSize > 300<<20 && fileSize <= 1024<<20 {
-		chunkSize = 1 << 20 //1M
-	} else if fileSize > 1024<<20 {
-		chunkSize = 4 << 20 //4M
-	}
-	return chunkSize
-}
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/metadata"
+	"github.com/popescuag/RH/internal/pkg/sparse"
+)
+
+// Options controls how signatures are computed. The zero value uses the default chunk size policy
+type Options struct {
+	ChunkSize ChunkSizePolicy
+	// Codec compresses the signature file, which is written as it is if nil
+	Codec codec.Codec
+	// Metadata records the mode, modification time, owner and extended attributes of the file, when the
+	// signature is computed from one
+	Metadata bool
+}
+
+func (o Options) chunkSize(fileSize int64) (int, error) {
+	policy := o.ChunkSize
+	if policy == nil {
+		policy = DefaultChunkSizePolicy
+	}
+	chunkSize := policy.ChunkSize(fileSize)
+	return chunkSize, ValidateChunkSize(chunkSize)
+}
+
+func GetSignature(data []byte) ([]byte, error) {
+	return GetSignatureWithOptions(data, Options{})
+}
+
+func GetSignatureWithOptions(data []byte, options Options) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	len64 := int64(len(data))
+	chunkSize, err := options.chunkSize(len64)
+	if err != nil {
+		return nil, err
+	}
+	output, err := codec.NewWriter(buf, options.Codec)
+	if err != nil {
+		return nil, err
+	}
+	err = createSignatureFile(io.NopCloser(bytes.NewReader(data)), len64, chunkSize, nil, output)
+	if err != nil {
+		return nil, err
+	}
+	err = output.Close()
+	return buf.Bytes(), err
+}
+
+func Compute(inputFileName string, outputFile string, options Options) error {
+	f, err := os.Open(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	inputFileSize := fi.Size()
+	input, err := sparse.NewReader(f, inputFileSize)
+	if err != nil {
+		return err
+	}
+
+	chunkSize, err := options.chunkSize(inputFileSize)
+	if err != nil {
+		return err
+	}
+	var file *metadata.Metadata
+	if options.Metadata {
+		if file, err = metadata.Read(f); err != nil {
+			return err
+		}
+	}
+	out, err := atomicfile.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := bufio.NewWriter(out)
+	compressed, err := codec.NewWriter(output, options.Codec)
+	if err != nil {
+		return err
+	}
+	err = createSignatureFile(input, inputFileSize, chunkSize, file, compressed)
+	if err != nil {
+		return err
+	}
+	err = compressed.Close()
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// Write computes the signature of the input of the given size, without holes skipped, to output
+func Write(input io.Reader, inputSize int64, output io.Writer, options Options) error {
+	chunkSize, err := options.chunkSize(inputSize)
+	if err != nil {
+		return err
+	}
+	compressed, err := codec.NewWriter(output, options.Codec)
+	if err != nil {
+		return err
+	}
+	err = createSignatureFile(io.NopCloser(input), inputSize, chunkSize, nil, compressed)
+	if err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// BuildFromReader computes the signature of the input of the given size, without writing it to a file
+func BuildFromReader(input io.ReadCloser, inputSize int64, options Options) (SignatureData, error) {
+	chunkSize, err := options.chunkSize(inputSize)
+	if err != nil {
+		return SignatureData{}, err
+	}
+	buf := new(bytes.Buffer)
+	err = createSignatureFile(input, inputSize, chunkSize, nil, buf)
+	if err != nil {
+		return SignatureData{}, err
+	}
+	limits := DefaultLimits
+	limits.MaxChunkCount = math.MaxUint32
+	limits.MaxMemory = math.MaxInt64
+	return ParseFromReaderWithLimits(io.NopCloser(buf), int64(buf.Len()), limits)
+}
+
+// createSignatureFile writes the signature of the input, with the metadata of the file unless it is nil
+func createSignatureFile(input io.ReadCloser, inputFileSize int64, chunkSize int, file *metadata.Metadata,
+	output io.Writer) error {
+	defer input.Close()
+
+	md := signatureMetadata{}
+
+	chunkCount := uint32(inputFileSize / int64(chunkSize))
+	if inputFileSize%int64(chunkSize) > 0 {
+		chunkCount++
+	}
+	md.ChunkCount = chunkCount
+	md.ChunkSize = uint32(chunkSize)
+	if file != nil {
+		md.ChunkSize |= fileMetadataFlag
+	}
+
+	err := md.write(output)
+
+	//err := binary.Write(output, binary.LittleEndian, binarySignature)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		if err = writeFileMetadata(file, output); err != nil {
+			return err
+		}
+	}
+	holes, _ := input.(sparse.HoleSkipper)
+	chunk := make([]byte, chunkSize)
+	zeroChecksum := GetChecksum(make([]byte, chunkSize))
+	var totalBytesRead int64
+	for totalBytesRead < inputFileSize {
+		// The last chunk (or the only one, for files smaller than a chunk) can be shorter
+		n := int64(chunkSize)
+		if inputFileSize-totalBytesRead < n {
+			n = inputFileSize - totalBytesRead
+		}
+
+		// The checksum of the whole chunks in the holes of sparse files is known without reading them
+		if holes != nil && n == int64(chunkSize) {
+			skipped, err := holes.SkipHole(n)
+			if err != nil {
+				return err
+			}
+			if skipped {
+				totalBytesRead += n
+				if _, err = io.WriteString(output, zeroChecksum); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		br, err := io.ReadFull(input, chunk[:n])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: input ended after %d of %d bytes", ErrTruncated, totalBytesRead+int64(br), inputFileSize)
+		}
+		if err != nil {
+			return err
+		}
+		totalBytesRead += int64(br)
+		//err = binary.Write(output, binary.LittleEndian, sha256.Sum256(chunk[:br]))
+		err = writeChecksum(chunk[:br], output)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BuildSignatureData(chunks [][]byte, chunkSize uint32) SignatureData {
+	chunksCount := len(chunks)
+	signatureData := SignatureData{
+		Metadata: signatureMetadata{
+			ChunkSize:  chunkSize,
+			ChunkCount: uint32(chunksCount),
+		},
+	}
+	signatureData.Checksums = make([]string, chunksCount)
+
+	for i := 0; i < chunksCount; i++ {
+		buf := new(bytes.Buffer)
+		writeChecksum(chunks[i], buf)
+		signatureData.Checksums[i] = buf.String()
+	}
+	return signatureData
+}
+
+func computeChunkSize(fileSize int64) int {
+	chunkSize := 32
+	if fileSize > 5<<20 && fileSize <= 50<<20 {
+		chunkSize = 4 << 10 //4k
+	} else if fileSize > 50<<20 && fileSize <= 100<<20 {
+		chunkSize = 64 << 10 //64k
+	} else if fileSize > 100<<20 && fileSize <= 300<<20 {
+		chunkSize = 256 << 10 //256k
+	} else if fileSize > 300<<20 && fileSize <= 1024<<20 {
+		chunkSize = 1 << 20 //1M
+	} else if fileSize > 1024<<20 {
+		chunkSize = 4 << 20 //4M
+	}
+	return chunkSize
+}
@@ -1,192 +1,331 @@
-package signature
-
-import (
-	"bytes"
-	"io"
-	"log"
-	"sync"
-	"testing"
-
-	"github.com/stretchr/testify/assert"
-)
-
-func TestCreateSignatures(t *testing.T) {
-	testCases := []struct {
-		name           string
-		inputData      []byte
-		expectedResult []byte
-		chunkSize      int
-	}{
-		{
-			name:           "Last chunk smaller than the rest",
-			inputData:      buildInput1(),
-			expectedResult: buildOutput1(),
-			chunkSize:      512,
-		},
-		{
-			name:           "All chunks equal",
-			inputData:      buildInput2(),
-			expectedResult: buildOutput2(),
-			chunkSize:      512,
-		},
-		{
-			name:           "Large file 640MB",
-			inputData:      buildInput3(),
-			expectedResult: buildOutput3(),
-			chunkSize:      1 << 20,
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			var wg sync.WaitGroup
-			// For input
-			pri, pwi := io.Pipe()
-
-			wg.Add(1)
-			go func(w *io.PipeWriter, t *testing.T) {
-				bw, err := io.Copy(w, bytes.NewReader(tc.inputData))
-				if err != nil {
-					t.Errorf("%v", err)
-				}
-				assert.Equal(t, bw, int64(len(tc.inputData)))
-				if bw < int64(len(tc.inputData)) {
-					t.Errorf("Less bytes written than expected: %v", bw)
-				}
-				w.Close()
-				wg.Done()
-			}(pwi, t)
-
-			//For output
-			pro, pwo := io.Pipe()
-			wg.Add(1)
-			go func(r *io.PipeReader, len int, t *testing.T) {
-				output := make([]byte, len)
-				br, _ := io.ReadFull(pro, output)
-				// t.Logf("%v\n%v", tc.name, string(output))
-				// t.Logf("\n%v", string(tc.expectedResult))
-				equal := bytes.Compare(output, tc.expectedResult)
-				assert.Equal(t, 0, equal)
-				assert.Equal(t, len, br)
-				//t.Logf("%v %v", len, br)
-				wg.Done()
-			}(pro, len(tc.expectedResult), t)
-
-			err := createSignatureFile(pri, int64(len(tc.inputData)), tc.chunkSize, pwo)
-			pwo.Close()
-
-			assert.Nil(t, err)
-			wg.Wait()
-			log.Printf("Test %v complete", tc.name)
-		})
-	}
-}
-
-func buildInput1() []byte {
-	return make([]byte, 1<<10+10)
-}
-
-func buildOutput1() []byte {
-	buf := new(bytes.Buffer)
-	// 3 chunks, first 2 512, last 10 bytes
-	chunk512 := make([]byte, 512)
-	chunk10 := make([]byte, 10)
-
-	md := signatureMetadata{
-		ChunkSize:  512,
-		ChunkCount: 3,
-	}
-	md.write(buf)
-	writeChecksum(chunk512, buf)
-	writeChecksum(chunk512, buf)
-	writeChecksum(chunk10, buf)
-
-	return buf.Bytes()
-}
-
-func buildInput2() []byte {
-	return make([]byte, 1<<10)
-}
-
-func buildOutput2() []byte {
-	buf := new(bytes.Buffer)
-	// 2 chunks, 512 bytes each
-	chunk512 := make([]byte, 512)
-
-	md := signatureMetadata{
-		ChunkSize:  512,
-		ChunkCount: 2,
-	}
-	md.write(buf)
-	writeChecksum(chunk512, buf)
-	writeChecksum(chunk512, buf)
-
-	return buf.Bytes()
-}
-
-func buildInput3() []byte {
-	return make([]byte, 640<<20)
-}
-
-func buildOutput3() []byte {
-	buf := new(bytes.Buffer)
-	chunkSize := 1 << 20
-	chunkCount := 640
-	chunk1M := make([]byte, chunkSize)
-
-	md := signatureMetadata{
-		ChunkSize:  uint32(chunkSize),
-		ChunkCount: uint32(chunkCount),
-	}
-	md.write(buf)
-	for i := 0; i < chunkCount; i++ {
-		writeChecksum(chunk1M, buf)
-	}
-
-	return buf.Bytes()
-}
-
-func TestComputeChunkSize(t *testing.T) {
-	testCases := []struct {
-		name           string
-		fileSize       int64
-		expectedResult int
-	}{
-		{
-			name:           "XS file",
-			fileSize:       2 << 10,
-			expectedResult: 32,
-		},
-		{
-			name:           "S file",
-			fileSize:       7 << 20,
-			expectedResult: 4 << 10,
-		},
-		{
-			name:           "M file",
-			fileSize:       60 << 20,
-			expectedResult: 64 << 10,
-		},
-		{
-			name:           "L file",
-			fileSize:       150 << 20,
-			expectedResult: 256 << 10,
-		},
-		{
-			name:           "XL file",
-			fileSize:       600 << 20,
-			expectedResult: 1 << 20,
-		},
-		{
-			name:           "XXL file",
-			fileSize:       1025 << 20,
-			expectedResult: 4 << 20,
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			assert.Equal(t, tc.expectedResult, computeChunkSize(tc.fileSize))
-		})
-	}
-}
+package signature
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateSignatures(t *testing.T) {
+	testCases := []struct {
+		name           string
+		inputData      []byte
+		expectedResult []byte
+		chunkSize      int
+	}{
+		{
+			name:           "Last chunk smaller than the rest",
+			inputData:      buildInput1(),
+			expectedResult: buildOutput1(),
+			chunkSize:      512,
+		},
+		{
+			name:           "All chunks equal",
+			inputData:      buildInput2(),
+			expectedResult: buildOutput2(),
+			chunkSize:      512,
+		},
+		{
+			name:           "Empty file",
+			inputData:      []byte{},
+			expectedResult: buildOutput4(),
+			chunkSize:      32,
+		},
+		{
+			name:           "File smaller than a chunk",
+			inputData:      buildInput5(),
+			expectedResult: buildOutput5(),
+			chunkSize:      32,
+		},
+		{
+			name:           "Large file 640MB",
+			inputData:      buildInput3(),
+			expectedResult: buildOutput3(),
+			chunkSize:      1 << 20,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			// For input
+			pri, pwi := io.Pipe()
+
+			wg.Add(1)
+			go func(w *io.PipeWriter, t *testing.T) {
+				bw, err := io.Copy(w, bytes.NewReader(tc.inputData))
+				if err != nil {
+					t.Errorf("%v", err)
+				}
+				assert.Equal(t, bw, int64(len(tc.inputData)))
+				if bw < int64(len(tc.inputData)) {
+					t.Errorf("Less bytes written than expected: %v", bw)
+				}
+				w.Close()
+				wg.Done()
+			}(pwi, t)
+
+			//For output
+			pro, pwo := io.Pipe()
+			wg.Add(1)
+			go func(r *io.PipeReader, len int, t *testing.T) {
+				output := make([]byte, len)
+				br, _ := io.ReadFull(pro, output)
+				// t.Logf("%v\n%v", tc.name, string(output))
+				// t.Logf("\n%v", string(tc.expectedResult))
+				equal := bytes.Compare(output, tc.expectedResult)
+				assert.Equal(t, 0, equal)
+				assert.Equal(t, len, br)
+				//t.Logf("%v %v", len, br)
+				wg.Done()
+			}(pro, len(tc.expectedResult), t)
+
+			err := createSignatureFile(pri, int64(len(tc.inputData)), tc.chunkSize, nil, pwo)
+			pwo.Close()
+
+			assert.Nil(t, err)
+			wg.Wait()
+			log.Printf("Test %v complete", tc.name)
+		})
+	}
+}
+
+func buildInput1() []byte {
+	return make([]byte, 1<<10+10)
+}
+
+func buildOutput1() []byte {
+	buf := new(bytes.Buffer)
+	// 3 chunks, first 2 512, last 10 bytes
+	chunk512 := make([]byte, 512)
+	chunk10 := make([]byte, 10)
+
+	md := signatureMetadata{
+		ChunkSize:  512,
+		ChunkCount: 3,
+	}
+	md.write(buf)
+	writeChecksum(chunk512, buf)
+	writeChecksum(chunk512, buf)
+	writeChecksum(chunk10, buf)
+
+	return buf.Bytes()
+}
+
+func buildInput2() []byte {
+	return make([]byte, 1<<10)
+}
+
+func buildOutput2() []byte {
+	buf := new(bytes.Buffer)
+	// 2 chunks, 512 bytes each
+	chunk512 := make([]byte, 512)
+
+	md := signatureMetadata{
+		ChunkSize:  512,
+		ChunkCount: 2,
+	}
+	md.write(buf)
+	writeChecksum(chunk512, buf)
+	writeChecksum(chunk512, buf)
+
+	return buf.Bytes()
+}
+
+func buildInput3() []byte {
+	return make([]byte, 640<<20)
+}
+
+func buildOutput3() []byte {
+	buf := new(bytes.Buffer)
+	chunkSize := 1 << 20
+	chunkCount := 640
+	chunk1M := make([]byte, chunkSize)
+
+	md := signatureMetadata{
+		ChunkSize:  uint32(chunkSize),
+		ChunkCount: uint32(chunkCount),
+	}
+	md.write(buf)
+	for i := 0; i < chunkCount; i++ {
+		writeChecksum(chunk1M, buf)
+	}
+
+	return buf.Bytes()
+}
+
+func buildOutput4() []byte {
+	buf := new(bytes.Buffer)
+	md := signatureMetadata{
+		ChunkSize:  32,
+		ChunkCount: 0,
+	}
+	md.write(buf)
+
+	return buf.Bytes()
+}
+
+func buildInput5() []byte {
+	return []byte("tiny")
+}
+
+func buildOutput5() []byte {
+	buf := new(bytes.Buffer)
+	md := signatureMetadata{
+		ChunkSize:  32,
+		ChunkCount: 1,
+	}
+	md.write(buf)
+	writeChecksum(buildInput5(), buf)
+
+	return buf.Bytes()
+}
+
+func TestComputeSparseFile(t *testing.T) {
+	// A 1MB hole between two chunks, and a shorter last chunk in the hole at the end of the file
+	data := make([]byte, 3<<20+100)
+	copy(data, buildInput1())
+	copy(data[2<<20:], buildInput1())
+
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "sparse")
+	f, err := os.Create(inputFile)
+	assert.Nil(t, err)
+	_, err = f.Write(data[:1<<20])
+	assert.Nil(t, err)
+	_, err = f.WriteAt(data[2<<20:3<<20], 2<<20)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Truncate(int64(len(data))))
+	assert.Nil(t, f.Close())
+
+	outputFile := filepath.Join(dir, "signature")
+	options := Options{ChunkSize: FixedChunkSizePolicy(4 << 10)}
+	assert.Nil(t, Compute(inputFile, outputFile, options))
+	signatureData, err := os.ReadFile(outputFile)
+	assert.Nil(t, err)
+	expected, err := GetSignatureWithOptions(data, options)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, signatureData)
+}
+
+func TestCompressedSignature(t *testing.T) {
+	data := buildInput1()
+	plain, err := GetSignature(data)
+	assert.Nil(t, err)
+	expected, err := ParseFromReader(io.NopCloser(bytes.NewReader(plain)))
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "input")
+	assert.Nil(t, os.WriteFile(inputFile, data, 0644))
+	for _, c := range []codec.Codec{codec.Gzip, codec.Zlib} {
+		t.Run(c.Name(), func(t *testing.T) {
+			options := Options{Codec: c}
+			signatureData, err := GetSignatureWithOptions(data, options)
+			assert.Nil(t, err)
+			assert.NotEqual(t, plain, signatureData)
+			parsed, err := ParseFromReaderWithLimits(io.NopCloser(bytes.NewReader(signatureData)),
+				int64(len(signatureData)), DefaultLimits)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, parsed)
+
+			outputFile := filepath.Join(dir, c.Name())
+			assert.Nil(t, Compute(inputFile, outputFile, options))
+			parsed, err = ParseFromFile(outputFile)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, parsed)
+
+			// The checksum of the codec, at the end of the signature, is checked too
+			corrupted := append([]byte{}, signatureData...)
+			corrupted[len(corrupted)-1] ^= 0xff
+			_, err = ParseFromReader(io.NopCloser(bytes.NewReader(corrupted)))
+			assert.ErrorIs(t, err, codec.ErrCorrupted)
+		})
+	}
+}
+
+func TestComputeWithMetadata(t *testing.T) {
+	data := buildInput1()
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "input")
+	assert.Nil(t, os.WriteFile(inputFile, data, 0640))
+	assert.Nil(t, os.Chmod(inputFile, 0640))
+	modTime := time.Unix(1e9, 123)
+	assert.Nil(t, os.Chtimes(inputFile, modTime, modTime))
+
+	outputFile := filepath.Join(dir, "signature")
+	assert.Nil(t, Compute(inputFile, outputFile, Options{Metadata: true}))
+	parsed, err := ParseFromFile(outputFile)
+	assert.Nil(t, err)
+	if assert.NotNil(t, parsed.File) {
+		assert.Equal(t, fs.FileMode(0640), parsed.File.Mode)
+		assert.True(t, modTime.Equal(parsed.File.ModTime))
+	}
+
+	// The checksums are the same as without the metadata
+	plain, err := GetSignature(data)
+	assert.Nil(t, err)
+	expected, err := ParseFromReader(io.NopCloser(bytes.NewReader(plain)))
+	assert.Nil(t, err)
+	parsed.File = nil
+	assert.Equal(t, expected, parsed)
+
+	signatureData, err := os.ReadFile(outputFile)
+	assert.Nil(t, err)
+	_, err = ParseFromReaderWithLimits(io.NopCloser(bytes.NewReader(signatureData[:20])), 20, DefaultLimits)
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestComputeChunkSize(t *testing.T) {
+	testCases := []struct {
+		name           string
+		fileSize       int64
+		expectedResult int
+	}{
+		{
+			name:           "XS file",
+			fileSize:       2 << 10,
+			expectedResult: 32,
+		},
+		{
+			name:           "S file",
+			fileSize:       7 << 20,
+			expectedResult: 4 << 10,
+		},
+		{
+			name:           "M file",
+			fileSize:       60 << 20,
+			expectedResult: 64 << 10,
+		},
+		{
+			name:           "L file",
+			fileSize:       150 << 20,
+			expectedResult: 256 << 10,
+		},
+		{
+			name:           "XL file",
+			fileSize:       600 << 20,
+			expectedResult: 1 << 20,
+		},
+		{
+			name:           "XXL file",
+			fileSize:       1025 << 20,
+			expectedResult: 4 << 20,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedResult, computeChunkSize(tc.fileSize))
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package sparse
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Whence values of lseek finding the data and the holes of sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Holes returns the holes of the file, which read as zeros without being stored on disk.
+// None are found on file systems that cannot report them
+func Holes(f *os.File, size int64) ([]Region, error) {
+	holes := []Region{}
+	var offset int64
+	for offset < size {
+		data, err := f.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// No data up to the end of the file
+			holes = append(holes, Region{Offset: offset, Length: size - offset})
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data > offset {
+			holes = append(holes, Region{Offset: offset, Length: data - offset})
+		}
+
+		offset, err = f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return holes, nil
+}
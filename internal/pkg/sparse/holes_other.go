@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sparse
+
+import (
+	"os"
+)
+
+// Holes returns the holes of the file. Only Linux reports them, elsewhere files are read as a whole
+func Holes(f *os.File, size int64) ([]Region, error) {
+	return nil, nil
+}
@@ -0,0 +1,82 @@
+package sparse
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+)
+
+// Region is a range of bytes of a file
+type Region struct {
+	Offset int64
+	Length int64
+}
+
+// IsZero tells whether data only has zeros
+func IsZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// HoleSkipper is implemented by the inputs that know where the holes of the file they read are
+type HoleSkipper interface {
+	SkipHole(n int64) (bool, error)
+}
+
+// Reader reads a file sequentially, and can skip over its holes without reading them
+type Reader struct {
+	file   *os.File
+	input  *bufio.Reader
+	holes  []Region
+	offset int64
+}
+
+// NewReader reads the file from its start. The holes of the file are found when the reader is created
+func NewReader(f *os.File, size int64) (*Reader, error) {
+	holes, err := Holes(f, size)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{file: f, input: bufio.NewReader(f), holes: holes}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.input.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// SkipHole skips the next n bytes if they are all in a hole of the file, and tells whether it did
+func (r *Reader) SkipHole(n int64) (bool, error) {
+	if !r.inHole(r.offset, n) {
+		return false, nil
+	}
+	r.offset += n
+	_, err := r.file.Seek(r.offset, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	r.input.Reset(r.file)
+	return true, nil
+}
+
+// Close does nothing: the file belongs to the caller
+func (r *Reader) Close() error {
+	return nil
+}
+
+func (r *Reader) inHole(offset int64, n int64) bool {
+	i := sort.Search(len(r.holes), func(i int) bool {
+		return r.holes[i].Offset+r.holes[i].Length > offset
+	})
+	return i < len(r.holes) && r.holes[i].Offset <= offset && offset+n <= r.holes[i].Offset+r.holes[i].Length
+}
@@ -0,0 +1,55 @@
+package sparse
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsZero(t *testing.T) {
+	assert.True(t, IsZero([]byte{}))
+	assert.True(t, IsZero(make([]byte, 100)))
+	assert.False(t, IsZero(append(make([]byte, 100), 1)))
+}
+
+func TestReader(t *testing.T) {
+	// 1MB of data, a 4MB hole and 1MB of data
+	data := bytes.Repeat([]byte("data"), 1<<18)
+	path := filepath.Join(t.TempDir(), "sparse")
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.Write(data)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(data, 5<<20)
+	assert.Nil(t, err)
+
+	holes, err := Holes(f, 6<<20)
+	assert.Nil(t, err)
+	if len(holes) == 0 {
+		t.Skip("the file system does not report holes")
+	}
+	assert.Equal(t, []Region{{Offset: 1 << 20, Length: 4 << 20}}, holes)
+
+	r, err := NewReader(f, 6<<20)
+	assert.Nil(t, err)
+	chunk := make([]byte, 1<<20)
+	_, err = io.ReadFull(r, chunk)
+	assert.Nil(t, err)
+	assert.Equal(t, data, chunk)
+
+	skipped, err := r.SkipHole(5 << 20)
+	assert.Nil(t, err)
+	assert.False(t, skipped, "data after the hole cannot be skipped")
+	skipped, err = r.SkipHole(4 << 20)
+	assert.Nil(t, err)
+	assert.True(t, skipped)
+
+	_, err = io.ReadFull(r, chunk)
+	assert.Nil(t, err)
+	assert.Equal(t, data, chunk)
+}
@@ -0,0 +1,378 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// GetDelta = computes the bundle turning the directory of the manifest into the new directory
+func GetDelta(manifestData []byte, newDir string, options d.Options, treeOptions Options) ([]byte, error) {
+	m, err := ParseManifest(bytes.NewReader(manifestData), s.DefaultLimits)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	output, err := codec.NewWriter(buf, options.Codec)
+	if err != nil {
+		return nil, err
+	}
+	err = WriteDelta(m, newDir, output, options, treeOptions)
+	if err != nil {
+		return nil, err
+	}
+	err = output.Close()
+	return buf.Bytes(), err
+}
+
+// Delta writes the bundle turning the directory the manifest was computed from into the new directory.
+// Only the paths the filter of the tree options includes are synced, the others are left as they are
+func Delta(manifestFile string, newDir string, bundleFile string, options d.Options, treeOptions Options) error {
+	m, err := ParseManifestFile(manifestFile, s.DefaultLimits)
+	if err != nil {
+		return err
+	}
+	out, err := atomicfile.Create(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := bufio.NewWriter(out)
+	compressed, err := codec.NewWriter(output, options.Codec)
+	if err != nil {
+		return err
+	}
+	err = WriteDelta(m, newDir, compressed, options, treeOptions)
+	if err != nil {
+		return err
+	}
+	err = compressed.Close()
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// WriteDelta writes the bundle of the new directory against the manifest to output, not compressed. New
+// files at paths the manifest does not list are copied, renamed or patched from the basis file with the same
+// contents or sharing the most chunks with them, wherever it is. The paths of the manifest that are gone
+// are deleted first, children before their parents, then the new directories are created, parents before
+// their children. Then come the files taken from other paths, the deletion of the basis files they were
+// taken from and the directories holding them, and last the other files. Unless the tree options ask for
+// checksums, files with the size and the modification time of the manifest are taken as unchanged. Hard
+// links come after the file they link to, and are written again when it is replaced
+func WriteDelta(m *Manifest, newDir string, output io.Writer, options d.Options, treeOptions Options) error {
+	entries, err := walk(dirFS(newDir), ".", treeOptions)
+	if err != nil {
+		return err
+	}
+	m = m.filter(treeOptions.Filter)
+	newEntries := make(map[string]Entry, len(entries))
+	for _, e := range entries {
+		newEntries[e.Path] = e
+	}
+	matches, err := findMatches(m, newDir, entries, newEntries)
+	if err != nil {
+		return err
+	}
+	if err = writeKind(output, bundleKind, versionOf(entries)); err != nil {
+		return err
+	}
+	options.Codec = nil
+
+	// The last new file taken from a basis file that is gone moves it when it has the same contents.
+	// Otherwise the basis file, and the directories holding it, are only deleted once all are taken
+	lastUse := make(map[string]string)
+	for _, e := range entries {
+		if mt, found := matches[e.Path]; found {
+			lastUse[mt.source.Path] = e.Path
+		}
+	}
+	renamed := make(map[string]bool)
+	movedAway := make(map[string]bool)
+	deferred := make(map[string]bool)
+	for source, target := range lastUse {
+		if _, found := newEntries[source]; found {
+			continue
+		}
+		if matches[target].exact {
+			renamed[target] = true
+			movedAway[source] = true
+		} else {
+			deferred[source] = true
+		}
+		for dir := path.Dir(source); dir != "."; dir = path.Dir(dir) {
+			if e, found := newEntries[dir]; !found || !e.Dir {
+				deferred[dir] = true
+			}
+		}
+	}
+
+	early := func(path string) bool { return !deferred[path] && !movedAway[path] }
+	if err = writeDeletes(m, newEntries, early, output); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Dir {
+			continue
+		}
+		h := header{path: e.Path}
+		if old, found := m.Entry(e.Path); found && old.Dir {
+			if old.Mode == e.Mode {
+				continue
+			}
+			h.set(opKey, modeOp)
+		} else {
+			h.set(opKey, dirOp)
+		}
+		h.setMode(e.Mode)
+		if err = h.write(output); err != nil {
+			return err
+		}
+	}
+
+	// Deltas are written to a temporary file first, as their length comes before them
+	spool, err := os.CreateTemp("", "rh-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// Files replaced by the bundle, which are not the ones their hard links were made to anymore
+	replaced := make(map[string]bool)
+	for _, e := range entries {
+		mt, found := matches[e.Path]
+		if !found {
+			continue
+		}
+		replaced[e.Path] = true
+		h := header{path: e.Path}
+		if mt.exact {
+			if renamed[e.Path] {
+				h.set(opKey, renameOp)
+			} else {
+				h.set(opKey, copyOp)
+			}
+			h.setPath(fromKey, mt.source.Path)
+			h.setMode(e.Mode)
+			err = h.write(output)
+		} else {
+			_, err = writeFileDelta(h, mt.source, e, filepath.Join(newDir, filepath.FromSlash(e.Path)), spool,
+				output, options)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	late := func(path string) bool { return deferred[path] }
+	if err = writeDeletes(m, newEntries, late, output); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if _, found := matches[e.Path]; e.Dir || found {
+			continue
+		}
+		h := header{path: e.Path}
+		path := filepath.Join(newDir, filepath.FromSlash(e.Path))
+		old, found := m.Entry(e.Path)
+		switch {
+		case e.symlink():
+			if found && old.symlink() && old.Target == e.Target {
+				continue
+			}
+			h.set(opKey, symlinkOp)
+			h.setPath(targetKey, e.Target)
+			err = h.write(output)
+		case e.Link != "":
+			if found && old.Link == e.Link && !replaced[e.Link] {
+				continue
+			}
+			h.set(opKey, hardlinkOp)
+			h.setPath(fromKey, e.Link)
+			err = h.write(output)
+		case !e.regular():
+			sameNode := found && old.Mode.Type() == e.Mode.Type() && old.Major == e.Major && old.Minor == e.Minor
+			if sameNode && old.Mode == e.Mode {
+				continue
+			}
+			if sameNode {
+				h.set(opKey, modeOp)
+				h.setMode(e.Mode)
+			} else {
+				h.set(opKey, specialOp)
+				h.setSpecial(e)
+			}
+			err = h.write(output)
+		case found && old.plain() && !treeOptions.Checksum && quickCheck(old, e):
+			if old.Mode == e.Mode {
+				continue
+			}
+			h.set(opKey, modeOp)
+			h.setMode(e.Mode)
+			err = h.write(output)
+		case found && old.regular():
+			// Paths leaving a group of hard links are replaced even when unchanged, to be files of their own
+			replaced[e.Path], err = writeFileDelta(h, old, e, path, spool, output, options)
+		default:
+			replaced[e.Path] = true
+			h.set(opKey, fileOp)
+			h.setMode(e.Mode)
+			h.setNumber(sizeKey, e.Size)
+			err = writeFile(h, path, e.Size, output)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quickCheck tells if the file has the size and the modification time recorded in the manifest, so it is
+// taken as unchanged without reading it
+func quickCheck(old Entry, e Entry) bool {
+	return !old.ModTime.IsZero() && old.Size == e.Size && old.ModTime.Equal(e.ModTime)
+}
+
+// writeDeletes writes the deletion of the selected paths of the manifest that are gone or changed type, in
+// reverse order
+func writeDeletes(m *Manifest, newEntries map[string]Entry, selected func(path string) bool,
+	output io.Writer) error {
+	for i := len(m.Entries) - 1; i >= 0; i-- {
+		old := m.Entries[i]
+		if e, found := newEntries[old.Path]; found && e.Dir == old.Dir || !selected(old.Path) {
+			continue
+		}
+		h := header{path: old.Path}
+		h.set(opKey, deleteOp)
+		if err := h.write(output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile writes the header and the contents of a new file
+func writeFile(h header, path string, size int64, output io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = h.write(output); err != nil {
+		return err
+	}
+	n, err := io.Copy(output, io.LimitReader(f, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writeFileDelta writes the delta of a file against the signature of its basis file in the manifest, and
+// tells if the file is replaced. When the file did not change, only its mode is written, or its copy when the
+// basis file is another one or a hard link to another path
+func writeFileDelta(h header, old Entry, e Entry, path string, spool *os.File, output io.Writer,
+	options d.Options) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err = spool.Truncate(0); err != nil {
+		return false, err
+	}
+	buffered := bufio.NewWriter(spool)
+	err = d.Write(old.Signature, bufio.NewReader(io.LimitReader(f, e.Size)), e.Size, buffered, options)
+	if err != nil {
+		return false, err
+	}
+	if err = buffered.Flush(); err != nil {
+		return false, err
+	}
+	length, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+
+	unchanged, err := isUnchanged(old, e, spool)
+	if err != nil {
+		return false, err
+	}
+	other := old.Path != e.Path
+	if unchanged {
+		switch {
+		case other || old.Link != "":
+			h.set(opKey, copyOp)
+			h.setPath(fromKey, old.Path)
+		case old.Mode == e.Mode:
+			return false, nil
+		default:
+			h.set(opKey, modeOp)
+			h.setMode(e.Mode)
+			return false, h.write(output)
+		}
+		h.setMode(e.Mode)
+		return true, h.write(output)
+	}
+
+	h.set(opKey, deltaOp)
+	if other {
+		h.setPath(fromKey, old.Path)
+	}
+	h.setMode(e.Mode)
+	h.setNumber(basisKey, old.Size)
+	h.setNumber(deltaKey, length)
+	if err = h.write(output); err != nil {
+		return false, err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	_, err = io.CopyN(output, spool, length)
+	return true, err
+}
+
+// isUnchanged tells if the delta in the spool only points at the chunks of the basis file, in order
+func isUnchanged(old Entry, e Entry, spool *os.File) (bool, error) {
+	if old.Size != e.Size {
+		return false, nil
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	r, err := d.NewReader(bufio.NewReader(spool))
+	if err != nil {
+		return false, err
+	}
+	for i := uint32(0); ; i++ {
+		op, err := r.Next()
+		if err == io.EOF {
+			return i == old.Signature.Metadata.ChunkCount, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if op.Type != d.PointerOp || op.Index != i {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package tree
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Options chooses the files of the trees and how they are compared
+type Options struct {
+	Filter *Filter
+	// Checksum compares the contents of all the files, instead of skipping the ones with the size and the
+	// modification time recorded in the manifest
+	Checksum bool
+	// SkipSpecial leaves FIFOs and device files out, as sockets always are
+	SkipSpecial bool
+	// Warn is told about the files that are skipped: by the walk of a tree, and by patches not permitted to
+	// create device files. Nil ignores them
+	Warn func(path string, reason string)
+}
+
+func (o Options) warn(path string, reason string) {
+	if o.Warn != nil {
+		o.Warn(path, reason)
+	}
+}
+
+// Filter chooses the paths of a tree that are synced, with include and exclude rules like the ones of
+// rsync: the first rule matching a path decides, and paths no rule matches are included. The contents of
+// excluded directories are excluded too. A nil filter includes everything
+type Filter struct {
+	rules []rule
+}
+
+type rule struct {
+	include bool
+	pattern string
+	// Patterns with a slash match the whole path, the others its last element
+	anchored bool
+	dirOnly  bool
+}
+
+// NewFilter returns the filter of the rules, in order. Each rule is "+ pattern" to include the paths
+// matching the pattern, "- pattern" to exclude them, or ". file" to read more rules from a file, one per
+// line, where empty lines and lines starting with # are skipped. Patterns are those of path.Match; a
+// pattern ending with a slash only matches directories, and one starting with a slash is anchored to the
+// root of the tree
+func NewFilter(rules ...string) (*Filter, error) {
+	f := &Filter{}
+	for _, r := range rules {
+		if err := f.add(r, true); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *Filter) add(line string, mergeFiles bool) error {
+	kind, pattern, found := strings.Cut(line, " ")
+	if !found || pattern == "" {
+		return fmt.Errorf("invalid filter rule %q", line)
+	}
+	switch kind {
+	case "+", "-":
+	case ".":
+		if !mergeFiles {
+			return fmt.Errorf("filter file %v read from another filter file", pattern)
+		}
+		return f.readFile(pattern)
+	default:
+		return fmt.Errorf("invalid filter rule %q, use + pattern, - pattern or . file", line)
+	}
+
+	r := rule{include: kind == "+"}
+	r.dirOnly = strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	r.anchored = strings.Contains(pattern, "/")
+	r.pattern = strings.TrimPrefix(pattern, "/")
+	if _, err := path.Match(r.pattern, ""); err != nil || r.pattern == "" {
+		return fmt.Errorf("invalid filter pattern %q", pattern)
+	}
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+func (f *Filter) readFile(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	lines := bufio.NewScanner(in)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = f.add(line, false); err != nil {
+			return fmt.Errorf("%v:%d: %w", file, n, err)
+		}
+	}
+	return lines.Err()
+}
+
+// matches tells if the path is included by the rules, without looking at its parents
+func (f *Filter) matches(p string, dir bool) bool {
+	if f == nil {
+		return true
+	}
+	for _, r := range f.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+		name := p
+		if !r.anchored {
+			name = path.Base(p)
+		}
+		if matched, _ := path.Match(r.pattern, name); matched {
+			return r.include
+		}
+	}
+	return true
+}
+
+// Includes tells if the slash separated path, relative to the root of the tree, is synced: neither the
+// path nor one of its parents is excluded
+func (f *Filter) Includes(p string, dir bool) bool {
+	if f == nil {
+		return true
+	}
+	for parent := path.Dir(p); parent != "."; parent = path.Dir(parent) {
+		if !f.matches(parent, true) {
+			return false
+		}
+	}
+	return f.matches(p, dir)
+}
@@ -0,0 +1,311 @@
+package tree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"strconv"
+	"strings"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// Manifests and bundles start with a line naming them and their version, then have one entry per path.
+// Each entry is a line with the quoted path, slash separated and relative to the directory, followed by
+// key=value fields, and the data announced by the fields, if any. They are written with version 1 unless
+// they have links or special files
+const (
+	manifestKind  = "rh-manifest"
+	bundleKind    = "rh-bundle"
+	formatVersion = 2 // latest version that can be read
+	linksVersion  = 2 // first version with symbolic links, hard links and special files
+)
+
+// Lines longer than this are not accepted, so a file without line breaks cannot be read in memory
+const maxLineSize = 1 << 16
+
+// Fields of the entries
+const (
+	typeKey      = "type"      // type of the entries of manifests, and of the special files of bundles
+	opKey        = "op"        // change of the path, in bundles
+	modeKey      = "mode"      // permissions, in octal
+	sizeKey      = "size"      // size of the file
+	modTimeKey   = "mtime"     // modification time of the file in nanoseconds since 1970, in manifests
+	hashKey      = "sha256"    // hash of the whole file, in manifests
+	signatureKey = "signature" // length of the signature of the file that follows the entry, in manifests
+	basisKey     = "basis"     // size of the basis file of a delta, in bundles
+	deltaKey     = "delta"     // length of the delta that follows the entry, in bundles
+	fromKey      = "from"      // quoted path of the file copied, renamed, patched or linked, when it is another one
+	targetKey    = "target"    // quoted target of a symbolic link
+	linkKey      = "link"      // quoted first path of the tree of a file with several hard links, in manifests
+	majorKey     = "major"     // major number of a device file
+	minorKey     = "minor"     // minor number of a device file
+)
+
+// Types of the manifest entries
+const (
+	fileType        = "f"
+	dirType         = "d"
+	symlinkType     = "l"
+	hardlinkType    = "h" // one of the other paths of a file with several hard links
+	fifoType        = "p"
+	charDeviceType  = "c"
+	blockDeviceType = "b"
+)
+
+// specialTypes are the types of the special files, as in the output of ls -l
+var specialTypes = map[string]fs.FileMode{
+	fifoType:        fs.ModeNamedPipe,
+	charDeviceType:  fs.ModeDevice | fs.ModeCharDevice,
+	blockDeviceType: fs.ModeDevice,
+}
+
+// Changes of the bundle entries
+const (
+	deleteOp   = "delete"   // removes the path
+	dirOp      = "dir"      // creates a directory
+	fileOp     = "file"     // creates or replaces a file with the size bytes that follow
+	deltaOp    = "delta"    // patches the file with the delta that follows
+	modeOp     = "mode"     // only changes the permissions
+	copyOp     = "copy"     // copies another file
+	renameOp   = "rename"   // moves another file
+	symlinkOp  = "symlink"  // creates or replaces a symbolic link
+	hardlinkOp = "hardlink" // creates or replaces a hard link to another file
+	specialOp  = "special"  // creates or replaces a FIFO or a device file
+)
+
+type field struct {
+	key   string
+	value string
+}
+
+// header is the line starting an entry
+type header struct {
+	path   string
+	fields []field
+}
+
+func (h *header) set(key string, value string) {
+	h.fields = append(h.fields, field{key: key, value: value})
+}
+
+func (h *header) setNumber(key string, value int64) {
+	h.set(key, strconv.FormatInt(value, 10))
+}
+
+func (h *header) setPath(key string, path string) {
+	h.set(key, strconv.Quote(path))
+}
+
+func (h *header) setMode(mode fs.FileMode) {
+	h.set(modeKey, strconv.FormatUint(uint64(mode.Perm()), 8))
+}
+
+// setSpecial sets the type, the mode and the device numbers of a special file
+func (h *header) setSpecial(e Entry) {
+	for t, mode := range specialTypes {
+		if e.Mode.Type() == mode {
+			h.set(typeKey, t)
+		}
+	}
+	h.setMode(e.Mode)
+	if e.Mode&fs.ModeDevice != 0 {
+		h.setNumber(majorKey, int64(e.Major))
+		h.setNumber(minorKey, int64(e.Minor))
+	}
+}
+
+func (h *header) get(key string) (string, bool) {
+	for _, f := range h.fields {
+		if f.key == key {
+			return f.value, true
+		}
+	}
+	return "", false
+}
+
+// number returns the value of a field holding a size, the error wrapping invalid when it has none
+func (h *header) number(key string, invalid error) (int64, error) {
+	value, found := h.get(key)
+	if !found {
+		return 0, fmt.Errorf("%w: %q without %v", invalid, h.path, key)
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %q with invalid %v %q", invalid, h.path, key, value)
+	}
+	return n, nil
+}
+
+// fromPath returns the path of the from field, the path of the entry itself when it has none
+func (h *header) fromPath(invalid error) (string, error) {
+	from, found := h.get(fromKey)
+	if !found {
+		return h.path, nil
+	}
+	if !fs.ValidPath(from) || from == "." {
+		return "", fmt.Errorf("%w: %q from invalid path %q", invalid, h.path, from)
+	}
+	return from, nil
+}
+
+// special reads the type, the mode and the device numbers of a special file into the entry
+func (h *header) special(e *Entry, invalid error) error {
+	t, _ := h.get(typeKey)
+	special, found := specialTypes[t]
+	if !found {
+		return fmt.Errorf("%w: %q of unknown type %q", invalid, h.path, t)
+	}
+	mode, err := h.mode(invalid)
+	if err != nil {
+		return err
+	}
+	e.Mode = mode | special
+	if special&fs.ModeDevice == 0 {
+		return nil
+	}
+	major, err := h.number(majorKey, invalid)
+	if err != nil {
+		return err
+	}
+	minor, err := h.number(minorKey, invalid)
+	if err != nil {
+		return err
+	}
+	if major > math.MaxUint32 || minor > math.MaxUint32 {
+		return fmt.Errorf("%w: %q with invalid device numbers %d,%d", invalid, h.path, major, minor)
+	}
+	e.Major, e.Minor = uint32(major), uint32(minor)
+	return nil
+}
+
+// target returns the target of a symbolic link
+func (h *header) target(invalid error) (string, error) {
+	target, found := h.get(targetKey)
+	if !found || target == "" || strings.ContainsRune(target, 0) {
+		return "", fmt.Errorf("%w: %q with invalid %v %q", invalid, h.path, targetKey, target)
+	}
+	return target, nil
+}
+
+func (h *header) mode(invalid error) (fs.FileMode, error) {
+	value, found := h.get(modeKey)
+	if !found {
+		return 0, fmt.Errorf("%w: %q without %v", invalid, h.path, modeKey)
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > uint64(fs.ModePerm) {
+		return 0, fmt.Errorf("%w: %q with invalid %v %q", invalid, h.path, modeKey, value)
+	}
+	return fs.FileMode(mode), nil
+}
+
+func (h *header) write(output io.Writer) error {
+	line := new(strings.Builder)
+	line.WriteString(strconv.Quote(h.path))
+	for _, f := range h.fields {
+		fmt.Fprintf(line, " %v=%v", f.key, f.value)
+	}
+	line.WriteByte('\n')
+	_, err := io.WriteString(output, line.String())
+	return err
+}
+
+// readLine reads a line without its line break, or io.EOF at the end of the input. Lines cut by the end
+// of the input are truncated, and format errors wrap invalid
+func readLine(input *bufio.Reader, invalid error) (string, error) {
+	line := make([]byte, 0, 128)
+	for {
+		b, err := input.ReadByte()
+		if err == io.EOF && len(line) > 0 {
+			return "", fmt.Errorf("%w: entry without line break", s.ErrTruncated)
+		}
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) == maxLineSize {
+			return "", fmt.Errorf("%w: line longer than %d bytes", invalid, maxLineSize)
+		}
+		line = append(line, b)
+	}
+}
+
+// readHeader reads the header of the next entry, or returns io.EOF after the last one. Paths are checked
+// to stay inside the directory
+func readHeader(input *bufio.Reader, invalid error) (header, error) {
+	line, err := readLine(input, invalid)
+	if err != nil {
+		return header{}, err
+	}
+	quoted, err := strconv.QuotedPrefix(line)
+	if err != nil {
+		return header{}, fmt.Errorf("%w: entry without quoted path %q", invalid, line)
+	}
+	h := header{}
+	h.path, _ = strconv.Unquote(quoted)
+	if !fs.ValidPath(h.path) || h.path == "." {
+		return header{}, fmt.Errorf("%w: invalid path %q", invalid, h.path)
+	}
+	// Fields are separated by spaces, and values with spaces are quoted
+	rest := line[len(quoted):]
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			return h, nil
+		}
+		key, value, found := strings.Cut(rest, "=")
+		if !found || key == "" || strings.Contains(key, " ") {
+			return header{}, fmt.Errorf("%w: %q with invalid field %q", invalid, h.path, rest)
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return header{}, fmt.Errorf("%w: %q with invalid %v %v", invalid, h.path, key, value)
+			}
+			rest = value[len(quoted):]
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			value, rest, _ = strings.Cut(value, " ")
+		}
+		h.set(key, value)
+	}
+}
+
+func writeKind(output io.Writer, kind string, version int) error {
+	_, err := fmt.Fprintf(output, "%v v=%d\n", kind, version)
+	return err
+}
+
+// versionOf returns the oldest version that can list the entries
+func versionOf(entries []Entry) int {
+	for _, e := range entries {
+		if !e.Dir && !e.plain() {
+			return linksVersion
+		}
+	}
+	return 1
+}
+
+// readKind checks the first line of a manifest or a bundle, the error wrapping invalid when it is not one
+func readKind(input *bufio.Reader, kind string, invalid error) error {
+	line, err := readLine(input, invalid)
+	if err == io.EOF {
+		return fmt.Errorf("%w: empty %v", s.ErrTruncated, kind)
+	}
+	if err != nil {
+		return err
+	}
+	var version int
+	if _, err = fmt.Sscanf(line, kind+" v=%d", &version); err != nil {
+		return fmt.Errorf("%w: not a %v", invalid, kind)
+	}
+	if version > formatVersion {
+		return fmt.Errorf("%w: %v version %d", s.ErrUnsupportedVersion, kind, version)
+	}
+	return nil
+}
@@ -0,0 +1,447 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// Entry is a file, a directory, a symbolic link or a special file of a tree
+type Entry struct {
+	Path      string // slash separated, relative to the directory of the tree
+	Dir       bool
+	Mode      fs.FileMode // permissions, with the type of symbolic links and special files
+	Size      int64
+	ModTime   time.Time       // of files, zero when not recorded
+	Hash      string          // hex SHA-256 of files, in manifests, empty when not recorded
+	Signature s.SignatureData // of files, in manifests
+	Target    string          // of symbolic links
+	// Link is the first path of the tree of a file with several hard links, for its other paths, which
+	// have the size, the mode and the signature of the first one
+	Link  string
+	Major uint32 // of device files
+	Minor uint32
+}
+
+// regular tells if the entry is a regular file, maybe a hard link to another path
+func (e Entry) regular() bool {
+	return !e.Dir && e.Mode.Type() == 0
+}
+
+// plain tells if the entry is a regular file that is not a hard link to another path
+func (e Entry) plain() bool {
+	return e.regular() && e.Link == ""
+}
+
+// symlink tells if the entry is a symbolic link
+func (e Entry) symlink() bool {
+	return e.Mode&fs.ModeSymlink != 0
+}
+
+// Manifest is the signature of a directory tree: its entries in the order of a walk of the tree, with the
+// signature of each file
+type Manifest struct {
+	Entries []Entry
+	paths   map[string]int
+}
+
+// Entry returns the entry of the path, if the manifest has one
+func (m *Manifest) Entry(path string) (Entry, bool) {
+	i, found := m.paths[path]
+	if !found {
+		return Entry{}, false
+	}
+	return m.Entries[i], true
+}
+
+// filter returns the manifest of the entries the filter includes
+func (m *Manifest) filter(f *Filter) *Manifest {
+	if f == nil {
+		return m
+	}
+	filtered := &Manifest{}
+	for _, e := range m.Entries {
+		if f.Includes(e.Path, e.Dir) {
+			filtered.add(e)
+		}
+	}
+	return filtered
+}
+
+func (m *Manifest) add(e Entry) {
+	if m.paths == nil {
+		m.paths = make(map[string]int)
+	}
+	m.paths[e.Path] = len(m.Entries)
+	m.Entries = append(m.Entries, e)
+}
+
+// readLinkFS is a file system that can read the targets of its symbolic links, like the ReadLinkFS of later
+// versions of io/fs
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// dirFS is the file system of a directory of the operating system
+type dirFS string
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(dir)).Open(name)
+}
+
+func (dir dirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Readlink(filepath.Join(string(dir), filepath.FromSlash(name)))
+}
+
+// displayPath names the path of the file system in errors
+func displayPath(fsys fs.FS, name string) string {
+	if dir, ok := fsys.(dirFS); ok {
+		return filepath.Join(string(dir), filepath.FromSlash(name))
+	}
+	return name
+}
+
+// withDisplayPath names the path of the error as displayPath does
+func withDisplayPath(fsys fs.FS, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		pathErr.Path = displayPath(fsys, pathErr.Path)
+	}
+	return err
+}
+
+// walk lists what is under the root of the file system the filter of the options includes, parents before
+// children and in lexical order, as tar does: symbolic links are not followed, the paths of a file after the
+// first one are hard links to it, and FIFOs and device files are listed unless the options skip them.
+// Sockets are skipped, and so are symbolic links when the file system cannot read them
+func walk(fsys fs.FS, root string, options Options) ([]Entry, error) {
+	var entries []Entry
+	links := make(map[fileID]string)
+	err := fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return withDisplayPath(fsys, err)
+		}
+		if p == root {
+			if !d.IsDir() {
+				return fmt.Errorf("%v is not a directory", displayPath(fsys, root))
+			}
+			return nil
+		}
+		rel := p
+		if root != "." {
+			rel = strings.TrimPrefix(p, root+"/")
+		}
+		if !options.Filter.matches(rel, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := Entry{Path: rel, Dir: d.IsDir(), Mode: fi.Mode().Perm()}
+		switch t := fi.Mode().Type(); {
+		case e.Dir:
+		case t == 0:
+			e.Size = fi.Size()
+			e.ModTime = fi.ModTime()
+			if id, found := hardLinkID(fi); found {
+				if first, seen := links[id]; seen {
+					e.Link = first
+				} else {
+					links[id] = e.Path
+				}
+			}
+		case t == fs.ModeSymlink:
+			linkFS, ok := fsys.(readLinkFS)
+			if !ok {
+				options.warn(e.Path, "symbolic link skipped, its target cannot be read")
+				return nil
+			}
+			e.Mode |= t
+			if e.Target, err = linkFS.ReadLink(p); err != nil {
+				return err
+			}
+		case t&(fs.ModeNamedPipe|fs.ModeDevice) != 0 && !options.SkipSpecial:
+			e.Mode |= t
+			if t&fs.ModeDevice != 0 {
+				e.Major, e.Minor = deviceNumbers(fi)
+			}
+		default:
+			options.warn(e.Path, fmt.Sprintf("%v skipped", describeType(t)))
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// describeType names the type of a file that is not synced
+func describeType(t fs.FileMode) string {
+	switch {
+	case t&fs.ModeSocket != 0:
+		return "socket"
+	case t&fs.ModeNamedPipe != 0:
+		return "FIFO"
+	case t&fs.ModeDevice != 0:
+		return "device file"
+	}
+	return "irregular file"
+}
+
+// GetSignature = computes the manifest of the directory
+func GetSignature(dir string, options s.Options, treeOptions Options) ([]byte, error) {
+	return GetSignatureFS(dirFS(dir), ".", options, treeOptions)
+}
+
+// Signature writes the manifest of the directory to the manifest file, with the signatures of the files
+// computed with the options. Only the paths the filter of the tree options includes are listed, and the
+// special files unless the tree options skip them
+func Signature(dir string, manifestFile string, options s.Options, treeOptions Options) error {
+	out, err := atomicfile.Create(manifestFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	output := bufio.NewWriter(out)
+	compressed, err := codec.NewWriter(output, options.Codec)
+	if err != nil {
+		return err
+	}
+	err = WriteSignature(dir, compressed, options, treeOptions)
+	if err != nil {
+		return err
+	}
+	err = compressed.Close()
+	if err != nil {
+		return err
+	}
+	err = output.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// WriteSignature writes the manifest of the directory to output, not compressed
+func WriteSignature(dir string, output io.Writer, options s.Options, treeOptions Options) error {
+	return WriteSignatureFS(dirFS(dir), ".", output, options, treeOptions)
+}
+
+// GetSignatureFS = computes the manifest of the tree under the root directory of the file system, such as an
+// embedded file system or a zip archive. The targets of symbolic links are read when the file system has a
+// ReadLink method, like the ReadLinkFS of later versions of io/fs
+func GetSignatureFS(fsys fs.FS, root string, options s.Options, treeOptions Options) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	output, err := codec.NewWriter(buf, options.Codec)
+	if err != nil {
+		return nil, err
+	}
+	err = WriteSignatureFS(fsys, root, output, options, treeOptions)
+	if err != nil {
+		return nil, err
+	}
+	err = output.Close()
+	return buf.Bytes(), err
+}
+
+// WriteSignatureFS writes the manifest of the tree under the root directory of the file system to output, not
+// compressed
+func WriteSignatureFS(fsys fs.FS, root string, output io.Writer, options s.Options, treeOptions Options) error {
+	if !fs.ValidPath(root) {
+		return &fs.PathError{Op: "walk", Path: root, Err: fs.ErrInvalid}
+	}
+	entries, err := walk(fsys, root, treeOptions)
+	if err != nil {
+		return err
+	}
+	if err = writeKind(output, manifestKind, versionOf(entries)); err != nil {
+		return err
+	}
+	options.Codec = nil
+	sig := new(bytes.Buffer)
+	for _, e := range entries {
+		h := header{path: e.Path}
+		if !e.plain() {
+			switch {
+			case e.Dir:
+				h.set(typeKey, dirType)
+				h.setMode(e.Mode)
+			case e.symlink():
+				h.set(typeKey, symlinkType)
+				h.setPath(targetKey, e.Target)
+			case e.Link != "":
+				h.set(typeKey, hardlinkType)
+				h.setPath(linkKey, e.Link)
+			default:
+				h.setSpecial(e)
+			}
+			if err = h.write(output); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sig.Reset()
+		hash, err := signFile(fsys, path.Join(root, e.Path), e.Size, sig, options)
+		if err != nil {
+			return withDisplayPath(fsys, err)
+		}
+		h.set(typeKey, fileType)
+		h.setMode(e.Mode)
+		h.setNumber(sizeKey, e.Size)
+		// Files of embedded file systems have no modification time
+		if !e.ModTime.IsZero() {
+			h.setNumber(modTimeKey, e.ModTime.UnixNano())
+		}
+		h.set(hashKey, hash)
+		h.setNumber(signatureKey, int64(sig.Len()))
+		if err = h.write(output); err != nil {
+			return err
+		}
+		if _, err = output.Write(sig.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signFile writes the signature of the file and returns the hash of its contents
+func signFile(fsys fs.FS, name string, size int64, output io.Writer, options s.Options) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	input := bufio.NewReader(io.TeeReader(io.LimitReader(f, size), hash))
+	if err = s.Write(input, size, output, options); err != nil {
+		return "", err
+	}
+	// The whole file is hashed even if the signature did not read all of it
+	if _, err = io.Copy(io.Discard, input); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ParseManifestFile reads a manifest, compressed or not
+func ParseManifestFile(manifestFile string, limits s.Limits) (*Manifest, error) {
+	f, err := os.Open(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseManifest(bufio.NewReader(f), limits)
+}
+
+// ParseManifest reads a manifest, compressed or not. The signature of each file is parsed within the limits
+func ParseManifest(input io.Reader, limits s.Limits) (*Manifest, error) {
+	decoded, _, err := codec.NewReader(input)
+	if err != nil {
+		return nil, err
+	}
+	defer decoded.Close()
+	r := bufio.NewReader(decoded)
+	if err = readKind(r, manifestKind, s.ErrInvalidSignature); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	for {
+		h, err := readHeader(r, s.ErrInvalidSignature)
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, found := m.Entry(h.path); found {
+			return nil, fmt.Errorf("%w: %q listed twice", s.ErrInvalidSignature, h.path)
+		}
+		e, err := readEntry(r, h, m, limits)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", h.path, err)
+		}
+		m.add(e)
+	}
+}
+
+// readEntry reads the entry of the header, and the signature following it. Hard links take the size, the mode
+// and the signature of the entry of m they link to
+func readEntry(r *bufio.Reader, h header, m *Manifest, limits s.Limits) (Entry, error) {
+	e := Entry{Path: h.path}
+	var err error
+	switch t, _ := h.get(typeKey); t {
+	case symlinkType:
+		e.Mode = fs.ModeSymlink | fs.ModePerm
+		e.Target, err = h.target(s.ErrInvalidSignature)
+		return e, err
+	case hardlinkType:
+		first, _ := h.get(linkKey)
+		linked, found := m.Entry(first)
+		if !found || !linked.plain() {
+			return Entry{}, fmt.Errorf("%w: hard link to %q, which is not a file listed before",
+				s.ErrInvalidSignature, first)
+		}
+		linked.Path, linked.Link = e.Path, first
+		return linked, nil
+	case dirType, fileType:
+	default:
+		err = h.special(&e, s.ErrInvalidSignature)
+		return e, err
+	}
+	if e.Mode, err = h.mode(s.ErrInvalidSignature); err != nil {
+		return Entry{}, err
+	}
+	if t, _ := h.get(typeKey); t == dirType {
+		e.Dir = true
+		return e, nil
+	}
+	if e.Size, err = h.number(sizeKey, s.ErrInvalidSignature); err != nil {
+		return Entry{}, err
+	}
+	if value, found := h.get(modTimeKey); found {
+		// Times before 1970 are negative
+		modTime, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return Entry{}, fmt.Errorf("%w: invalid %v %q", s.ErrInvalidSignature, modTimeKey, value)
+		}
+		e.ModTime = time.Unix(0, modTime)
+	}
+	if hash, found := h.get(hashKey); found {
+		if sum, err := hex.DecodeString(hash); err != nil || len(sum) != sha256.Size {
+			return Entry{}, fmt.Errorf("%w: invalid %v %q", s.ErrInvalidSignature, hashKey, hash)
+		}
+		e.Hash = hash
+	}
+	length, err := h.number(signatureKey, s.ErrInvalidSignature)
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Signature, err = s.ParseFromReaderWithLimits(io.NopCloser(io.LimitReader(r, length)), length, limits)
+	return e, err
+}
@@ -0,0 +1,127 @@
+package tree
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// match is the basis file a new file is copied or patched from, when the manifest has nothing at its path
+type match struct {
+	source Entry
+	exact  bool // same contents
+}
+
+// sources indexes the basis files new files can be matched against, by hash and by chunk checksum
+type sources struct {
+	entries []Entry
+	hashes  map[string]int
+	chunks  map[uint32]map[string][]int // chunk size, then checksum, to the entries holding the chunk
+	sizes   []uint32
+}
+
+func newSources(m *Manifest, newEntries map[string]Entry) *sources {
+	src := &sources{hashes: make(map[string]int), chunks: make(map[uint32]map[string][]int)}
+	for _, old := range m.Entries {
+		// Basis files turned into directories are removed before the directories are created
+		if e, found := newEntries[old.Path]; !old.plain() || old.Size == 0 || found && e.Dir {
+			continue
+		}
+		i := len(src.entries)
+		src.entries = append(src.entries, old)
+		if _, found := src.hashes[old.Hash]; old.Hash != "" && !found {
+			src.hashes[old.Hash] = i
+		}
+		size := old.Signature.Metadata.ChunkSize
+		if src.chunks[size] == nil {
+			src.chunks[size] = make(map[string][]int)
+			src.sizes = append(src.sizes, size)
+		}
+		for _, sum := range old.Signature.Checksums {
+			holders := src.chunks[size][sum]
+			if len(holders) == 0 || holders[len(holders)-1] != i {
+				src.chunks[size][sum] = append(holders, i)
+			}
+		}
+	}
+	sort.Slice(src.sizes, func(i, j int) bool { return src.sizes[i] < src.sizes[j] })
+	return src
+}
+
+// findMatches finds a basis file for each new file at a path the manifest does not list: one with the
+// same contents, or else the one sharing the most chunks with it. Files sharing nothing have no match
+func findMatches(m *Manifest, newDir string, entries []Entry, newEntries map[string]Entry) (map[string]match,
+	error) {
+	matches := make(map[string]match)
+	src := newSources(m, newEntries)
+	if len(src.entries) == 0 {
+		return matches, nil
+	}
+	for _, e := range entries {
+		if _, found := m.Entry(e.Path); !e.plain() || e.Size == 0 || found {
+			continue
+		}
+		mt, found, err := src.find(filepath.Join(newDir, filepath.FromSlash(e.Path)), e.Size)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			matches[e.Path] = mt
+		}
+	}
+	return matches, nil
+}
+
+func (src *sources) find(path string, size int64) (match, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return match{}, false, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, io.LimitReader(f, size)); err != nil {
+		return match{}, false, err
+	}
+	if i, found := src.hashes[hex.EncodeToString(hash.Sum(nil))]; found {
+		return match{source: src.entries[i], exact: true}, true, nil
+	}
+
+	// The chunks of the file are compared at the positions a delta would look for them
+	shared := make([]int, len(src.entries))
+	for _, chunkSize := range src.sizes {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return match{}, false, err
+		}
+		input := bufio.NewReader(io.LimitReader(f, size))
+		chunk := make([]byte, chunkSize)
+		for {
+			n, err := io.ReadFull(input, chunk)
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return match{}, false, err
+			}
+			for _, i := range src.chunks[chunkSize][s.GetChecksum(chunk[:n])] {
+				shared[i]++
+			}
+		}
+	}
+	best := -1
+	for i, n := range shared {
+		if n > 0 && (best < 0 || n > shared[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return match{}, false, nil
+	}
+	return match{source: src.entries[best]}, true, nil
+}
@@ -0,0 +1,276 @@
+package tree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/popescuag/RH/internal/pkg/atomicfile"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// errSpecialUnsupported is returned when special files cannot be created on the system
+var errSpecialUnsupported = errors.New("special files not supported")
+
+// Patch applies the bundle to the directory, in place. Each file is replaced at once, but a bundle that
+// fails midway leaves the directory partly patched
+func Patch(dir string, bundleFile string) error {
+	return PatchWithOptions(dir, bundleFile, Options{})
+}
+
+// PatchWithOptions is Patch telling the Warn function of the options about the device files the process is
+// not permitted to create, which are skipped
+func PatchWithOptions(dir string, bundleFile string, options Options) error {
+	f, err := os.Open(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ApplyWithOptions(dir, bufio.NewReader(f), options)
+}
+
+// Apply applies the bundle read from input, compressed or not, to the directory
+func Apply(dir string, input io.Reader) error {
+	return ApplyWithOptions(dir, input, Options{})
+}
+
+// ApplyWithOptions is Apply telling the Warn function of the options about the special files it skips
+func ApplyWithOptions(dir string, input io.Reader, options Options) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	decoded, _, err := codec.NewReader(input)
+	if err != nil {
+		return err
+	}
+	defer decoded.Close()
+	r := bufio.NewReader(decoded)
+	if err = readKind(r, bundleKind, d.ErrInvalidDelta); err != nil {
+		return err
+	}
+
+	for {
+		h, err := readHeader(r, d.ErrInvalidDelta)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = applyEntry(dir, h, r, options); err != nil {
+			return fmt.Errorf("%q: %w", h.path, err)
+		}
+	}
+}
+
+func applyEntry(dir string, h header, r *bufio.Reader, options Options) error {
+	path := filepath.Join(dir, filepath.FromSlash(h.path))
+	op, _ := h.get(opKey)
+	from, err := h.fromPath(d.ErrInvalidDelta)
+	if err != nil {
+		return err
+	}
+	// Symbolic links made by the bundle must not lead it out of the directory
+	if err = checkParents(dir, h.path); err != nil {
+		return err
+	}
+	if err = checkParents(dir, from); err != nil {
+		return err
+	}
+	// The basis file of copies, renames, deltas and hard links
+	basisPath := filepath.Join(dir, filepath.FromSlash(from))
+
+	switch op {
+	case deleteOp:
+		return os.Remove(path)
+	case symlinkOp:
+		target, err := h.target(d.ErrInvalidDelta)
+		if err != nil {
+			return err
+		}
+		return replaceWith(path, func(tmp string) error {
+			return os.Symlink(target, tmp)
+		})
+	case hardlinkOp:
+		if err = checkRegular(basisPath, from); err != nil {
+			return err
+		}
+		return replaceWith(path, func(tmp string) error {
+			return os.Link(basisPath, tmp)
+		})
+	case specialOp:
+		e := Entry{}
+		if err = h.special(&e, d.ErrInvalidDelta); err != nil {
+			return err
+		}
+		err = replaceWith(path, func(tmp string) error {
+			if err := makeSpecial(tmp, e); err != nil {
+				return err
+			}
+			// The mode given to mknod is masked by the umask
+			return os.Chmod(tmp, e.Mode.Perm())
+		})
+		if errors.Is(err, fs.ErrPermission) || errors.Is(err, errSpecialUnsupported) {
+			options.warn(h.path, fmt.Sprintf("%v not created: %v", describeType(e.Mode.Type()), err))
+			return nil
+		}
+		return err
+	}
+	mode, err := h.mode(d.ErrInvalidDelta)
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case modeOp:
+		// Chmod follows symbolic links
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: mode of a symbolic link", d.ErrInvalidDelta)
+		}
+		return os.Chmod(path, mode)
+	case dirOp:
+		if err = os.Mkdir(path, mode); err != nil {
+			return err
+		}
+		// The mode given to Mkdir is masked by the umask
+		return os.Chmod(path, mode)
+	case fileOp:
+		size, err := h.number(sizeKey, d.ErrInvalidDelta)
+		if err != nil {
+			return err
+		}
+		return replaceFile(path, mode, func(out *os.File) error {
+			n, err := io.CopyN(out, r, size)
+			if err == io.EOF {
+				err = fmt.Errorf("%w: %d of %d bytes of the file", s.ErrTruncated, n, size)
+			}
+			return err
+		})
+	case copyOp:
+		if err = checkRegular(basisPath, from); err != nil {
+			return err
+		}
+		basis, err := os.Open(basisPath)
+		if err != nil {
+			return err
+		}
+		defer basis.Close()
+		return replaceFile(path, mode, func(out *os.File) error {
+			_, err := io.Copy(out, basis)
+			return err
+		})
+	case renameOp:
+		if err = checkRegular(basisPath, from); err != nil {
+			return err
+		}
+		if err = os.Rename(basisPath, path); err != nil {
+			return err
+		}
+		return os.Chmod(path, mode)
+	case deltaOp:
+		basisSize, err := h.number(basisKey, d.ErrInvalidDelta)
+		if err != nil {
+			return err
+		}
+		length, err := h.number(deltaKey, d.ErrInvalidDelta)
+		if err != nil {
+			return err
+		}
+		if err = checkRegular(basisPath, from); err != nil {
+			return err
+		}
+		basis, err := os.Open(basisPath)
+		if err != nil {
+			return err
+		}
+		defer basis.Close()
+		fi, err := basis.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() != basisSize {
+			return fmt.Errorf("%w: file of %d bytes instead of %d", patch.ErrBasisMismatch, fi.Size(), basisSize)
+		}
+		return replaceFile(path, mode, func(out *os.File) error {
+			delta := &io.LimitedReader{R: r, N: length}
+			if err := patch.Apply(basis, basisSize, delta, out); err != nil {
+				return err
+			}
+			if delta.N > 0 {
+				return fmt.Errorf("%w: %d bytes after the end of the delta", d.ErrInvalidDelta, delta.N)
+			}
+			return nil
+		})
+	}
+	return fmt.Errorf("%w: unknown change %q", d.ErrInvalidDelta, op)
+}
+
+// checkParents makes sure no parent of the slash separated path is a symbolic link
+func checkParents(dir string, p string) error {
+	for parent := path.Dir(p); parent != "."; parent = path.Dir(parent) {
+		fi, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(parent)))
+		if err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %q is a symbolic link", d.ErrInvalidDelta, parent)
+		}
+	}
+	return nil
+}
+
+// checkRegular makes sure the basis file is a regular file, and not a symbolic link
+func checkRegular(basisPath string, from string) error {
+	fi, err := os.Lstat(basisPath)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%w: %q is not a regular file", d.ErrInvalidDelta, from)
+	}
+	return nil
+}
+
+// replaceWith makes the file with create at a temporary path next to path, then moves it to path
+func replaceWith(path string, create func(tmp string) error) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := create(tmp); err != nil {
+		return err
+	}
+	err := os.Rename(tmp, path)
+	// Renaming a hard link to another link of the same file does nothing
+	if removeErr := os.Remove(tmp); err == nil && removeErr != nil && !os.IsNotExist(removeErr) {
+		err = removeErr
+	}
+	return err
+}
+
+// replaceFile writes the file atomically with the given mode
+func replaceFile(path string, mode fs.FileMode, write func(out *os.File) error) error {
+	out, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err = write(out.File); err != nil {
+		return err
+	}
+	out.SetMode(mode)
+	return out.Commit()
+}
@@ -0,0 +1,50 @@
+package tree
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID identifies a file on its file system
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinkID returns the identity of a file with several hard links, so its paths can be grouped
+func hardLinkID(fi fs.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// deviceNumbers returns the major and minor numbers of a device file, in the encoding of glibc
+func deviceNumbers(fi fs.FileInfo) (uint32, uint32) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(st.Rdev)
+	return uint32(dev>>8&0xfff | dev>>32&^0xfff), uint32(dev&0xff | dev>>12&^0xff)
+}
+
+// makeSpecial creates a FIFO or a device file. Only privileged processes can create device files
+func makeSpecial(path string, e Entry) error {
+	mode := uint32(e.Mode.Perm())
+	switch {
+	case e.Mode&fs.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case e.Mode&fs.ModeCharDevice != 0:
+		mode |= syscall.S_IFCHR
+	default:
+		mode |= syscall.S_IFBLK
+	}
+	major, minor := uint64(e.Major), uint64(e.Minor)
+	dev := minor&0xff | major&0xfff<<8 | minor&^0xff<<12 | major&^0xfff<<32
+	if err := syscall.Mknod(path, mode, int(dev)); err != nil {
+		return &fs.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
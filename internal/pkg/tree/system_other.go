@@ -0,0 +1,27 @@
+//go:build !linux
+
+package tree
+
+import (
+	"fmt"
+	"io/fs"
+	"runtime"
+)
+
+// fileID identifies a file on its file system
+type fileID struct{}
+
+// hardLinkID returns the identity of a file with several hard links, which is not known on this system
+func hardLinkID(fi fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// deviceNumbers returns the major and minor numbers of a device file, which are not known on this system
+func deviceNumbers(fi fs.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// makeSpecial creates a FIFO or a device file, which is not supported on this system
+func makeSpecial(path string, e Entry) error {
+	return fmt.Errorf("%w: special files are not supported on %v", errSpecialUnsupported, runtime.GOOS)
+}
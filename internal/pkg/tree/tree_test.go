@@ -0,0 +1,540 @@
+package tree
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/popescuag/RH/internal/pkg/codec"
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTree creates the files, and the directories of the paths ending with a slash
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for path, contents := range files {
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		if strings.HasSuffix(path, "/") {
+			assert.Nil(t, os.MkdirAll(full, 0755))
+			continue
+		}
+		assert.Nil(t, os.MkdirAll(filepath.Dir(full), 0755))
+		assert.Nil(t, os.WriteFile(full, []byte(contents), 0644))
+	}
+}
+
+// readTree returns the contents of the files of the directory, the modes of everything, the directories
+// with a slash and the targets of the symbolic links
+func readTree(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		assert.Nil(t, err)
+		if path == dir {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fi, err := e.Info()
+		assert.Nil(t, err)
+		if e.IsDir() {
+			files[filepath.ToSlash(rel)+"/"] = fi.Mode().Perm().String()
+			return nil
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			assert.Nil(t, err)
+			files[filepath.ToSlash(rel)] = "-> " + target
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			files[filepath.ToSlash(rel)] = fi.Mode().String()
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		files[filepath.ToSlash(rel)] = fi.Mode().Perm().String() + " " + string(data)
+		return nil
+	})
+	assert.Nil(t, err)
+	return files
+}
+
+// setModTimes sets the modification time of all the files of the directory, so the quick check of deltas
+// does not depend on the resolution of the file system
+func setModTimes(t *testing.T, dir string, modTime time.Time) {
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		assert.Nil(t, err)
+		return os.Chtimes(path, modTime, modTime)
+	})
+	assert.Nil(t, err)
+}
+
+func randomText(r *rand.Rand, size int) string {
+	data := make([]byte, size)
+	r.Read(data)
+	return string(data)
+}
+
+func TestTree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	large := randomText(r, 100000)
+	basis := map[string]string{
+		"unchanged":        large,
+		"changed":          large,
+		"removed":          "removed",
+		"dir/nested":       "nested",
+		"gone/a":           "a",
+		"gone/b/c":         "c",
+		"empty/":           "",
+		"mode":             "mode",
+		"file becomes dir": "file",
+	}
+	newTree := map[string]string{
+		"unchanged":          large,
+		"changed":            large[:50000] + "replaced" + large[50008:],
+		"dir/nested":         "nested",
+		"dir/new":            "new file",
+		"added/deeper/file":  randomText(r, 5000),
+		"empty/":             "",
+		"new empty/":         "",
+		"mode":               "mode",
+		"file becomes dir/x": "x",
+		"with \"quotes\"\n":  "newline",
+	}
+
+	for _, c := range []codec.Codec{nil, codec.Gzip} {
+		dir := t.TempDir()
+		basisDir := filepath.Join(dir, "basis")
+		newDir := filepath.Join(dir, "new")
+		writeTree(t, basisDir, basis)
+		writeTree(t, newDir, newTree)
+		setModTimes(t, basisDir, time.Unix(1e9, 0))
+		assert.Nil(t, os.Chmod(filepath.Join(newDir, "mode"), 0600))
+		assert.Nil(t, os.Chmod(filepath.Join(newDir, "new empty"), 0700))
+		assert.Nil(t, os.Chmod(filepath.Join(newDir, "dir/new"), 0600))
+
+		manifestFile := filepath.Join(dir, "manifest")
+		bundleFile := filepath.Join(dir, "bundle")
+		options := s.Options{ChunkSize: s.FixedChunkSizePolicy(4096), Codec: c}
+		assert.Nil(t, Signature(basisDir, manifestFile, options, Options{}))
+		assert.Nil(t, Delta(manifestFile, newDir, bundleFile, d.Options{Codec: c}, Options{}))
+		fi, err := os.Stat(bundleFile)
+		assert.Nil(t, err)
+		assert.Less(t, fi.Size(), int64(len(large)/10), "only the changes are in the bundle")
+
+		assert.Nil(t, Patch(basisDir, bundleFile))
+		assert.Equal(t, readTree(t, newDir), readTree(t, basisDir))
+	}
+}
+
+func TestMoves(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	moved, copied, edited := randomText(r, 50000), randomText(r, 50000), randomText(r, 50000)
+	basis := map[string]string{
+		"old dir/moved": moved,
+		"copied":        copied,
+		"edited":        edited,
+		"twice":         moved[:20000],
+	}
+	newTree := map[string]string{
+		"new dir/moved":   moved,
+		"copied":          copied,
+		"copy":            copied,
+		"renamed/edited":  edited[:30000] + "replaced" + edited[30008:],
+		"twice 1":         moved[:20000],
+		"twice 2":         moved[:20000],
+		"with \"quotes\"": copied,
+	}
+
+	for _, withHashes := range []bool{true, false} {
+		dir := t.TempDir()
+		basisDir := filepath.Join(dir, "basis")
+		newDir := filepath.Join(dir, "new")
+		writeTree(t, basisDir, basis)
+		writeTree(t, newDir, newTree)
+
+		manifest, err := GetSignature(basisDir, s.Options{ChunkSize: s.FixedChunkSizePolicy(4096)}, Options{})
+		assert.Nil(t, err)
+		if !withHashes {
+			manifest = regexp.MustCompile(` sha256=[0-9a-f]+`).ReplaceAll(manifest, nil)
+		}
+		bundle, err := GetDelta(manifest, newDir, d.Options{}, Options{})
+		assert.Nil(t, err)
+		assert.Less(t, len(bundle), 10000, "the files are taken from the basis files")
+		if withHashes {
+			assert.Contains(t, string(bundle), "\"new dir/moved\" op=rename from=\"old dir/moved\"")
+			assert.Contains(t, string(bundle), "\"copy\" op=copy from=\"copied\"")
+			assert.Contains(t, string(bundle), "\"renamed/edited\" op=delta from=\"edited\"")
+		}
+
+		assert.Nil(t, Apply(basisDir, bytes.NewReader(bundle)))
+		assert.Equal(t, readTree(t, newDir), readTree(t, basisDir))
+	}
+}
+
+// writeLinks creates the symbolic links to the targets, and the hard links to the files
+func writeLinks(t *testing.T, dir string, symlinks map[string]string, hardlinks map[string]string) {
+	for path, target := range symlinks {
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(full), 0755))
+		assert.Nil(t, os.Symlink(target, full))
+	}
+	for path, file := range hardlinks {
+		assert.Nil(t, os.Link(filepath.Join(dir, filepath.FromSlash(file)), filepath.Join(dir, filepath.FromSlash(path))))
+	}
+}
+
+func sameFile(t *testing.T, dir string, a string, b string) bool {
+	fa, err := os.Stat(filepath.Join(dir, a))
+	assert.Nil(t, err)
+	fb, err := os.Stat(filepath.Join(dir, b))
+	assert.Nil(t, err)
+	return os.SameFile(fa, fb)
+}
+
+func TestLinks(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	large := randomText(r, 50000)
+	dir := t.TempDir()
+	basisDir := filepath.Join(dir, "basis")
+	newDir := filepath.Join(dir, "new")
+	writeTree(t, basisDir, map[string]string{
+		"file":                "contents",
+		"file becomes link":   "x",
+		"group/a":             large,
+		"leaving/a":           "leaving",
+		"dir becomes link/x/": "",
+	})
+	writeLinks(t, basisDir, map[string]string{
+		"link":              "file",
+		"changed link":      "file",
+		"link becomes file": "file",
+	}, map[string]string{"group/b": "group/a", "leaving/b": "leaving/a"})
+	writeTree(t, newDir, map[string]string{
+		"file":              "contents",
+		"link becomes file": "now a file",
+		"group/a":           large[:20000] + "replaced" + large[20008:],
+		"leaving/a":         "leaving",
+		"leaving/b":         "leaving",
+		"new group/x":       "new",
+	})
+	writeLinks(t, newDir, map[string]string{
+		"link":              "file",
+		"changed link":      "../outside",
+		"file becomes link": "file",
+		"dir becomes link":  "group",
+	}, map[string]string{"group/b": "group/a", "group/c": "group/a", "new group/y": "new group/x"})
+	fifo := makeSpecial(filepath.Join(newDir, "fifo"), Entry{Mode: fs.ModeNamedPipe | 0640}) == nil
+
+	manifest, err := GetSignature(basisDir, s.Options{}, Options{})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(manifest), "rh-manifest v=2\n"))
+	assert.Contains(t, string(manifest), "\"link\" type=l target=\"file\"\n")
+	assert.Contains(t, string(manifest), "\"group/b\" type=h link=\"group/a\"\n")
+	bundle, err := GetDelta(manifest, newDir, d.Options{}, Options{})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(bundle), "\"link\"", "the link did not change")
+	assert.Contains(t, string(bundle), "\"group/b\" op=hardlink from=\"group/a\"", "group/a is replaced")
+	assert.Contains(t, string(bundle), "\"leaving/b\" op=copy from=\"leaving/b\"")
+	if fifo {
+		assert.Contains(t, string(bundle), "\"fifo\" op=special type=p mode=640\n")
+	}
+
+	assert.Nil(t, Apply(basisDir, bytes.NewReader(bundle)))
+	assert.Equal(t, readTree(t, newDir), readTree(t, basisDir))
+	assert.True(t, sameFile(t, basisDir, "group/a", "group/b"))
+	assert.True(t, sameFile(t, basisDir, "group/a", "group/c"))
+	assert.True(t, sameFile(t, basisDir, "new group/x", "new group/y"))
+	assert.False(t, sameFile(t, basisDir, "leaving/a", "leaving/b"))
+
+	// Special files can be left out, like sockets always are
+	var warnings []string
+	options := Options{SkipSpecial: true, Warn: func(path string, reason string) {
+		warnings = append(warnings, path+": "+reason)
+	}}
+	manifest, err = GetSignature(newDir, s.Options{}, options)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(manifest), "\"fifo\"")
+	if fifo {
+		assert.Equal(t, []string{"fifo: FIFO skipped"}, warnings)
+	}
+}
+
+func TestDeviceFiles(t *testing.T) {
+	dir := t.TempDir()
+	bundle := "rh-bundle v=2\n\"null\" op=special type=c mode=666 major=1 minor=3\n"
+	var warnings []string
+	err := ApplyWithOptions(dir, strings.NewReader(bundle), Options{Warn: func(path string, reason string) {
+		warnings = append(warnings, path)
+	}})
+	assert.Nil(t, err)
+	if len(warnings) > 0 {
+		// Not permitted to create device files
+		assert.Equal(t, []string{"null"}, warnings)
+		return
+	}
+
+	manifest, err := GetSignature(dir, s.Options{}, Options{})
+	assert.Nil(t, err)
+	assert.Contains(t, string(manifest), "\"null\" type=c mode=666 major=1 minor=3\n")
+	m, err := ParseManifest(bytes.NewReader(manifest), s.DefaultLimits)
+	assert.Nil(t, err)
+	assert.Equal(t, []Entry{{Path: "null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0666, Major: 1, Minor: 3}},
+		m.Entries)
+}
+
+func TestSignatureFS(t *testing.T) {
+	modTime := time.Unix(1e9, 0)
+	large := strings.Repeat("large", 2000)
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a/b": "b", "c": large, "d/": ""})
+	setModTimes(t, dir, modTime)
+	writeLinks(t, dir, map[string]string{"link": "c"}, nil)
+	fsys := fstest.MapFS{
+		"root":          {Mode: fs.ModeDir | 0755},
+		"root/a":        {Mode: fs.ModeDir | 0755},
+		"root/a/b":      {Data: []byte("b"), Mode: 0644, ModTime: modTime},
+		"root/c":        {Data: []byte(large), Mode: 0644, ModTime: modTime},
+		"root/d":        {Mode: fs.ModeDir | 0755},
+		"root/link":     {Data: []byte("c"), Mode: fs.ModeSymlink | 0777},
+		"other/ignored": {Data: []byte("ignored")},
+	}
+
+	expected, err := GetSignature(dir, s.Options{}, Options{})
+	assert.Nil(t, err)
+	manifest, err := GetSignatureFS(fsys, "root", s.Options{}, Options{})
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected, manifest), "same manifest as the one of the directory")
+
+	// Symbolic links are skipped when the file system cannot read them
+	var warnings []string
+	manifest, err = GetSignatureFS(struct{ fs.FS }{fsys}, "root", s.Options{}, Options{
+		Warn: func(path string, reason string) {
+			warnings = append(warnings, path)
+		}})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(manifest), "\"link\"")
+	assert.Equal(t, []string{"link"}, warnings)
+
+	// Zip archives list the directories of their files even without entries for them
+	zipped := new(bytes.Buffer)
+	w := zip.NewWriter(zipped)
+	for _, name := range []string{"tree/a/b", "tree/c"} {
+		f, err := w.Create(name)
+		assert.Nil(t, err)
+		_, err = f.Write(fsys["root/"+strings.TrimPrefix(name, "tree/")].Data)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+	r, err := zip.NewReader(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	assert.Nil(t, err)
+	manifest, err = GetSignatureFS(r, "tree", s.Options{}, Options{})
+	assert.Nil(t, err)
+	m, err := ParseManifest(bytes.NewReader(manifest), s.DefaultLimits)
+	assert.Nil(t, err)
+	paths := []string{}
+	for _, e := range m.Entries {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal(t, []string{"a", "a/b", "c"}, paths)
+	c, _ := m.Entry("c")
+	assert.Equal(t, int64(len(large)), c.Size)
+
+	_, err = GetSignatureFS(fsys, "root/c", s.Options{}, Options{})
+	assert.EqualError(t, err, "root/c is not a directory")
+	_, err = GetSignatureFS(fsys, "/root", s.Options{}, Options{})
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+}
+
+func TestFilter(t *testing.T) {
+	dir := t.TempDir()
+	rulesFile := filepath.Join(dir, "rules")
+	assert.Nil(t, os.WriteFile(rulesFile, []byte("# build outputs\n\n- *.o\n+ /keep/*.tmp\n"), 0644))
+	f, err := NewFilter("- cache/", ". "+rulesFile, "- *.tmp", "- /top")
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		path     string
+		dir      bool
+		included bool
+	}{
+		{path: "a/main.go", included: true},
+		{path: "a/main.o", included: false},
+		{path: "cache", dir: true, included: false},
+		{path: "cache", included: true},
+		{path: "a/cache/file", included: false},
+		{path: "keep/x.tmp", included: true},
+		{path: "a/keep/x.tmp", included: false},
+		{path: "x.tmp", included: false},
+		{path: "top", included: false},
+		{path: "top/file", included: false},
+		{path: "a/top", included: true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.included, f.Includes(tc.path, tc.dir), tc.path)
+	}
+	assert.True(t, (*Filter)(nil).Includes("anything", false))
+
+	for _, rule := range []string{"* a", "-", "- [", "- /", ". " + filepath.Join(dir, "missing")} {
+		_, err = NewFilter(rule)
+		assert.NotNil(t, err, rule)
+	}
+	assert.Nil(t, os.WriteFile(rulesFile, []byte(". "+rulesFile+"\n"), 0644))
+	_, err = NewFilter(". " + rulesFile)
+	assert.NotNil(t, err, "filter files do not read other ones")
+}
+
+func TestFilteredTree(t *testing.T) {
+	dir := t.TempDir()
+	basisDir := filepath.Join(dir, "basis")
+	newDir := filepath.Join(dir, "new")
+	writeTree(t, basisDir, map[string]string{"src/a.go": "a", "src/a.o": "old object", "cache/x": "x"})
+	writeTree(t, newDir, map[string]string{"src/a.go": "changed a", "src/b.o": "object", "b.go": "b"})
+
+	filter, err := NewFilter("- *.o", "- cache/")
+	assert.Nil(t, err)
+	options := Options{Filter: filter}
+	manifest, err := GetSignature(basisDir, s.Options{}, options)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(manifest), "a.o")
+	assert.NotContains(t, string(manifest), "cache")
+
+	// Excluded paths are neither synced nor deleted, even when the manifest lists them
+	manifest, err = GetSignature(basisDir, s.Options{}, Options{})
+	assert.Nil(t, err)
+	bundle, err := GetDelta(manifest, newDir, d.Options{}, options)
+	assert.Nil(t, err)
+	assert.Nil(t, Apply(basisDir, bytes.NewReader(bundle)))
+	assert.Equal(t, map[string]string{
+		"src/":     "-rwxr-xr-x",
+		"src/a.go": "-rw-r--r-- changed a",
+		"src/a.o":  "-rw-r--r-- old object",
+		"cache/":   "-rwxr-xr-x",
+		"cache/x":  "-rw-r--r-- x",
+		"b.go":     "-rw-r--r-- b",
+	}, readTree(t, basisDir))
+}
+
+func TestQuickCheck(t *testing.T) {
+	dir := t.TempDir()
+	basisDir := filepath.Join(dir, "basis")
+	newDir := filepath.Join(dir, "new")
+	writeTree(t, basisDir, map[string]string{"same": "basis", "touched": "basis"})
+	writeTree(t, newDir, map[string]string{"same": "other", "touched": "other"})
+	modTime := time.Unix(1e9, 0)
+	setModTimes(t, basisDir, modTime)
+	setModTimes(t, newDir, modTime)
+	touched := filepath.Join(newDir, "touched")
+	assert.Nil(t, os.Chtimes(touched, modTime, modTime.Add(time.Second)))
+
+	manifest, err := GetSignature(basisDir, s.Options{}, Options{})
+	assert.Nil(t, err)
+	bundle, err := GetDelta(manifest, newDir, d.Options{}, Options{})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(bundle), "\"same\"", "the size and the modification time did not change")
+	assert.Contains(t, string(bundle), "\"touched\"")
+
+	bundle, err = GetDelta(manifest, newDir, d.Options{}, Options{Checksum: true})
+	assert.Nil(t, err)
+	assert.Contains(t, string(bundle), "\"same\"")
+	assert.Nil(t, Apply(basisDir, bytes.NewReader(bundle)))
+	assert.Equal(t, readTree(t, newDir), readTree(t, basisDir))
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a/b": "b", "c": strings.Repeat("c", 5000), "d/": ""})
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteSignature(dir, buf, s.Options{ChunkSize: s.FixedChunkSizePolicy(1024)}, Options{}))
+	m, err := ParseManifest(bytes.NewReader(buf.Bytes()), s.DefaultLimits)
+	assert.Nil(t, err)
+
+	paths := []string{}
+	for _, e := range m.Entries {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal(t, []string{"a", "a/b", "c", "d"}, paths)
+	c, found := m.Entry("c")
+	assert.True(t, found)
+	assert.Equal(t, int64(5000), c.Size)
+	assert.Equal(t, fs.FileMode(0644), c.Mode)
+	assert.Equal(t, uint32(5), c.Signature.Metadata.ChunkCount)
+
+	manifest := buf.String()
+	testCases := []struct {
+		name     string
+		manifest string
+		err      error
+	}{
+		{name: "Empty", manifest: "", err: s.ErrTruncated},
+		{name: "Not a manifest", manifest: "rh-bundle v=1\n", err: s.ErrInvalidSignature},
+		{name: "Newer version", manifest: "rh-manifest v=3\n", err: s.ErrUnsupportedVersion},
+		{name: "Truncated", manifest: manifest[:len(manifest)-10], err: s.ErrTruncated},
+		{name: "Outside the directory", manifest: "rh-manifest v=1\n\"../a\" type=d mode=755\n",
+			err: s.ErrInvalidSignature},
+		{name: "Listed twice", manifest: "rh-manifest v=1\n\"a\" type=d mode=755\n\"a\" type=d mode=755\n",
+			err: s.ErrInvalidSignature},
+		{name: "Without mode", manifest: "rh-manifest v=1\n\"a\" type=d\n", err: s.ErrInvalidSignature},
+		{name: "Invalid modification time", manifest: "rh-manifest v=1\n\"a\" type=f mode=644 size=0 mtime=x signature=0\n",
+			err: s.ErrInvalidSignature},
+		{name: "Invalid hash", manifest: "rh-manifest v=1\n\"a\" type=f mode=644 size=0 sha256=abc signature=0\n",
+			err: s.ErrInvalidSignature},
+		{name: "Unterminated quote", manifest: "rh-manifest v=1\n\"a\" type=d mode=755 x=\"y\n",
+			err: s.ErrInvalidSignature},
+		{name: "Unknown type", manifest: "rh-manifest v=2\n\"a\" type=s mode=755\n", err: s.ErrInvalidSignature},
+		{name: "Hard link to a path not listed before", manifest: "rh-manifest v=2\n\"b\" type=h link=\"a\"\n",
+			err: s.ErrInvalidSignature},
+		{name: "Symbolic link without target", manifest: "rh-manifest v=2\n\"a\" type=l\n",
+			err: s.ErrInvalidSignature},
+		{name: "Device without numbers", manifest: "rh-manifest v=2\n\"a\" type=b mode=600\n",
+			err: s.ErrInvalidSignature},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseManifest(strings.NewReader(tc.manifest), s.DefaultLimits)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "basis"})
+	testCases := []struct {
+		name   string
+		bundle string
+		err    error
+	}{
+		{name: "Outside the directory", bundle: "rh-bundle v=1\n\"../a\" op=delete\n", err: d.ErrInvalidDelta},
+		{name: "Absolute path", bundle: "rh-bundle v=1\n\"/a\" op=delete\n", err: d.ErrInvalidDelta},
+		{name: "Unknown change", bundle: "rh-bundle v=1\n\"a\" op=link mode=644\n", err: d.ErrInvalidDelta},
+		{name: "Truncated file", bundle: "rh-bundle v=1\n\"b\" op=file mode=644 size=10\nabc", err: s.ErrTruncated},
+		{name: "Copy from outside the directory", bundle: "rh-bundle v=1\n\"b\" op=copy from=\"../a\" mode=644\n",
+			err: d.ErrInvalidDelta},
+		{name: "Rename of a directory", bundle: "rh-bundle v=1\n\"c\" op=dir mode=755\n\"b\" op=rename from=\"c\" mode=644\n",
+			err: d.ErrInvalidDelta},
+		{name: "Through a symbolic link", bundle: "rh-bundle v=2\n\"l\" op=symlink target=\"..\"\n" +
+			"\"l/b\" op=file mode=644 size=0\n", err: d.ErrInvalidDelta},
+		{name: "Hard link to a symbolic link", bundle: "rh-bundle v=2\n\"l\" op=symlink target=\"a\"\n" +
+			"\"b\" op=hardlink from=\"l\"\n", err: d.ErrInvalidDelta},
+		{name: "Basis of another size", bundle: "rh-bundle v=1\n\"a\" op=delta mode=644 basis=4 delta=0\n",
+			err: patch.ErrBasisMismatch},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.ErrorIs(t, Apply(dir, strings.NewReader(tc.bundle)), tc.err)
+		})
+	}
+	// Failed files are not created
+	_, err := os.Stat(filepath.Join(dir, "b"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,87 +1,537 @@
-package validator
-
-import (
-	"errors"
-	"fmt"
-	"os"
-
-	"github.com/popescuag/RH/internal/pkg/signature"
-)
-
-const (
-	SIGNATURE_CMD = "signature"
-	DELTA_CMD     = "delta"
-	min_file_size = 64
-)
-
-func ValidateInputParams(params []string) error {
-	if len(params) < 3 {
-		return fmt.Errorf("3 or more parameters expected (%d provided)", len(params))
-	}
-
-	err := validateOperation(params[0])
-	if err != nil {
-		return err
-	}
-
-	if params[0] == SIGNATURE_CMD {
-		_, err = validateSignatureParams(params[1:])
-	} else {
-		err = validateDeltaParams(params[1:])
-	}
-
-	return err
-}
-
-func validateOperation(operation string) error {
-	if operation != SIGNATURE_CMD && operation != DELTA_CMD {
-		return errors.New("first paramter should be signature or delta")
-	}
-	return nil
-}
-
-func validateSignatureParams(params []string) (int64, error) {
-	if len(params) != 2 {
-		return 0, fmt.Errorf("signature function requires exactly 2 parameters (%d provided)", len(params))
-	}
-
-	s, err := os.Stat(params[0])
-	if err != nil {
-		return 0, fmt.Errorf("file %v not found", params[0])
-	}
-
-	if s.Size() < min_file_size {
-		return 0, fmt.Errorf("input file %v too small", params[0])
-	}
-
-	return s.Size(), nil
-}
-
-func validateDeltaParams(params []string) error {
-	if len(params) != 3 {
-		return fmt.Errorf("delta function requires exactly 3 parameters (%d provided)", len(params))
-	}
-
-	_, err := os.Stat(params[0])
-	if err != nil {
-		return fmt.Errorf("signature file %v not found", params[0])
-	}
-
-	_, err = os.Stat(params[1])
-	if err != nil {
-		return fmt.Errorf("file %v cannot be found", params[1])
-	}
-
-	_, err = signature.ParseFromFile(params[0])
-	if err != nil {
-		return fmt.Errorf("file %v is not a valid signature file", params[0])
-	}
-
-	f, err := os.Create(params[2])
-	if err != nil {
-		return fmt.Errorf("cannot create %v file", params[2])
-	}
-	defer f.Close()
-
-	return nil
-}
+package validator
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/popescuag/RH/internal/pkg/algorithm"
+	"github.com/popescuag/RH/internal/pkg/codec"
+	"github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/rdiff"
+	"github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/popescuag/RH/internal/pkg/tree"
+)
+
+const (
+	SIGNATURE_CMD      = "signature"
+	DELTA_CMD          = "delta"
+	PATCH_CMD          = "patch"
+	VALIDATE_DELTA_CMD = "validate-delta"
+	COMPOSE_CMD        = "compose"
+	DIFF_CMD           = "diff"
+)
+
+// ErrInvalidParams is returned when the command line cannot be understood
+var ErrInvalidParams = errors.New("invalid parameters")
+
+// Command is the operation to run, with its files and options, as parsed from the command line
+type Command struct {
+	Operation string
+	Files     []string
+	ChunkSize int
+	InPlace   bool
+	Rollback  bool
+	Resume    bool
+	Reverse   string
+	Literals  string
+	Compress  string
+	Algorithm string
+	Format    string
+	Recursive bool
+	Filters   []string // rules of the tree filter, in the order of the command line
+	Checksum  bool
+	// SkipSpecial leaves the FIFOs and device files of trees out
+	SkipSpecial bool
+	// NoMetadata leaves out the mode, modification time, owner and extended attributes of the files
+	NoMetadata bool
+	// Checkpoint keeps the partial output of a failed patch with its checkpoint, so it can be resumed
+	Checkpoint bool
+	// SignatureMetadata records the metadata of the basis file in its signature, which older readers cannot parse
+	SignatureMetadata bool
+}
+
+// Formats of signature and delta files other than the one of this tool. The rdiff format is written by
+// the algorithm of the same name, and the vcdiff one holds the deltas of the other algorithms
+const (
+	RDIFF_FORMAT  = "rdiff"
+	VCDIFF_FORMAT = "vcdiff"
+)
+
+func ValidateInputParams(params []string) (Command, error) {
+	if len(params) < 3 {
+		return Command{}, fmt.Errorf("%w: 3 or more parameters expected (%d provided)", ErrInvalidParams, len(params))
+	}
+
+	err := validateOperation(params[0])
+	if err != nil {
+		return Command{}, err
+	}
+
+	cmd := Command{Operation: params[0]}
+	flags := newFlagSet(&cmd)
+	err = flags.Parse(params[1:])
+	if err != nil {
+		return cmd, fmt.Errorf("%w: %v", ErrInvalidParams, err)
+	}
+	cmd.Files = flags.Args()
+
+	err = validateFormat(&cmd)
+	if err != nil {
+		return cmd, err
+	}
+	if cmd.SignatureMetadata && cmd.NoMetadata {
+		return cmd, fmt.Errorf("%w: --signature-metadata and --no-metadata cannot be used together", ErrInvalidParams)
+	}
+	if cmd.Recursive {
+		return cmd, validateTreeParams(cmd)
+	}
+	if len(cmd.Filters) > 0 || cmd.Checksum {
+		return cmd, fmt.Errorf("%w: --include, --exclude, --filter-file and --checksum only apply to -r",
+			ErrInvalidParams)
+	}
+	if cmd.SkipSpecial {
+		return cmd, fmt.Errorf("%w: --skip-special only applies to -r", ErrInvalidParams)
+	}
+
+	switch cmd.Operation {
+	case SIGNATURE_CMD:
+		_, err = validateSignatureParams(cmd.Files)
+		if err == nil && cmd.ChunkSize != 0 {
+			err = signature.ValidateChunkSize(cmd.ChunkSize)
+		}
+		if err == nil {
+			err = validateCodec(cmd.Compress)
+		}
+		if err == nil {
+			err = validateAlgorithm(cmd.Algorithm)
+		}
+	case DELTA_CMD:
+		// Deltas of librsync signatures are written by rdiff
+		if cmd.Algorithm == "" && len(cmd.Files) > 0 && isRdiffSignature(cmd.Files[0]) {
+			cmd.Algorithm = algorithm.Rdiff.Name()
+		}
+		// Only signatures of the default algorithm are known
+		err = validateDeltaParams(cmd.Files, cmd.Algorithm == "" || cmd.Algorithm == algorithm.Rsync.Name())
+		if err == nil && delta.ValidateLiteralCodec(delta.LiteralCodec(cmd.Literals)) != nil {
+			err = fmt.Errorf("%w: unknown literal codec %q, use flate or zlib", ErrInvalidParams, cmd.Literals)
+		}
+		if err == nil {
+			err = validateCodec(cmd.Compress)
+		}
+		if err == nil {
+			err = validateAlgorithm(cmd.Algorithm)
+		}
+	case PATCH_CMD:
+		switch {
+		case cmd.InPlace && cmd.Rollback:
+			err = fmt.Errorf("%w: --in-place and --rollback cannot be used together", ErrInvalidParams)
+		case cmd.Resume && (cmd.InPlace || cmd.Rollback):
+			err = fmt.Errorf("%w: --resume only applies to patches written to an output file", ErrInvalidParams)
+		case cmd.Checkpoint && (cmd.InPlace || cmd.Rollback):
+			err = fmt.Errorf("%w: --checkpoint only applies to patches written to an output file", ErrInvalidParams)
+		case cmd.Reverse != "" && (cmd.InPlace || cmd.Rollback):
+			err = fmt.Errorf("%w: --reverse only applies to patches written to an output file", ErrInvalidParams)
+		case cmd.Rollback:
+			err = validateRollbackParams(cmd.Files)
+		case cmd.InPlace:
+			err = validateInPlacePatchParams(cmd.Files)
+		default:
+			err = validatePatchParams(cmd.Files)
+			if err == nil && cmd.Reverse != "" {
+				err = validateOutputFile(cmd.Reverse, "reverse delta")
+			}
+		}
+	case VALIDATE_DELTA_CMD:
+		err = validateDeltaValidationParams(cmd.Files)
+	case COMPOSE_CMD:
+		err = validateComposeParams(cmd.Files)
+	case DIFF_CMD:
+		err = validateDiffParams(cmd.Files)
+		if err == nil && cmd.ChunkSize != 0 {
+			err = signature.ValidateChunkSize(cmd.ChunkSize)
+		}
+		if err == nil && delta.ValidateLiteralCodec(delta.LiteralCodec(cmd.Literals)) != nil {
+			err = fmt.Errorf("%w: unknown literal codec %q, use flate or zlib", ErrInvalidParams, cmd.Literals)
+		}
+		if err == nil {
+			err = validateCodec(cmd.Compress)
+		}
+		if err == nil {
+			err = validateAlgorithm(cmd.Algorithm)
+		}
+	}
+
+	return cmd, err
+}
+
+func newFlagSet(cmd *Command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.Operation, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+
+	if cmd.Operation == SIGNATURE_CMD || cmd.Operation == DIFF_CMD {
+		flags.IntVar(&cmd.ChunkSize, "chunk-size", 0, "chunk size in bytes (chosen from the file size by default)")
+	}
+	if cmd.Operation == SIGNATURE_CMD || cmd.Operation == DELTA_CMD || cmd.Operation == DIFF_CMD {
+		flags.StringVar(&cmd.Compress, "compress", "", "compress the whole output file with the codec")
+	}
+	if cmd.Operation == DELTA_CMD || cmd.Operation == DIFF_CMD {
+		flags.StringVar(&cmd.Literals, "compress-literals", "", "compress new data with the flate or zlib codec")
+	}
+	if cmd.Operation == SIGNATURE_CMD || cmd.Operation == DELTA_CMD || cmd.Operation == DIFF_CMD {
+		flags.StringVar(&cmd.Algorithm, "algorithm", "", "compute the signature and the delta with the named algorithm")
+		flags.StringVar(&cmd.Format, "format", "", "write the signature and the delta in the rh, rdiff or vcdiff format")
+	}
+	if cmd.Operation == SIGNATURE_CMD || cmd.Operation == DELTA_CMD || cmd.Operation == PATCH_CMD {
+		flags.BoolVar(&cmd.Recursive, "r", false, "sign, diff or patch a whole directory tree")
+	}
+	if cmd.Operation == SIGNATURE_CMD || cmd.Operation == DELTA_CMD {
+		addRule := func(prefix string) func(string) error {
+			return func(value string) error {
+				cmd.Filters = append(cmd.Filters, prefix+value)
+				return nil
+			}
+		}
+		flags.Func("include", "sync the paths of the tree matching the pattern", addRule("+ "))
+		flags.Func("exclude", "do not sync the paths of the tree matching the pattern", addRule("- "))
+		flags.Func("filter-file", "read include (+ pattern) and exclude (- pattern) rules from the file", addRule(". "))
+		flags.BoolVar(&cmd.SkipSpecial, "skip-special", false, "skip the FIFOs and device files of the tree")
+	}
+	if cmd.Operation == SIGNATURE_CMD || cmd.Operation == DELTA_CMD || cmd.Operation == DIFF_CMD ||
+		cmd.Operation == PATCH_CMD {
+		flags.BoolVar(&cmd.NoMetadata, "no-metadata", false, "do not record or apply the mode, modification time, "+
+			"owner and extended attributes of the files")
+	}
+	if cmd.Operation == SIGNATURE_CMD {
+		flags.BoolVar(&cmd.SignatureMetadata, "signature-metadata", false, "also record the mode, modification "+
+			"time, owner and extended attributes of the basis file in the signature")
+	}
+	if cmd.Operation == DELTA_CMD {
+		flags.BoolVar(&cmd.Checksum, "checksum", false, "compare the contents of the tree files even when their "+
+			"size and modification time did not change")
+	}
+	if cmd.Operation == PATCH_CMD {
+		flags.BoolVar(&cmd.InPlace, "in-place", false, "patch the basis file itself instead of writing an output file")
+		flags.BoolVar(&cmd.Rollback, "rollback", false, "undo an interrupted in-place patch of the basis file")
+		flags.BoolVar(&cmd.Checkpoint, "checkpoint", false, "write checkpoints and keep the partial output of a "+
+			"failed or interrupted patch, to resume it")
+		flags.BoolVar(&cmd.Resume, "resume", false, "continue an interrupted patch from its last checkpoint")
+		flags.StringVar(&cmd.Reverse, "reverse", "", "also write the delta that rebuilds the basis file from the output")
+	}
+	return flags
+}
+
+func validateOperation(operation string) error {
+	switch operation {
+	case SIGNATURE_CMD, DELTA_CMD, PATCH_CMD, VALIDATE_DELTA_CMD, COMPOSE_CMD, DIFF_CMD:
+	default:
+		return fmt.Errorf("%w: first paramter should be signature, delta, patch, validate-delta, compose or diff",
+			ErrInvalidParams)
+	}
+	return nil
+}
+
+func validateSignatureParams(params []string) (int64, error) {
+	if len(params) != 2 {
+		return 0, fmt.Errorf("%w: signature function requires exactly 2 parameters (%d provided)", ErrInvalidParams, len(params))
+	}
+
+	s, err := os.Stat(params[0])
+	if err != nil {
+		return 0, fmt.Errorf("input file not found: %w", err)
+	}
+
+	err = validateOutputFile(params[1], "signature")
+	if err != nil {
+		return 0, err
+	}
+
+	return s.Size(), nil
+}
+
+func validateDeltaParams(params []string, parseSignature bool) error {
+	if len(params) != 3 {
+		return fmt.Errorf("%w: delta function requires exactly 3 parameters (%d provided)", ErrInvalidParams, len(params))
+	}
+
+	_, err := os.Stat(params[0])
+	if err != nil {
+		return fmt.Errorf("signature file not found: %w", err)
+	}
+
+	_, err = os.Stat(params[1])
+	if err != nil {
+		return fmt.Errorf("new file not found: %w", err)
+	}
+
+	if parseSignature {
+		_, err = signature.ParseFromFile(params[0])
+		if err != nil {
+			return fmt.Errorf("file %v is not a valid signature file: %w", params[0], err)
+		}
+	}
+
+	return validateOutputFile(params[2], "delta")
+}
+
+func validatePatchParams(params []string) error {
+	if len(params) != 3 {
+		return fmt.Errorf("%w: patch function requires exactly 3 parameters (%d provided)", ErrInvalidParams, len(params))
+	}
+
+	_, err := os.Stat(params[0])
+	if err != nil {
+		return fmt.Errorf("basis file not found: %w", err)
+	}
+
+	_, err = os.Stat(params[1])
+	if err != nil {
+		return fmt.Errorf("delta file not found: %w", err)
+	}
+
+	return validateOutputFile(params[2], "output")
+}
+
+func validateInPlacePatchParams(params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("%w: in-place patch requires exactly 2 parameters (%d provided)", ErrInvalidParams, len(params))
+	}
+
+	_, err := os.Stat(params[0])
+	if err != nil {
+		return fmt.Errorf("basis file not found: %w", err)
+	}
+
+	_, err = os.Stat(params[1])
+	if err != nil {
+		return fmt.Errorf("delta file not found: %w", err)
+	}
+
+	return nil
+}
+
+func validateRollbackParams(params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("%w: rollback requires exactly 1 parameter (%d provided)", ErrInvalidParams, len(params))
+	}
+
+	_, err := os.Stat(params[0])
+	if err != nil {
+		return fmt.Errorf("basis file not found: %w", err)
+	}
+
+	return nil
+}
+
+func validateDeltaValidationParams(params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("%w: validate-delta function requires exactly 2 parameters (%d provided)", ErrInvalidParams,
+			len(params))
+	}
+
+	_, err := os.Stat(params[0])
+	if err != nil {
+		return fmt.Errorf("signature file not found: %w", err)
+	}
+
+	_, err = os.Stat(params[1])
+	if err != nil {
+		return fmt.Errorf("delta file not found: %w", err)
+	}
+
+	return nil
+}
+
+func validateComposeParams(params []string) error {
+	if len(params) < 3 {
+		return fmt.Errorf("%w: compose function requires 2 or more deltas and the output (%d parameters provided)",
+			ErrInvalidParams, len(params))
+	}
+
+	for _, deltaFile := range params[:len(params)-1] {
+		_, err := os.Stat(deltaFile)
+		if err != nil {
+			return fmt.Errorf("delta file not found: %w", err)
+		}
+	}
+
+	return validateOutputFile(params[len(params)-1], "delta")
+}
+
+func validateDiffParams(params []string) error {
+	if len(params) != 3 {
+		return fmt.Errorf("%w: diff function requires exactly 3 parameters (%d provided)", ErrInvalidParams, len(params))
+	}
+
+	_, err := os.Stat(params[0])
+	if err != nil {
+		return fmt.Errorf("old file not found: %w", err)
+	}
+
+	_, err = os.Stat(params[1])
+	if err != nil {
+		return fmt.Errorf("new file not found: %w", err)
+	}
+
+	return validateOutputFile(params[2], "delta")
+}
+
+// validateTreeParams checks the parameters of the operations on directory trees: signature -r <dir>
+// <manifest>, delta -r <manifest> <new dir> <bundle> and patch -r <dir> <bundle>
+func validateTreeParams(cmd Command) error {
+	if cmd.Algorithm != "" && cmd.Algorithm != algorithm.Rsync.Name() || cmd.Format != "" && cmd.Format != "rh" {
+		return fmt.Errorf("%w: directory trees are only signed with the rsync algorithm in the rh format",
+			ErrInvalidParams)
+	}
+	if _, err := tree.NewFilter(cmd.Filters...); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidParams, err)
+	}
+	if cmd.NoMetadata || cmd.SignatureMetadata {
+		return fmt.Errorf("%w: --no-metadata and --signature-metadata do not apply to -r, which keeps the "+
+			"permissions of the tree", ErrInvalidParams)
+	}
+	files := cmd.Files
+	switch cmd.Operation {
+	case SIGNATURE_CMD:
+		if len(files) != 2 {
+			return fmt.Errorf("%w: signature -r requires exactly 2 parameters (%d provided)", ErrInvalidParams,
+				len(files))
+		}
+		if err := validateDir(files[0], "input"); err != nil {
+			return err
+		}
+		if cmd.ChunkSize != 0 {
+			if err := signature.ValidateChunkSize(cmd.ChunkSize); err != nil {
+				return err
+			}
+		}
+		if err := validateCodec(cmd.Compress); err != nil {
+			return err
+		}
+		return validateOutputFile(files[1], "manifest")
+	case DELTA_CMD:
+		if len(files) != 3 {
+			return fmt.Errorf("%w: delta -r requires exactly 3 parameters (%d provided)", ErrInvalidParams, len(files))
+		}
+		if _, err := os.Stat(files[0]); err != nil {
+			return fmt.Errorf("manifest file not found: %w", err)
+		}
+		if err := validateDir(files[1], "new"); err != nil {
+			return err
+		}
+		if delta.ValidateLiteralCodec(delta.LiteralCodec(cmd.Literals)) != nil {
+			return fmt.Errorf("%w: unknown literal codec %q, use flate or zlib", ErrInvalidParams, cmd.Literals)
+		}
+		if err := validateCodec(cmd.Compress); err != nil {
+			return err
+		}
+		return validateOutputFile(files[2], "bundle")
+	default:
+		if cmd.InPlace || cmd.Rollback || cmd.Checkpoint || cmd.Resume || cmd.Reverse != "" {
+			return fmt.Errorf("%w: patch -r always patches the directory in place, without other options",
+				ErrInvalidParams)
+		}
+		if len(files) != 2 {
+			return fmt.Errorf("%w: patch -r requires exactly 2 parameters (%d provided)", ErrInvalidParams, len(files))
+		}
+		if err := validateDir(files[0], "basis"); err != nil {
+			return err
+		}
+		if _, err := os.Stat(files[1]); err != nil {
+			return fmt.Errorf("bundle file not found: %w", err)
+		}
+		return nil
+	}
+}
+
+func validateDir(dir string, kind string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("%v directory not found: %w", kind, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%w: %v is not a directory", ErrInvalidParams, dir)
+	}
+	return nil
+}
+
+// validateCodec checks that the codec is registered, when one is given
+func validateCodec(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := codec.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("%w: %v, use one of %v", ErrInvalidParams, err, strings.Join(codec.Names(), ", "))
+	}
+	return nil
+}
+
+// validateOutputFile checks that the output can be written. Outputs are first written to a temporary
+// file in the same directory, so nothing is created here
+func validateOutputFile(outputFile string, kind string) error {
+	_, err := os.Stat(filepath.Dir(outputFile))
+	if err != nil {
+		return fmt.Errorf("cannot create %v file: %w", kind, err)
+	}
+	return nil
+}
+
+// validateAlgorithm checks that the algorithm has both a signature builder and a differ, when one is given
+func validateAlgorithm(name string) error {
+	if name == "" {
+		return nil
+	}
+	names := algorithm.Names()
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown algorithm %q, use one of %v", ErrInvalidParams, name, strings.Join(names, ", "))
+}
+
+// validateFormat checks the format of the output, and chooses the algorithm writing it
+func validateFormat(cmd *Command) error {
+	switch cmd.Format {
+	case "", "rh":
+		if cmd.Algorithm == algorithm.Rdiff.Name() && cmd.Format != "" {
+			return fmt.Errorf("%w: the rdiff algorithm only writes the rdiff format", ErrInvalidParams)
+		}
+	case RDIFF_FORMAT:
+		if cmd.Algorithm != "" && cmd.Algorithm != algorithm.Rdiff.Name() {
+			return fmt.Errorf("%w: the rdiff format is only written by the rdiff algorithm", ErrInvalidParams)
+		}
+		cmd.Algorithm = algorithm.Rdiff.Name()
+	case VCDIFF_FORMAT:
+		if cmd.Operation == SIGNATURE_CMD {
+			return fmt.Errorf("%w: the vcdiff format only holds deltas", ErrInvalidParams)
+		}
+		if cmd.Algorithm == algorithm.Rdiff.Name() {
+			return fmt.Errorf("%w: the rdiff algorithm only writes the rdiff format", ErrInvalidParams)
+		}
+	default:
+		return fmt.Errorf("%w: unknown format %q, use rh, rdiff or vcdiff", ErrInvalidParams, cmd.Format)
+	}
+	return nil
+}
+
+// isRdiffSignature tells if the file is a librsync signature, compressed or not
+func isRdiffSignature(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	decoded, _, err := codec.NewReader(f)
+	if err != nil {
+		return false
+	}
+	prefix := make([]byte, 4)
+	_, err = io.ReadFull(decoded, prefix)
+	return err == nil && rdiff.IsSignature(prefix)
+}
@@ -1,121 +1,766 @@
-package validator
-
-import (
-	"errors"
-	"fmt"
-	"os"
-	"testing"
-
-	"github.com/stretchr/testify/assert"
-)
-
-func TestValidateOperation(t *testing.T) {
-	assert.Nil(t, validateOperation(DELTA_CMD))
-	assert.Nil(t, validateOperation(SIGNATURE_CMD))
-	assert.NotNil(t, validateOperation("dummyOp"))
-}
-
-func TestValidateSignatureParams(t *testing.T) {
-	validFile := "testdata/validFileForSignature"     // larger than 1kb
-	invalidFile := "testdata/invalidFileForSignature" // smaller than 1kb
-
-	stat, err := os.Stat(validFile)
-	if err != nil {
-		t.Error(err)
-	}
-	size := stat.Size()
-
-	testCases := []struct {
-		name               string
-		input              []string
-		expectedSizeOutput int64
-		expectedError      error
-	}{
-		{
-			name:               "Valid test",
-			input:              []string{validFile, "test"},
-			expectedSizeOutput: size,
-			expectedError:      nil,
-		},
-		{
-			name:               "Too small input file",
-			input:              []string{invalidFile, "test"},
-			expectedSizeOutput: 0,
-			expectedError:      fmt.Errorf("input file %v too small", invalidFile),
-		},
-		{
-			name:               "Input file not found",
-			input:              []string{"invalidFile", "test"},
-			expectedSizeOutput: 0,
-			expectedError:      fmt.Errorf("file %v not found", "invalidFile"),
-		},
-		{
-			name:               "Too many params",
-			input:              []string{"validFile", "test", "extraParam"},
-			expectedSizeOutput: 0,
-			expectedError:      errors.New("signature function requires exactly 2 parameters (3 provided)"),
-		},
-		{
-			name:               "Too few params",
-			input:              []string{},
-			expectedSizeOutput: 0,
-			expectedError:      errors.New("signature function requires exactly 2 parameters (0 provided)"),
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			size, err := validateSignatureParams(tc.input)
-			assert.Equal(t, tc.expectedSizeOutput, size)
-			assert.Equal(t, tc.expectedError, err)
-		})
-	}
-}
-
-func TestValidateDeltaParams(t *testing.T) {
-	testCases := []struct {
-		name          string
-		input         []string
-		expectedError error
-	}{
-		{
-			name:          "Valid test",
-			input:         []string{"testdata/validSignatureFile", "testdata/validNewFile", "delta"},
-			expectedError: nil,
-		},
-		{
-			name:          "Invalid signature file",
-			input:         []string{"testdata/invalidSignatureFile", "testdata/validNewFile", "delta"},
-			expectedError: errors.New("file testdata/invalidSignatureFile is not a valid signature file"),
-		},
-		{
-			name:          "Invalid new file",
-			input:         []string{"testdata/validSignatureFile", "xyxyxy", "delta"},
-			expectedError: errors.New("file xyxyxy cannot be found"),
-		},
-		{
-			name:          "Invalid delta file",
-			input:         []string{"testdata/validSignatureFile", "testdata/validNewFile", "testdata123/delta"},
-			expectedError: errors.New("cannot create testdata123/delta file"),
-		},
-		{
-			name:          "Too many params",
-			input:         []string{"testdata/validSignatureFile", "testdata/validNewFile", "delta", "extraParam"},
-			expectedError: errors.New("delta function requires exactly 3 parameters (4 provided)"),
-		},
-		{
-			name:          "Too few params",
-			input:         []string{},
-			expectedError: errors.New("delta function requires exactly 3 parameters (0 provided)"),
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			t.Run(tc.name, func(t *testing.T) {
-				err := validateDeltaParams(tc.input)
-				assert.Equal(t, tc.expectedError, err)
-			})
-		})
-	}
-}
+package validator
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOperation(t *testing.T) {
+	assert.Nil(t, validateOperation(DELTA_CMD))
+	assert.Nil(t, validateOperation(SIGNATURE_CMD))
+	assert.Nil(t, validateOperation(PATCH_CMD))
+	assert.Nil(t, validateOperation(VALIDATE_DELTA_CMD))
+	assert.Nil(t, validateOperation(COMPOSE_CMD))
+	assert.ErrorIs(t, validateOperation("dummyOp"), ErrInvalidParams)
+}
+
+func TestValidateInputParams(t *testing.T) {
+	validFile := "testdata/validFileForSignature"
+
+	testCases := []struct {
+		name            string
+		input           []string
+		expectedCommand Command
+		expectedError   error
+		expectedMessage string
+	}{
+		{
+			name:  "Signature",
+			input: []string{SIGNATURE_CMD, validFile, "test"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "test"},
+			},
+		},
+		{
+			name:  "Signature with metadata",
+			input: []string{SIGNATURE_CMD, "--signature-metadata", validFile, "test"},
+			expectedCommand: Command{
+				Operation:         SIGNATURE_CMD,
+				Files:             []string{validFile, "test"},
+				SignatureMetadata: true,
+			},
+		},
+		{
+			name:  "Signature with and without metadata",
+			input: []string{SIGNATURE_CMD, "--signature-metadata", "--no-metadata", validFile, "test"},
+			expectedCommand: Command{
+				Operation:         SIGNATURE_CMD,
+				Files:             []string{validFile, "test"},
+				SignatureMetadata: true,
+				NoMetadata:        true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: --signature-metadata and --no-metadata cannot be used together",
+		},
+		{
+			name:  "Signature with chunk size",
+			input: []string{SIGNATURE_CMD, "--chunk-size", "1024", validFile, "test"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "test"},
+				ChunkSize: 1024,
+			},
+		},
+		{
+			name:  "Chunk size too small",
+			input: []string{SIGNATURE_CMD, "--chunk-size=16", validFile, "test"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "test"},
+				ChunkSize: 16,
+			},
+			expectedError:   signature.ErrInvalidChunkSize,
+			expectedMessage: "invalid chunk size: 16 out of range [32, 268435456]",
+		},
+		{
+			name:            "Chunk size is not a number",
+			input:           []string{SIGNATURE_CMD, "--chunk-size=big", validFile, "test"},
+			expectedCommand: Command{Operation: SIGNATURE_CMD},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: invalid value \"big\" for flag -chunk-size: parse error",
+		},
+		{
+			name:            "Chunk size is only for signatures",
+			input:           []string{PATCH_CMD, "--chunk-size=64", validFile, "delta", "output"},
+			expectedCommand: Command{Operation: PATCH_CMD},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: flag provided but not defined: -chunk-size",
+		},
+		{
+			name:  "Delta with compressed literals",
+			input: []string{DELTA_CMD, "--compress-literals", "zlib", "testdata/validSignatureFile", "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DELTA_CMD,
+				Files:     []string{"testdata/validSignatureFile", "testdata/validNewFile", "delta"},
+				Literals:  "zlib",
+			},
+		},
+		{
+			name:  "Unknown literal codec",
+			input: []string{DELTA_CMD, "--compress-literals=lz4", "testdata/validSignatureFile", "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DELTA_CMD,
+				Files:     []string{"testdata/validSignatureFile", "testdata/validNewFile", "delta"},
+				Literals:  "lz4",
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: unknown literal codec \"lz4\", use flate or zlib",
+		},
+		{
+			name:  "Delta compressed with gzip",
+			input: []string{DELTA_CMD, "--compress", "gzip", "testdata/validSignatureFile", "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DELTA_CMD,
+				Files:     []string{"testdata/validSignatureFile", "testdata/validNewFile", "delta"},
+				Compress:  "gzip",
+			},
+		},
+		{
+			name:  "Unknown codec",
+			input: []string{SIGNATURE_CMD, "--compress=lz4", validFile, "signature"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "signature"},
+				Compress:  "lz4",
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: unknown codec: \"lz4\", use one of gzip, none, zlib",
+		},
+		{
+			name:  "Signature algorithm",
+			input: []string{SIGNATURE_CMD, "--algorithm", "bsdiff", validFile, "signature"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "signature"},
+				Algorithm: "bsdiff",
+			},
+		},
+		{
+			name:  "Rdiff signature",
+			input: []string{SIGNATURE_CMD, "--format=rdiff", validFile, "signature"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "signature"},
+				Algorithm: "rdiff",
+				Format:    "rdiff",
+			},
+		},
+		{
+			name:  "Unknown format",
+			input: []string{SIGNATURE_CMD, "--format=xdelta", validFile, "signature"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "signature"},
+				Format:    "xdelta",
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: unknown format \"xdelta\", use rh, rdiff or vcdiff",
+		},
+		{
+			name:  "Vcdiff signature",
+			input: []string{SIGNATURE_CMD, "--format=vcdiff", validFile, "signature"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "signature"},
+				Format:    "vcdiff",
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: the vcdiff format only holds deltas",
+		},
+		{
+			name:  "Vcdiff diff",
+			input: []string{DIFF_CMD, "--format=vcdiff", "--algorithm=blocks", validFile, "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DIFF_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "delta"},
+				Algorithm: "blocks",
+				Format:    "vcdiff",
+			},
+		},
+		{
+			name:  "Rdiff format of another algorithm",
+			input: []string{SIGNATURE_CMD, "--format=rdiff", "--algorithm=bsdiff", validFile, "signature"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "signature"},
+				Algorithm: "bsdiff",
+				Format:    "rdiff",
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: the rdiff format is only written by the rdiff algorithm",
+		},
+		{
+			name:  "Delta of an rdiff signature",
+			input: []string{DELTA_CMD, "testdata/validRdiffSignatureFile", "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DELTA_CMD,
+				Files:     []string{"testdata/validRdiffSignatureFile", "testdata/validNewFile", "delta"},
+				Algorithm: "rdiff",
+			},
+		},
+		{
+			name:  "Diff with chunk size",
+			input: []string{DIFF_CMD, "--chunk-size", "4096", validFile, "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DIFF_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "delta"},
+				ChunkSize: 4096,
+			},
+		},
+		{
+			name:  "Diff algorithm",
+			input: []string{DIFF_CMD, "--algorithm=blocks", validFile, "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DIFF_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "delta"},
+				Algorithm: "blocks",
+			},
+		},
+		{
+			name:  "Unknown diff algorithm",
+			input: []string{DIFF_CMD, "--algorithm=xdelta", validFile, "testdata/validNewFile", "delta"},
+			expectedCommand: Command{
+				Operation: DIFF_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "delta"},
+				Algorithm: "xdelta",
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: unknown algorithm \"xdelta\", use one of blocks, bsdiff, rdiff, rsync",
+		},
+		{
+			name:  "In-place patch",
+			input: []string{PATCH_CMD, "--in-place", validFile, "testdata/validNewFile"},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile, "testdata/validNewFile"},
+				InPlace:   true,
+			},
+		},
+		{
+			name:  "Rollback",
+			input: []string{PATCH_CMD, "--rollback", validFile},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile},
+				Rollback:  true,
+			},
+		},
+		{
+			name:  "In-place patch needs no output",
+			input: []string{PATCH_CMD, "--in-place", validFile, "testdata/validNewFile", "output"},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "output"},
+				InPlace:   true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: in-place patch requires exactly 2 parameters (3 provided)",
+		},
+		{
+			name:  "Rollback and in-place patch",
+			input: []string{PATCH_CMD, "--in-place", "--rollback", validFile},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile},
+				InPlace:   true,
+				Rollback:  true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: --in-place and --rollback cannot be used together",
+		},
+		{
+			name:  "Resumed patch",
+			input: []string{PATCH_CMD, "--resume", validFile, "testdata/validNewFile", "output"},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "output"},
+				Resume:    true,
+			},
+		},
+		{
+			name:  "Patch with checkpoints",
+			input: []string{PATCH_CMD, "--checkpoint", validFile, "testdata/validNewFile", "output"},
+			expectedCommand: Command{
+				Operation:  PATCH_CMD,
+				Files:      []string{validFile, "testdata/validNewFile", "output"},
+				Checkpoint: true,
+			},
+		},
+		{
+			name:  "In-place patch with checkpoints",
+			input: []string{PATCH_CMD, "--checkpoint", "--in-place", validFile, "testdata/validNewFile"},
+			expectedCommand: Command{
+				Operation:  PATCH_CMD,
+				Files:      []string{validFile, "testdata/validNewFile"},
+				InPlace:    true,
+				Checkpoint: true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: --checkpoint only applies to patches written to an output file",
+		},
+		{
+			name:  "Resumed in-place patch",
+			input: []string{PATCH_CMD, "--resume", "--in-place", validFile, "testdata/validNewFile"},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile, "testdata/validNewFile"},
+				InPlace:   true,
+				Resume:    true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: --resume only applies to patches written to an output file",
+		},
+		{
+			name:  "Patch with reverse delta",
+			input: []string{PATCH_CMD, "--reverse", "reverse", validFile, "testdata/validNewFile", "output"},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "output"},
+				Reverse:   "reverse",
+			},
+		},
+		{
+			name:  "Reverse delta in a missing directory",
+			input: []string{PATCH_CMD, "--reverse=testdata123/reverse", validFile, "testdata/validNewFile", "output"},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{validFile, "testdata/validNewFile", "output"},
+				Reverse:   "testdata123/reverse",
+			},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "cannot create reverse delta file: stat testdata123: no such file or directory",
+		},
+		{
+			name:  "Tree signature",
+			input: []string{SIGNATURE_CMD, "-r", "testdata", "manifest"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{"testdata", "manifest"},
+				Recursive: true,
+			},
+		},
+		{
+			name:  "Tree signature of a file",
+			input: []string{SIGNATURE_CMD, "-r", validFile, "manifest"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "manifest"},
+				Recursive: true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: testdata/validFileForSignature is not a directory",
+		},
+		{
+			name:  "Tree delta",
+			input: []string{DELTA_CMD, "-r", validFile, "testdata", "bundle"},
+			expectedCommand: Command{
+				Operation: DELTA_CMD,
+				Files:     []string{validFile, "testdata", "bundle"},
+				Recursive: true,
+			},
+		},
+		{
+			name:  "Tree patch",
+			input: []string{PATCH_CMD, "-r", "testdata", validFile},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{"testdata", validFile},
+				Recursive: true,
+			},
+		},
+		{
+			name:  "Tree patch resumed",
+			input: []string{PATCH_CMD, "-r", "--resume", "testdata", validFile},
+			expectedCommand: Command{
+				Operation: PATCH_CMD,
+				Files:     []string{"testdata", validFile},
+				Recursive: true,
+				Resume:    true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: patch -r always patches the directory in place, without other options",
+		},
+		{
+			name:  "Tree in the rdiff format",
+			input: []string{SIGNATURE_CMD, "-r", "--format=rdiff", "testdata", "manifest"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{"testdata", "manifest"},
+				Recursive: true,
+				Algorithm: "rdiff",
+				Format:    "rdiff",
+			},
+			expectedError: ErrInvalidParams,
+			expectedMessage: "invalid parameters: directory trees are only signed with the rsync algorithm " +
+				"in the rh format",
+		},
+		{
+			name: "Tree delta with filters",
+			input: []string{DELTA_CMD, "-r", "--exclude=*.o", "--include=/src/", "--exclude", "*", "--checksum",
+				validFile, "testdata", "bundle"},
+			expectedCommand: Command{
+				Operation: DELTA_CMD,
+				Files:     []string{validFile, "testdata", "bundle"},
+				Recursive: true,
+				Filters:   []string{"- *.o", "+ /src/", "- *"},
+				Checksum:  true,
+			},
+		},
+		{
+			name:  "Tree filter file not found",
+			input: []string{SIGNATURE_CMD, "-r", "--filter-file=testdata123/rules", "testdata", "manifest"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{"testdata", "manifest"},
+				Recursive: true,
+				Filters:   []string{". testdata123/rules"},
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: open testdata123/rules: no such file or directory",
+		},
+		{
+			name:  "Invalid filter pattern",
+			input: []string{SIGNATURE_CMD, "-r", "--exclude=[", "testdata", "manifest"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{"testdata", "manifest"},
+				Recursive: true,
+				Filters:   []string{"- ["},
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: invalid filter pattern \"[\"",
+		},
+		{
+			name:  "Filters of a file",
+			input: []string{SIGNATURE_CMD, "--exclude=*.o", validFile, "signature"},
+			expectedCommand: Command{
+				Operation: SIGNATURE_CMD,
+				Files:     []string{validFile, "signature"},
+				Filters:   []string{"- *.o"},
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: --include, --exclude, --filter-file and --checksum only apply to -r",
+		},
+		{
+			name:  "Special files of a file",
+			input: []string{SIGNATURE_CMD, "--skip-special", validFile, "signature"},
+			expectedCommand: Command{
+				Operation:   SIGNATURE_CMD,
+				Files:       []string{validFile, "signature"},
+				SkipSpecial: true,
+			},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: --skip-special only applies to -r",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, err := ValidateInputParams(tc.input)
+			assert.Equal(t, tc.expectedCommand, cmd)
+			assertError(t, tc.expectedError, tc.expectedMessage, err)
+		})
+	}
+}
+
+func TestValidateSignatureParams(t *testing.T) {
+	validFile := "testdata/validFileForSignature"   // larger than 1kb
+	smallFile := "testdata/invalidFileForSignature" // smaller than 1kb
+
+	stat, err := os.Stat(validFile)
+	if err != nil {
+		t.Error(err)
+	}
+	size := stat.Size()
+
+	stat, err = os.Stat(smallFile)
+	if err != nil {
+		t.Error(err)
+	}
+	smallSize := stat.Size()
+
+	testCases := []struct {
+		name               string
+		input              []string
+		expectedSizeOutput int64
+		expectedError      error
+		expectedMessage    string
+	}{
+		{
+			name:               "Valid test",
+			input:              []string{validFile, "test"},
+			expectedSizeOutput: size,
+			expectedError:      nil,
+		},
+		{
+			name:               "Small input file",
+			input:              []string{smallFile, "test"},
+			expectedSizeOutput: smallSize,
+			expectedError:      nil,
+		},
+		{
+			name:               "Input file not found",
+			input:              []string{"invalidFile", "test"},
+			expectedSizeOutput: 0,
+			expectedError:      fs.ErrNotExist,
+			expectedMessage:    "input file not found: stat invalidFile: no such file or directory",
+		},
+		{
+			name:               "Too many params",
+			input:              []string{"validFile", "test", "extraParam"},
+			expectedSizeOutput: 0,
+			expectedError:      ErrInvalidParams,
+			expectedMessage:    "invalid parameters: signature function requires exactly 2 parameters (3 provided)",
+		},
+		{
+			name:               "Too few params",
+			input:              []string{},
+			expectedSizeOutput: 0,
+			expectedError:      ErrInvalidParams,
+			expectedMessage:    "invalid parameters: signature function requires exactly 2 parameters (0 provided)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			size, err := validateSignatureParams(tc.input)
+			assert.Equal(t, tc.expectedSizeOutput, size)
+			assertError(t, tc.expectedError, tc.expectedMessage, err)
+		})
+	}
+}
+
+func TestValidateDeltaParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		input           []string
+		expectedError   error
+		expectedMessage string
+	}{
+		{
+			name:          "Valid test",
+			input:         []string{"testdata/validSignatureFile", "testdata/validNewFile", "delta"},
+			expectedError: nil,
+		},
+		{
+			name:            "Invalid signature file",
+			input:           []string{"testdata/invalidSignatureFile", "testdata/validNewFile", "delta"},
+			expectedError:   signature.ErrLimitExceeded,
+			expectedMessage: "file testdata/invalidSignatureFile is not a valid signature file: signature exceeds the parser limits: chunk size 741486901 larger than 268435456 (metadata, offset 0)",
+		},
+		{
+			name:            "Invalid new file",
+			input:           []string{"testdata/validSignatureFile", "xyxyxy", "delta"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "new file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Invalid delta file",
+			input:           []string{"testdata/validSignatureFile", "testdata/validNewFile", "testdata123/delta"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "cannot create delta file: stat testdata123: no such file or directory",
+		},
+		{
+			name:            "Too many params",
+			input:           []string{"testdata/validSignatureFile", "testdata/validNewFile", "delta", "extraParam"},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: delta function requires exactly 3 parameters (4 provided)",
+		},
+		{
+			name:            "Too few params",
+			input:           []string{},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: delta function requires exactly 3 parameters (0 provided)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run(tc.name, func(t *testing.T) {
+				err := validateDeltaParams(tc.input, true)
+				assertError(t, tc.expectedError, tc.expectedMessage, err)
+			})
+		})
+	}
+}
+
+func TestValidatePatchParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		input           []string
+		expectedError   error
+		expectedMessage string
+	}{
+		{
+			name:          "Valid test",
+			input:         []string{"testdata/validFileForSignature", "testdata/validNewFile", "output"},
+			expectedError: nil,
+		},
+		{
+			name:            "Invalid basis file",
+			input:           []string{"xyxyxy", "testdata/validNewFile", "output"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "basis file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Invalid delta file",
+			input:           []string{"testdata/validFileForSignature", "xyxyxy", "output"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "delta file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Too few params",
+			input:           []string{},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: patch function requires exactly 3 parameters (0 provided)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePatchParams(tc.input)
+			assertError(t, tc.expectedError, tc.expectedMessage, err)
+		})
+	}
+}
+
+func TestValidateDeltaValidationParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		input           []string
+		expectedError   error
+		expectedMessage string
+	}{
+		{
+			name:          "Valid test",
+			input:         []string{"testdata/validSignatureFile", "testdata/validNewFile"},
+			expectedError: nil,
+		},
+		{
+			name:            "Invalid signature file",
+			input:           []string{"xyxyxy", "testdata/validNewFile"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "signature file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Invalid delta file",
+			input:           []string{"testdata/validSignatureFile", "xyxyxy"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "delta file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Too many params",
+			input:           []string{"testdata/validSignatureFile", "testdata/validNewFile", "extraParam"},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: validate-delta function requires exactly 2 parameters (3 provided)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateDeltaValidationParams(tc.input)
+			assertError(t, tc.expectedError, tc.expectedMessage, err)
+		})
+	}
+}
+
+func TestValidateComposeParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		input           []string
+		expectedError   error
+		expectedMessage string
+	}{
+		{
+			name:          "Valid test",
+			input:         []string{"testdata/validNewFile", "testdata/validNewFile", "composed"},
+			expectedError: nil,
+		},
+		{
+			name:            "Invalid delta file",
+			input:           []string{"testdata/validNewFile", "xyxyxy", "composed"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "delta file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Invalid output file",
+			input:           []string{"testdata/validNewFile", "testdata/validNewFile", "testdata123/composed"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "cannot create delta file: stat testdata123: no such file or directory",
+		},
+		{
+			name:            "Single delta",
+			input:           []string{"testdata/validNewFile", "composed"},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: compose function requires 2 or more deltas and the output (2 parameters provided)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateComposeParams(tc.input)
+			assertError(t, tc.expectedError, tc.expectedMessage, err)
+		})
+	}
+}
+
+func TestValidateDiffParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		input           []string
+		expectedError   error
+		expectedMessage string
+	}{
+		{
+			name:          "Valid test",
+			input:         []string{"testdata/validFileForSignature", "testdata/validNewFile", "delta"},
+			expectedError: nil,
+		},
+		{
+			name:            "Invalid old file",
+			input:           []string{"xyxyxy", "testdata/validNewFile", "delta"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "old file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Invalid new file",
+			input:           []string{"testdata/validFileForSignature", "xyxyxy", "delta"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "new file not found: stat xyxyxy: no such file or directory",
+		},
+		{
+			name:            "Invalid output file",
+			input:           []string{"testdata/validFileForSignature", "testdata/validNewFile", "testdata123/delta"},
+			expectedError:   fs.ErrNotExist,
+			expectedMessage: "cannot create delta file: stat testdata123: no such file or directory",
+		},
+		{
+			name:            "Missing delta file",
+			input:           []string{"testdata/validFileForSignature", "testdata/validNewFile"},
+			expectedError:   ErrInvalidParams,
+			expectedMessage: "invalid parameters: diff function requires exactly 3 parameters (2 provided)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateDiffParams(tc.input)
+			assertError(t, tc.expectedError, tc.expectedMessage, err)
+		})
+	}
+}
+
+func assertError(t *testing.T, expectedError error, expectedMessage string, err error) {
+	if expectedError == nil {
+		assert.Nil(t, err)
+		return
+	}
+	assert.True(t, errors.Is(err, expectedError), "expected %v, got %v", expectedError, err)
+	assert.EqualError(t, err, expectedMessage)
+}
@@ -0,0 +1,256 @@
+package vcdiff
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// The new file is written in windows of this size at most, buffering the data of a window only
+const maxEncodedWindow = 4 << 20
+
+// instruction is a single instruction of the window being encoded
+type instruction struct {
+	kind   byte
+	size   int64
+	addr   int64 // offset in the basis file for source copies, in the new file for target copies
+	target bool
+}
+
+// encoder writes the windows of a VCDIFF delta, with the addresses of the copies in the self mode
+type encoder struct {
+	out          *bufio.Writer
+	newFile      io.ReaderAt
+	start        int64 // offset of the window in the new file
+	length       int64
+	instructions []instruction
+	data         []byte
+	window       []byte
+}
+
+// Encode writes the delta of this tool, read from native, in the VCDIFF format. The data the delta does not
+// copy from the basis file or the new file is read back from the new file
+func Encode(native io.Reader, newFile io.ReaderAt, output io.Writer) error {
+	r, err := d.NewReader(native)
+	if err != nil {
+		return err
+	}
+	size := r.Metadata.Size
+	if size < 0 {
+		return fmt.Errorf("%w: deltas of version %d cannot be written as VCDIFF", s.ErrUnsupportedVersion,
+			r.Metadata.Version)
+	}
+	chunkSize := int64(r.Metadata.ChunkSize)
+
+	e := &encoder{out: bufio.NewWriter(output), newFile: newFile}
+	if _, err = e.out.Write(append(append([]byte{}, magic...), version, 0)); err != nil {
+		return err
+	}
+	for {
+		op, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		position := e.start + e.length
+		switch op.Type {
+		case d.PointerOp:
+			length := chunkSize
+			if size-position < length {
+				length = size - position
+			}
+			err = e.copy(int64(op.Index)*chunkSize, length, false)
+		case d.CopyOp:
+			err = e.copy(op.Source, op.Length, false)
+		case d.OutputCopyOp:
+			err = e.copy(op.Source, op.Length, true)
+		case d.ZeroOp:
+			err = e.run(op.Length)
+		case d.NewChunkOp:
+			err = e.add(op.Data)
+		default:
+			// Compressed chunks and adds are the data of the new file at the position of the instruction
+			err = e.addNewData(op.Length)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if e.start+e.length != size {
+		return fmt.Errorf("%w: delta of %d bytes instead of %d", d.ErrInvalidDelta, e.start+e.length, size)
+	}
+	if err = e.flush(); err != nil {
+		return err
+	}
+	return e.out.Flush()
+}
+
+// room returns how much of length fits in the window, writing the window first when it is full
+func (e *encoder) room(length int64) (int64, error) {
+	if e.length == maxEncodedWindow {
+		if err := e.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if length > maxEncodedWindow-e.length {
+		length = maxEncodedWindow - e.length
+	}
+	return length, nil
+}
+
+// copy copies from the basis file, or from the new file. Copies of the new file starting before the window
+// are written as the new data instead
+func (e *encoder) copy(source int64, length int64, target bool) error {
+	for length > 0 {
+		n, err := e.room(length)
+		if err != nil {
+			return err
+		}
+		if target && source < e.start {
+			if err = e.addNewData(n); err != nil {
+				return err
+			}
+		} else {
+			e.instructions = append(e.instructions, instruction{kind: copyInst, size: n, addr: source, target: target})
+			e.length += n
+		}
+		source += n
+		length -= n
+	}
+	return nil
+}
+
+func (e *encoder) run(length int64) error {
+	for length > 0 {
+		n, err := e.room(length)
+		if err != nil {
+			return err
+		}
+		e.instructions = append(e.instructions, instruction{kind: run, size: n})
+		e.data = append(e.data, 0)
+		e.length += n
+		length -= n
+	}
+	return nil
+}
+
+func (e *encoder) add(data []byte) error {
+	for len(data) > 0 {
+		n, err := e.room(int64(len(data)))
+		if err != nil {
+			return err
+		}
+		e.appendAdd(data[:n])
+		data = data[n:]
+	}
+	return nil
+}
+
+// addNewData adds the data of the new file at the end of the window
+func (e *encoder) addNewData(length int64) error {
+	for length > 0 {
+		n, err := e.room(length)
+		if err != nil {
+			return err
+		}
+		if int64(cap(e.window)) < n {
+			e.window = make([]byte, maxEncodedWindow)
+		}
+		read, err := e.newFile.ReadAt(e.window[:n], e.start+e.length)
+		if int64(read) < n {
+			if err == io.EOF {
+				err = fmt.Errorf("%w: new file shorter than the delta", d.ErrSignatureMismatch)
+			}
+			return err
+		}
+		e.appendAdd(e.window[:n])
+		length -= n
+	}
+	return nil
+}
+
+// appendAdd adds the data to the window, merging it with an add just before it
+func (e *encoder) appendAdd(data []byte) {
+	if last := len(e.instructions) - 1; last >= 0 && e.instructions[last].kind == add {
+		e.instructions[last].size += int64(len(data))
+	} else {
+		e.instructions = append(e.instructions, instruction{kind: add, size: int64(len(data))})
+	}
+	e.data = append(e.data, data...)
+	e.length += int64(len(data))
+}
+
+// flush writes the window with the source segment spanning all its copies of the basis file
+func (e *encoder) flush() error {
+	if e.length == 0 {
+		return nil
+	}
+	sourceStart, sourceEnd := int64(-1), int64(0)
+	for _, inst := range e.instructions {
+		if inst.kind != copyInst || inst.target {
+			continue
+		}
+		if sourceStart < 0 || inst.addr < sourceStart {
+			sourceStart = inst.addr
+		}
+		if inst.addr+inst.size > sourceEnd {
+			sourceEnd = inst.addr + inst.size
+		}
+	}
+	sourceLength := int64(0)
+	if sourceStart >= 0 {
+		sourceLength = sourceEnd - sourceStart
+	}
+
+	var instructions, addresses []byte
+	for _, inst := range e.instructions {
+		switch {
+		case inst.kind == run:
+			instructions = appendInt(append(instructions, 0), uint64(inst.size))
+		case inst.kind == add && inst.size <= 17:
+			instructions = append(instructions, byte(1+inst.size))
+		case inst.kind == add:
+			instructions = appendInt(append(instructions, 1), uint64(inst.size))
+		default:
+			// Copies of the self mode are the codes 19, with the size in the instructions, and 20 to 34
+			if inst.size >= 4 && inst.size <= 18 {
+				instructions = append(instructions, byte(19+inst.size-3))
+			} else {
+				instructions = appendInt(append(instructions, 19), uint64(inst.size))
+			}
+			addr := inst.addr - sourceStart
+			if inst.target {
+				addr = sourceLength + inst.addr - e.start
+			}
+			addresses = appendInt(addresses, uint64(addr))
+		}
+	}
+
+	body := appendInt(nil, uint64(e.length))
+	body = append(body, 0)
+	body = appendInt(body, uint64(len(e.data)))
+	body = appendInt(body, uint64(len(instructions)))
+	body = appendInt(body, uint64(len(addresses)))
+	header := []byte{0}
+	if sourceLength > 0 {
+		header[0] = vcdSource
+		header = appendInt(appendInt(header, uint64(sourceLength)), uint64(sourceStart))
+	}
+	header = appendInt(header, uint64(len(body)+len(e.data)+len(instructions)+len(addresses)))
+	for _, b := range [][]byte{header, body, e.data, instructions, addresses} {
+		if _, err := e.out.Write(b); err != nil {
+			return err
+		}
+	}
+
+	e.start += e.length
+	e.length = 0
+	e.instructions = e.instructions[:0]
+	e.data = e.data[:0]
+	return nil
+}
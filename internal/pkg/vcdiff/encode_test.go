@@ -0,0 +1,87 @@
+package vcdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncode(t *testing.T) {
+	basis := readTestFile(t, "basis.txt")
+	newData := append(append([]byte{}, basis[64:128]...), "new chunk data"...)
+	newData = append(append(newData, basis[1000:1100]...), make([]byte, 20)...)
+	newData = append(newData, newData[:30]...)
+	differences := make([]byte, 10)
+	for i := range differences {
+		differences[i] = byte(i + 1)
+		newData = append(newData, basis[200+i]+differences[i])
+	}
+
+	native := new(bytes.Buffer)
+	w, err := d.NewWriter(native, 64, int64(len(newData)), d.CopyOp, d.ZeroOp, d.OutputCopyOp, d.AddOp)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Pointer(1))
+	assert.Nil(t, w.NewChunk([]byte("new chunk data")))
+	assert.Nil(t, w.Copy(1000, 100))
+	assert.Nil(t, w.ZeroRun(20))
+	assert.Nil(t, w.OutputCopy(0, 30))
+	assert.Nil(t, w.Add(200, differences))
+
+	encoded := new(bytes.Buffer)
+	assert.Nil(t, Encode(native, bytes.NewReader(newData), encoded))
+	assert.Equal(t, readTestFile(t, "ops.vcdiff"), encoded.Bytes())
+
+	output := new(bytes.Buffer)
+	assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), encoded, output))
+	assert.Equal(t, newData, output.Bytes())
+}
+
+func TestEncodeWindows(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	basis := make([]byte, 3*maxEncodedWindow)
+	r.Read(basis)
+	chunk := make([]byte, 1000)
+	r.Read(chunk)
+	// The copies and the zeros span several windows, and the output copy starts in the previous window
+	var newData []byte
+	newData = append(newData, chunk...)
+	newData = append(newData, basis[10:10+2*maxEncodedWindow]...)
+	newData = append(newData, make([]byte, maxEncodedWindow+5)...)
+	newData = append(newData, newData[100:100+maxEncodedWindow]...)
+
+	native := new(bytes.Buffer)
+	w, err := d.NewWriter(native, 1000, int64(len(newData)), d.CopyOp, d.ZeroOp, d.OutputCopyOp)
+	assert.Nil(t, err)
+	assert.Nil(t, w.NewChunk(chunk))
+	assert.Nil(t, w.Copy(10, 2*maxEncodedWindow))
+	assert.Nil(t, w.ZeroRun(maxEncodedWindow+5))
+	assert.Nil(t, w.OutputCopy(100, maxEncodedWindow))
+
+	encoded := new(bytes.Buffer)
+	assert.Nil(t, Encode(native, bytes.NewReader(newData), encoded))
+	assert.Less(t, encoded.Len(), 3*maxEncodedWindow/2)
+	output := new(bytes.Buffer)
+	assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), encoded, output))
+	assert.Equal(t, len(newData), output.Len())
+	assert.True(t, bytes.Equal(newData, output.Bytes()))
+
+	t.Run("Empty", func(t *testing.T) {
+		native := new(bytes.Buffer)
+		_, err := d.NewWriter(native, 1000, 0)
+		assert.Nil(t, err)
+		encoded := new(bytes.Buffer)
+		assert.Nil(t, Encode(native, bytes.NewReader(nil), encoded))
+		assert.Equal(t, []byte{0xd6, 0xc3, 0xc4, 0, 0}, encoded.Bytes())
+	})
+	t.Run("Shorter new file", func(t *testing.T) {
+		native := new(bytes.Buffer)
+		w, err := d.NewWriter(native, 1000, 2000, d.AddOp)
+		assert.Nil(t, err)
+		assert.Nil(t, w.NewChunk(chunk))
+		assert.Nil(t, w.Add(0, chunk))
+		assert.ErrorIs(t, Encode(native, bytes.NewReader(nil), new(bytes.Buffer)), d.ErrSignatureMismatch)
+	})
+}
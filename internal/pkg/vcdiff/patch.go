@@ -0,0 +1,360 @@
+package vcdiff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+)
+
+// Windows rebuilding more than this are not applied, so a corrupt delta cannot allocate any size
+const maxTargetWindow = 1 << 26
+
+// The sections of a window hold its target data at most, plus the instructions and addresses
+const maxWindowEncoding = 4 * maxTargetWindow
+
+// Apply writes the new file rebuilt from the basis file of the given size and the VCDIFF delta to output.
+// Deltas with secondary compression, custom code tables or copies from the target file are not supported
+func Apply(basis io.ReaderAt, basisSize int64, delta io.Reader, output io.Writer) error {
+	r := &reader{input: bufio.NewReader(delta), window: -1}
+	header := make([]byte, len(magic)+2)
+	if err := r.readFull(header); err != nil {
+		return err
+	}
+	if !IsDelta(header) {
+		return r.parseError(fmt.Errorf("%w: not a VCDIFF delta", d.ErrInvalidDelta))
+	}
+	if header[3] != version {
+		return r.parseError(fmt.Errorf("%w: VCDIFF version %#x", s.ErrUnsupportedVersion, header[3]))
+	}
+	indicator := header[4]
+	if indicator&^(vcdDecompress|vcdCodeTable|vcdAppHeader) != 0 {
+		return r.parseError(fmt.Errorf("%w: header indicator %#x", d.ErrInvalidDelta, indicator))
+	}
+	if indicator&(vcdDecompress|vcdCodeTable) != 0 {
+		return r.parseError(fmt.Errorf("%w: VCDIFF secondary compression and custom code tables",
+			s.ErrUnsupportedVersion))
+	}
+	if indicator&vcdAppHeader != 0 {
+		length, err := r.readInt()
+		if err != nil {
+			return err
+		}
+		n, err := io.CopyN(io.Discard, r.input, int64(length))
+		r.offset += n
+		if err != nil {
+			return r.readError(err)
+		}
+	}
+
+	for {
+		if _, err := r.input.Peek(1); err == io.EOF {
+			return nil
+		}
+		r.window++
+		target, err := r.readWindow(basis, basisSize)
+		if err != nil {
+			return err
+		}
+		if _, err = output.Write(target); err != nil {
+			return err
+		}
+	}
+}
+
+// reader reads the windows of a VCDIFF delta, keeping track of where it is for the errors
+type reader struct {
+	input  *bufio.Reader
+	offset int64
+	window int
+}
+
+func (r *reader) readFull(b []byte) error {
+	n, err := io.ReadFull(r.input, b)
+	r.offset += int64(n)
+	if err != nil {
+		return r.readError(err)
+	}
+	return nil
+}
+
+func (r *reader) readInt() (uint64, error) {
+	value, err := readInt(r.input.ReadByte, func() { r.offset++ })
+	if err != nil {
+		return 0, r.readError(err)
+	}
+	return value, nil
+}
+
+func (r *reader) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: VCDIFF window", s.ErrTruncated)
+	}
+	return r.parseError(err)
+}
+
+func (r *reader) parseError(err error) error {
+	return &s.ParseError{Offset: r.offset, ChunkIndex: r.window, Err: err}
+}
+
+// readInt reads a VCDIFF integer one byte at a time
+func readInt(readByte func() (byte, error), count func()) (uint64, error) {
+	var value uint64
+	for i := 0; ; i++ {
+		b, err := readByte()
+		if err != nil {
+			return 0, err
+		}
+		count()
+		if i == 9 || value > 1<<56 {
+			return 0, fmt.Errorf("%w: integer overflow", d.ErrInvalidDelta)
+		}
+		value = value<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+}
+
+// section is the data, the instructions or the addresses of a window
+type section struct {
+	data []byte
+	name string
+}
+
+func (sec *section) readByte() (byte, error) {
+	if len(sec.data) == 0 {
+		return 0, fmt.Errorf("%w: end of the %v section", d.ErrInvalidDelta, sec.name)
+	}
+	b := sec.data[0]
+	sec.data = sec.data[1:]
+	return b, nil
+}
+
+func (sec *section) readInt() (uint64, error) {
+	return readInt(sec.readByte, func() {})
+}
+
+func (sec *section) next(n uint64) ([]byte, error) {
+	if n > uint64(len(sec.data)) {
+		return nil, fmt.Errorf("%w: end of the %v section", d.ErrInvalidDelta, sec.name)
+	}
+	b := sec.data[:n]
+	sec.data = sec.data[n:]
+	return b, nil
+}
+
+// readWindow reads a window and returns the target data it rebuilds
+func (r *reader) readWindow(basis io.ReaderAt, basisSize int64) ([]byte, error) {
+	indicator, err := r.input.ReadByte()
+	if err != nil {
+		return nil, r.readError(err)
+	}
+	r.offset++
+	if indicator&^(vcdSource|vcdTarget|vcdAdler32) != 0 || indicator&vcdSource != 0 && indicator&vcdTarget != 0 {
+		return nil, r.parseError(fmt.Errorf("%w: window indicator %#x", d.ErrInvalidDelta, indicator))
+	}
+	if indicator&vcdTarget != 0 {
+		return nil, r.parseError(fmt.Errorf("%w: VCDIFF windows copying from the target file",
+			s.ErrUnsupportedVersion))
+	}
+	var sourceLength, sourcePosition uint64
+	if indicator&vcdSource != 0 {
+		if sourceLength, err = r.readInt(); err != nil {
+			return nil, err
+		}
+		if sourcePosition, err = r.readInt(); err != nil {
+			return nil, err
+		}
+		if sourcePosition > uint64(basisSize) || sourceLength > uint64(basisSize)-sourcePosition {
+			return nil, fmt.Errorf("%w: source segment of %d bytes at offset %d of a %d bytes basis file",
+				patch.ErrBasisMismatch, sourceLength, sourcePosition, basisSize)
+		}
+	}
+	encodingLength, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if encodingLength > maxWindowEncoding {
+		return nil, r.parseError(fmt.Errorf("%w: window of %d bytes", s.ErrLimitExceeded, encodingLength))
+	}
+	// The encoding grows as it is read rather than being allocated from its length, so a header of a few
+	// bytes cannot allocate the largest window
+	buf := new(bytes.Buffer)
+	n, err := buf.ReadFrom(io.LimitReader(r.input, int64(encodingLength)))
+	r.offset += n
+	if err == nil && uint64(n) < encodingLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, r.readError(err)
+	}
+	encoding := buf.Bytes()
+
+	header := &section{data: encoding, name: "window"}
+	var lengths [4]uint64 // target, data, instructions and addresses
+	for i := range lengths {
+		if lengths[i], err = header.readInt(); err != nil {
+			return nil, r.parseError(err)
+		}
+		if i > 0 {
+			if lengths[i] > encodingLength {
+				return nil, r.parseError(fmt.Errorf("%w: section of %d bytes in a window of %d", d.ErrInvalidDelta,
+					lengths[i], encodingLength))
+			}
+			continue
+		}
+		if lengths[0] > maxTargetWindow {
+			return nil, r.parseError(fmt.Errorf("%w: target window of %d bytes", s.ErrLimitExceeded, lengths[0]))
+		}
+		deltaIndicator, err := header.readByte()
+		if err != nil {
+			return nil, r.parseError(err)
+		}
+		if deltaIndicator != 0 {
+			return nil, r.parseError(fmt.Errorf("%w: VCDIFF secondary compression", s.ErrUnsupportedVersion))
+		}
+	}
+	var checksum []byte
+	if indicator&vcdAdler32 != 0 {
+		if checksum, err = header.next(4); err != nil {
+			return nil, r.parseError(err)
+		}
+	}
+	if lengths[1]+lengths[2]+lengths[3] != uint64(len(header.data)) {
+		return nil, r.parseError(fmt.Errorf("%w: sections of %d bytes in a window of %d", d.ErrInvalidDelta,
+			lengths[1]+lengths[2]+lengths[3], len(header.data)))
+	}
+	rest := header.data
+	data := &section{data: rest[:lengths[1]], name: "data"}
+	instructions := &section{data: rest[lengths[1] : lengths[1]+lengths[2]], name: "instructions"}
+	addresses := &section{data: rest[lengths[1]+lengths[2]:], name: "addresses"}
+
+	w := &window{basis: basis, sourcePosition: int64(sourcePosition), sourceLength: sourceLength,
+		target: make([]byte, 0, lengths[0]), addresses: addresses}
+	for len(instructions.data) > 0 {
+		index, _ := instructions.readByte()
+		c := defaultCodeTable[index]
+		for _, inst := range [2][3]byte{{c.inst1, c.size1, c.mode1}, {c.inst2, c.size2, c.mode2}} {
+			kind, mode := inst[0], inst[2]
+			if kind == noop {
+				continue
+			}
+			size := uint64(inst[1])
+			if size == 0 {
+				if size, err = instructions.readInt(); err != nil {
+					return nil, r.parseError(err)
+				}
+			}
+			if size > uint64(cap(w.target)-len(w.target)) {
+				return nil, r.parseError(fmt.Errorf("%w: instructions beyond the target window of %d bytes",
+					d.ErrInvalidDelta, cap(w.target)))
+			}
+			switch kind {
+			case add:
+				b, err := data.next(size)
+				if err != nil {
+					return nil, r.parseError(err)
+				}
+				w.target = append(w.target, b...)
+			case run:
+				b, err := data.readByte()
+				if err != nil {
+					return nil, r.parseError(err)
+				}
+				for i := uint64(0); i < size; i++ {
+					w.target = append(w.target, b)
+				}
+			default:
+				if err = w.copy(size, mode); err != nil {
+					return nil, r.parseError(err)
+				}
+			}
+		}
+	}
+	if uint64(len(w.target)) != lengths[0] || len(data.data) > 0 || len(addresses.data) > 0 {
+		return nil, r.parseError(fmt.Errorf("%w: window of %d bytes rebuilding %d instead of %d", d.ErrInvalidDelta,
+			encodingLength, len(w.target), lengths[0]))
+	}
+	if checksum != nil && adler32.Checksum(w.target) != binary.BigEndian.Uint32(checksum) {
+		return nil, r.parseError(fmt.Errorf("%w: Adler-32 of the window", patch.ErrBasisMismatch))
+	}
+	return w.target, nil
+}
+
+// window rebuilds the target data of a window, decoding the addresses of the copies with the address cache
+type window struct {
+	basis          io.ReaderAt
+	sourcePosition int64
+	sourceLength   uint64
+	target         []byte
+	addresses      *section
+	near           [nearSlots]uint64
+	nextNear       int
+	same           [sameSlots * 256]uint64
+}
+
+// copy copies size bytes from the source segment followed by the target data, which the copy can overlap
+func (w *window) copy(size uint64, mode byte) error {
+	here := w.sourceLength + uint64(len(w.target))
+	addr, err := w.address(here, mode)
+	if err != nil {
+		return err
+	}
+	if addr >= here {
+		return fmt.Errorf("%w: copy from address %d beyond %d", d.ErrInvalidDelta, addr, here)
+	}
+	if addr < w.sourceLength {
+		n := size
+		if n > w.sourceLength-addr {
+			n = w.sourceLength - addr
+		}
+		start := len(w.target)
+		w.target = w.target[:start+int(n)]
+		read, err := w.basis.ReadAt(w.target[start:], w.sourcePosition+int64(addr))
+		if read < int(n) {
+			return err
+		}
+		addr += n
+		size -= n
+	}
+	for i := addr - w.sourceLength; size > 0; i, size = i+1, size-1 {
+		w.target = append(w.target, w.target[i])
+	}
+	return nil
+}
+
+// address decodes the address of a copy and caches it
+func (w *window) address(here uint64, mode byte) (uint64, error) {
+	var addr uint64
+	if mode >= 2+nearSlots {
+		b, err := w.addresses.readByte()
+		if err != nil {
+			return 0, err
+		}
+		addr = w.same[int(mode-2-nearSlots)*256+int(b)]
+	} else {
+		value, err := w.addresses.readInt()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case mode == selfMode:
+			addr = value
+		case mode == hereMode:
+			addr = here - value
+		default:
+			addr = w.near[mode-2] + value
+		}
+	}
+	w.near[w.nextNear] = addr
+	w.nextNear = (w.nextNear + 1) % nearSlots
+	w.same[addr%(sameSlots*256)] = addr
+	return addr, nil
+}
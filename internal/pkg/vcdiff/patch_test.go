@@ -0,0 +1,70 @@
+package vcdiff
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"testing"
+
+	d "github.com/popescuag/RH/internal/pkg/delta"
+	"github.com/popescuag/RH/internal/pkg/patch"
+	s "github.com/popescuag/RH/internal/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func readTestFile(t *testing.T, name string) []byte {
+	data, err := os.ReadFile("testdata/" + name)
+	assert.Nil(t, err)
+	return data
+}
+
+func TestApplyAllocatesWindowsAsRead(t *testing.T) {
+	// The window claims the largest encoding, which the delta does not have
+	delta := []byte{0xd6, 0xc3, 0xc4, 0, 0, 0, 0xff, 0xff, 0xff, 0x7f}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := Apply(bytes.NewReader(nil), 0, bytes.NewReader(delta), new(bytes.Buffer))
+	runtime.ReadMemStats(&after)
+	assert.ErrorIs(t, err, s.ErrTruncated)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestApply(t *testing.T) {
+	// new.vcdiff has an application header, checksums, combined instructions, every address mode and copies
+	// overlapping the target data. It was assembled from RFC 3284, and TestXdelta3 checks that xdelta3 decodes it
+	basis := readTestFile(t, "basis.txt")
+	delta := readTestFile(t, "new.vcdiff")
+	buf := new(bytes.Buffer)
+	assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), bytes.NewReader(delta), buf))
+	assert.Equal(t, readTestFile(t, "new.txt"), buf.Bytes())
+
+	changed := append([]byte{}, basis...)
+	changed[105]++
+	testCases := []struct {
+		name  string
+		basis []byte
+		delta []byte
+		err   error
+	}{
+		{name: "Truncated", basis: basis, delta: delta[:len(delta)-1], err: s.ErrTruncated},
+		{name: "Not VCDIFF", basis: basis, delta: []byte("16,v=7,size=0|"), err: d.ErrInvalidDelta},
+		{name: "Version", basis: basis, delta: []byte{0xd6, 0xc3, 0xc4, 0x53, 0}, err: s.ErrUnsupportedVersion},
+		{name: "Secondary compression", basis: basis, delta: []byte{0xd6, 0xc3, 0xc4, 0, 1, 2},
+			err: s.ErrUnsupportedVersion},
+		{name: "Code table", basis: basis, delta: []byte{0xd6, 0xc3, 0xc4, 0, 2}, err: s.ErrUnsupportedVersion},
+		{name: "Target window", basis: basis, delta: []byte{0xd6, 0xc3, 0xc4, 0, 0, 2, 1, 0, 0},
+			err: s.ErrUnsupportedVersion},
+		{name: "Copy beyond here", basis: basis, delta: []byte{0xd6, 0xc3, 0xc4, 0, 0, 0, 7, 4, 0, 0, 2, 1, 19, 4, 0},
+			err: d.ErrInvalidDelta},
+		{name: "Window too large", basis: basis, delta: []byte{0xd6, 0xc3, 0xc4, 0, 0, 0, 9, 0x81, 0x80, 0x80, 0x80, 0,
+			0, 0, 0, 0}, err: s.ErrLimitExceeded},
+		{name: "Changed basis", basis: changed, delta: delta, err: patch.ErrBasisMismatch},
+		{name: "Shorter basis", basis: basis[:1000], delta: delta, err: patch.ErrBasisMismatch},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Apply(bytes.NewReader(tc.basis), int64(len(tc.basis)), bytes.NewReader(tc.delta), new(bytes.Buffer))
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package vcdiff
+
+// VCDIFF files (RFC 3284) start with the magic, the version and the header indicator. They are a list of
+// windows, each rebuilding a part of the target file from a segment of the source file, the basis, and
+// from what was already rebuilt in the window
+var magic = []byte{0xd6, 0xc3, 0xc4}
+
+const version = 0
+
+// Bits of the header indicator
+const (
+	vcdDecompress = 0x01 // secondary compressor of the sections
+	vcdCodeTable  = 0x02 // custom code table
+	vcdAppHeader  = 0x04 // application data, written by xdelta3
+)
+
+// Bits of the window indicator
+const (
+	vcdSource  = 0x01 // the window copies from a segment of the source file
+	vcdTarget  = 0x02 // the window copies from a segment of the target file
+	vcdAdler32 = 0x04 // the window has the Adler-32 of its target data, written by xdelta3
+)
+
+// Instructions of the code table
+const (
+	noop = iota
+	add
+	run
+	copyInst
+)
+
+// Address modes of the copies. The address cache has 4 near and 3 same modes
+const (
+	selfMode  = 0
+	hereMode  = 1
+	nearSlots = 4
+	sameSlots = 3
+	modeCount = 2 + nearSlots + sameSlots
+)
+
+// code is an entry of the code table, one or two instructions. A size of 0 is read from the instructions
+type code struct {
+	inst1, size1, mode1 byte
+	inst2, size2, mode2 byte
+}
+
+// defaultCodeTable is the code table of section 5.6 of RFC 3284
+var defaultCodeTable = func() [256]code {
+	var table [256]code
+	table[0] = code{inst1: run}
+	i := 1
+	for size := 0; size <= 17; size++ {
+		table[i] = code{inst1: add, size1: byte(size)}
+		i++
+	}
+	for mode := 0; mode < modeCount; mode++ {
+		table[i] = code{inst1: copyInst, mode1: byte(mode)}
+		i++
+		for size := 4; size <= 18; size++ {
+			table[i] = code{inst1: copyInst, size1: byte(size), mode1: byte(mode)}
+			i++
+		}
+	}
+	for mode := 0; mode < modeCount; mode++ {
+		copySizes := []int{4, 5, 6}
+		if mode >= 2+nearSlots {
+			copySizes = copySizes[:1]
+		}
+		for addSize := 1; addSize <= 4; addSize++ {
+			for _, copySize := range copySizes {
+				table[i] = code{inst1: add, size1: byte(addSize), inst2: copyInst, size2: byte(copySize),
+					mode2: byte(mode)}
+				i++
+			}
+		}
+	}
+	for mode := 0; mode < modeCount; mode++ {
+		table[i] = code{inst1: copyInst, size1: 4, mode1: byte(mode), inst2: add, size2: 1}
+		i++
+	}
+	return table
+}()
+
+// IsDelta tells if the data starts like a VCDIFF delta
+func IsDelta(prefix []byte) bool {
+	return len(prefix) >= len(magic) && prefix[0] == magic[0] && prefix[1] == magic[1] && prefix[2] == magic[2]
+}
+
+// appendInt appends the value as a VCDIFF integer, 7 bits per byte, most significant first, with the high
+// bit set on all the bytes but the last
+func appendInt(b []byte, value uint64) []byte {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(value & 0x7f)
+	for value >>= 7; value > 0; value >>= 7 {
+		i--
+		buf[i] = byte(value&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
@@ -0,0 +1,56 @@
+package vcdiff
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestXdelta3 checks the VCDIFF deltas of this package against xdelta3, when it is installed. From this
+// directory, the delta of
+//
+//	xdelta3 -e -S none -s testdata/basis.txt testdata/new.txt new.vcdiff
+//
+// must rebuild new.txt with Apply. Secondary compression, which newer xdelta3 builds turn on by default,
+// is not supported. The goldens must be decoded by
+//
+//	xdelta3 -d -s testdata/basis.txt testdata/new.vcdiff new.txt
+//	xdelta3 -d -s testdata/basis.txt testdata/ops.vcdiff ops
+func TestXdelta3(t *testing.T) {
+	xdelta3, err := exec.LookPath("xdelta3")
+	if err != nil {
+		t.Skip("xdelta3 is not installed")
+	}
+	dir := t.TempDir()
+	basisFile := filepath.Join("testdata", "basis.txt")
+	basis := readTestFile(t, "basis.txt")
+	newData := readTestFile(t, "new.txt")
+	run := func(args ...string) []byte {
+		output, err := exec.Command(xdelta3, args...).CombinedOutput()
+		assert.Nil(t, err, string(output))
+		data, err := os.ReadFile(args[len(args)-1])
+		assert.Nil(t, err)
+		return data
+	}
+
+	delta := run("-e", "-S", "none", "-s", basisFile, filepath.Join("testdata", "new.txt"),
+		filepath.Join(dir, "new.vcdiff"))
+	output := new(bytes.Buffer)
+	assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)), bytes.NewReader(delta), output))
+	assert.Equal(t, newData, output.Bytes())
+
+	for _, name := range []string{"new.vcdiff", "ops.vcdiff"} {
+		t.Run(name, func(t *testing.T) {
+			// Both decoders rebuild the same file
+			expected := new(bytes.Buffer)
+			assert.Nil(t, Apply(bytes.NewReader(basis), int64(len(basis)),
+				bytes.NewReader(readTestFile(t, name)), expected))
+			decoded := run("-d", "-s", basisFile, filepath.Join("testdata", name), filepath.Join(dir, name+".out"))
+			assert.Equal(t, expected.Bytes(), decoded)
+		})
+	}
+}